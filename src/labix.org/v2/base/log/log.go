@@ -26,7 +26,10 @@
 
 package log
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ---------------------------------------------------------------------------
 // Logging integration.
@@ -38,12 +41,52 @@ type log_Logger interface {
 	Output(calldepth int, s string) error
 }
 
+// Level is the severity of a logged message.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (level Level) String() string {
+	switch level {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// Logger is a leveled logger that receives messages along with fields
+// describing them, given as alternating keys and values.
+type Logger interface {
+	// Enabled reports whether messages with the given level are logged,
+	// so that callers may avoid the cost of building them otherwise.
+	Enabled(level Level) bool
+	Log(level Level, msg string, fields ...interface{})
+}
+
 var globalLogger log_Logger
 var globalDebug bool
+var globalStructured Logger
+
+// adapted adapts globalLogger and globalDebug to the Logger interface.
+var adapted outputLogger
 
 // Specify the *log.Logger object where log messages should be sent to.
+// It replaces any logger set with SetStructured.
 func SetLogger(logger log_Logger) {
 	globalLogger = logger
+	globalStructured = nil
+	adapted.output = logger
 }
 
 func GetLogger() log_Logger {
@@ -54,44 +97,139 @@ func GetLogger() log_Logger {
 // if a logger is also set.
 func SetDebug(debug bool) {
 	globalDebug = debug
+	adapted.debug = debug
 }
 
 func GetDebug() bool {
 	return globalDebug
 }
 
-func Log(v ...interface{}) {
+// SetStructured sets the logger package level messages are sent to,
+// replacing the one set with SetLogger.
+func SetStructured(logger Logger) {
+	globalStructured = logger
+	globalLogger = nil
+	adapted.output = nil
+}
+
+// Structured returns the logger package level messages are sent to: the one
+// set with SetStructured, or one adapting the logger set with SetLogger and
+// the SetDebug setting. It returns nil if no logger is set.
+func Structured() Logger {
+	if globalStructured != nil {
+		return globalStructured
+	}
 	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprint(v...))
+		return &adapted
+	}
+	return nil
+}
+
+// Enabled reports whether package level messages with the given level
+// are logged.
+func Enabled(level Level) bool {
+	logger := Structured()
+	return logger != nil && logger.Enabled(level)
+}
+
+// Adapt returns a Logger that writes messages to output, such as a
+// *log.Logger, with their fields appended as key=value pairs. Debug messages
+// are dropped unless debug is true.
+func Adapt(output log_Logger, debug bool) Logger {
+	return &outputLogger{output, debug}
+}
+
+type outputLogger struct {
+	output log_Logger
+	debug  bool
+}
+
+func (l *outputLogger) Enabled(level Level) bool {
+	return level > DebugLevel || l.debug
+}
+
+func (l *outputLogger) Log(level Level, msg string, fields ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	if len(fields) > 0 {
+		msg = strings.TrimSuffix(msg, "\n") + formatFields(fields)
+	}
+	// Skip Log and the helper that called it.
+	l.output.Output(3, msg)
+}
+
+func formatFields(fields []interface{}) string {
+	var buf strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		if i+1 == len(fields) {
+			fmt.Fprintf(&buf, "%v", fields[i])
+			break
+		}
+		value := fmt.Sprint(fields[i+1])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, "%v=%s", fields[i], value)
+	}
+	return buf.String()
+}
+
+// With returns a logger that adds the given fields to the messages
+// logged through it before passing them on to logger.
+func With(logger Logger, fields ...interface{}) Logger {
+	if w, ok := logger.(*withLogger); ok {
+		return &withLogger{w.logger, append(w.fields[:len(w.fields):len(w.fields)], fields...)}
+	}
+	return &withLogger{logger, fields}
+}
+
+type withLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+func (l *withLogger) Enabled(level Level) bool {
+	return l.logger.Enabled(level)
+}
+
+func (l *withLogger) Log(level Level, msg string, fields ...interface{}) {
+	l.logger.Log(level, msg, append(l.fields[:len(l.fields):len(l.fields)], fields...)...)
+}
+
+func Log(v ...interface{}) {
+	if logger := Structured(); logger != nil && logger.Enabled(InfoLevel) {
+		logger.Log(InfoLevel, fmt.Sprint(v...))
 	}
 }
 
 func Logln(v ...interface{}) {
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintln(v...))
+	if logger := Structured(); logger != nil && logger.Enabled(InfoLevel) {
+		logger.Log(InfoLevel, fmt.Sprintln(v...))
 	}
 }
 
 func Logf(format string, v ...interface{}) {
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, v...))
+	if logger := Structured(); logger != nil && logger.Enabled(InfoLevel) {
+		logger.Log(InfoLevel, fmt.Sprintf(format, v...))
 	}
 }
 
 func Debug(v ...interface{}) {
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprint(v...))
+	if logger := Structured(); logger != nil && logger.Enabled(DebugLevel) {
+		logger.Log(DebugLevel, fmt.Sprint(v...))
 	}
 }
 
 func Debugln(v ...interface{}) {
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintln(v...))
+	if logger := Structured(); logger != nil && logger.Enabled(DebugLevel) {
+		logger.Log(DebugLevel, fmt.Sprintln(v...))
 	}
 }
 
 func Debugf(format string, v ...interface{}) {
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, v...))
+	if logger := Structured(); logger != nil && logger.Enabled(DebugLevel) {
+		logger.Log(DebugLevel, fmt.Sprintf(format, v...))
 	}
 }
@@ -0,0 +1,110 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package log
+
+import (
+	"strings"
+	"testing"
+)
+
+type output struct {
+	lines []string
+}
+
+func (o *output) Output(calldepth int, s string) error {
+	o.lines = append(o.lines, s)
+	return nil
+}
+
+type record struct {
+	level  Level
+	msg    string
+	fields []interface{}
+}
+
+type recorder struct {
+	level   Level
+	records []record
+}
+
+func (r *recorder) Enabled(level Level) bool {
+	return level >= r.level
+}
+
+func (r *recorder) Log(level Level, msg string, fields ...interface{}) {
+	r.records = append(r.records, record{level, msg, fields})
+}
+
+func TestAdapter(t *testing.T) {
+	o := &output{}
+	SetLogger(o)
+	defer SetLogger(nil)
+	SetDebug(false)
+	defer SetDebug(false)
+
+	Logf("a %d", 1)
+	Debugf("b %d", 2)
+	SetDebug(true)
+	Debugf("c %d", 3)
+	if strings.Join(o.lines, "|") != "a 1|c 3" {
+		t.Fatal("unexpected lines:", o.lines)
+	}
+
+	o.lines = nil
+	logger := With(Structured(), "tenant", "acme")
+	logger.Log(WarnLevel, "slow query", "op", "find", "took", "1.5 s", "odd")
+	if len(o.lines) != 1 || o.lines[0] != `slow query tenant=acme op=find took="1.5 s" odd` {
+		t.Fatal("unexpected lines:", o.lines)
+	}
+}
+
+func TestStructured(t *testing.T) {
+	r := &recorder{level: InfoLevel}
+	SetStructured(r)
+	defer SetStructured(nil)
+
+	if GetLogger() != nil {
+		t.Fatal("SetStructured should replace the output logger")
+	}
+	Logf("a %d", 1)
+	Debugf("b %d", 2)
+	With(With(r, "x", 1), "y", 2).Log(ErrorLevel, "c", "z", 3)
+	if len(r.records) != 2 || r.records[0].msg != "a 1" || r.records[0].level != InfoLevel {
+		t.Fatal("unexpected records:", r.records)
+	}
+	if c := r.records[1]; c.msg != "c" || c.level != ErrorLevel || len(c.fields) != 6 || c.fields[5] != 3 {
+		t.Fatal("unexpected record:", c)
+	}
+	if Enabled(DebugLevel) || !Enabled(WarnLevel) {
+		t.Fatal("Enabled should follow the structured logger")
+	}
+
+	SetLogger(&output{})
+	if Structured() == Logger(r) {
+		t.Fatal("SetLogger should replace the structured logger")
+	}
+}
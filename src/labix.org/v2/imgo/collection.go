@@ -1,48 +1,65 @@
 package imgo
 
+import (
+	"context"
+	"time"
+)
+
 type Collection interface {
 	FindId(interface{}) Query
 	Find(interface{}) Query
-	//Pipe(pipeline interface{}) *Pipe
+	Pipe(pipeline interface{}) Pipe
 	Insert(...interface{}) error
 	Update(selector interface{}, change interface{}) error
 	UpdateId(id interface{}, change interface{}) error
-	//UpdateAll(selector interface{}, change interface{}) (*mgo.ChangeInfo, error)
-	//Upsert(selector interface{}, change interface{}) (*mgo.ChangeInfo, error)
-	//UpsertId(id interface{}, change interface{}) (*mgo.ChangeInfo, error)
+	UpdateAll(selector interface{}, change interface{}) (*ChangeInfo, error)
+	Upsert(selector interface{}, change interface{}) (*ChangeInfo, error)
+	UpsertId(id interface{}, change interface{}) (*ChangeInfo, error)
 	Remove(selector interface{}) error
 	RemoveId(id interface{}) error
-	//RemoveAll(selector interface{}) (ChangeInfo, error)
-	//DropCollection() error
-	//Create(info *CollectionInfo) error
-	//Count() (n int, err error)
+	RemoveAll(selector interface{}) (*ChangeInfo, error)
+	InsertContext(ctx context.Context, docs ...interface{}) error
+	UpdateContext(ctx context.Context, selector interface{}, change interface{}) error
+	UpdateAllContext(ctx context.Context, selector interface{}, change interface{}) (*ChangeInfo, error)
+	UpsertContext(ctx context.Context, selector interface{}, change interface{}) (*ChangeInfo, error)
+	RemoveContext(ctx context.Context, selector interface{}) error
+	RemoveAllContext(ctx context.Context, selector interface{}) (*ChangeInfo, error)
+	WithWriteConcern(wc *WriteConcern) Collection
+	DropCollection() error
+	Create(info *CollectionInfo) error
+	Count() (n int, err error)
 	//With(s *Session) Collection
-	//EnsureIndexKey(key ...string) error
-	//EnsureIndex(index Index) error
-	//DropIndex(key ...string) error
-	//Indexes() (indexes []Index, err error)
+	EnsureIndexKey(key ...string) error
+	EnsureIndex(index Index) error
+	DropIndex(key ...string) error
+	Indexes() (indexes []Index, err error)
 }
 
 type Query interface {
-	//Batch(n int) Query
-	//Prefetch(p float64) Query
+	Batch(n int) Query
+	Prefetch(p float64) Query
 	Skip(n int) Query
 	Limit(n int) Query
-	//Select(selector interface{}) Query
+	Select(selector interface{}) Query
 	Sort(fields ...string) Query
-	//Explain(result interface{}) error
-	//Hint(indexKey ...string) Query
-	//Snapshot() Query
-	//LogReplay() Query
+	ReadPreference(pref *ReadPreference) Query
+	Explain(result interface{}) error
+	Hint(indexKey ...string) Query
+	Snapshot() Query
+	LogReplay() Query
 	One(result interface{}) (err error)
+	OneContext(ctx context.Context, result interface{}) (err error)
 	Iter() Iter
-	//Tail(timeout time.Duration) *Iter
+	IterContext(ctx context.Context) Iter
+	Tail(timeout time.Duration) Iter
 	All(result interface{}) error
-	//For(result interface{}, f func() error) error
+	AllContext(ctx context.Context, result interface{}) error
+	For(result interface{}, f func() error) error
 	Count() (n int, err error)
-	//Distinct(key string, result interface{}) error
+	CountContext(ctx context.Context) (n int, err error)
+	Distinct(key string, result interface{}) error
 	//MapReduce(job *MapReduce, result interface{}) (info *MapReduceInfo, err error)
-	//Apply(change Change, result interface{}) (info *ChangeInfo, err error)
+	Apply(change Change, result interface{}) (info *ChangeInfo, err error)
 }
 
 type Iter interface {
@@ -51,5 +68,109 @@ type Iter interface {
 	Timeout() bool
 	Next(result interface{}) bool
 	All(result interface{}) error
-	//For(result interface{}, f func() error) (err error)
+	For(result interface{}, f func() error) (err error)
+}
+
+type Pipe interface {
+	Iter() Iter
+	IterContext(ctx context.Context) Iter
+	All(result interface{}) error
+	AllContext(ctx context.Context, result interface{}) error
+	One(result interface{}) error
+	OneContext(ctx context.Context, result interface{}) error
+}
+
+// WriteConcern defines the acknowledgement requested from the servers for
+// a write. It may be set for the writes made with a collection value with
+// Collection.WithWriteConcern, overriding the safety mode of the session
+// (see Session.SetSafe in mgo).
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/write-concern/
+//     http://docs.mongodb.org/manual/tutorial/configure-replica-set-tag-sets/
+//
+type WriteConcern struct {
+	// Unacknowledged sends writes without waiting for any outcome, in
+	// which case the other fields are ignored.
+	Unacknowledged bool
+
+	// W is the number of servers that must acknowledge the write,
+	// including the primary. Defaults to 1.
+	W int
+
+	// WMode takes precedence over W if set. It's either "majority" or
+	// one of the modes defined in the getLastErrorModes setting of the
+	// replica set configuration, which require acknowledgement from
+	// servers with given tags. Such modes are validated before writing.
+	WMode string
+
+	// WTimeout limits how long to wait for W or WMode to be satisfied,
+	// after which the write fails with a *mgo.WriteConcernError, although it
+	// isn't undone. There's no limit if zero.
+	WTimeout time.Duration
+
+	// J waits for the write to be committed to the journal.
+	J bool
+
+	// FSync waits for the write to be flushed to disk. It can't be
+	// combined with J.
+	FSync bool
+}
+
+// ChangeInfo holds details about the outcome of an update operation.
+type ChangeInfo struct {
+	Updated    int         // Number of existing documents updated
+	Removed    int         // Number of documents removed
+	UpsertedId interface{} // Upserted _id field, when not explicitly provided
+}
+
+// Change holds fields for running a findAndModify MongoDB command via
+// the Query.Apply method.
+type Change struct {
+	Update    interface{} // The update document
+	Upsert    bool        // Whether to insert in case the document isn't found
+	Remove    bool        // Whether to remove the document found rather than updating
+	ReturnNew bool        // Should the modified document be returned rather than the old one
+}
+
+type Index struct {
+	Key        []string // Index key fields; prefix name with dash (-) for descending order
+	Unique     bool     // Prevent two documents from having the same index key
+	DropDups   bool     // Drop documents with the same index key as a previously indexed one
+	Background bool     // Build index in background and return immediately
+	Sparse     bool     // Only index documents containing the Key fields
+
+	ExpireAfter time.Duration // Periodically delete docs with indexed time.Time older than that.
+
+	Name string // Index name, computed by EnsureIndex
+
+	Bits, Min, Max int // Properties for spatial indexes
+}
+
+// The CollectionInfo type holds metadata about a collection.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/createCollection+Command
+//     http://www.mongodb.org/display/DOCS/Capped+Collections
+//
+type CollectionInfo struct {
+	// DisableIdIndex prevents the automatic creation of the index
+	// on the _id field for the collection.
+	DisableIdIndex bool
+
+	// ForceIdIndex enforces the automatic creation of the index
+	// on the _id field for the collection. Capped collections,
+	// for example, do not have such an index by default.
+	ForceIdIndex bool
+
+	// If Capped is true new documents will replace old ones when
+	// the collection is full. MaxBytes must necessarily be set
+	// to define the size when the collection wraps around.
+	// MaxDocs optionally defines the number of documents when it
+	// wraps, but MaxBytes still needs to be set.
+	Capped   bool
+	MaxBytes int
+	MaxDocs  int
 }
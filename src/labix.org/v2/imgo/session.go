@@ -0,0 +1,125 @@
+package imgo
+
+import (
+	"context"
+	"time"
+
+	"labix.org/v2/base/bson"
+)
+
+type Session interface {
+	DB(name string) Database
+	New() Session
+	Copy() Session
+	Clone() Session
+	Close()
+	Refresh()
+	LiveServers() (addrs []string)
+	SetMode(consistency Mode, refresh bool)
+	Mode() Mode
+	SetSyncTimeout(d time.Duration)
+	SetSocketTimeout(d time.Duration)
+	SetCursorTimeout(d time.Duration)
+	SetBatch(n int)
+	SetPrefetch(p float64)
+	Safe() (safe *Safe)
+	SetSafe(safe *Safe)
+	EnsureSafe(safe *Safe)
+	Run(cmd interface{}, result interface{}) error
+	Ping() error
+	DatabaseNames() (names []string, err error)
+	FindRef(ref *DBRef) Query
+}
+
+type Database interface {
+	C(name string) Collection
+	//With(s *Session) *Database
+	//GridFS(prefix string) *GridFS
+	Run(cmd interface{}, result interface{}) error
+	RunContext(ctx context.Context, cmd interface{}, result interface{}) error
+	Login(user, pass string) error
+	Logout()
+	AddUser(user, pass string, readOnly bool) error
+	RemoveUser(user string) error
+	DropDatabase() error
+	CollectionNames() (names []string, err error)
+	FindRef(ref *DBRef) Query
+}
+
+// Mode is the consistency mode of a session. See the Eventual, Monotonic
+// and Strong constants in mgo.
+type Mode int
+
+// ReadMode selects the kind of servers reads are sent to. See the
+// ReadPrimary, ReadPrimaryPreferred, ReadSecondary, ReadSecondaryPreferred
+// and ReadNearest constants in mgo.
+type ReadMode int
+
+var readModeNames = []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"}
+
+// String returns the name of the mode as used in connection strings
+// and by mongos, such as "secondaryPreferred".
+func (mode ReadMode) String() string {
+	if mode >= 0 && int(mode) < len(readModeNames) {
+		return readModeNames[mode]
+	}
+	return "unknown"
+}
+
+// ReadPreference defines which servers of a replica set the reads of a
+// session or query are sent to. See Session.SetReadPreference and
+// Query.ReadPreference in mgo.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/core/read-preference/
+//
+type ReadPreference struct {
+	Mode ReadMode
+
+	// TagSets restricts the secondaries read from to those with all the
+	// tags in a set. Sets are tried in order until one matches some
+	// server, and an empty set matches any server. It's ignored with
+	// ReadPrimary.
+	TagSets []bson.D
+
+	// MaxStaleness, if not zero, excludes the secondaries estimated to
+	// lag behind the primary by more than that. It must be at least 90
+	// seconds. Servers older than 3.4, which don't report their last
+	// write, are never considered stale.
+	MaxStaleness time.Duration
+
+	// LocalThreshold is the latency window: suitable servers whose ping
+	// time is within that of the nearest one are equally preferred.
+	// Defaults to 15 milliseconds.
+	LocalThreshold time.Duration
+}
+
+// See SetSafe for details on the Safe type.
+type Safe struct {
+	W        int    // Min # of servers to ack before success
+	WMode    string // Write mode for MongoDB 2.0+ (e.g. "majority")
+	WTimeout int    // Milliseconds to wait for W before timing out
+	FSync    bool   // Should servers sync to disk before returning success
+	J        bool   // Wait for next group commit if journaling; no effect otherwise
+}
+
+// The DBRef type implements support for the database reference MongoDB
+// convention as supported by multiple drivers.  This convention enables
+// cross-referencing documents between collections and databases using
+// a structure which includes a collection name, a document id, and
+// optionally a database name.
+//
+// See the FindRef methods on Session and on Database.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Database+References
+//
+type DBRef struct {
+	Collection string      `bson:"$ref"`
+	Id         interface{} `bson:"$id"`
+	Database   string      `bson:"$db,omitempty"`
+}
+
+// NOTE: Order of fields for DBRef above does matter, per documentation.
@@ -27,12 +27,20 @@
 package mgo
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
+	"labix.org/v2/mgo/scram"
+	"strings"
 	"sync"
 )
 
@@ -44,6 +52,12 @@ type authCmd struct {
 	Key   string
 }
 
+type authX509Cmd struct {
+	Authenticate int
+	Mechanism    string
+	User         string
+}
+
 type startSaslCmd struct {
 	StartSASL int `bson:"startSasl"`
 }
@@ -90,6 +104,41 @@ type saslStepper interface {
 	Close()
 }
 
+// saslScram implements the SCRAM-SHA-1 and SCRAM-SHA-256 mechanisms
+// natively, so they work without the cgo based SASL support.
+type saslScram struct {
+	client *scram.Client
+}
+
+// newSaslScram returns a SCRAM conversation for cred, which reuses the
+// salted passwords held in cache, if not nil.
+func newSaslScram(cred Credential, cache *scram.Cache) (*saslScram, error) {
+	var client *scram.Client
+	if cred.Mechanism == "SCRAM-SHA-256" {
+		// Unlike SCRAM-SHA-1, SCRAM-SHA-256 requires passwords prepared
+		// with SASLprep.
+		pass, err := scram.SASLprep(cred.Password)
+		if err != nil {
+			return nil, err
+		}
+		client = scram.NewClient(sha256.New, cred.Username, pass)
+	} else {
+		// SCRAM-SHA-1 uses the same digest of the password as MONGO-CR.
+		psum := md5.New()
+		psum.Write([]byte(cred.Username + ":mongo:" + cred.Password))
+		client = scram.NewClient(sha1.New, cred.Username, hex.EncodeToString(psum.Sum(nil)))
+	}
+	client.SetCache(cache)
+	return &saslScram{client}, nil
+}
+
+func (s *saslScram) Step(serverData []byte) (clientData []byte, done bool, err error) {
+	done = s.client.Step(serverData)
+	return s.client.Out(), done, s.client.Err()
+}
+
+func (s *saslScram) Close() {}
+
 func (socket *mongoSocket) getNonce() (nonce string, err error) {
 	socket.Lock()
 	for socket.cachedNonce == "" && socket.dead == nil {
@@ -179,10 +228,11 @@ func (socket *mongoSocket) Login(cred Credential) error {
 	switch cred.Mechanism {
 	case "", "MONGO-CR":
 		err = socket.loginClassic(cred)
-	case "MONGO-X509":
-		err = fmt.Errorf("unsupported authentication mechanism: %s", cred.Mechanism)
+	case "MONGODB-X509", "MONGO-X509":
+		err = socket.loginX509(cred)
 	default:
-		// Try SASL for everything else, if it is available.
+		// SCRAM is handled natively; try SASL for everything else, if
+		// it is available.
 		err = socket.loginSASL(cred)
 	}
 
@@ -228,8 +278,151 @@ func (socket *mongoSocket) loginClassic(cred Credential) error {
 	})
 }
 
+func (socket *mongoSocket) loginX509(cred Credential) error {
+	user := cred.Username
+	if user == "" {
+		var err error
+		user, err = socket.x509Username()
+		if err != nil {
+			return err
+		}
+	}
+	cmd := authX509Cmd{Authenticate: 1, Mechanism: "MONGODB-X509", User: user}
+	res := authResult{}
+	return socket.loginRun(cred.Source, &cmd, &res, func() error {
+		if !res.Ok {
+			return errors.New(res.ErrMsg)
+		}
+		socket.Lock()
+		socket.dropAuth(cred.Source)
+		socket.creds = append(socket.creds, cred)
+		socket.Unlock()
+		return nil
+	})
+}
+
+// x509Username returns the subject of the client certificate presented to
+// the server of socket, which is the user name authenticated by MONGODB-X509.
+func (socket *mongoSocket) x509Username() (string, error) {
+	server := socket.Server()
+	server.RLock()
+	config := server.dial.tls
+	server.RUnlock()
+	if config == nil || len(config.Certificates) == 0 {
+		return "", errors.New("MONGODB-X509 authentication requires a TLS client certificate")
+	}
+	cert := config.Certificates[0]
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return "", err
+		}
+	}
+	return x509Subject(leaf.RawSubject)
+}
+
+// x509Names maps the attribute types known by the server to the names it
+// uses for them in subjects.
+var x509Names = map[string]string{
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+	"2.5.4.3":                    "CN",
+	"2.5.4.4":                    "SN",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "street",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.12":                   "title",
+	"2.5.4.42":                   "GN",
+	"2.5.4.43":                   "initials",
+	"2.5.4.44":                   "generationQualifier",
+	"2.5.4.46":                   "dnQualifier",
+	"2.5.4.65":                   "pseudonym",
+}
+
+// x509Subject returns the RFC 2253 string of the DER encoded subject raw
+// as the server formats it: with every attribute in the certificate, in
+// reverse order, and with the server names for the attribute types.
+// Unknown types are written as their OID, and values that aren't strings
+// as the hex of their DER.
+func x509Subject(raw []byte) (string, error) {
+	var rdns pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(raw, &rdns); err != nil {
+		return "", err
+	} else if len(rest) != 0 {
+		return "", errors.New("trailing data after X.509 subject")
+	}
+	var buf bytes.Buffer
+	for i := len(rdns) - 1; i >= 0; i-- {
+		if i < len(rdns)-1 {
+			buf.WriteByte(',')
+		}
+		for j, atv := range rdns[i] {
+			if j > 0 {
+				buf.WriteByte('+')
+			}
+			name, ok := x509Names[atv.Type.String()]
+			if !ok {
+				name = atv.Type.String()
+			}
+			value, ok := atv.Value.(string)
+			if ok {
+				value = x509Escape(value)
+			} else {
+				der, err := asn1.Marshal(atv.Value)
+				if err != nil {
+					return "", err
+				}
+				value = "#" + hex.EncodeToString(der)
+			}
+			buf.WriteString(name)
+			buf.WriteByte('=')
+			buf.WriteString(value)
+		}
+	}
+	return buf.String(), nil
+}
+
+// x509Escape escapes value for use in an RFC 2253 string (section 2.4).
+func x509Escape(value string) string {
+	var buf bytes.Buffer
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// externalMechanism returns whether mechanism authenticates users defined
+// outside of MongoDB, whose credentials are established on $external.
+func externalMechanism(mechanism string) bool {
+	switch mechanism {
+	case "GSSAPI", "MONGODB-X509", "MONGO-X509":
+		return true
+	}
+	return false
+}
+
 func (socket *mongoSocket) loginSASL(cred Credential) error {
-	sasl, err := saslNew(cred, socket.Server().Addr)
+	var sasl saslStepper
+	var err error
+	switch cred.Mechanism {
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		sasl, err = newSaslScram(cred, socket.Server().scramCache)
+	default:
+		sasl, err = saslNew(cred, socket.Server().Addr)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,596 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"context"
+	"fmt"
+	"labix.org/v2/base/bson"
+	"sort"
+)
+
+// Bulk queues insert, update and remove operations on a collection, so
+// that they may be sent to the server at once by Run. It's created with
+// Collection.Bulk.
+//
+// Operations are sent in batches respecting the limits reported by the
+// server. With servers older than 2.6, which lack write commands, each
+// operation is sent on its own, except for consecutive inserts.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/core/bulk-write-operations/
+//
+type Bulk struct {
+	c         *Collection
+	unordered bool
+	actions   []bulkAction
+}
+
+type bulkKind int
+
+const (
+	bulkInsert bulkKind = iota
+	bulkUpdate
+	bulkRemove
+)
+
+// bulkAction is a single operation queued in a Bulk.
+type bulkAction struct {
+	kind     bulkKind
+	selector interface{} // The document, for inserts.
+	update   interface{}
+	multi    bool
+	upsert   bool
+}
+
+// BulkResult holds the outcome of a bulk operation.
+type BulkResult struct {
+	Inserted int
+	Matched  int
+	Removed  int
+	Upserted int
+
+	// Modified is how many of the matched documents were actually changed.
+	// With servers older than 2.6 it's the same as Matched.
+	Modified int
+
+	// UpsertedIds holds the _id of each document inserted by an upsert.
+	UpsertedIds []BulkUpserted
+}
+
+// BulkUpserted holds the _id of a document inserted by the upsert queued
+// at the given index of a bulk operation.
+type BulkUpserted struct {
+	Index int
+	Id    interface{}
+}
+
+// BulkError is returned by Bulk.Run when some of its operations fail.
+type BulkError struct {
+	ecases []BulkErrorCase
+}
+
+// BulkErrorCase holds the error of the operation queued at the given index
+// of a bulk operation. Operations fail with a *LastError, while write
+// concern problems affecting the whole bulk are reported with index -1
+// and a *WriteConcernError.
+type BulkErrorCase struct {
+	Index int
+	Err   error
+}
+
+func (e *BulkError) Error() string {
+	if len(e.ecases) == 1 {
+		return e.ecases[0].Err.Error()
+	}
+	return fmt.Sprintf("%d errors in bulk operation; first: %v", len(e.ecases), e.ecases[0].Err)
+}
+
+// Cases returns the errors of the failed operations, ordered by index.
+func (e *BulkError) Cases() []BulkErrorCase {
+	return e.ecases
+}
+
+// Bulk returns a value to prepare the execution of a bulk operation on
+// the collection. Operations are run in order by default, stopping at the
+// first one that fails. See the Unordered method.
+func (c *Collection) Bulk() *Bulk {
+	return &Bulk{c: c}
+}
+
+// Unordered puts the bulk operation in unordered mode, in which the server
+// may reorder its operations, and keeps going when some of them fail.
+func (b *Bulk) Unordered() {
+	b.unordered = true
+}
+
+// Insert queues up the provided documents for insertion.
+func (b *Bulk) Insert(docs ...interface{}) {
+	for _, doc := range docs {
+		b.actions = append(b.actions, bulkAction{kind: bulkInsert, selector: doc})
+	}
+}
+
+// Update queues up the provided pairs of updating instructions, each made
+// of a selector and an update document, in that order. Only the first
+// document matching each selector is changed. See Collection.Update.
+func (b *Bulk) Update(pairs ...interface{}) {
+	b.queueUpdates("Update", pairs, false, false)
+}
+
+// UpdateAll queues up the provided pairs of updating instructions like
+// Update, but changes all documents matching each selector.
+// See Collection.UpdateAll.
+func (b *Bulk) UpdateAll(pairs ...interface{}) {
+	b.queueUpdates("UpdateAll", pairs, true, false)
+}
+
+// Upsert queues up the provided pairs of upserting instructions like
+// Update, but inserts a new document when nothing matches the selector.
+// See Collection.Upsert.
+func (b *Bulk) Upsert(pairs ...interface{}) {
+	b.queueUpdates("Upsert", pairs, false, true)
+}
+
+func (b *Bulk) queueUpdates(method string, pairs []interface{}, multi, upsert bool) {
+	if len(pairs)%2 != 0 {
+		panic("Bulk." + method + " requires an even number of parameters")
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		selector := pairs[i]
+		if selector == nil {
+			selector = bson.D{}
+		}
+		b.actions = append(b.actions, bulkAction{
+			kind:     bulkUpdate,
+			selector: selector,
+			update:   pairs[i+1],
+			multi:    multi,
+			upsert:   upsert,
+		})
+	}
+}
+
+// Remove queues up the provided selectors for removing a single matching
+// document each. See Collection.Remove.
+func (b *Bulk) Remove(selectors ...interface{}) {
+	b.queueRemoves(selectors, false)
+}
+
+// RemoveAll queues up the provided selectors for removing all matching
+// documents. See Collection.RemoveAll.
+func (b *Bulk) RemoveAll(selectors ...interface{}) {
+	b.queueRemoves(selectors, true)
+}
+
+func (b *Bulk) queueRemoves(selectors []interface{}, multi bool) {
+	for _, selector := range selectors {
+		if selector == nil {
+			selector = bson.D{}
+		}
+		b.actions = append(b.actions, bulkAction{kind: bulkRemove, selector: selector, multi: multi})
+	}
+}
+
+// Run runs all the operations queued up, and returns their outcome.
+//
+// If some operations fail, the error is a *BulkError holding the error of
+// each of them, and the result accounts for the ones that succeeded. If
+// the operations succeed but the write concern can't be satisfied, the
+// error is a *WriteConcernError. If the session is unsafe (see SetSafe),
+// the result is empty and failures aren't reported.
+func (b *Bulk) Run() (*BulkResult, error) {
+	return b.RunContext(context.Background())
+}
+
+// RunContext works like Run, but gives up waiting for the outcome of the
+// operations with ctx.Err() once ctx is done. Some of them may be applied
+// in that case.
+func (b *Bulk) RunContext(ctx context.Context) (*BulkResult, error) {
+	c := b.c
+	s := c.Database.Session
+	socket, err := s.acquireSocketContext(ctx, c.Database.Name == "local")
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Release()
+
+	safeOp, err := c.safeOp(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &bulkRun{
+		bulk:    b,
+		ctx:     ctx,
+		socket:  socket,
+		safeOp:  safeOp,
+		monitor: s.commandMonitor(),
+		result:  &BulkResult{},
+	}
+	if socket.ServerInfo().MaxWireVersion >= 2 {
+		err = run.commands()
+	} else {
+		err = run.legacy()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if safeOp == nil {
+		return &BulkResult{}, nil
+	}
+	return run.result, run.err()
+}
+
+// bulkRun holds the state of a single execution of a bulk operation.
+type bulkRun struct {
+	bulk    *Bulk
+	ctx     context.Context
+	socket  *mongoSocket
+	safeOp  *queryOp
+	monitor CommandMonitor
+
+	result *BulkResult
+	ecases []BulkErrorCase
+	wcerr  *WriteConcernError
+}
+
+// err returns the error to be reported for the failures seen so far.
+func (run *bulkRun) err() error {
+	if len(run.ecases) == 0 {
+		if run.wcerr != nil {
+			return run.wcerr
+		}
+		return nil
+	}
+	ecases := run.ecases
+	if run.wcerr != nil {
+		ecases = append(ecases, BulkErrorCase{-1, run.wcerr})
+	}
+	return &BulkError{ecases}
+}
+
+// failed reports whether an ordered bulk must stop due to a failure.
+func (run *bulkRun) failed() bool {
+	return !run.bulk.unordered && len(run.ecases) > 0
+}
+
+// legacy runs the bulk operation against servers without write commands,
+// sending each operation followed by getLastError over the socket of the
+// run. Consecutive inserts are sent together as far as the server message
+// size allows, and since getLastError doesn't tell which of them failed,
+// the failure of such a batch is reported at the index of its first
+// document and none of its documents are accounted as inserted.
+func (run *bulkRun) legacy() error {
+	c := run.bulk.c
+	result := run.result
+	maxSize := legacyMessageLimit(run.socket.ServerInfo(), c.FullName)
+	actions := run.bulk.actions
+	for i, n := 0, 1; i < len(actions); i += n {
+		action := &actions[i]
+		var op interface{}
+		n = 1
+		switch action.kind {
+		case bulkInsert:
+			var docs []interface{}
+			size := 0
+			for n = 0; i+n < len(actions) && actions[i+n].kind == bulkInsert; n++ {
+				doc := actions[i+n].selector
+				data, err := bson.Marshal(doc)
+				if err != nil {
+					return err
+				}
+				if n > 0 && size+len(data) > maxSize {
+					break
+				}
+				docs = append(docs, doc)
+				size += len(data)
+			}
+			var flags uint32
+			if run.bulk.unordered {
+				flags = 1 // ContinueOnError
+			}
+			op = &insertOp{c.FullName, docs, flags}
+		case bulkUpdate:
+			var flags uint32
+			if action.upsert {
+				flags |= 1
+			}
+			if action.multi {
+				flags |= 2
+			}
+			op = &updateOp{c.FullName, action.selector, action.update, flags}
+		case bulkRemove:
+			var flags uint32
+			if !action.multi {
+				flags = 1
+			}
+			op = &deleteOp{c.FullName, action.selector, flags}
+		}
+		lerr, err := c.writeOp(run.ctx, run.socket, run.safeOp, run.monitor, op)
+		if wcerr, ok := err.(*WriteConcernError); ok {
+			// Applied, but not as safely as requested.
+			run.wcerr, err = wcerr, nil
+		}
+		if lerr, ok := err.(*LastError); ok {
+			run.ecases = append(run.ecases, BulkErrorCase{i, lerr})
+			if run.failed() {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if lerr == nil {
+			continue
+		}
+		switch action.kind {
+		case bulkInsert:
+			// getLastError reports no count for inserts.
+			result.Inserted += n
+		case bulkUpdate:
+			if lerr.UpdatedExisting || lerr.UpsertedId == nil {
+				result.Matched += lerr.N
+				result.Modified += lerr.N
+			} else {
+				result.Upserted++
+				result.UpsertedIds = append(result.UpsertedIds, BulkUpserted{i, lerr.UpsertedId})
+			}
+		case bulkRemove:
+			result.Removed += lerr.N
+		}
+	}
+	return nil
+}
+
+// Default limits assumed for servers that don't report them.
+const (
+	defaultMaxBSONSize       = 16 * 1024 * 1024
+	defaultMaxMessageSize    = 48000000
+	defaultMaxWriteBatchSize = 1000
+)
+
+// legacyMessageLimit returns the maximum size of the documents that may be
+// sent in a single insert message for the collection named fullName to the
+// server described by info.
+func legacyMessageLimit(info *mongoServerInfo, fullName string) int {
+	size := info.MaxMessageSize
+	if size <= 0 {
+		size = defaultMaxMessageSize
+	}
+	// Leave room for the header, the flags and the collection name.
+	return size - 16 - 4 - len(fullName) - 1
+}
+
+// bulkLimits returns the maximum number of operations and the maximum
+// size of their documents that may be sent in a single write command to
+// the server described by info. Write commands are documents themselves,
+// so they're bound by maxBsonObjectSize rather than maxMessageSizeBytes,
+// which only limits the legacy insert messages. See legacyMessageLimit.
+func bulkLimits(info *mongoServerInfo) (count, size int) {
+	count, size = info.MaxWriteBatchSize, info.MaxBSONSize
+	if count <= 0 {
+		count = defaultMaxWriteBatchSize
+	}
+	if size <= 0 {
+		size = defaultMaxBSONSize
+	}
+	return count, size
+}
+
+// bulkBatch is a set of operations of the same kind sent in a single
+// write command.
+type bulkBatch struct {
+	kind    bulkKind
+	indexes []int // Index in the bulk of each operation.
+	docs    []interface{}
+	size    int
+}
+
+// commands runs the bulk operation with write commands, sending as few
+// of them as the server limits allow.
+func (run *bulkRun) commands() error {
+	maxCount, maxSize := bulkLimits(run.socket.ServerInfo())
+
+	var batches []*bulkBatch
+	last := make(map[bulkKind]*bulkBatch)
+	for i, action := range run.bulk.actions {
+		doc, err := action.document()
+		if err != nil {
+			return err
+		}
+		batch := last[action.kind]
+		if !run.bulk.unordered && len(batches) > 0 && batches[len(batches)-1] != batch {
+			// Ordered operations can't jump over others.
+			batch = nil
+		}
+		if batch != nil && (len(batch.docs) == maxCount || batch.size+len(doc.Data) > maxSize) {
+			batch = nil
+		}
+		if batch == nil {
+			batch = &bulkBatch{kind: action.kind}
+			batches = append(batches, batch)
+			last[action.kind] = batch
+		}
+		batch.indexes = append(batch.indexes, i)
+		batch.docs = append(batch.docs, doc)
+		batch.size += len(doc.Data)
+	}
+
+	for _, batch := range batches {
+		if err := run.command(batch); err != nil {
+			return err
+		}
+		if run.failed() {
+			break
+		}
+	}
+	if len(run.ecases) > 1 && run.bulk.unordered {
+		sort.Sort(bulkErrorCases(run.ecases))
+	}
+	return nil
+}
+
+// document returns the document describing the action in a write command.
+func (action *bulkAction) document() (bson.Raw, error) {
+	var doc interface{}
+	switch action.kind {
+	case bulkInsert:
+		doc = action.selector
+	case bulkUpdate:
+		doc = bson.D{
+			{"q", action.selector},
+			{"u", action.update},
+			{"multi", action.multi},
+			{"upsert", action.upsert},
+		}
+	case bulkRemove:
+		limit := 1
+		if action.multi {
+			limit = 0
+		}
+		doc = bson.D{{"q", action.selector}, {"limit", limit}}
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	return bson.Raw{0x03, data}, nil
+}
+
+type writeCmdResult struct {
+	N           int
+	NModified   int "nModified"
+	Upserted    []writeCmdUpserted
+	WriteErrors []writeCmdError "writeErrors"
+
+	WriteConcernError *commandWriteConcernError "writeConcernError"
+}
+
+type writeCmdUpserted struct {
+	Index int
+	Id    interface{} "_id"
+}
+
+type writeCmdError struct {
+	Index  int
+	Code   int
+	ErrMsg string
+}
+
+// command sends batch to the server as a write command, and accounts for
+// its outcome.
+func (run *bulkRun) command(batch *bulkBatch) error {
+	c := run.bulk.c
+	var cmd bson.D
+	switch batch.kind {
+	case bulkInsert:
+		cmd = bson.D{{"insert", c.Name}, {"documents", batch.docs}}
+	case bulkUpdate:
+		cmd = bson.D{{"update", c.Name}, {"updates", batch.docs}}
+	case bulkRemove:
+		cmd = bson.D{{"delete", c.Name}, {"deletes", batch.docs}}
+	}
+	cmd = append(cmd,
+		bson.DocElem{"ordered", !run.bulk.unordered},
+		bson.DocElem{"writeConcern", safeWriteConcern(run.safeOp)})
+
+	op := &queryOp{
+		collection: c.Database.Name + ".$cmd",
+		query:      cmd,
+		limit:      -1,
+	}
+	data, err := run.socket.SimpleQueryContext(run.ctx, run.monitor, op)
+	if err != nil {
+		return err
+	}
+	if err := checkQueryError(op.collection, data); err != nil {
+		return err
+	}
+	var reply writeCmdResult
+	if err := bson.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	c.Database.Session.debugf("Result from bulk %s command: %#v", cmd[0].Name, reply)
+
+	result := run.result
+	switch batch.kind {
+	case bulkInsert:
+		result.Inserted += reply.N
+	case bulkUpdate:
+		result.Matched += reply.N - len(reply.Upserted)
+		result.Modified += reply.NModified
+		result.Upserted += len(reply.Upserted)
+		for _, upserted := range reply.Upserted {
+			index := batch.indexes[upserted.Index]
+			result.UpsertedIds = append(result.UpsertedIds, BulkUpserted{index, upserted.Id})
+		}
+	case bulkRemove:
+		result.Removed += reply.N
+	}
+	for _, werr := range reply.WriteErrors {
+		lerr := &LastError{Err: werr.ErrMsg, Code: werr.Code}
+		run.ecases = append(run.ecases, BulkErrorCase{batch.indexes[werr.Index], lerr})
+	}
+	if reply.WriteConcernError != nil && run.wcerr == nil {
+		run.wcerr = reply.WriteConcernError.error(nil)
+	}
+	return nil
+}
+
+// safeWriteConcern returns the write concern document equivalent to the
+// getLastError query safeOp, as taken by write commands.
+func safeWriteConcern(safeOp *queryOp) bson.D {
+	if safeOp == nil {
+		return bson.D{{"w", 0}}
+	}
+	gle := safeOp.query.(*getLastError)
+	doc := bson.D{}
+	if gle.W != nil {
+		doc = append(doc, bson.DocElem{"w", gle.W})
+	}
+	if gle.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{"wtimeout", gle.WTimeout})
+	}
+	if gle.J {
+		doc = append(doc, bson.DocElem{"j", true})
+	}
+	if gle.FSync {
+		doc = append(doc, bson.DocElem{"fsync", true})
+	}
+	return doc
+}
+
+// bulkErrorCases sorts error cases by index, as unordered batches may
+// report them out of order.
+type bulkErrorCases []BulkErrorCase
+
+func (slice bulkErrorCases) Len() int           { return len(slice) }
+func (slice bulkErrorCases) Less(i, j int) bool { return slice[i].Index < slice[j].Index }
+func (slice bulkErrorCases) Swap(i, j int)      { slice[i], slice[j] = slice[j], slice[i] }
@@ -27,10 +27,14 @@
 package mgo
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
+	"labix.org/v2/mgo/scram"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -55,17 +59,30 @@ type mongoCluster struct {
 	failFast     bool
 	syncCount    uint
 	cachedIndex  map[string]bool
+	writeModes   map[string]serverWriteModes
 	sync         chan bool
 	dial         dialer
+	pool         poolConfig
+	setName      string
+	appName      string
+	resolver     Resolver
+	srv          *srvSeeds
+	scramCache   *scram.Cache
 }
 
-func newCluster(userSeeds []string, direct, failFast bool, dial dialer) *mongoCluster {
+func newCluster(userSeeds []string, direct, failFast bool, dial dialer, pool poolConfig, setName, appName string, resolver Resolver, srv *srvSeeds) *mongoCluster {
 	cluster := &mongoCluster{
 		userSeeds:  userSeeds,
 		references: 1,
 		direct:     direct,
 		failFast:   failFast,
 		dial:       dial,
+		pool:       pool,
+		setName:    setName,
+		appName:    appName,
+		resolver:   resolver,
+		srv:        srv,
+		scramCache: scram.NewCache(),
 	}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	cluster.sync = make(chan bool, 1)
@@ -131,13 +148,34 @@ type isMasterResult struct {
 	Passives  []string
 	Tags      bson.D
 	Msg       string
+	SetName   string "setName"
+	LastWrite struct {
+		LastWriteDate time.Time "lastWriteDate"
+	} "lastWrite"
+
+	MaxWireVersion    int "maxWireVersion"
+	MaxBSONSize       int "maxBsonObjectSize"
+	MaxMessageSize    int "maxMessageSizeBytes"
+	MaxWriteBatchSize int "maxWriteBatchSize"
 }
 
+// maxAppNameSize is the largest application name accepted by servers.
+const maxAppNameSize = 128
+
 func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResult) error {
 	// Monotonic let's it talk to a slave and still hold the socket.
 	session := newSession(Monotonic, cluster, 10*time.Second)
 	session.setSocket(socket)
-	err := session.Run("ismaster", result)
+	cmd := bson.D{{"ismaster", 1}}
+	if cluster.appName != "" && socket.handshake() {
+		// Servers only take the client metadata on the first isMaster.
+		cmd = append(cmd, bson.DocElem{"client", bson.D{
+			{"application", bson.D{{"name", cluster.appName}}},
+			{"driver", bson.D{{"name", "mgo"}, {"version", "v2"}}},
+			{"os", bson.D{{"type", runtime.GOOS}, {"architecture", runtime.GOARCH}}},
+		}})
+	}
+	err := session.Run(cmd, result)
 	session.Close()
 	return err
 }
@@ -170,7 +208,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 
 		// It's not clear what would be a good timeout here. Is it
 		// better to wait longer or to retry?
-		socket, _, err := server.AcquireSocket(0, syncSocketTimeout)
+		socket, _, err := server.AcquireSocket(context.Background(), 0, syncSocketTimeout)
 		if err != nil {
 			tryerr = err
 			Logf("SYNC Failed to get socket to %s: %v", addr, err)
@@ -187,6 +225,12 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		break
 	}
 
+	if cluster.setName != "" && result.SetName != cluster.setName && result.Msg != "isdbgrid" {
+		Logf("SYNC %s is not a member of replica set %q.", addr, cluster.setName)
+		stats.conn(-1, false)
+		return nil, nil, fmt.Errorf("%s is not a member of replica set %q", addr, cluster.setName)
+	}
+
 	if result.IsMaster {
 		Debugf("SYNC %s is a master.", addr)
 		// Made an incorrect assumption above, so fix stats.
@@ -207,6 +251,14 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		Master: result.IsMaster,
 		Mongos: result.Msg == "isdbgrid",
 		Tags:   result.Tags,
+
+		LastWrite:  result.LastWrite.LastWriteDate,
+		LastUpdate: time.Now(),
+
+		MaxWireVersion:    result.MaxWireVersion,
+		MaxBSONSize:       result.MaxBSONSize,
+		MaxMessageSize:    result.MaxMessageSize,
+		MaxWriteBatchSize: result.MaxWriteBatchSize,
 	}
 
 	hosts = make([]string, 0, 1+len(result.Hosts)+len(result.Passives))
@@ -239,6 +291,9 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 			return
 		}
 		cluster.servers.Add(server)
+		if server.pool.minSize > 0 || server.pool.maxIdleTime > 0 {
+			go server.maintainPool()
+		}
 		if info.Master {
 			cluster.masters.Add(server)
 			Log("SYNC Adding ", server.Addr, " to cluster as a master.")
@@ -308,7 +363,8 @@ const syncShortDelay = 500 * time.Millisecond
 
 // syncServersLoop loops while the cluster is alive to keep its idea of
 // the server topology up-to-date. It must be called just once from
-// newCluster.  The loop iterates once syncServersDelay has passed, or
+// newCluster.  The loop iterates once syncServersDelay has passed, once
+// the SRV records the seeds came from are due to be looked up again, or
 // if somebody injects a value into the cluster.sync channel to force a
 // synchronization.  A loop iteration will contact all servers in
 // parallel, ask them about known peers and their own role within the
@@ -327,6 +383,7 @@ func (cluster *mongoCluster) syncServersLoop() {
 		direct := cluster.direct
 		cluster.Unlock()
 
+		cluster.pollSRV()
 		cluster.syncServersIteration(direct)
 
 		// We just synchronized, so consume any outstanding requests.
@@ -369,6 +426,7 @@ func (cluster *mongoCluster) syncServersLoop() {
 		select {
 		case <-cluster.sync:
 		case <-time.After(syncServersDelay):
+		case <-cluster.pollSRVTimer():
 		}
 	}
 	Debugf("SYNC Cluster %p is stopping its sync loop.", cluster)
@@ -381,7 +439,7 @@ func (cluster *mongoCluster) server(addr string, tcpaddr *net.TCPAddr) *mongoSer
 	if server != nil {
 		return server
 	}
-	return newServer(addr, tcpaddr, cluster.sync, cluster.dial)
+	return newServer(addr, tcpaddr, cluster.sync, cluster.dial, cluster.pool, cluster.scramCache)
 }
 
 func resolveAddr(addr string) (*net.TCPAddr, error) {
@@ -417,7 +475,7 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 		go func() {
 			defer wg.Done()
 
-			tcpaddr, err := resolveAddr(addr)
+			tcpaddr, err := cluster.resolveAddr(addr)
 			if err != nil {
 				Log("SYNC Failed to start sync of ", addr, ": ", err.Error())
 				return
@@ -502,18 +560,38 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 	cluster.Unlock()
 }
 
+// socketsPerServer is the default limit of sockets in use per server.
 var socketsPerServer = 4096
 
 // AcquireSocket returns a socket to a server in the cluster.  If slaveOk is
 // true, it will attempt to return a socket to a slave server.  If it is
-// false, the socket will necessarily be to a master server.
-func (cluster *mongoCluster) AcquireSocket(slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D) (s *mongoSocket, err error) {
+// false, the socket will necessarily be to a master server.  If readPref
+// is not nil, the server is selected according to it instead, and the
+// slaveOk and serverTags parameters are ignored.  Waiting for servers is
+// abandoned with ctx.Err() once ctx is done.
+func (cluster *mongoCluster) AcquireSocket(ctx context.Context, slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D, readPref *ReadPreference) (s *mongoSocket, err error) {
+	if readPref != nil {
+		slaveOk = readPref.Mode != ReadPrimary
+	}
 	var started time.Time
 	var syncCount uint
-	warnedLimit := false
+	stop := context.AfterFunc(ctx, func() {
+		// Wake up waiters so they notice ctx is done.
+		cluster.Lock()
+		cluster.serverSynced.Broadcast()
+		cluster.Unlock()
+	})
+	defer stop()
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		cluster.RLock()
 		for {
+			if err := ctx.Err(); err != nil {
+				cluster.RUnlock()
+				return nil, err
+			}
 			ml := cluster.masters.Len()
 			sl := cluster.servers.Len()
 			Debugf("Cluster has %d known masters and %d known slaves.", ml, sl-ml)
@@ -536,26 +614,35 @@ func (cluster *mongoCluster) AcquireSocket(slaveOk bool, syncTimeout time.Durati
 		}
 
 		var server *mongoServer
-		if slaveOk {
+		switch {
+		case readPref != nil:
+			server, err = cluster.servers.SelectRead(readPref)
+		case slaveOk:
 			server = cluster.servers.BestFit(serverTags)
-		} else {
+		default:
 			server = cluster.masters.BestFit(nil)
 		}
 		cluster.RUnlock()
+		if err != nil {
+			return nil, err
+		}
 
 		if server == nil {
 			// Must have failed the requested tags. Sleep to avoid spinning.
+			if readPref != nil {
+				if started.IsZero() {
+					started = time.Now()
+				} else if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) {
+					return nil, errors.New("no reachable servers matching the read preference")
+				}
+			}
 			time.Sleep(1e8)
 			continue
 		}
 
-		s, abended, err := server.AcquireSocket(socketsPerServer, socketTimeout)
-		if err == errSocketLimit {
-			if !warnedLimit {
-				Log("WARNING: Per-server connection limit reached.")
-			}
-			time.Sleep(1e8)
-			continue
+		s, abended, err := server.AcquireSocket(ctx, cluster.pool.limit(), socketTimeout)
+		if err == ErrPoolTimeout || err != nil && err == ctx.Err() {
+			return nil, err
 		}
 		if err != nil {
 			cluster.removeServer(server)
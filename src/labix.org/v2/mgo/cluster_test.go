@@ -44,19 +44,19 @@ func (s *S) TestNewSession(c *C) {
 	defer session.Close()
 
 	// Do a dummy operation to wait for connection.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"_id": 1})
 	c.Assert(err, IsNil)
 
 	// Tweak safety and query settings to ensure other has copied those.
 	session.SetSafe(nil)
 	session.SetBatch(-1)
-	other := session.New()
+	other := session.new()
 	defer other.Close()
 	session.SetSafe(&Safe{})
 
 	// Clone was copied while session was unsafe, so no errors.
-	otherColl := other.DB("mydb").C("mycoll")
+	otherColl := other.db("mydb").c("mycoll")
 	err = otherColl.Insert(M{"_id": 1})
 	c.Assert(err, IsNil)
 
@@ -98,19 +98,19 @@ func (s *S) TestCloneSession(c *C) {
 	defer session.Close()
 
 	// Do a dummy operation to wait for connection.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"_id": 1})
 	c.Assert(err, IsNil)
 
 	// Tweak safety and query settings to ensure clone is copying those.
 	session.SetSafe(nil)
 	session.SetBatch(-1)
-	clone := session.Clone()
+	clone := session.clone()
 	defer clone.Close()
 	session.SetSafe(&Safe{})
 
 	// Clone was copied while session was unsafe, so no errors.
-	cloneColl := clone.DB("mydb").C("mycoll")
+	cloneColl := clone.db("mydb").c("mycoll")
 	err = cloneColl.Insert(M{"_id": 1})
 	c.Assert(err, IsNil)
 
@@ -168,12 +168,12 @@ func (s *S) TestSetModeStrong(c *C) {
 	c.Assert(session.Mode(), Equals, Strong)
 
 	result := M{}
-	cmd := session.DB("admin").C("$cmd")
+	cmd := session.db("admin").c("$cmd")
 	err = cmd.Find(M{"ismaster": 1}).One(&result)
 	c.Assert(err, IsNil)
 	c.Assert(result["ismaster"], Equals, true)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -206,12 +206,12 @@ func (s *S) TestSetModeMonotonic(c *C) {
 	c.Assert(session.Mode(), Equals, Monotonic)
 
 	result := M{}
-	cmd := session.DB("admin").C("$cmd")
+	cmd := session.db("admin").c("$cmd")
 	err = cmd.Find(M{"ismaster": 1}).One(&result)
 	c.Assert(err, IsNil)
 	c.Assert(result["ismaster"], Equals, false)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -246,7 +246,7 @@ func (s *S) TestSetModeMonotonicAfterStrong(c *C) {
 	defer session.Close()
 
 	// Insert something to force a connection to the master.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -264,7 +264,7 @@ func (s *S) TestSetModeMonotonicAfterStrong(c *C) {
 
 	// Confirm it's the master even though it's Monotonic by now.
 	result := M{}
-	cmd := session.DB("admin").C("$cmd")
+	cmd := session.db("admin").c("$cmd")
 	err = cmd.Find(M{"ismaster": 1}).One(&result)
 	c.Assert(err, IsNil)
 	c.Assert(result["ismaster"], Equals, true)
@@ -321,8 +321,8 @@ func (s *S) TestSetModeMonotonicWriteOnIteration(c *C) {
 
 	c.Assert(session.Mode(), Equals, Monotonic)
 
-	coll1 := session.DB("mydb").C("mycoll1")
-	coll2 := session.DB("mydb").C("mycoll2")
+	coll1 := session.db("mydb").c("mycoll1")
+	coll2 := session.db("mydb").c("mycoll2")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -342,7 +342,7 @@ func (s *S) TestSetModeMonotonicWriteOnIteration(c *C) {
 		}
 	}
 
-	iter := coll1.find(nil).Batch(2).iter()
+	iter := coll1.find(nil).batch(2).iter()
 	i := 0
 	m := M{}
 	for iter.Next(&m) {
@@ -371,7 +371,7 @@ func (s *S) TestSetModeEventual(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(result["ismaster"], Equals, false)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -401,7 +401,7 @@ func (s *S) TestSetModeEventualAfterStrong(c *C) {
 	defer session.Close()
 
 	// Insert something to force a connection to the master.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -419,7 +419,7 @@ func (s *S) TestSetModeEventualAfterStrong(c *C) {
 
 	// Confirm it's the master even though it's Eventual by now.
 	result := M{}
-	cmd := session.DB("admin").C("$cmd")
+	cmd := session.db("admin").c("$cmd")
 	err = cmd.Find(M{"ismaster": 1}).One(&result)
 	c.Assert(err, IsNil)
 	c.Assert(result["ismaster"], Equals, true)
@@ -467,7 +467,7 @@ func (s *S) TestPrimaryShutdownStrong(c *C) {
 	c.Assert(result.Host, Not(Equals), host)
 
 	// Insert some data to confirm it's indeed a master.
-	err = session.DB("mydb").C("mycoll").Insert(M{"n": 42})
+	err = session.db("mydb").c("mycoll").Insert(M{"n": 42})
 	c.Assert(err, IsNil)
 }
 
@@ -490,7 +490,7 @@ func (s *S) TestPrimaryHiccup(c *C) {
 	// incorrect cached socket.
 	var sessions []*Session
 	for i := 0; i < 20; i++ {
-		sessions = append(sessions, session.Copy())
+		sessions = append(sessions, session.copy())
 		err = sessions[len(sessions)-1].Run("serverStatus", result)
 		c.Assert(err, IsNil)
 	}
@@ -518,7 +518,7 @@ func (s *S) TestPrimaryHiccup(c *C) {
 	session.SetSyncTimeout(3 * time.Minute)
 
 	// Insert some data to confirm it's indeed a master.
-	err = session.DB("mydb").C("mycoll").Insert(M{"n": 42})
+	err = session.db("mydb").c("mycoll").Insert(M{"n": 42})
 	c.Assert(err, IsNil)
 }
 
@@ -534,7 +534,7 @@ func (s *S) TestPrimaryShutdownMonotonic(c *C) {
 	session.SetMode(Monotonic, true)
 
 	// Insert something to force a switch to the master.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -629,7 +629,7 @@ func (s *S) TestPrimaryShutdownMonotonicWithSlave(c *C) {
 
 	// If we try to insert something, it'll have to hold until the new
 	// master is available to move the connection, and work correctly.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -661,7 +661,7 @@ func (s *S) TestPrimaryShutdownEventual(c *C) {
 	session.SetMode(Eventual, true)
 
 	// Should connect to the master when needed.
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -672,7 +672,7 @@ func (s *S) TestPrimaryShutdownEventual(c *C) {
 	s.Stop(master)
 
 	// Should still work, with the new master now.
-	coll = session.DB("mydb").C("mycoll")
+	coll = session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
 
@@ -740,7 +740,7 @@ func (s *S) TestTopologySyncWithSingleMaster(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"a": 1, "b": 2})
 	c.Assert(err, IsNil)
 
@@ -764,7 +764,7 @@ func (s *S) TestTopologySyncWithSlaveSeed(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 
 	result := struct{ Ok bool }{}
@@ -920,12 +920,12 @@ func (s *S) TestDirect(c *C) {
 	// We've got no master, so it'll timeout.
 	session.SetSyncTimeout(5e8 * time.Nanosecond)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"test": 1})
 	c.Assert(err, ErrorMatches, "no reachable servers")
 
 	// Writing to the local database is okay.
-	coll = session.DB("local").C("mycoll")
+	coll = session.db("local").c("mycoll")
 	defer coll.RemoveAll(nil)
 	id := bson.NewObjectId()
 	err = coll.Insert(M{"_id": id})
@@ -958,7 +958,7 @@ func (s *S) TestDirectToUnknownStateMember(c *C) {
 	// We've got no master, so it'll timeout.
 	session.SetSyncTimeout(5e8 * time.Nanosecond)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"test": 1})
 	c.Assert(err, ErrorMatches, "no reachable servers")
 
@@ -1037,7 +1037,7 @@ func (s *S) TestMonotonicSlaveOkFlagWithMongos(c *C) {
 
 	mongos.SetMode(Monotonic, true)
 
-	coll := mongos.DB("mydb").C("mycoll")
+	coll := mongos.db("mydb").c("mycoll")
 	result := &struct{}{}
 	for i := 0; i != 5; i++ {
 		err := coll.Find(nil).One(result)
@@ -1097,7 +1097,7 @@ func (s *S) TestRemovalOfClusterMember(c *C) {
 		IsMaster bool
 		Me       string
 	}{}
-	slave := master.Copy()
+	slave := master.copy()
 	slave.SetMode(Monotonic, true) // Monotonic can hold a non-master socket persistently.
 	err = slave.Run("isMaster", result)
 	c.Assert(err, IsNil)
@@ -1166,7 +1166,7 @@ func (s *S) TestSocketLimit(c *C) {
 	// Consume the whole limit for the master.
 	var master []*Session
 	for i := 0; i < socketLimit; i++ {
-		s := session.Copy()
+		s := session.copy()
 		defer s.Close()
 		err := s.Ping()
 		c.Assert(err, IsNil)
@@ -1188,6 +1188,36 @@ func (s *S) TestSocketLimit(c *C) {
 	c.Assert(delay < 6e9, Equals, true)
 }
 
+func (s *S) TestPoolWaitQueueTimeout(c *C) {
+	info := &DialInfo{
+		Addrs:            []string{"localhost:40001"},
+		Timeout:          5 * time.Second,
+		MaxPoolSize:      1,
+		WaitQueueTimeout: 500 * time.Millisecond,
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetMode(Strong, true)
+
+	held := session.copy()
+	defer held.Close()
+	c.Assert(held.Ping(), IsNil)
+
+	other := session.copy()
+	defer other.Close()
+	before := time.Now()
+	c.Assert(other.Ping(), Equals, ErrPoolTimeout)
+	c.Assert(time.Since(before) >= 5e8, Equals, true)
+
+	// Once released, the socket is handed over to the waiting operation.
+	go func() {
+		time.Sleep(1e8)
+		held.Refresh()
+	}()
+	c.Assert(other.Ping(), IsNil)
+}
+
 func (s *S) TestSetModeEventualIterBug(c *C) {
 	session1, err := Dial("localhost:40011")
 	c.Assert(err, IsNil)
@@ -1195,7 +1225,7 @@ func (s *S) TestSetModeEventualIterBug(c *C) {
 
 	session1.SetMode(Eventual, false)
 
-	coll1 := session1.DB("mydb").C("mycoll")
+	coll1 := session1.db("mydb").c("mycoll")
 
 	const N = 100
 	for i := 0; i < N; i++ {
@@ -1219,10 +1249,10 @@ func (s *S) TestSetModeEventualIterBug(c *C) {
 
 	session2.SetMode(Eventual, false)
 
-	coll2 := session2.DB("mydb").C("mycoll")
+	coll2 := session2.db("mydb").c("mycoll")
 
 	i := 0
-	iter := coll2.find(nil).Batch(10).iter()
+	iter := coll2.find(nil).batch(10).iter()
 	var result struct{}
 	for iter.Next(&result) {
 		i++
@@ -1311,8 +1341,8 @@ func (s *S) TestPrimaryShutdownOnAuthShard(c *C) {
 	defer session.Close()
 
 	// Login and insert something to make it more realistic.
-	session.DB("admin").Login("root", "rapadura")
-	coll := session.DB("mydb").C("mycoll")
+	session.db("admin").Login("root", "rapadura")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(bson.M{"n": 1})
 	c.Assert(err, IsNil)
 
@@ -1463,6 +1493,57 @@ func (s *S) TestSelectServers(c *C) {
 	c.Assert(hostPort(result.Host), Equals, "40013")
 }
 
+func (s *S) TestReadPreference(c *C) {
+	if !s.versionAtLeast(2, 2) {
+		c.Skip("read preferences introduced in 2.2")
+	}
+
+	session, err := Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var result struct{ Host string }
+
+	// The first tag set matching some secondary is used.
+	session.SetReadPreference(&ReadPreference{
+		Mode:    ReadSecondary,
+		TagSets: []bson.D{{{"rs1", "z"}}, {{"rs1", "c"}}, {{"rs1", "b"}}},
+	})
+	c.Assert(session.Mode(), Equals, Eventual)
+	err = session.Run("serverStatus", &result)
+	c.Assert(err, IsNil)
+	c.Assert(hostPort(result.Host), Equals, "40013")
+
+	// Nothing matches, so fall back to the primary.
+	session.SetReadPreference(&ReadPreference{
+		Mode:    ReadSecondaryPreferred,
+		TagSets: []bson.D{{{"rs1", "z"}}},
+	})
+	err = session.Run("serverStatus", &result)
+	c.Assert(err, IsNil)
+	c.Assert(hostPort(result.Host), Equals, "40011")
+
+	// Queries may override the session's preference.
+	session.SetReadPreference(nil)
+	c.Assert(session.Mode(), Equals, Strong)
+	c.Assert(session.ReadPreference(), IsNil)
+	query := session.db("admin").c("$cmd").find(bson.D{{"serverStatus", 1}})
+	query.ReadPreference(&ReadPreference{Mode: ReadSecondary, TagSets: []bson.D{{{"rs1", "b"}}}})
+	err = query.One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(hostPort(result.Host), Equals, "40012")
+
+	// The secondaries are up to date.
+	query.ReadPreference(&ReadPreference{Mode: ReadSecondary, MaxStaleness: 90 * time.Second})
+	err = query.One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(hostPort(result.Host), Not(Equals), "40011")
+
+	query.ReadPreference(&ReadPreference{Mode: ReadNearest, MaxStaleness: 10 * time.Second})
+	err = query.One(&result)
+	c.Assert(err, ErrorMatches, "read preference maxStaleness must be at least 90 seconds")
+}
+
 func (s *S) TestSelectServersWithMongos(c *C) {
 	if !s.versionAtLeast(2, 2) {
 		c.Skip("read preferences introduced in 2.2")
@@ -1510,7 +1591,7 @@ func (s *S) TestSelectServersWithMongos(c *C) {
 
 	mongos.Refresh()
 	mongos.SelectServers(bson.D{{"rs2", slave1}})
-	coll := mongos.DB("mydb").C("mycoll")
+	coll := mongos.db("mydb").c("mycoll")
 	result := &struct{}{}
 	for i := 0; i != 5; i++ {
 		err := coll.Find(nil).One(result)
@@ -1519,7 +1600,7 @@ func (s *S) TestSelectServersWithMongos(c *C) {
 
 	mongos.Refresh()
 	mongos.SelectServers(bson.D{{"rs2", slave2}})
-	coll = mongos.DB("mydb").C("mycoll")
+	coll = mongos.db("mydb").c("mycoll")
 	for i := 0; i != 7; i++ {
 		err := coll.Find(nil).One(result)
 		c.Assert(err, Equals, ErrNotFound)
@@ -1550,3 +1631,166 @@ func (s *S) TestSelectServersWithMongos(c *C) {
 		c.Fatal("Uh?")
 	}
 }
+
+func (s *S) TestWatch(c *C) {
+	session, err := Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.db("mydb").c("mycoll")
+	coll.Insert(M{"_id": 0})
+
+	stream, err := session.Watch(WatchOptions{Database: "mydb", Timeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+	err = session.db("otherdb").c("mycoll").Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+	err = coll.Update(M{"_id": 1}, M{"$set": M{"n": 2}})
+	c.Assert(err, IsNil)
+	err = coll.Update(M{"_id": 1}, M{"n": 3})
+	c.Assert(err, IsNil)
+	err = coll.Remove(M{"_id": 1})
+	c.Assert(err, IsNil)
+
+	var event ChangeEvent
+	var doc struct{ N int }
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Op, Equals, "insert")
+	c.Assert(event.Database, Equals, "mydb")
+	c.Assert(event.Collection, Equals, "mycoll")
+	c.Assert(event.Id, Equals, 1)
+	c.Assert(event.Doc.Unmarshal(&doc), IsNil)
+	c.Assert(doc.N, Equals, 1)
+	inserted := event.ResumeToken
+
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Op, Equals, "update")
+	c.Assert(event.Id, Equals, 1)
+	c.Assert(event.Doc.Kind, Equals, byte(0))
+	var update struct {
+		Set struct{ N int } "$set"
+	}
+	c.Assert(event.Update.Unmarshal(&update), IsNil)
+	c.Assert(update.Set.N, Equals, 2)
+
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Op, Equals, "update")
+	c.Assert(event.Doc.Unmarshal(&doc), IsNil)
+	c.Assert(doc.N, Equals, 3)
+
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Op, Equals, "delete")
+	c.Assert(event.Id, Equals, 1)
+	c.Assert(stream.ResumeToken(), Equals, event.ResumeToken)
+
+	// Resuming from a persisted token delivers the following changes.
+	resumed, err := session.Watch(WatchOptions{Database: "mydb", Ops: []string{"delete"}, ResumeAfter: &inserted})
+	c.Assert(err, IsNil)
+	defer resumed.Close()
+	c.Assert(resumed.Next(&event), Equals, true)
+	c.Assert(event.Op, Equals, "delete")
+
+	_, err = session.Watch(WatchOptions{Ops: []string{"drop"}})
+	c.Assert(err, ErrorMatches, "unknown change stream operation: drop")
+	_, err = session.Watch(WatchOptions{Collections: []string{"mycoll"}})
+	c.Assert(err, ErrorMatches, "watching collections requires a database")
+
+	bogus := ResumeToken{Timestamp: 1, Hash: 1}
+	stream, err = session.Watch(WatchOptions{ResumeAfter: &bogus})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Assert(stream.Next(&event), Equals, false)
+	c.Assert(stream.Err(), Equals, ErrResumeTokenNotFound)
+}
+
+func (s *S) TestWatchCloseWhileBlocked(c *C) {
+	session, err := Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	stream, err := session.Watch(WatchOptions{Database: "mydb"})
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	go func() {
+		var event ChangeEvent
+		done <- stream.Next(&event)
+	}()
+
+	// Let Next block waiting for changes that never come.
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-done:
+		c.Fatalf("Next returned without changes")
+	default:
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- stream.Close()
+	}()
+	select {
+	case err := <-closed:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Close blocked by Next")
+	}
+	select {
+	case ok := <-done:
+		c.Assert(ok, Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Next not interrupted by Close")
+	}
+	c.Assert(stream.Err(), IsNil)
+
+	var event ChangeEvent
+	c.Assert(stream.Next(&event), Equals, false)
+}
+
+func (s *S) TestWatchPrimaryShutdown(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.db("mydb").c("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	stream, err := session.Watch(WatchOptions{Collections: []string{"mycoll"}, Database: "mydb"})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	stream.session.SetSyncTimeout(3 * time.Minute)
+
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+
+	var event ChangeEvent
+	var doc struct{ N int }
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Doc.Unmarshal(&doc), IsNil)
+	c.Assert(doc.N, Equals, 2)
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	s.Stop(result.Host)
+
+	// Write through a new session once the new primary is elected.
+	wsession := session.new()
+	defer wsession.Close()
+	wsession.SetSyncTimeout(3 * time.Minute)
+	err = wsession.db("mydb").c("mycoll").Insert(M{"n": 3})
+	c.Assert(err, IsNil)
+
+	// The stream resumes against the new primary.
+	c.Assert(stream.Next(&event), Equals, true)
+	c.Assert(event.Doc.Unmarshal(&doc), IsNil)
+	c.Assert(doc.N, Equals, 3)
+}
@@ -33,7 +33,6 @@ import (
 	"hash"
 	"io"
 	"labix.org/v2/base/bson"
-	. "labix.org/v2/base/log"
 	"os"
 	"sync"
 	"time"
@@ -102,7 +101,7 @@ type gfsCachedChunk struct {
 }
 
 func newGridFS(db *Database, prefix string) *GridFS {
-	return &GridFS{db.C(prefix + ".files"), db.C(prefix + ".chunks")}
+	return &GridFS{db.c(prefix + ".files"), db.c(prefix + ".chunks")}
 }
 
 func (gfs *GridFS) newFile() *GridFile {
@@ -365,6 +364,11 @@ func (file *GridFile) assertMode(mode gfsFileMode) {
 	}
 }
 
+// session returns the session the file's messages are logged through.
+func (file *GridFile) session() *Session {
+	return file.gfs.Files.Database.Session
+}
+
 // SetChunkSize sets size of saved chunks.  Once the file is written to, it
 // will be split in blocks of that size and each block saved into an
 // independent chunk document.  The default chunk size is 256kb.
@@ -373,7 +377,7 @@ func (file *GridFile) assertMode(mode gfsFileMode) {
 // being written to.
 func (file *GridFile) SetChunkSize(bytes int) {
 	file.assertMode(gfsWriting)
-	Debugf("GridFile %p: setting chunk size to %d", file, bytes)
+	file.session().debugf("GridFile %p: setting chunk size to %d", file, bytes)
 	file.m.Lock()
 	file.doc.ChunkSize = bytes
 	file.m.Unlock()
@@ -509,7 +513,7 @@ func (file *GridFile) Close() (err error) {
 		file.rcache = nil
 	}
 	file.mode = gfsClosed
-	Debugf("GridFile %p: closed", file)
+	file.session().debugf("GridFile %p: closed", file)
 	return file.err
 }
 
@@ -527,7 +531,7 @@ func (file *GridFile) Close() (err error) {
 func (file *GridFile) Write(data []byte) (n int, err error) {
 	file.assertMode(gfsWriting)
 	file.m.Lock()
-	Debugf("GridFile %p: writing %d bytes", file, len(data))
+	file.session().debugf("GridFile %p: writing %d bytes", file, len(data))
 	defer file.m.Unlock()
 
 	if file.err != nil {
@@ -574,7 +578,7 @@ func (file *GridFile) Write(data []byte) (n int, err error) {
 func (file *GridFile) insertChunk(data []byte) {
 	n := file.chunk
 	file.chunk++
-	Debugf("GridFile %p: adding to checksum: %q", file, string(data))
+	file.session().debugf("GridFile %p: adding to checksum: %q", file, string(data))
 	file.wsum.Write(data)
 
 	for file.doc.ChunkSize*file.wpending >= 1024*1024 {
@@ -587,7 +591,7 @@ func (file *GridFile) insertChunk(data []byte) {
 
 	file.wpending++
 
-	Debugf("GridFile %p: inserting chunk %d with %d bytes", file, n, len(data))
+	file.session().debugf("GridFile %p: inserting chunk %d with %d bytes", file, n, len(data))
 
 	// We may not own the memory of data, so rather than
 	// simply copying it, we'll marshal the document ahead of time.
@@ -612,7 +616,7 @@ func (file *GridFile) insertChunk(data []byte) {
 func (file *GridFile) insertFile() {
 	hexsum := hex.EncodeToString(file.wsum.Sum(nil))
 	for file.wpending > 0 {
-		Debugf("GridFile %p: waiting for %d pending chunks to insert file", file, file.wpending)
+		file.session().debugf("GridFile %p: waiting for %d pending chunks to insert file", file, file.wpending)
 		file.c.Wait()
 	}
 	if file.err == nil {
@@ -630,7 +634,7 @@ func (file *GridFile) insertFile() {
 // an Error, if any.
 func (file *GridFile) Seek(offset int64, whence int) (pos int64, err error) {
 	file.m.Lock()
-	Debugf("GridFile %p: seeking for %s (whence=%d)", file, offset, whence)
+	file.session().debugf("GridFile %p: seeking for %s (whence=%d)", file, offset, whence)
 	defer file.m.Unlock()
 	switch whence {
 	case os.SEEK_SET:
@@ -670,7 +674,7 @@ func (file *GridFile) Seek(offset int64, whence int) (pos int64, err error) {
 func (file *GridFile) Read(b []byte) (n int, err error) {
 	file.assertMode(gfsReading)
 	file.m.Lock()
-	Debugf("GridFile %p: reading at offset %d into buffer of length %d", file, file.offset, len(b))
+	file.session().debugf("GridFile %p: reading at offset %d into buffer of length %d", file, file.offset, len(b))
 	defer file.m.Unlock()
 	if file.offset == file.doc.Length {
 		return 0, io.EOF
@@ -693,11 +697,11 @@ func (file *GridFile) getChunk() (data []byte, err error) {
 	cache := file.rcache
 	file.rcache = nil
 	if cache != nil && cache.n == file.chunk {
-		Debugf("GridFile %p: Getting chunk %d from cache", file, file.chunk)
+		file.session().debugf("GridFile %p: Getting chunk %d from cache", file, file.chunk)
 		cache.wait.Lock()
 		data, err = cache.data, cache.err
 	} else {
-		Debugf("GridFile %p: Fetching chunk %d", file, file.chunk)
+		file.session().debugf("GridFile %p: Fetching chunk %d", file, file.chunk)
 		var doc gfsChunk
 		err = file.gfs.Chunks.Find(bson.D{{"files_id", file.doc.Id}, {"n", file.chunk}}).One(&doc)
 		data = doc.Data
@@ -707,10 +711,10 @@ func (file *GridFile) getChunk() (data []byte, err error) {
 		// Read the next one in background.
 		cache = &gfsCachedChunk{n: file.chunk}
 		cache.wait.Lock()
-		Debugf("GridFile %p: Scheduling chunk %d for background caching", file, file.chunk)
+		file.session().debugf("GridFile %p: Scheduling chunk %d for background caching", file, file.chunk)
 		// Clone the session to avoid having it closed in between.
 		chunks := file.gfs.Chunks
-		session := chunks.Database.Session.Clone()
+		session := chunks.Database.Session.clone()
 		go func(id interface{}, n int) {
 			defer session.Close()
 			chunks = chunks.With(session)
@@ -721,6 +725,6 @@ func (file *GridFile) getChunk() (data []byte, err error) {
 		}(file.doc.Id, file.chunk)
 		file.rcache = cache
 	}
-	Debugf("Returning err: %#v", err)
+	file.session().debugf("Returning err: %#v", err)
 	return
 }
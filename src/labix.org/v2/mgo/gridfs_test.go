@@ -40,7 +40,7 @@ func (s *S) TestGridFSCreate(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	before := bson.Now()
 
@@ -59,7 +59,7 @@ func (s *S) TestGridFSCreate(c *C) {
 
 	// Check the file information.
 	result := M{}
-	err = db.C("fs.files").Find(nil).One(result)
+	err = db.c("fs.files").Find(nil).One(result)
 	c.Assert(err, IsNil)
 
 	fileId, ok := result["_id"].(bson.ObjectId)
@@ -83,7 +83,7 @@ func (s *S) TestGridFSCreate(c *C) {
 
 	// Check the chunk.
 	result = M{}
-	err = db.C("fs.chunks").Find(nil).One(result)
+	err = db.c("fs.chunks").Find(nil).One(result)
 	c.Assert(err, IsNil)
 
 	chunkId, ok := result["_id"].(bson.ObjectId)
@@ -100,7 +100,7 @@ func (s *S) TestGridFSCreate(c *C) {
 	c.Assert(result, DeepEquals, expected)
 
 	// Check that an index was created.
-	indexes, err := db.C("fs.chunks").Indexes()
+	indexes, err := db.c("fs.chunks").Indexes()
 	c.Assert(err, IsNil)
 	c.Assert(len(indexes), Equals, 2)
 	c.Assert(indexes[1].Key, DeepEquals, []string{"files_id", "n"})
@@ -111,7 +111,7 @@ func (s *S) TestGridFSFileDetails(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -164,7 +164,7 @@ func (s *S) TestGridFSFileDetails(c *C) {
 	c.Assert(ud.After(now.Add(-3*time.Second)), Equals, true)
 
 	result := M{}
-	err = db.C("fs.files").Find(nil).One(result)
+	err = db.c("fs.files").Find(nil).One(result)
 	c.Assert(err, IsNil)
 
 	result["uploadDate"] = "<timestamp>"
@@ -187,7 +187,7 @@ func (s *S) TestGridFSCreateWithChunking(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -221,7 +221,7 @@ func (s *S) TestGridFSCreateWithChunking(c *C) {
 
 	// Check the file information.
 	result := M{}
-	err = db.C("fs.files").Find(nil).One(result)
+	err = db.c("fs.files").Find(nil).One(result)
 	c.Assert(err, IsNil)
 
 	fileId, _ := result["_id"].(bson.ObjectId)
@@ -239,7 +239,7 @@ func (s *S) TestGridFSCreateWithChunking(c *C) {
 	c.Assert(result, DeepEquals, expected)
 
 	// Check the chunks.
-	iter := db.C("fs.chunks").Find(nil).Sort("n").Iter()
+	iter := db.c("fs.chunks").Find(nil).Sort("n").Iter()
 	dataChunks := []string{"abcde", "fghij", "klmno", "pqrst", "uv"}
 	for i := 0; ; i++ {
 		result = M{}
@@ -268,7 +268,7 @@ func (s *S) TestGridFSOpenNotFound(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 	file, err := gfs.OpenId("non-existent")
@@ -285,7 +285,7 @@ func (s *S) TestGridFSReadAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 	file, err := gfs.Create("")
@@ -322,7 +322,7 @@ func (s *S) TestGridFSReadChunking(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -382,7 +382,7 @@ func (s *S) TestGridFSOpen(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -412,7 +412,7 @@ func (s *S) TestGridFSSeek(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 	file, err := gfs.Create("")
@@ -484,7 +484,7 @@ func (s *S) TestGridFSRemoveId(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -512,7 +512,7 @@ func (s *S) TestGridFSRemoveId(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(string(b[:]), Equals, "1")
 
-	n, err := db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	n, err := db.c("fs.chunks").Find(M{"files_id": id}).Count()
 	c.Assert(err, IsNil)
 	c.Assert(n, Equals, 0)
 }
@@ -522,7 +522,7 @@ func (s *S) TestGridFSRemove(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
@@ -542,7 +542,7 @@ func (s *S) TestGridFSRemove(c *C) {
 	_, err = gfs.Open("myfile.txt")
 	c.Assert(err == ErrNotFound, Equals, true)
 
-	n, err := db.C("fs.chunks").Find(nil).Count()
+	n, err := db.c("fs.chunks").Find(nil).Count()
 	c.Assert(err, IsNil)
 	c.Assert(n, Equals, 0)
 }
@@ -552,7 +552,7 @@ func (s *S) TestGridFSOpenNext(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 
 	gfs := db.GridFS("fs")
 
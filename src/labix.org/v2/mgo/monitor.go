@@ -0,0 +1,167 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandMonitor receives events for the operations a session sends to the
+// database, and may be used to trace them or to log slow ones. See
+// DialInfo.Monitor and Session.SetCommandMonitor.
+//
+// Started is called once an operation is sent, and then either Succeeded or
+// Failed once its reply arrives. Operations that get no reply, such as
+// unacknowledged writes and cursor kills, are reported as done right after
+// being sent. A write made in safe mode is followed by its own getLastError
+// command, which is reported separately.
+//
+// Methods may be called concurrently and must return quickly, since the
+// replies of other operations on the same socket wait for them.
+type CommandMonitor interface {
+	Started(event *CommandEvent)
+	Succeeded(event *CommandEvent)
+	Failed(event *CommandEvent)
+}
+
+// CommandEvent describes an operation reported to a CommandMonitor.
+type CommandEvent struct {
+	// RequestId identifies the operation on the wire, and is the same
+	// for all events of an operation. It's zero for operations that get
+	// no reply.
+	RequestId int32
+
+	Database string
+
+	// CommandName is the name of the command run, such as "count" or
+	// "getLastError", or one of "find", "getMore", "insert", "update",
+	// "delete" and "killCursors" for other operations.
+	CommandName string
+
+	// Server is the address of the server the operation was sent to.
+	Server string
+
+	// Duration is how long the operation took. It's only set for
+	// Succeeded and Failed events.
+	Duration time.Duration
+
+	// Err is the error the operation failed with. It's only set for
+	// Failed events.
+	Err error
+}
+
+// monitoredOp tracks an operation being reported to a CommandMonitor.
+type monitoredOp struct {
+	monitor CommandMonitor
+	event   CommandEvent
+	start   time.Time
+	started chan struct{}
+	replied bool
+}
+
+func newMonitoredOp(monitor CommandMonitor, server, collection, name string) *monitoredOp {
+	database := collection
+	if i := strings.Index(collection, "."); i >= 0 {
+		database = collection[:i]
+	}
+	return &monitoredOp{
+		monitor: monitor,
+		event:   CommandEvent{Database: database, CommandName: name, Server: server},
+		start:   time.Now(),
+		started: make(chan struct{}),
+	}
+}
+
+func (m *monitoredOp) begin() {
+	event := m.event
+	m.monitor.Started(&event)
+	close(m.started)
+}
+
+// end reports the operation as done. It waits for the Started event to be
+// delivered, since the reply may arrive before that happens.
+func (m *monitoredOp) end(err error) {
+	<-m.started
+	event := m.event
+	event.Duration = time.Since(m.start)
+	if err != nil {
+		event.Err = err
+		m.monitor.Failed(&event)
+	} else {
+		m.monitor.Succeeded(&event)
+	}
+}
+
+// wrap returns a replyFunc that reports the operation as done when its
+// reply arrives, and then calls replyFunc.
+func (m *monitoredOp) wrap(collection string, replyFunc replyFunc) replyFunc {
+	m.replied = true
+	var once sync.Once
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		once.Do(func() {
+			failure := err
+			if err == nil && docNum == 0 {
+				failure = checkQueryError(collection, docData)
+			}
+			m.end(failure)
+		})
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// commandName returns the name of the command in the marshalled document,
+// which is its first key, looking into $query if the command has options.
+func commandName(doc []byte) string {
+	for len(doc) > 5 && doc[4] != 0 {
+		end := 5
+		for end < len(doc) && doc[end] != 0 {
+			end++
+		}
+		name := string(doc[5:end])
+		if name != "$query" || doc[4] != 0x03 || end+1 >= len(doc) {
+			return name
+		}
+		doc = doc[end+1:]
+	}
+	return ""
+}
+
+// monitorSent reports the given operations as started once they were sent,
+// or failed to be sent with err, and reports as done the ones that get no
+// reply. The others are reported as done when their reply arrives.
+func monitorSent(monitored []*monitoredOp, err error) {
+	for _, m := range monitored {
+		m.begin()
+	}
+	for _, m := range monitored {
+		if !m.replied {
+			m.end(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"labix.org/v2/base/bson"
+	"labix.org/v2/imgo"
+	"time"
+)
+
+// ReadMode selects the kind of servers reads are sent to. See ReadPreference.
+type ReadMode = imgo.ReadMode
+
+const (
+	// ReadPrimary sends reads to the primary only.
+	ReadPrimary ReadMode = iota
+
+	// ReadPrimaryPreferred sends reads to the primary, or to a
+	// secondary when no primary is available.
+	ReadPrimaryPreferred
+
+	// ReadSecondary sends reads to secondaries only.
+	ReadSecondary
+
+	// ReadSecondaryPreferred sends reads to a secondary, or to the
+	// primary when no secondary is suitable.
+	ReadSecondaryPreferred
+
+	// ReadNearest sends reads to the suitable server with the lowest
+	// latency, be it the primary or a secondary.
+	ReadNearest
+)
+
+// ParseReadMode returns the mode with the given name, such as "nearest".
+func ParseReadMode(name string) (ReadMode, error) {
+	for mode := ReadPrimary; mode <= ReadNearest; mode++ {
+		if name == mode.String() {
+			return mode, nil
+		}
+	}
+	return 0, errors.New("unknown read preference mode: " + name)
+}
+
+// ReadPreference defines which servers of a replica set the reads of a
+// session or query are sent to. See Session.SetReadPreference and
+// Query.ReadPreference.
+type ReadPreference = imgo.ReadPreference
+
+// minMaxStaleness is the smallest MaxStaleness accepted, since servers
+// only record their last write every 10 seconds and are synced every
+// syncServersDelay.
+const minMaxStaleness = 90 * time.Second
+
+const defaultLocalThreshold = 15 * time.Millisecond
+
+var errMaxStaleness = errors.New("read preference maxStaleness must be at least 90 seconds")
+
+// readPrefDocument returns the read preference as sent to mongos in
+// $readPreference.
+func readPrefDocument(pref *ReadPreference) bson.D {
+	doc := bson.D{{"mode", pref.Mode.String()}}
+	if len(pref.TagSets) > 0 && pref.Mode != ReadPrimary {
+		doc = append(doc, bson.DocElem{"tags", pref.TagSets})
+	}
+	if pref.MaxStaleness > 0 {
+		doc = append(doc, bson.DocElem{"maxStalenessSeconds", int(pref.MaxStaleness / time.Second)})
+	}
+	return doc
+}
+
+// readCandidate is a snapshot of the state of a server considered for
+// reading from.
+type readCandidate struct {
+	server *mongoServer
+	info   *mongoServerInfo
+	ping   time.Duration
+	inUse  int
+}
+
+// SelectRead returns the server to read from according to pref, or nil
+// if no server is suitable.
+func (servers *mongoServers) SelectRead(pref *ReadPreference) (*mongoServer, error) {
+	if pref.MaxStaleness > 0 && pref.MaxStaleness < minMaxStaleness {
+		return nil, errMaxStaleness
+	}
+	var primary *readCandidate
+	var secondaries, routers []*readCandidate
+	for _, server := range servers.slice {
+		server.RLock()
+		c := &readCandidate{server, server.info, server.pingValue, len(server.liveSockets) - len(server.unusedSockets)}
+		server.RUnlock()
+		switch {
+		case c.info.Mongos:
+			routers = append(routers, c)
+		case c.info.Master:
+			primary = c
+		default:
+			secondaries = append(secondaries, c)
+		}
+	}
+	if len(routers) > 0 {
+		// mongos applies the preference itself. See queryOp.finalQuery.
+		return nearest(pref, routers), nil
+	}
+	switch pref.Mode {
+	case ReadPrimary:
+		return primary.serverOrNil(), nil
+	case ReadPrimaryPreferred:
+		if primary != nil {
+			return primary.server, nil
+		}
+		return nearest(pref, eligible(pref, secondaries, secondaries, primary)), nil
+	case ReadSecondary:
+		return nearest(pref, eligible(pref, secondaries, secondaries, primary)), nil
+	case ReadSecondaryPreferred:
+		if server := nearest(pref, eligible(pref, secondaries, secondaries, primary)); server != nil {
+			return server, nil
+		}
+		return primary.serverOrNil(), nil
+	case ReadNearest:
+		candidates := secondaries
+		if primary != nil {
+			candidates = append(candidates[:len(candidates):len(candidates)], primary)
+		}
+		return nearest(pref, eligible(pref, candidates, secondaries, primary)), nil
+	}
+	return nil, errors.New("unknown read preference mode")
+}
+
+func (c *readCandidate) serverOrNil() *mongoServer {
+	if c == nil {
+		return nil
+	}
+	return c.server
+}
+
+// eligible returns the candidates that aren't too stale and that match
+// the first tag set of pref matching any of them.
+func eligible(pref *ReadPreference, candidates, secondaries []*readCandidate, primary *readCandidate) []*readCandidate {
+	if pref.MaxStaleness > 0 {
+		fresh := make([]*readCandidate, 0, len(candidates))
+		for _, c := range candidates {
+			if c == primary || staleness(c, primary, secondaries) <= pref.MaxStaleness {
+				fresh = append(fresh, c)
+			}
+		}
+		candidates = fresh
+	}
+	if len(pref.TagSets) == 0 {
+		return candidates
+	}
+	for _, tags := range pref.TagSets {
+		var matched []*readCandidate
+		for _, c := range candidates {
+			if c.info.hasTags([]bson.D{tags}) {
+				matched = append(matched, c)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return nil
+}
+
+// staleness estimates how far behind the primary the secondary c is, or
+// behind the most up to date secondary when there's no primary.
+func staleness(c, primary *readCandidate, secondaries []*readCandidate) time.Duration {
+	if c.info.LastWrite.IsZero() {
+		return 0
+	}
+	if primary != nil && !primary.info.LastWrite.IsZero() {
+		lag := c.info.LastUpdate.Sub(c.info.LastWrite) - primary.info.LastUpdate.Sub(primary.info.LastWrite)
+		return lag + syncServersDelay
+	}
+	newest := c.info.LastWrite
+	for _, s := range secondaries {
+		if s.info.LastWrite.After(newest) {
+			newest = s.info.LastWrite
+		}
+	}
+	return newest.Sub(c.info.LastWrite) + syncServersDelay
+}
+
+// nearest returns the candidate with the lowest ping time, preferring
+// the ones with fewer sockets in use among those within the latency window
+// of pref.
+func nearest(pref *ReadPreference, candidates []*readCandidate) *mongoServer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	threshold := pref.LocalThreshold
+	if threshold == 0 {
+		threshold = defaultLocalThreshold
+	}
+	fastest := candidates[0].ping
+	for _, c := range candidates[1:] {
+		if c.ping < fastest {
+			fastest = c.ping
+		}
+	}
+	var best *readCandidate
+	for _, c := range candidates {
+		if c.ping > fastest+threshold {
+			continue
+		}
+		if best == nil || c.inUse < best.inUse {
+			best = c
+		}
+	}
+	return best.server
+}
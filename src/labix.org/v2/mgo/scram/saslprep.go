@@ -0,0 +1,146 @@
+package scram
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/bidi"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// SASLprep prepares s as defined by the SASLprep profile of stringprep
+// (RFC 4013), which SCRAM-SHA-256 requires of passwords. It maps spaces
+// and removes invisible characters, normalizes the result with NFKC, and
+// fails if the result holds prohibited or unassigned characters, or mixes
+// text directions.
+func SASLprep(s string) (string, error) {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7E {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s, nil
+	}
+
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(mappedToNothing, r):
+			return -1
+		case unicode.Is(nonASCIISpace, r):
+			return ' '
+		}
+		return r
+	}, s)
+	prepared := norm.NFKC.String(mapped)
+
+	var randAL, l bool
+	for _, r := range prepared {
+		if unicode.Is(prohibited, r) || r&0xFFFE == 0xFFFE {
+			return "", fmt.Errorf("SASLprep: prohibited character %U", r)
+		}
+		if !unicode.In(r, assigned...) {
+			return "", fmt.Errorf("SASLprep: unassigned character %U", r)
+		}
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.R, bidi.AL:
+			randAL = true
+		case bidi.L:
+			l = true
+		}
+	}
+	if randAL {
+		first, _ := bidi.LookupString(prepared)
+		last, _ := bidi.LookupRune(lastRune(prepared))
+		if l || !isRandAL(first) || !isRandAL(last) {
+			return "", errors.New("SASLprep: invalid mix of left-to-right and right-to-left text")
+		}
+	}
+	return prepared, nil
+}
+
+func isRandAL(props bidi.Properties) bool {
+	class := props.Class()
+	return class == bidi.R || class == bidi.AL
+}
+
+func lastRune(s string) rune {
+	var last rune
+	for _, r := range s {
+		last = r
+	}
+	return last
+}
+
+// assigned holds the categories of assigned characters, which is all of
+// them but Cn.
+var assigned = []*unicode.RangeTable{
+	unicode.L, unicode.M, unicode.N, unicode.P, unicode.S, unicode.Z,
+	unicode.Cc, unicode.Cf, unicode.Co, unicode.Cs,
+}
+
+// mappedToNothing holds the characters commonly mapped to nothing
+// (RFC 3454 B.1).
+var mappedToNothing = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00AD, 0x00AD, 1},
+		{0x034F, 0x034F, 1},
+		{0x1806, 0x1806, 1},
+		{0x180B, 0x180D, 1},
+		{0x200B, 0x200D, 1},
+		{0x2060, 0x2060, 1},
+		{0xFE00, 0xFE0F, 1},
+		{0xFEFF, 0xFEFF, 1},
+	},
+	LatinOffset: 1,
+}
+
+// nonASCIISpace holds the non-ASCII space characters (RFC 3454 C.1.2).
+var nonASCIISpace = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A0, 0x00A0, 1},
+		{0x1680, 0x1680, 1},
+		{0x2000, 0x200B, 1},
+		{0x202F, 0x202F, 1},
+		{0x205F, 0x205F, 1},
+		{0x3000, 0x3000, 1},
+	},
+	LatinOffset: 1,
+}
+
+// prohibited holds the characters SASLprep prohibits (RFC 3454 C.1.2,
+// C.2.1, C.2.2 and C.3 to C.9), except for the noncharacters at the end of
+// each plane, which are checked separately.
+var prohibited = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x0000, 0x001F, 1},
+		{0x007F, 0x00A0, 1},
+		{0x0340, 0x0341, 1},
+		{0x06DD, 0x06DD, 1},
+		{0x070F, 0x070F, 1},
+		{0x1680, 0x1680, 1},
+		{0x180E, 0x180E, 1},
+		{0x2000, 0x200F, 1},
+		{0x2028, 0x202F, 1},
+		{0x205F, 0x2063, 1},
+		{0x206A, 0x206F, 1},
+		{0x2FF0, 0x2FFB, 1},
+		{0x3000, 0x3000, 1},
+		{0xD800, 0xF8FF, 1},
+		{0xFDD0, 0xFDEF, 1},
+		{0xFEFF, 0xFEFF, 1},
+		{0xFFF9, 0xFFFF, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1D173, 0x1D17A, 1},
+		{0xE0001, 0xE0001, 1},
+		{0xE0020, 0xE007F, 1},
+		{0xF0000, 0xFFFFD, 1},
+		{0x100000, 0x10FFFD, 1},
+	},
+	LatinOffset: 2,
+}
@@ -0,0 +1,277 @@
+// Package scram implements the client side of the SCRAM-SHA-1 and
+// SCRAM-SHA-256 SASL mechanisms, as defined in RFC 5802 and RFC 7677.
+//
+// It's an implementation detail of the mgo package, which uses it to
+// authenticate without the cgo based sasl package.
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Client holds the state of a SCRAM conversation from the client side.
+//
+// Each call to Step consumes the last message from the server and prepares
+// the next message to be sent, which is available via Out, until Step
+// returns true to flag the conversation is over. Err reports whether
+// it failed.
+type Client struct {
+	newHash func() hash.Hash
+	user    string
+	pass    string
+	cache   *Cache
+
+	step    int
+	out     bytes.Buffer
+	err     error
+	nonce   []byte
+	authMsg bytes.Buffer
+
+	serverSignature []byte
+}
+
+// NewClient returns a client for a SCRAM conversation authenticating user
+// with pass, using newHash to create the hash of the mechanism, such as
+// sha1.New for SCRAM-SHA-1 and sha256.New for SCRAM-SHA-256.
+//
+// The password is used as provided; callers must prepare it as required
+// by the mechanism.
+func NewClient(newHash func() hash.Hash, user, pass string) *Client {
+	return &Client{newHash: newHash, user: user, pass: pass}
+}
+
+// SetCache makes the client reuse the salted passwords held in cache, and
+// record the ones it computes. Salting is slow by design, so the cache
+// avoids repeating it for every conversation with the same credential.
+func (c *Client) SetCache(cache *Cache) {
+	c.cache = cache
+}
+
+// SetNonce sets the client nonce, which is otherwise randomly generated.
+// It's meant for testing recorded conversations.
+func (c *Client) SetNonce(nonce []byte) {
+	c.nonce = nonce
+}
+
+// Out returns the data to be sent to the server in the current step.
+func (c *Client) Out() []byte {
+	if c.out.Len() == 0 {
+		return nil
+	}
+	return c.out.Bytes()
+}
+
+// Err returns the error that occurred, or nil if there were no errors.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// Step processes the incoming data from the server and makes the next
+// round of data for the server available via Out. Step returns true once
+// the conversation is over, either because it completed or because it
+// failed.
+func (c *Client) Step(in []byte) bool {
+	c.out.Reset()
+	if c.step > 2 || c.err != nil {
+		return true
+	}
+	c.step++
+	switch c.step {
+	case 1:
+		c.err = c.step1(in)
+	case 2:
+		c.err = c.step2(in)
+	case 3:
+		c.err = c.step3(in)
+	}
+	return c.step > 2 || c.err != nil
+}
+
+// escaper escapes the characters not allowed in names (RFC 5802 5.1).
+var escaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+func (c *Client) step1(in []byte) error {
+	if len(c.nonce) == 0 {
+		const nonceLen = 24
+		buf := make([]byte, nonceLen+base64.StdEncoding.EncodedLen(nonceLen))
+		if _, err := rand.Read(buf[:nonceLen]); err != nil {
+			return fmt.Errorf("cannot read random SCRAM nonce from operating system: %v", err)
+		}
+		c.nonce = buf[nonceLen:]
+		base64.StdEncoding.Encode(c.nonce, buf[:nonceLen])
+	}
+	c.authMsg.WriteString("n=")
+	escaper.WriteString(&c.authMsg, c.user)
+	c.authMsg.WriteString(",r=")
+	c.authMsg.Write(c.nonce)
+
+	c.out.WriteString("n,,")
+	c.out.Write(c.authMsg.Bytes())
+	return nil
+}
+
+func (c *Client) step2(in []byte) error {
+	c.authMsg.WriteByte(',')
+	c.authMsg.Write(in)
+
+	fields := bytes.Split(in, []byte(","))
+	if len(fields) != 3 {
+		return fmt.Errorf("expected 3 fields in first SCRAM server message, got %d: %q", len(fields), in)
+	}
+	if !bytes.HasPrefix(fields[0], []byte("r=")) || len(fields[0]) < 2 {
+		return fmt.Errorf("server sent an invalid SCRAM nonce: %q", fields[0])
+	}
+	if !bytes.HasPrefix(fields[1], []byte("s=")) || len(fields[1]) < 6 {
+		return fmt.Errorf("server sent an invalid SCRAM salt: %q", fields[1])
+	}
+	if !bytes.HasPrefix(fields[2], []byte("i=")) || len(fields[2]) < 6 {
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
+	}
+
+	nonce := fields[0][2:]
+	if !bytes.HasPrefix(nonce, c.nonce) {
+		return fmt.Errorf("server SCRAM nonce is not prefixed by client nonce: got %q, want %q+\"...\"", nonce, c.nonce)
+	}
+	salt := make([]byte, base64.StdEncoding.DecodedLen(len(fields[1][2:])))
+	n, err := base64.StdEncoding.Decode(salt, fields[1][2:])
+	if err != nil {
+		return fmt.Errorf("cannot decode SCRAM salt sent by server: %q", fields[1])
+	}
+	salt = salt[:n]
+	iterCount, err := strconv.Atoi(string(fields[2][2:]))
+	if err != nil || iterCount < 1 {
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
+	}
+
+	c.out.WriteString("c=biws,r=")
+	c.out.Write(nonce)
+	c.authMsg.WriteByte(',')
+	c.authMsg.Write(c.out.Bytes())
+
+	saltedPass := c.saltedPassword(salt, iterCount)
+	clientKey := c.hmac(saltedPass, []byte("Client Key"))
+	storedKey := c.hash(clientKey)
+	clientSignature := c.hmac(storedKey, c.authMsg.Bytes())
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	serverKey := c.hmac(saltedPass, []byte("Server Key"))
+	c.serverSignature = c.hmac(serverKey, c.authMsg.Bytes())
+
+	c.out.WriteString(",p=")
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(proof)))
+	base64.StdEncoding.Encode(encoded, proof)
+	c.out.Write(encoded)
+	return nil
+}
+
+func (c *Client) step3(in []byte) error {
+	if bytes.HasPrefix(in, []byte("e=")) {
+		return errors.New("SCRAM authentication failed: " + string(in[2:]))
+	}
+	if !bytes.HasPrefix(in, []byte("v=")) {
+		return fmt.Errorf("unexpected final SCRAM server message: %q", in)
+	}
+	signature := make([]byte, base64.StdEncoding.DecodedLen(len(in)-2))
+	n, err := base64.StdEncoding.Decode(signature, in[2:])
+	if err != nil || !hmac.Equal(signature[:n], c.serverSignature) {
+		return fmt.Errorf("cannot authenticate SCRAM server signature: %q", in[2:])
+	}
+	return nil
+}
+
+func (c *Client) hash(data []byte) []byte {
+	h := c.newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (c *Client) hmac(key, data []byte) []byte {
+	h := hmac.New(c.newHash, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// saltedPassword returns Hi(password, salt, iterCount) (RFC 5802 2.2),
+// from the cache when possible.
+func (c *Client) saltedPassword(salt []byte, iterCount int) []byte {
+	key := cacheKey{
+		hash:      fmt.Sprintf("%T", c.newHash()),
+		user:      c.user,
+		pass:      sha256.Sum256([]byte(c.pass)),
+		salt:      string(salt),
+		iterCount: iterCount,
+	}
+	if c.cache != nil {
+		if saltedPass, ok := c.cache.get(key); ok {
+			return saltedPass
+		}
+	}
+
+	mac := hmac.New(c.newHash, []byte(c.pass))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	ui := mac.Sum(nil)
+	hi := make([]byte, len(ui))
+	copy(hi, ui)
+	for i := 1; i < iterCount; i++ {
+		mac.Reset()
+		mac.Write(ui)
+		mac.Sum(ui[:0])
+		for j, b := range ui {
+			hi[j] ^= b
+		}
+	}
+
+	if c.cache != nil {
+		c.cache.set(key, hi)
+	}
+	return hi
+}
+
+// Cache holds salted passwords computed by clients, which may be shared
+// by clients running concurrently. See Client.SetCache.
+//
+// Entries are keyed by user, salt and iteration count, and by a digest of
+// the password, so the cache never holds passwords in plain text.
+type Cache struct {
+	m      sync.Mutex
+	salted map[cacheKey][]byte
+}
+
+type cacheKey struct {
+	hash      string
+	user      string
+	pass      [sha256.Size]byte
+	salt      string
+	iterCount int
+}
+
+// NewCache returns a new empty cache of salted passwords.
+func NewCache() *Cache {
+	return &Cache{salted: make(map[cacheKey][]byte)}
+}
+
+func (cache *Cache) get(key cacheKey) ([]byte, bool) {
+	cache.m.Lock()
+	saltedPass, ok := cache.salted[key]
+	cache.m.Unlock()
+	return saltedPass, ok
+}
+
+func (cache *Cache) set(key cacheKey, saltedPass []byte) {
+	cache.m.Lock()
+	cache.salted[key] = saltedPass
+	cache.m.Unlock()
+}
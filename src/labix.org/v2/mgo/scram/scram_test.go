@@ -0,0 +1,151 @@
+package scram_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"labix.org/v2/mgo/scram"
+	. "launchpad.net/gocheck"
+	"strings"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+// Conversations recorded in RFC 5802 and RFC 7677, where the client and
+// server messages alternate.
+var tests = []struct {
+	newHash func() hash.Hash
+	user    string
+	pass    string
+	nonce   string
+	steps   []string
+}{{
+	sha1.New, "user", "pencil", "fyko+d2lbbFgONRv9qkxdawL",
+	[]string{
+		"",
+		"n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		"",
+	},
+}, {
+	sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO",
+	[]string{
+		"",
+		"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		"",
+	},
+}}
+
+func (s *S) TestExamples(c *C) {
+	cache := scram.NewCache()
+	for _, useCache := range []bool{false, true, true} {
+		for _, test := range tests {
+			client := scram.NewClient(test.newHash, test.user, test.pass)
+			client.SetNonce([]byte(test.nonce))
+			if useCache {
+				client.SetCache(cache)
+			}
+			for i := 0; i < len(test.steps); i += 2 {
+				done := client.Step([]byte(test.steps[i]))
+				c.Assert(client.Err(), IsNil)
+				c.Assert(string(client.Out()), Equals, test.steps[i+1])
+				c.Assert(done, Equals, i+2 == len(test.steps))
+			}
+		}
+	}
+}
+
+func (s *S) TestEscapedUser(c *C) {
+	client := scram.NewClient(sha1.New, "a=b,c", "pass")
+	client.SetNonce([]byte("nonce"))
+	client.Step(nil)
+	c.Assert(string(client.Out()), Equals, "n,,n=a=3Db=2Cc,r=nonce")
+}
+
+func (s *S) TestServerErrors(c *C) {
+	test := tests[0]
+	bad := []struct{ step, message, error string }{
+		{test.steps[2], "r=other,s=QSXCR+Q6sek8bf92,i=4096", "server SCRAM nonce is not prefixed by client nonce.*"},
+		{test.steps[2], "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=0", "server sent an invalid SCRAM iteration count.*"},
+		{test.steps[2], "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j", "expected 3 fields in first SCRAM server message.*"},
+		{test.steps[4], "v=" + strings.Repeat("A", 28), "cannot authenticate SCRAM server signature.*"},
+		{test.steps[4], "e=invalid-proof", "SCRAM authentication failed: invalid-proof"},
+	}
+	for _, b := range bad {
+		client := scram.NewClient(test.newHash, test.user, test.pass)
+		client.SetNonce([]byte(test.nonce))
+		for i := 0; ; i += 2 {
+			in := test.steps[i]
+			if in == b.step {
+				in = b.message
+			}
+			if client.Step([]byte(in)) {
+				break
+			}
+		}
+		c.Assert(client.Err(), ErrorMatches, b.error)
+	}
+}
+
+var saslprepTests = []struct {
+	in, out, error string
+}{
+	{"user", "user", ""},
+	{"I\u00ADX", "IX", ""},
+	{"\u00AA", "a", ""},
+	{"\u2168", "IX", ""},
+	{"a\u2000b", "a b", ""},
+	{"\u0627\u0644\u0628", "\u0627\u0644\u0628", ""},
+	{"\u0007", "", `SASLprep: prohibited character U\+0007`},
+	{"a\uE000", "", `SASLprep: prohibited character U\+E000`},
+	{"a\U0001FFFE", "", `SASLprep: prohibited character U\+1FFFE`},
+	{"a\u0378", "", `SASLprep: unassigned character U\+0378`},
+	{"\u06271", "", "SASLprep: invalid mix of left-to-right and right-to-left text"},
+	{"\u0627a\u0627", "", "SASLprep: invalid mix of left-to-right and right-to-left text"},
+}
+
+func (s *S) TestSASLprep(c *C) {
+	for _, test := range saslprepTests {
+		c.Logf("Input: %+q", test.in)
+		out, err := scram.SASLprep(test.in)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(out, Equals, test.out)
+		}
+	}
+}
+
+func (s *S) TestPreparedPassword(c *C) {
+	// The SCRAM-SHA-256 conversation from RFC 7677, with a password that
+	// SASLprep prepares as "IX".
+	pass, err := scram.SASLprep("\u2168")
+	c.Assert(err, IsNil)
+	client := scram.NewClient(sha256.New, "user", pass)
+	client.SetNonce([]byte("rOprNGfwEbeRWgbNEkqO"))
+	steps := []string{
+		"",
+		"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=Ccfz+MPysZ5YsRatnfoQRtOYQ0RquqCRk+EhNl23pFE=",
+		"v=oSLkEWhkxIA3AphzDz+SheC1WRVNS+NlSwxyipFvUvI=",
+		"",
+	}
+	for i := 0; i < len(steps); i += 2 {
+		done := client.Step([]byte(steps[i]))
+		c.Assert(client.Err(), IsNil)
+		c.Assert(string(client.Out()), Equals, steps[i+1])
+		c.Assert(done, Equals, i+2 == len(steps))
+	}
+}
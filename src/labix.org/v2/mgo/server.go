@@ -27,9 +27,12 @@
 package mgo
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
+	"labix.org/v2/mgo/scram"
 	"net"
 	"sort"
 	"sync"
@@ -46,10 +49,14 @@ type mongoServer struct {
 	tcpaddr       *net.TCPAddr
 	unusedSockets []*mongoSocket
 	liveSockets   []*mongoSocket
+	connecting    int
+	waiters       []chan *mongoSocket
+	pool          poolConfig
 	closed        bool
 	abended       bool
 	sync          chan bool
 	dial          dialer
+	scramCache    *scram.Cache
 	pingValue     time.Duration
 	pingIndex     int
 	pingCount     uint32
@@ -60,6 +67,9 @@ type mongoServer struct {
 type dialer struct {
 	old func(addr net.Addr) (net.Conn, error)
 	new func(addr *ServerAddr) (net.Conn, error)
+
+	// tls, if set, enables TLS over the connections established.
+	tls *tls.Config
 }
 
 func (dial dialer) isSet() bool {
@@ -70,17 +80,51 @@ type mongoServerInfo struct {
 	Master bool
 	Mongos bool
 	Tags   bson.D
+
+	// LastWrite is when the server last applied a write, as reported at
+	// LastUpdate. It's zero for servers older than 3.4.
+	LastWrite  time.Time
+	LastUpdate time.Time
+
+	// MaxWireVersion tells which wire protocol features the server
+	// supports. Write commands require version 2 (MongoDB 2.6) or later.
+	MaxWireVersion int
+
+	// The limits below are zero when not reported by the server; see
+	// bulkLimits for the defaults used in that case.
+	MaxBSONSize       int
+	MaxMessageSize    int
+	MaxWriteBatchSize int
 }
 
 var defaultServerInfo mongoServerInfo
 
-func newServer(addr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer) *mongoServer {
+// poolConfig holds the settings for the pool of sockets kept for each
+// server. See the respective fields in DialInfo.
+type poolConfig struct {
+	maxSize          int
+	minSize          int
+	maxIdleTime      time.Duration
+	waitQueueTimeout time.Duration
+}
+
+// limit returns the maximum number of sockets in use per server.
+func (pool poolConfig) limit() int {
+	if pool.maxSize > 0 {
+		return pool.maxSize
+	}
+	return socketsPerServer
+}
+
+func newServer(addr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer, pool poolConfig, scramCache *scram.Cache) *mongoServer {
 	server := &mongoServer{
 		Addr:         addr,
 		ResolvedAddr: tcpaddr.String(),
 		tcpaddr:      tcpaddr,
 		sync:         sync,
 		dial:         dial,
+		pool:         pool,
+		scramCache:   scramCache,
 		info:         &defaultServerInfo,
 	}
 	// Once so the server gets a ping value, then loop in background.
@@ -89,9 +133,12 @@ func newServer(addr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer) *
 	return server
 }
 
-var errSocketLimit = errors.New("per-server connection limit reached")
 var errServerClosed = errors.New("server was closed")
 
+// ErrPoolTimeout is returned when no socket to a server became available
+// within the WaitQueueTimeout defined in DialInfo.
+var ErrPoolTimeout = errors.New("timed out waiting for a socket from the pool")
+
 // AcquireSocket returns a socket for communicating with the server.
 // This will attempt to reuse an old connection, if one is available. Otherwise,
 // it will establish a new one. The returned socket is owned by the call site,
@@ -99,7 +146,10 @@ var errServerClosed = errors.New("server was closed")
 // the same number of times as AcquireSocket + Acquire were called for it.
 // If the limit argument is not zero, a socket will only be returned if the
 // number of sockets in use for this server is under the provided limit.
-func (server *mongoServer) AcquireSocket(limit int, timeout time.Duration) (socket *mongoSocket, abended bool, err error) {
+// Otherwise the call waits in line for a socket to be released, until
+// the pool's wait queue timeout elapses or ctx is done.
+func (server *mongoServer) AcquireSocket(ctx context.Context, limit int, timeout time.Duration) (socket *mongoSocket, abended bool, err error) {
+	var deadline time.Time
 	for {
 		server.Lock()
 		abended = server.abended
@@ -108,9 +158,29 @@ func (server *mongoServer) AcquireSocket(limit int, timeout time.Duration) (sock
 			return nil, abended, errServerClosed
 		}
 		n := len(server.unusedSockets)
-		if limit > 0 && len(server.liveSockets)-n >= limit {
+		if limit > 0 && n == 0 && len(server.liveSockets)+server.connecting >= limit {
+			if deadline.IsZero() && server.pool.waitQueueTimeout > 0 {
+				deadline = time.Now().Add(server.pool.waitQueueTimeout)
+			}
+			Debugf("Server %s has %d sockets in use, waiting for one to be released.", server.Addr, limit)
+			wait := make(chan *mongoSocket, 1)
+			server.waiters = append(server.waiters, wait)
 			server.Unlock()
-			return nil, false, errSocketLimit
+			socket, err = server.waitSocket(ctx, wait, deadline)
+			if err != nil {
+				return nil, false, err
+			}
+			if socket == nil {
+				// Room was made for a new connection.
+				continue
+			}
+			server.RLock()
+			info := server.info
+			server.RUnlock()
+			if socket.InitialAcquire(info, timeout) != nil {
+				continue
+			}
+			return socket, abended, nil
 		}
 		if n > 0 {
 			socket = server.unusedSockets[n-1]
@@ -123,27 +193,84 @@ func (server *mongoServer) AcquireSocket(limit int, timeout time.Duration) (sock
 				continue
 			}
 		} else {
+			server.connecting++
 			server.Unlock()
 			socket, err = server.Connect(timeout)
-			if err == nil {
-				server.Lock()
-				// We've waited for the Connect, see if we got
-				// closed in the meantime
-				if server.closed {
-					server.Unlock()
-					socket.Release()
-					socket.Close()
-					return nil, abended, errServerClosed
-				}
-				server.liveSockets = append(server.liveSockets, socket)
+			server.Lock()
+			server.connecting--
+			if err != nil {
+				server.wakeWaiter(nil)
+				server.Unlock()
+				return
+			}
+			// We've waited for the Connect, see if we got
+			// closed in the meantime
+			if server.closed {
 				server.Unlock()
+				socket.Release()
+				socket.Close()
+				return nil, abended, errServerClosed
 			}
+			server.liveSockets = append(server.liveSockets, socket)
+			server.Unlock()
 		}
 		return
 	}
 	panic("unreachable")
 }
 
+// waitSocket waits for a socket to be handed over through wait, which
+// must be in the server's wait queue. A nil socket means room was made for
+// a new connection.
+func (server *mongoServer) waitSocket(ctx context.Context, wait chan *mongoSocket, deadline time.Time) (*mongoSocket, error) {
+	stats.poolWaiting(+1)
+	defer stats.poolWaiting(-1)
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case socket := <-wait:
+		return socket, nil
+	case <-expired:
+		err = ErrPoolTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.Lock()
+	for i, other := range server.waiters {
+		if other == wait {
+			server.waiters = append(server.waiters[:i], server.waiters[i+1:]...)
+			server.Unlock()
+			if err == ErrPoolTimeout {
+				stats.poolTimeouts(+1)
+			}
+			return nil, err
+		}
+	}
+	server.Unlock()
+	// Served meanwhile, so the hand over is already buffered.
+	return <-wait, nil
+}
+
+// wakeWaiter hands socket over to the first call waiting for one, if any,
+// reporting whether it did so. A nil socket informs the waiter that room
+// was made for a new connection. Must be called with the server lock held.
+func (server *mongoServer) wakeWaiter(socket *mongoSocket) bool {
+	if len(server.waiters) == 0 {
+		return false
+	}
+	wait := server.waiters[0]
+	copy(server.waiters, server.waiters[1:])
+	server.waiters[len(server.waiters)-1] = nil
+	server.waiters = server.waiters[:len(server.waiters)-1]
+	wait <- socket
+	return true
+}
+
 // Connect establishes a new connection to the server. This should
 // generally be done through server.AcquireSocket().
 func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error) {
@@ -167,6 +294,9 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 	default:
 		panic("dialer is set, but both dial.old and dial.new are nil")
 	}
+	if err == nil && dial.tls != nil {
+		conn, err = tlsClient(conn, server.Addr, dial.tls, timeout)
+	}
 	if err != nil {
 		Logf("Connection to %s failed: %v", server.Addr, err.Error())
 		return nil, err
@@ -174,6 +304,7 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 	Logf("Connection to %s established.", server.Addr)
 
 	stats.conn(+1, master)
+	stats.connOpened(server.Addr)
 	return newSocket(server, conn, timeout), nil
 }
 
@@ -186,6 +317,8 @@ func (server *mongoServer) Close() {
 	unusedSockets := server.unusedSockets
 	server.liveSockets = nil
 	server.unusedSockets = nil
+	for server.wakeWaiter(nil) {
+	}
 	server.Unlock()
 	Logf("Connections to %s closing (%d live sockets).", server.Addr, len(liveSockets))
 	for i, s := range liveSockets {
@@ -197,10 +330,12 @@ func (server *mongoServer) Close() {
 	}
 }
 
-// RecycleSocket puts socket back into the unused cache.
+// RecycleSocket hands socket over to the first call waiting for one, or
+// puts it back into the unused cache.
 func (server *mongoServer) RecycleSocket(socket *mongoSocket) {
 	server.Lock()
-	if !server.closed {
+	if !server.closed && !server.wakeWaiter(socket) {
+		socket.idleSince = time.Now()
 		server.unusedSockets = append(server.unusedSockets, socket)
 	}
 	server.Unlock()
@@ -230,6 +365,7 @@ func (server *mongoServer) AbendSocket(socket *mongoSocket) {
 	}
 	server.liveSockets = removeSocket(server.liveSockets, socket)
 	server.unusedSockets = removeSocket(server.unusedSockets, socket)
+	server.wakeWaiter(nil)
 	server.Unlock()
 	// Maybe just a timeout, but suggest a cluster sync up just in case.
 	select {
@@ -252,11 +388,15 @@ func (server *mongoServer) Info() *mongoServerInfo {
 }
 
 func (server *mongoServer) hasTags(serverTags []bson.D) bool {
+	return server.info.hasTags(serverTags)
+}
+
+func (info *mongoServerInfo) hasTags(serverTags []bson.D) bool {
 NextTagSet:
 	for _, tags := range serverTags {
 	NextReqTag:
 		for _, req := range tags {
-			for _, has := range server.info.Tags {
+			for _, has := range info.Tags {
 				if req.Name == has.Name {
 					if req.Value == has.Value {
 						continue NextReqTag
@@ -285,11 +425,14 @@ func (server *mongoServer) pinger(loop bool) {
 			time.Sleep(pingDelay)
 		}
 		op := op
-		socket, _, err := server.AcquireSocket(0, 3*pingDelay)
+		socket, _, err := server.AcquireSocket(context.Background(), 0, 3*pingDelay)
 		if err == nil {
 			start := time.Now()
-			_, _ = socket.SimpleQuery(&op)
+			_, err = socket.SimpleQuery(&op)
 			delay := time.Now().Sub(start)
+			if err == nil {
+				stats.pinged(server.Addr, delay)
+			}
 
 			server.pingWindow[server.pingIndex] = delay
 			server.pingIndex = (server.pingIndex + 1) % len(server.pingWindow)
@@ -317,6 +460,74 @@ func (server *mongoServer) pinger(loop bool) {
 	}
 }
 
+// poolMaintainDelay is how often servers pre-warm and reap the sockets
+// in their pool.
+var poolMaintainDelay = 1 * time.Second
+
+// maintainPool keeps at least the minimum number of sockets open to the
+// server, and closes unused sockets idle for longer than the maximum idle
+// time, until the server is closed.
+func (server *mongoServer) maintainPool() {
+	for {
+		server.Lock()
+		if server.closed {
+			server.Unlock()
+			return
+		}
+		var idle []*mongoSocket
+		if server.pool.maxIdleTime > 0 {
+			// The least recently used sockets come first.
+			since := time.Now().Add(-server.pool.maxIdleTime)
+			for len(server.unusedSockets) > 0 && len(server.liveSockets) > server.pool.minSize {
+				socket := server.unusedSockets[0]
+				if socket.idleSince.After(since) {
+					break
+				}
+				server.unusedSockets = removeSocket(server.unusedSockets, socket)
+				server.liveSockets = removeSocket(server.liveSockets, socket)
+				idle = append(idle, socket)
+			}
+		}
+		missing := server.pool.minSize - len(server.liveSockets) - server.connecting
+		server.Unlock()
+
+		for _, socket := range idle {
+			socket.Close()
+			stats.poolReaped(+1)
+		}
+		if len(idle) > 0 {
+			Logf("Closed %d idle connection(s) to %s.", len(idle), server.Addr)
+		}
+		for i := 0; i < missing && server.warm(); i++ {
+		}
+		time.Sleep(poolMaintainDelay)
+	}
+}
+
+// warm establishes a new connection to the server and puts it in the pool,
+// reporting whether it succeeded.
+func (server *mongoServer) warm() bool {
+	server.Lock()
+	server.connecting++
+	server.Unlock()
+	socket, err := server.Connect(syncSocketTimeout)
+	server.Lock()
+	server.connecting--
+	if err != nil || server.closed {
+		server.wakeWaiter(nil)
+		server.Unlock()
+		if err == nil {
+			socket.Release()
+			socket.Close()
+		}
+		return false
+	}
+	server.liveSockets = append(server.liveSockets, socket)
+	server.Unlock()
+	socket.Release()
+	return true
+}
+
 type mongoServerSlice []*mongoServer
 
 func (s mongoServerSlice) Len() int {
@@ -27,7 +27,9 @@
 package mgo
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -36,20 +38,21 @@ import (
 	. "labix.org/v2/base/queue"
 	"math"
 	"net"
-	"net/url"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
+	liberr "labix.org/v2/error"
 	"labix.org/v2/imgo"
 )
 
-type mode int
+type mode = imgo.Mode
 
 const (
 	Eventual  mode = 0
@@ -75,6 +78,8 @@ type Session struct {
 	sourcedb     string
 	dialCred     *Credential
 	creds        []Credential
+	monitor      CommandMonitor
+	logger_      atomic.Value // loggerBox
 }
 
 type Database struct {
@@ -86,12 +91,16 @@ type Collection struct {
 	Database *Database
 	Name     string // "collection"
 	FullName string // "db.collection"
+
+	writeConcern *WriteConcern
 }
 
 type Query struct {
 	m       sync.Mutex
 	session *Session
 	query   // Enables default settings in session.
+
+	writeConcern *WriteConcern // Used by Apply.
 }
 
 type query struct {
@@ -122,9 +131,13 @@ type Iter struct {
 	docsBeforeMore int
 	timeout        time.Duration
 	timedout       bool
+	ctx            context.Context
+	stopCtx        func() bool
 }
 
-var ErrNotFound = errors.New("not found")
+// ErrNotFound is shared with the mockmgo package, so code written against
+// imgo may compare errors with it regardless of the implementation in use.
+var ErrNotFound = liberr.ErrNotFound
 
 const defaultPrefetch = 0.25
 
@@ -160,14 +173,28 @@ const defaultPrefetch = 0.25
 //
 // If the port number is not provided for a server, it defaults to 27017.
 //
+// Alternatively, the seed servers may be found via DNS:
+//
+//     mongodb+srv://[user:pass@]host[/database][?options]
+//
+// In that case, the seed servers are the ones listed in the SRV records for
+// _mongodb._tcp.host. When they're mongos routers, the records are looked up
+// again periodically so that routers added to or removed from them are
+// noticed. A TXT record for host may also
+// provide the authSource and replicaSet options, which take effect unless
+// they're in the URL. TLS is enabled unless the URL disables it, and the
+// connect=direct option can't be used. See DialInfo.SRVName.
+//
 // The username and password provided in the URL will be used to authenticate
 // into the database named after the slash at the end of the host names, or
 // into the "admin" database if none is provided.  The authentication information
 // will persist in sessions obtained through the New method as well.
 //
-// The following connection options are supported after the question mark:
+// The following connection options are supported after the question mark.
+// Their names are case insensitive, and their values, as well as the user
+// name and password, may be percent-encoded:
 //
-//     connect=direct
+//     connect=direct, directConnection=true
 //
 //         Disables the automatic replica set server discovery logic, and
 //         forces the use of servers provided only (even if secondaries).
@@ -175,6 +202,40 @@ const defaultPrefetch = 0.25
 //         must be relaxed to Monotonic or Eventual via SetMode.
 //
 //
+//     replicaSet=<name>
+//
+//         Ignores the servers that aren't members of the named replica set.
+//
+//
+//     connectTimeoutMS=<ms>, socketTimeoutMS=<ms>, serverSelectionTimeoutMS=<ms>
+//
+//         Define how long to wait for a server to respond when connecting,
+//         and on operations once connected, and how long operations wait
+//         for a suitable server. See DialInfo.
+//
+//
+//     readPreference=<mode>, readPreferenceTags=<tag:value,...>,
+//     maxStalenessSeconds=<seconds>
+//
+//         Define the initial read preference of the session, where mode is
+//         primary, primaryPreferred, secondary, secondaryPreferred or
+//         nearest. readPreferenceTags may be repeated to provide several
+//         tag sets in order of preference, and an empty value matches any
+//         server. See ReadPreference.
+//
+//
+//     localThresholdMS=<ms>
+//
+//         Defines the latency window of the read preference, within which
+//         servers are equally preferred. See ReadPreference.
+//
+//
+//     w=<n or mode>, wtimeoutMS=<ms>, journal=<bool>
+//
+//         Define the initial safety mode of the session. A w of 0 disables
+//         waiting for the outcome of writes. See WriteConcern.
+//
+//
 //     authSource=<db>
 //
 //         Informs the database used to establish credentials and privileges
@@ -186,75 +247,102 @@ const defaultPrefetch = 0.25
 //
 //        Defines the protocol for credential negotiation. Defaults to "MONGODB-CR",
 //        which is the default username/password challenge-response mechanism.
+//        "SCRAM-SHA-1", "SCRAM-SHA-256" and "MONGODB-X509" are supported natively,
+//        while other mechanisms such as "GSSAPI" require building with the sasl
+//        tag. "MONGODB-X509" authenticates with the certificate provided via
+//        tlsCertificateKeyFile, and the user name may be omitted.
 //
 //
-//     gssapiServiceName=<name>
+//     gssapiServiceName=<name>, authMechanismProperties=SERVICE_NAME:<name>
 //
 //           Defines the service name to use when authenticating with the GSSAPI
 //           mechanism. Defaults to "mongodb".
 //
 //
+//     maxPoolSize=<n>, minPoolSize=<n>
+//
+//         Define the maximum number of sockets in use and the number of
+//         sockets kept open per server. See DialInfo.
+//
+//
+//     maxIdleTimeMS=<ms>, waitQueueTimeoutMS=<ms>
+//
+//         Define how long a socket may stay unused in the pool and how long
+//         operations wait for a socket once maxPoolSize is reached.
+//         See DialInfo.
+//
+//
+//     ssl=<bool>, tls=<bool>
+//
+//         Enable TLS for the connections with the servers, which must present
+//         valid certificates for their host names. See DialInfo.TLS.
+//
+//
+//     tlsCAFile=<path>, tlsCertificateKeyFile=<path>
+//
+//         Define the PEM files holding the certificate authorities trusted to
+//         sign the server certificates, and the client certificate and key.
+//         Either one enables TLS.
+//
+//
+//     tlsAllowInvalidHostnames=<bool>, tlsAllowInvalidCertificates=<bool>,
+//     tlsInsecure=<bool>
+//
+//         Relax the verification of the server certificates, either by not
+//         checking their host names, or by skipping verification entirely.
+//
+//
+//     appName=<name>
+//
+//         Identifies the application to the servers, which record it in
+//         their logs and in the operations they report.
+//
+//
+// Other standard options without an equivalent here, such as retryWrites
+// and heartbeatFrequencyMS, are accepted and ignored.
+//
+//
 // Relevant documentation:
 //
 //     http://docs.mongodb.org/manual/reference/connection-string/
 //
 func Dial(url string) (*Session, error) {
-	session, err := DialWithTimeout(url, 10*time.Second)
-	if err == nil {
-		session.SetSyncTimeout(1 * time.Minute)
-		session.SetSocketTimeout(1 * time.Minute)
-	}
-	return session, err
+	return dialURL(url, 10*time.Second, 1*time.Minute)
 }
 
 // DialWithTimeout works like Dial, but uses timeout as the amount of time to
 // wait for a server to respond when first connecting and also on follow up
 // operations in the session. If timeout is zero, the call may block
-// forever waiting for a connection to be made.
+// forever waiting for a connection to be made. The connectTimeoutMS and
+// socketTimeoutMS URL options take precedence over timeout.
 //
 // See SetSyncTimeout for customizing the timeout for the session.
 func DialWithTimeout(url string, timeout time.Duration) (*Session, error) {
-	uinfo, err := parseURL(url)
+	return dialURL(url, timeout, 0)
+}
+
+// dialURL dials the cluster identified by url, waiting up to timeout to
+// connect unless the URL says otherwise. The session's timeouts are then
+// set to later, if not zero, unless the URL defines socketTimeoutMS or
+// serverSelectionTimeoutMS.
+func dialURL(url string, timeout, later time.Duration) (*Session, error) {
+	info, err := ParseURL(url)
 	if err != nil {
 		return nil, err
 	}
-	direct := false
-	mechanism := ""
-	service := ""
-	source := ""
-	for k, v := range uinfo.options {
-		switch k {
-		case "authSource":
-			source = v
-		case "authMechanism":
-			mechanism = v
-		case "gssapiServiceName":
-			service = v
-		case "connect":
-			if v == "direct" {
-				direct = true
-				break
-			}
-			if v == "replicaSet" {
-				break
-			}
-			fallthrough
-		default:
-			return nil, errors.New("unsupported connection URL option: " + k + "=" + v)
-		}
+	if info.Timeout == 0 {
+		info.Timeout = timeout
 	}
-	info := DialInfo{
-		Addrs:     uinfo.addrs,
-		Direct:    direct,
-		Timeout:   timeout,
-		Database:  uinfo.db,
-		Username:  uinfo.user,
-		Password:  uinfo.pass,
-		Mechanism: mechanism,
-		Service:   service,
-		Source:    source,
+	session, err := DialWithInfo(info)
+	if err == nil && later > 0 {
+		if info.ServerSelectionTimeout == 0 {
+			session.SetSyncTimeout(later)
+		}
+		if info.SocketTimeout == 0 {
+			session.SetSocketTimeout(later)
+		}
 	}
-	return DialWithInfo(&info)
+	return session, err
 }
 
 // DialInfo holds options for establishing a session with a MongoDB cluster.
@@ -263,6 +351,25 @@ type DialInfo struct {
 	// Addrs holds the addresses for the seed servers.
 	Addrs []string
 
+	// SRVName, if set, replaces Addrs with the servers listed in the SRV
+	// records for _mongodb._tcp.<SRVName>, which must be in the parent
+	// domain of SRVName. The authSource and replicaSet options may also be
+	// provided via a TXT record for SRVName, and are used when Source and
+	// ReplicaSetName are unset. While the servers found are mongos routers,
+	// the SRV records are looked up again every SRVPollInterval, so that
+	// routers added to or removed from them are noticed. SRVName can't be
+	// used with Direct.
+	SRVName string
+
+	// SRVPollInterval is how often the SRV records for SRVName are looked
+	// up again. Defaults to one minute.
+	SRVPollInterval time.Duration
+
+	// Resolver, if set, is used to look up the DNS records for SRVName
+	// and the addresses of the servers, instead of the resolver of the
+	// net package.
+	Resolver Resolver
+
 	// Direct informs whether to establish connections only with the
 	// specified seed servers, or to obtain information for the whole
 	// cluster and establish connections with further servers too.
@@ -287,8 +394,9 @@ type DialInfo struct {
 	Database string
 
 	// Source is the database used to establish credentials and privileges
-	// with a MongoDB server. Defaults to the value of Database, if that is
-	// set, or "admin" otherwise.
+	// with a MongoDB server. Defaults to "$external" with the GSSAPI and
+	// MONGODB-X509 mechanisms, and otherwise to the value of Database, if
+	// that is set, or "admin".
 	Source string
 
 	// Service defines the service name to use when authenticating with the GSSAPI
@@ -296,11 +404,17 @@ type DialInfo struct {
 	Service string
 
 	// Mechanism defines the protocol for credential negotiation.
-	// Defaults to "MONGODB-CR".
+	// Defaults to "MONGODB-CR". The "SCRAM-SHA-1", "SCRAM-SHA-256" and
+	// "MONGODB-X509" mechanisms are supported natively, and others are
+	// delegated to the SASL library when building with the sasl tag.
+	// MONGODB-X509 authenticates with the TLS client certificate, and
+	// requires no password.
 	Mechanism string
 
 	// Username and Password inform the credentials for the initial authentication
 	// done on the database defined by the Source field. See Session.Login.
+	// With the MONGODB-X509 mechanism, Username defaults to the subject of
+	// the client certificate.
 	Username string
 	Password string
 
@@ -310,6 +424,84 @@ type DialInfo struct {
 
 	// WARNING: This field is obsolete. See DialServer above.
 	Dial func(addr net.Addr) (net.Conn, error)
+
+	// ReplicaSetName, if set, makes the cluster ignore the servers that
+	// aren't members of the replica set with that name.
+	ReplicaSetName string
+
+	// SocketTimeout is the amount of time to wait for a server to respond
+	// to operations once connected. Defaults to Timeout.
+	SocketTimeout time.Duration
+
+	// ServerSelectionTimeout is the amount of time operations wait for a
+	// suitable server to be available. Defaults to Timeout. See
+	// Session.SetSyncTimeout.
+	ServerSelectionTimeout time.Duration
+
+	// ReadPreference, if set, is the initial read preference of the
+	// session. See Session.SetReadPreference.
+	ReadPreference *ReadPreference
+
+	// WriteConcern, if set, defines the initial safety mode of the
+	// session. See Session.SetSafe.
+	WriteConcern *WriteConcern
+
+	// AppName identifies the application to the servers, which record it
+	// in their logs and in the operations they report. It's limited to 128
+	// bytes.
+	AppName string
+
+	// TLS enables TLS for the connections with the servers, which must
+	// present certificates valid for their host names, signed by the
+	// authorities in TLSCAFile or by the ones trusted by the system. It's
+	// implied by setting TLSCAFile or TLSCertificateKeyFile. TLS is done
+	// over the connections made by DialServer too, if set.
+	TLS bool
+
+	// TLSCAFile is the file holding the PEM encoded certificates of the
+	// authorities trusted to sign the server certificates.
+	TLSCAFile string
+
+	// TLSCertificateKeyFile is the file holding the PEM encoded client
+	// certificate and its private key, presented to the servers.
+	TLSCertificateKeyFile string
+
+	// TLSAllowInvalidHostnames skips checking that the server certificates
+	// match their host names, while still verifying who signed them.
+	TLSAllowInvalidHostnames bool
+
+	// TLSInsecure skips all verification of the server certificates,
+	// which leaves connections open to man-in-the-middle attacks. It's
+	// only meant for testing.
+	TLSInsecure bool
+
+	// TLSConfig takes precedence over all the TLS options above when set,
+	// enabling TLS with the given configuration. Its ServerName defaults
+	// to the host name of each server.
+	TLSConfig *tls.Config
+
+	// MaxPoolSize limits the number of sockets in use per server. Once it
+	// is reached, operations wait in line for a socket to be released.
+	// Defaults to 4096.
+	MaxPoolSize int
+
+	// MinPoolSize is the number of sockets kept open per server. They are
+	// established in background once the server is found.
+	MinPoolSize int
+
+	// MaxIdleTime is how long a socket may remain unused in the pool before
+	// being closed, unless that would take the pool under MinPoolSize.
+	// Unused sockets are never closed if it is zero.
+	MaxIdleTime time.Duration
+
+	// WaitQueueTimeout is how long an operation waits for a socket once
+	// MaxPoolSize is reached before failing with ErrPoolTimeout. If it is
+	// zero, operations wait until a socket is available.
+	WaitQueueTimeout time.Duration
+
+	// Monitor optionally receives events for the operations sent by the
+	// session and its copies. See Session.SetCommandMonitor.
+	Monitor CommandMonitor
 }
 
 // ServerAddr represents the address for establishing a connection to an
@@ -331,6 +523,13 @@ func (addr *ServerAddr) TCPAddr() *net.TCPAddr {
 
 // DialWithInfo establishes a new session to the cluster identified by info.
 func DialWithInfo(info *DialInfo) (*Session, error) {
+	var srv *srvSeeds
+	if info.SRVName != "" {
+		var err error
+		if info, srv, err = info.resolveSRV(); err != nil {
+			return nil, err
+		}
+	}
 	addrs := make([]string, len(info.Addrs))
 	for i, addr := range info.Addrs {
 		p := strings.LastIndexAny(addr, "]:")
@@ -340,8 +539,33 @@ func DialWithInfo(info *DialInfo) (*Session, error) {
 		}
 		addrs[i] = addr
 	}
-	cluster := newCluster(addrs, info.Direct, info.FailFast, dialer{info.Dial, info.DialServer})
+	pool := poolConfig{
+		maxSize:          info.MaxPoolSize,
+		minSize:          info.MinPoolSize,
+		maxIdleTime:      info.MaxIdleTime,
+		waitQueueTimeout: info.WaitQueueTimeout,
+	}
+	tlsConfig, err := info.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if info.WriteConcern != nil {
+		if err := validateWriteConcern(info.WriteConcern); err != nil {
+			return nil, err
+		}
+	}
+	if len(info.AppName) > maxAppNameSize {
+		return nil, fmt.Errorf("application name must not exceed %d bytes", maxAppNameSize)
+	}
+	cluster := newCluster(addrs, info.Direct, info.FailFast, dialer{info.Dial, info.DialServer, tlsConfig}, pool, info.ReplicaSetName, info.AppName, info.Resolver, srv)
 	session := newSession(Eventual, cluster, info.Timeout)
+	if info.SocketTimeout > 0 {
+		session.sockTimeout = info.SocketTimeout
+	}
+	if info.ServerSelectionTimeout > 0 {
+		session.syncTimeout = info.ServerSelectionTimeout
+	}
+	session.monitor = info.Monitor
 	session.defaultdb = info.Database
 	if session.defaultdb == "" {
 		session.defaultdb = "test"
@@ -353,9 +577,10 @@ func DialWithInfo(info *DialInfo) (*Session, error) {
 			session.sourcedb = "admin"
 		}
 	}
-	if info.Username != "" {
+	// X.509 users may be identified by the client certificate alone.
+	if info.Username != "" || info.Mechanism == "MONGODB-X509" || info.Mechanism == "MONGO-X509" {
 		source := session.sourcedb
-		if info.Source == "" && info.Mechanism == "GSSAPI" {
+		if info.Source == "" && externalMechanism(info.Mechanism) {
 			source = "$external"
 		}
 		session.dialCred = &Credential{
@@ -378,60 +603,13 @@ func DialWithInfo(info *DialInfo) (*Session, error) {
 		return nil, err
 	}
 	session.SetMode(Strong, true)
-	return session, nil
-}
-
-func isOptSep(c rune) bool {
-	return c == ';' || c == '&'
-}
-
-type urlInfo struct {
-	addrs   []string
-	user    string
-	pass    string
-	db      string
-	options map[string]string
-}
-
-func parseURL(s string) (*urlInfo, error) {
-	if strings.HasPrefix(s, "mongodb://") {
-		s = s[10:]
+	if info.ReadPreference != nil {
+		session.SetReadPreference(info.ReadPreference)
 	}
-	info := &urlInfo{options: make(map[string]string)}
-	if c := strings.Index(s, "?"); c != -1 {
-		for _, pair := range strings.FieldsFunc(s[c+1:], isOptSep) {
-			l := strings.SplitN(pair, "=", 2)
-			if len(l) != 2 || l[0] == "" || l[1] == "" {
-				return nil, errors.New("connection option must be key=value: " + pair)
-			}
-			info.options[l[0]] = l[1]
-		}
-		s = s[:c]
+	if wc := info.WriteConcern; wc != nil {
+		session.SetSafe(writeConcernSafe(wc))
 	}
-	if c := strings.Index(s, "@"); c != -1 {
-		pair := strings.SplitN(s[:c], ":", 2)
-		if len(pair) > 2 || pair[0] == "" {
-			return nil, errors.New("credentials must be provided as user:pass@host")
-		}
-		var err error
-		info.user, err = url.QueryUnescape(pair[0])
-		if err != nil {
-			return nil, fmt.Errorf("cannot unescape username in URL: %q", pair[0])
-		}
-		if len(pair) > 1 {
-			info.pass, err = url.QueryUnescape(pair[1])
-			if err != nil {
-				return nil, fmt.Errorf("cannot unescape password in URL")
-			}
-		}
-		s = s[c+1:]
-	}
-	if c := strings.Index(s, "/"); c != -1 {
-		info.db = s[c+1:]
-		s = s[:c]
-	}
-	info.addrs = strings.Split(s, ",")
-	return info, nil
+	return session, nil
 }
 
 func newSession(consistency mode, cluster *mongoCluster, timeout time.Duration) (session *Session) {
@@ -464,7 +642,7 @@ func copySession(session *Session, keepCreds bool) (s *Session) {
 	scopy.m = sync.RWMutex{}
 	scopy.creds = creds
 	s = &scopy
-	Debugf("New session %p on cluster %p (copy from %p)", s, cluster, session)
+	s.debugf("New session %p on cluster %p (copy from %p)", s, cluster, session)
 	return s
 }
 
@@ -484,19 +662,27 @@ func (s *Session) LiveServers() (addrs []string) {
 //
 // Creating this value is a very lightweight operation, and
 // involves no network communication.
-func (s *Session) DB(name string) *Database {
+func (s *Session) db(name string) *Database {
 	if name == "" {
 		name = s.defaultdb
 	}
 	return &Database{s, name}
 }
 
+func (s *Session) DB(name string) imgo.Database {
+	return s.db(name)
+}
+
 // C returns a value representing the named collection.
 //
 // Creating this value is a very lightweight operation, and
 // involves no network communication.
-func (db *Database) C(name string) *Collection {
-	return &Collection{db, name, db.Name + "." + name}
+func (db *Database) c(name string) *Collection {
+	return &Collection{db, name, db.Name + "." + name, nil}
+}
+
+func (db *Database) C(name string) imgo.Collection {
+	return db.c(name)
 }
 
 // With returns a copy of db that uses session s.
@@ -554,22 +740,31 @@ func (db *Database) GridFS(prefix string) *GridFS {
 //     http://www.mongodb.org/display/DOCS/List+of+Database+CommandSkips
 //
 func (db *Database) Run(cmd interface{}, result interface{}) error {
+	return db.RunContext(context.Background(), cmd, result)
+}
+
+// RunContext works like Run, but gives up waiting for the command with
+// ctx.Err() once ctx is done.
+func (db *Database) RunContext(ctx context.Context, cmd interface{}, result interface{}) error {
 	if name, ok := cmd.(string); ok {
 		cmd = bson.D{{name, 1}}
 	}
-	return db.C("$cmd").Find(cmd).One(result)
+	return db.c("$cmd").find(cmd).OneContext(ctx, result)
 }
 
 // Credential holds details to authenticate with a MongoDB server.
 type Credential struct {
 	// Username and Password hold the basic details for authentication.
-	// Password is optional with some authentication mechanisms.
+	// Password is optional with some authentication mechanisms. With
+	// MONGODB-X509, Username defaults to the subject of the client
+	// certificate, in the RFC 2253 format expected by the server.
 	Username string
 	Password string
 
 	// Source is the database used to establish credentials and privileges
-	// with a MongoDB server. Defaults to the default database provided
-	// during dial, or "admin" if that was unset.
+	// with a MongoDB server. Defaults to "$external" with the GSSAPI and
+	// MONGODB-X509 mechanisms, and otherwise to the default database
+	// provided during dial, or "admin" if that was unset.
 	Source string
 
 	// Service defines the service name to use when authenticating with the GSSAPI
@@ -577,7 +772,11 @@ type Credential struct {
 	Service string
 
 	// Mechanism defines the protocol for credential negotiation.
-	// Defaults to "MONGODB-CR".
+	// Defaults to "MONGODB-CR". The "SCRAM-SHA-1", "SCRAM-SHA-256" and
+	// "MONGODB-X509" mechanisms are supported natively, and others are
+	// delegated to the SASL library when building with the sasl tag.
+	// MONGODB-X509 authenticates with the TLS client certificate, and
+	// requires no password.
 	Mechanism string
 }
 
@@ -602,7 +801,7 @@ func (s *Session) Login(cred *Credential) error {
 
 	credCopy := *cred
 	if cred.Source == "" {
-		if cred.Mechanism == "GSSAPI" {
+		if externalMechanism(cred.Mechanism) {
 			credCopy.Source = "$external"
 		} else {
 			credCopy.Source = s.sourcedb
@@ -761,7 +960,7 @@ func (db *Database) UpsertUser(user *User) error {
 	if len(user.OtherDBRoles) == 0 {
 		unset = append(unset, bson.DocElem{"otherDBRoles", 1})
 	}
-	c := db.C("system.users")
+	c := db.c("system.users")
 	_, err := c.Upsert(bson.D{{"user", user.Username}}, bson.D{{"$unset", unset}, {"$set", user}})
 	return err
 }
@@ -775,14 +974,14 @@ func (db *Database) AddUser(user, pass string, readOnly bool) error {
 	psum := md5.New()
 	psum.Write([]byte(user + ":mongo:" + pass))
 	digest := hex.EncodeToString(psum.Sum(nil))
-	c := db.C("system.users")
+	c := db.c("system.users")
 	_, err := c.Upsert(bson.M{"user": user}, bson.M{"$set": bson.M{"user": user, "pwd": digest, "readOnly": readOnly}})
 	return err
 }
 
 // RemoveUser removes the authentication credentials of user from the database.
 func (db *Database) RemoveUser(user string) error {
-	c := db.C("system.users")
+	c := db.c("system.users")
 	return c.Remove(bson.M{"user": user})
 }
 
@@ -797,19 +996,7 @@ type indexSpec struct {
 	ExpireAfter    int  "expireAfterSeconds,omitempty"
 }
 
-type Index struct {
-	Key        []string // Index key fields; prefix name with dash (-) for descending order
-	Unique     bool     // Prevent two documents from having the same index key
-	DropDups   bool     // Drop documents with the same index key as a previously indexed one
-	Background bool     // Build index in background and return immediately
-	Sparse     bool     // Only index documents containing the Key fields
-
-	ExpireAfter time.Duration // Periodically delete docs with indexed time.Time older than that.
-
-	Name string // Index name, computed by EnsureIndex
-
-	Bits, Min, Max int // Properties for spatial indexes
-}
+type Index = imgo.Index
 
 func parseIndexKey(key []string) (name string, realKey bson.D, err error) {
 	var order interface{}
@@ -974,13 +1161,13 @@ func (c *Collection) EnsureIndex(index Index) error {
 		ExpireAfter: int(index.ExpireAfter / time.Second),
 	}
 
-	session = session.Clone()
+	session = session.clone()
 	defer session.Close()
 	session.SetMode(Strong, false)
 	session.EnsureSafe(&Safe{})
 
 	db := c.Database.With(session)
-	err = db.C("system.indexes").Insert(&spec)
+	err = db.c("system.indexes").Insert(&spec)
 	if err == nil {
 		session.cluster().CacheIndex(cacheKey, true)
 	}
@@ -1009,7 +1196,7 @@ func (c *Collection) DropIndex(key ...string) error {
 	cacheKey := c.FullName + "\x00" + name
 	session.cluster().CacheIndex(cacheKey, false)
 
-	session = session.Clone()
+	session = session.clone()
 	defer session.Close()
 	session.SetMode(Strong, false)
 
@@ -1045,7 +1232,7 @@ func (c *Collection) DropIndex(key ...string) error {
 //
 // See the EnsureIndex method for more details on indexes.
 func (c *Collection) Indexes() (indexes []Index, err error) {
-	query := c.Database.C("system.indexes").Find(bson.M{"ns": c.FullName})
+	query := c.Database.c("system.indexes").Find(bson.M{"ns": c.FullName})
 	iter := query.Sort("name").Iter()
 	for {
 		var spec indexSpec
@@ -1110,7 +1297,7 @@ func (s *Session) ResetIndexCache() {
 //
 // See the Copy and Clone methods.
 //
-func (s *Session) New() *Session {
+func (s *Session) new() *Session {
 	s.m.Lock()
 	scopy := copySession(s, false)
 	s.m.Unlock()
@@ -1118,9 +1305,13 @@ func (s *Session) New() *Session {
 	return scopy
 }
 
+func (s *Session) New() imgo.Session {
+	return s.new()
+}
+
 // Copy works just like New, but preserves the exact authentication
 // information from the original session.
-func (s *Session) Copy() *Session {
+func (s *Session) copy() *Session {
 	s.m.Lock()
 	scopy := copySession(s, true)
 	s.m.Unlock()
@@ -1128,25 +1319,33 @@ func (s *Session) Copy() *Session {
 	return scopy
 }
 
+func (s *Session) Copy() imgo.Session {
+	return s.copy()
+}
+
 // Clone works just like Copy, but also reuses the same socket as the original
 // session, in case it had already reserved one due to its consistency
 // guarantees.  This behavior ensures that writes performed in the old session
 // are necessarily observed when using the new session, as long as it was a
 // strong or monotonic session.  That said, it also means that long operations
 // may cause other goroutines using the original session to wait.
-func (s *Session) Clone() *Session {
+func (s *Session) clone() *Session {
 	s.m.Lock()
 	scopy := copySession(s, true)
 	s.m.Unlock()
 	return scopy
 }
 
+func (s *Session) Clone() imgo.Session {
+	return s.clone()
+}
+
 // Close terminates the session.  It's a runtime error to use a session
 // after it has been closed.
 func (s *Session) Close() {
 	s.m.Lock()
 	if s.cluster_ != nil {
-		Debugf("Closing session %p", s)
+		s.debugf("Closing session %p", s)
 		s.unsetSocket()
 		s.cluster_.Release()
 		s.cluster_ = nil
@@ -1212,8 +1411,9 @@ func (s *Session) Refresh() {
 // connection is unsuitable (to a secondary server in a Strong session).
 func (s *Session) SetMode(consistency mode, refresh bool) {
 	s.m.Lock()
-	Debugf("Session %p: setting mode %d with refresh=%v (master=%p, slave=%p)", s, consistency, refresh, s.masterSocket, s.slaveSocket)
+	s.debugf("Session %p: setting mode %d with refresh=%v (master=%p, slave=%p)", s, consistency, refresh, s.masterSocket, s.slaveSocket)
 	s.consistency = consistency
+	s.queryConfig.op.readPref = nil
 	if refresh {
 		s.slaveOk = s.consistency != Strong
 		s.unsetSocket()
@@ -1225,6 +1425,39 @@ func (s *Session) SetMode(consistency mode, refresh bool) {
 	s.m.Unlock()
 }
 
+// SetReadPreference changes the servers the session reads from to those
+// selected by pref, replacing the consistency mode set with SetMode. The
+// session behaves as in the Strong mode with ReadPrimary, and as in the
+// Eventual mode otherwise, with the server for each read selected according
+// to pref. A nil pref restores the Strong mode. Sessions created with New,
+// Copy or Clone inherit the read preference, and it may be changed for
+// individual queries with Query.ReadPreference.
+func (s *Session) SetReadPreference(pref *ReadPreference) {
+	if pref == nil || pref.Mode == ReadPrimary {
+		s.SetMode(Strong, true)
+	} else {
+		s.SetMode(Eventual, true)
+	}
+	if pref != nil {
+		prefCopy := *pref
+		s.m.Lock()
+		s.queryConfig.op.readPref = &prefCopy
+		s.m.Unlock()
+	}
+}
+
+// ReadPreference returns the read preference set for the session with
+// SetReadPreference, or nil if the session uses a consistency mode.
+func (s *Session) ReadPreference() *ReadPreference {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.queryConfig.op.readPref == nil {
+		return nil
+	}
+	pref := *s.queryConfig.op.readPref
+	return &pref
+}
+
 // Mode returns the current consistency mode for the session.
 func (s *Session) Mode() mode {
 	s.m.RLock()
@@ -1257,6 +1490,64 @@ func (s *Session) SetSocketTimeout(d time.Duration) {
 	s.m.Unlock()
 }
 
+// SetCommandMonitor sets the monitor that receives events for the operations
+// sent to the database by the session, or stops reporting them if monitor is
+// nil. Sessions created with New, Copy or Clone inherit the monitor.
+func (s *Session) SetCommandMonitor(monitor CommandMonitor) {
+	s.m.Lock()
+	s.monitor = monitor
+	s.m.Unlock()
+}
+
+func (s *Session) commandMonitor() CommandMonitor {
+	s.m.RLock()
+	monitor := s.monitor
+	s.m.RUnlock()
+	return monitor
+}
+
+// SetLogger sets the logger that receives the messages about operations
+// made with the session, such as queries and iteration, which are sent to
+// the package logger if logger is nil. Sessions created with New, Copy or
+// Clone inherit the logger. Messages about the servers and connections,
+// which are shared by sessions, are always sent to the package logger.
+//
+// The logger may be wrapped with With so that all messages from the session
+// carry fields identifying it, for example:
+//
+//     session.SetLogger(log.With(logger, "tenant", tenant))
+//
+// See SetLogger and SetStructured in labix.org/v2/base/log.
+func (s *Session) SetLogger(logger Logger) {
+	s.m.Lock()
+	s.logger_.Store(loggerBox{logger})
+	s.m.Unlock()
+}
+
+type loggerBox struct {
+	logger Logger
+}
+
+// logger returns the logger for the session's messages.
+func (s *Session) logger() Logger {
+	if box, ok := s.logger_.Load().(loggerBox); ok && box.logger != nil {
+		return box.logger
+	}
+	return Structured()
+}
+
+func (s *Session) logf(level Level, format string, args ...interface{}) {
+	if logger := s.logger(); logger != nil && logger.Enabled(level) {
+		logger.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *Session) debugf(format string, args ...interface{}) {
+	if logger := s.logger(); logger != nil && logger.Enabled(DebugLevel) {
+		logger.Log(DebugLevel, fmt.Sprintf(format, args...))
+	}
+}
+
 // SetCursorTimeout changes the standard timeout period that the server
 // enforces on created cursors. The only supported value right now is
 // 0, which disables the timeout. The standard server timeout is 10 minutes.
@@ -1307,13 +1598,7 @@ func (s *Session) SetPrefetch(p float64) {
 }
 
 // See SetSafe for details on the Safe type.
-type Safe struct {
-	W        int    // Min # of servers to ack before success
-	WMode    string // Write mode for MongoDB 2.0+ (e.g. "majority")
-	WTimeout int    // Milliseconds to wait for W before timing out
-	FSync    bool   // Should servers sync to disk before returning success
-	J        bool   // Wait for next group commit if journaling; no effect otherwise
-}
+type Safe = imgo.Safe
 
 // Safe returns the current safety mode for the session.
 func (s *Session) Safe() (safe *Safe) {
@@ -1498,7 +1783,7 @@ func (s *Session) ensureSafe(safe *Safe) {
 //     http://www.mongodb.org/display/DOCS/List+of+Database+CommandSkips
 //
 func (s *Session) Run(cmd interface{}, result interface{}) error {
-	return s.DB("admin").Run(cmd, result)
+	return s.db("admin").Run(cmd, result)
 }
 
 // SelectServers restricts communication to servers configured with the
@@ -1568,7 +1853,7 @@ func (s *Session) FsyncLock() error {
 
 // FsyncUnlock releases the server for writes. See FsyncLock for details.
 func (s *Session) FsyncUnlock() error {
-	return s.DB("admin").C("$cmd.sys.unlock").Find(nil).One(nil) // WTF?
+	return s.db("admin").c("$cmd.sys.unlock").Find(nil).One(nil) // WTF?
 }
 
 // Find prepares a query using the provided document.  The document may be a
@@ -1596,7 +1881,7 @@ func (s *Session) FsyncUnlock() error {
 func (c *Collection) find(query interface{}) *Query {
 	session := c.Database.Session
 	session.m.RLock()
-	q := &Query{session: session, query: session.queryConfig}
+	q := &Query{session: session, query: session.queryConfig, writeConcern: c.writeConcern}
 	session.m.RUnlock()
 	q.op.query = query
 	q.op.collection = c.FullName
@@ -1616,6 +1901,15 @@ func (c *Collection) FindId(id interface{}) imgo.Query {
 	return c.Find(bson.D{{"_id", id}})
 }
 
+var (
+	_ imgo.Session    = (*Session)(nil)
+	_ imgo.Database   = (*Database)(nil)
+	_ imgo.Collection = (*Collection)(nil)
+	_ imgo.Query      = (*Query)(nil)
+	_ imgo.Iter       = (*Iter)(nil)
+	_ imgo.Pipe       = (*Pipe)(nil)
+)
+
 type Pipe struct {
 	session    *Session
 	collection *Collection
@@ -1636,7 +1930,7 @@ type Pipe struct {
 //     http://docs.mongodb.org/manual/applications/aggregation
 //     http://docs.mongodb.org/manual/tutorial/aggregation-examples
 //
-func (c *Collection) Pipe(pipeline interface{}) *Pipe {
+func (c *Collection) pipe(pipeline interface{}) *Pipe {
 	session := c.Database.Session
 	return &Pipe{
 		session:    session,
@@ -1645,17 +1939,28 @@ func (c *Collection) Pipe(pipeline interface{}) *Pipe {
 	}
 }
 
+func (c *Collection) Pipe(pipeline interface{}) imgo.Pipe {
+	return c.pipe(pipeline)
+}
+
 // Iter executes the pipeline and returns an iterator capable of going
 // over all the generated results.
-func (p *Pipe) Iter() *Iter {
+func (p *Pipe) iter() *Iter {
+	return p.iterContext(context.Background())
+}
+
+// IterContext works like Iter, but gives up running the pipeline with
+// ctx.Err() once ctx is done.
+func (p *Pipe) iterContext(ctx context.Context) *Iter {
 	iter := &Iter{
 		session: p.session,
 		timeout: -1,
+		ctx:     ctx,
 	}
 	iter.gotReply.L = &iter.m
 	var result struct{ Result []bson.Raw }
 	c := p.collection
-	iter.err = c.Database.Run(bson.D{{"aggregate", c.Name}, {"pipeline", p.pipeline}}, &result)
+	iter.err = c.Database.RunContext(ctx, bson.D{{"aggregate", c.Name}, {"pipeline", p.pipeline}}, &result)
 	if iter.err != nil {
 		return iter
 	}
@@ -1665,16 +1970,34 @@ func (p *Pipe) Iter() *Iter {
 	return iter
 }
 
+func (p *Pipe) Iter() imgo.Iter {
+	return p.iter()
+}
+
+func (p *Pipe) IterContext(ctx context.Context) imgo.Iter {
+	return p.iterContext(ctx)
+}
+
 // All works like Iter.All.
 func (p *Pipe) All(result interface{}) error {
-	return p.Iter().All(result)
+	return p.iter().All(result)
+}
+
+// AllContext works like All, with cancellation as in IterContext.
+func (p *Pipe) AllContext(ctx context.Context, result interface{}) error {
+	return p.iterContext(ctx).All(result)
 }
 
 // One executes the pipeline and unmarshals the first item from the
 // result set into the result parameter.
 // It returns ErrNotFound if no items are generated by the pipeline.
 func (p *Pipe) One(result interface{}) error {
-	iter := p.Iter()
+	return p.OneContext(context.Background(), result)
+}
+
+// OneContext works like One, with cancellation as in IterContext.
+func (p *Pipe) OneContext(ctx context.Context, result interface{}) error {
+	iter := p.iterContext(ctx)
 	if iter.Next(result) {
 		return nil
 	}
@@ -1704,6 +2027,7 @@ type queryError struct {
 	Code          int
 	AssertionCode int        "assertionCode"
 	LastError     *LastError "lastErrorObject"
+	Ok            float64
 }
 
 type QueryError struct {
@@ -1736,7 +2060,14 @@ func IsDup(err error) bool {
 // happens while inserting the provided documents, the returned error will
 // be of type *LastError.
 func (c *Collection) Insert(docs ...interface{}) error {
-	_, err := c.writeQuery(&insertOp{c.FullName, docs})
+	return c.InsertContext(context.Background(), docs...)
+}
+
+// InsertContext works like Insert, but gives up waiting for the outcome
+// of the insertion with ctx.Err() once ctx is done. The documents may
+// still be inserted in that case.
+func (c *Collection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	_, err := c.writeQuery(ctx, &insertOp{c.FullName, docs, 0})
 	return err
 }
 
@@ -1752,7 +2083,13 @@ func (c *Collection) Insert(docs ...interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) Update(selector interface{}, update interface{}) error {
-	lerr, err := c.writeQuery(&updateOp{c.FullName, selector, update, 0})
+	return c.UpdateContext(context.Background(), selector, update)
+}
+
+// UpdateContext works like Update, but gives up waiting for the outcome
+// of the update with ctx.Err() once ctx is done.
+func (c *Collection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	lerr, err := c.writeQuery(ctx, &updateOp{c.FullName, selector, update, 0})
 	if err == nil && lerr != nil && !lerr.UpdatedExisting {
 		return ErrNotFound
 	}
@@ -1769,11 +2106,7 @@ func (c *Collection) UpdateId(id interface{}, update interface{}) error {
 }
 
 // ChangeInfo holds details about the outcome of an update operation.
-type ChangeInfo struct {
-	Updated    int         // Number of existing documents updated
-	Removed    int         // Number of documents removed
-	UpsertedId interface{} // Upserted _id field, when not explicitly provided
-}
+type ChangeInfo = imgo.ChangeInfo
 
 // UpdateAll finds all documents matching the provided selector document
 // and modifies them according to the update document.
@@ -1788,7 +2121,13 @@ type ChangeInfo struct {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
-	lerr, err := c.writeQuery(&updateOp{c.FullName, selector, update, 2})
+	return c.UpdateAllContext(context.Background(), selector, update)
+}
+
+// UpdateAllContext works like UpdateAll, but gives up waiting for the
+// outcome of the update with ctx.Err() once ctx is done.
+func (c *Collection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	lerr, err := c.writeQuery(ctx, &updateOp{c.FullName, selector, update, 2})
 	if err == nil && lerr != nil {
 		info = &ChangeInfo{Updated: lerr.N}
 	}
@@ -1809,12 +2148,18 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) Upsert(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	return c.UpsertContext(context.Background(), selector, update)
+}
+
+// UpsertContext works like Upsert, but gives up waiting for the outcome
+// of the upsert with ctx.Err() once ctx is done.
+func (c *Collection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
 	data, err := bson.Marshal(update)
 	if err != nil {
 		return nil, err
 	}
 	update = bson.Raw{0x03, data}
-	lerr, err := c.writeQuery(&updateOp{c.FullName, selector, update, 1})
+	lerr, err := c.writeQuery(ctx, &updateOp{c.FullName, selector, update, 1})
 	if err == nil && lerr != nil {
 		info = &ChangeInfo{}
 		if lerr.UpdatedExisting {
@@ -1846,7 +2191,13 @@ func (c *Collection) UpsertId(id interface{}, update interface{}) (info *ChangeI
 //     http://www.mongodb.org/display/DOCS/Removing
 //
 func (c *Collection) Remove(selector interface{}) error {
-	lerr, err := c.writeQuery(&deleteOp{c.FullName, selector, 1})
+	return c.RemoveContext(context.Background(), selector)
+}
+
+// RemoveContext works like Remove, but gives up waiting for the outcome
+// of the removal with ctx.Err() once ctx is done.
+func (c *Collection) RemoveContext(ctx context.Context, selector interface{}) error {
+	lerr, err := c.writeQuery(ctx, &deleteOp{c.FullName, selector, 1})
 	if err == nil && lerr != nil && lerr.N == 0 {
 		return ErrNotFound
 	}
@@ -1872,7 +2223,13 @@ func (c *Collection) RemoveId(id interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Removing
 //
 func (c *Collection) RemoveAll(selector interface{}) (info *ChangeInfo, err error) {
-	lerr, err := c.writeQuery(&deleteOp{c.FullName, selector, 0})
+	return c.RemoveAllContext(context.Background(), selector)
+}
+
+// RemoveAllContext works like RemoveAll, but gives up waiting for the
+// outcome of the removal with ctx.Err() once ctx is done.
+func (c *Collection) RemoveAllContext(ctx context.Context, selector interface{}) (info *ChangeInfo, err error) {
+	lerr, err := c.writeQuery(ctx, &deleteOp{c.FullName, selector, 0})
 	if err == nil && lerr != nil {
 		info = &ChangeInfo{Removed: lerr.N}
 	}
@@ -1896,25 +2253,7 @@ func (c *Collection) DropCollection() error {
 //     http://www.mongodb.org/display/DOCS/createCollection+Command
 //     http://www.mongodb.org/display/DOCS/Capped+Collections
 //
-type CollectionInfo struct {
-	// DisableIdIndex prevents the automatic creation of the index
-	// on the _id field for the collection.
-	DisableIdIndex bool
-
-	// ForceIdIndex enforces the automatic creation of the index
-	// on the _id field for the collection. Capped collections,
-	// for example, do not have such an index by default.
-	ForceIdIndex bool
-
-	// If Capped is true new documents will replace old ones when
-	// the collection is full. MaxBytes must necessarily be set
-	// to define the size when the collection wraps around.
-	// MaxDocs optionally defines the number of documents when it
-	// wraps, but MaxBytes still needs to be set.
-	Capped   bool
-	MaxBytes int
-	MaxDocs  int
-}
+type CollectionInfo = imgo.CollectionInfo
 
 // Create explicitly creates the c collection with details of info.
 // MongoDB creates collections automatically on use, so this method
@@ -1955,7 +2294,7 @@ func (c *Collection) Create(info *CollectionInfo) error {
 // The default batch size is defined by the database itself.  As of this
 // writing, MongoDB will use an initial size of min(100 docs, 4MB) on the
 // first batch, and 4MB on remaining ones.
-func (q *Query) Batch(n int) *Query {
+func (q *Query) batch(n int) *Query {
 	if n == 1 {
 		// Server interprets 1 as -1 and closes the cursor (!?)
 		n = 2
@@ -1966,6 +2305,10 @@ func (q *Query) Batch(n int) *Query {
 	return q
 }
 
+func (q *Query) Batch(n int) imgo.Query {
+	return q.batch(n)
+}
+
 // Prefetch sets the point at which the next batch of results will be requested.
 // When there are p*batch_size remaining documents cached in an Iter, the next
 // batch will be requested in background. For instance, when using this:
@@ -1977,13 +2320,37 @@ func (q *Query) Batch(n int) *Query {
 // a per-session basis as well, using the SetPrefetch method of Session.
 //
 // The default prefetch value is 0.25.
-func (q *Query) Prefetch(p float64) *Query {
+func (q *Query) prefetcher(p float64) *Query {
 	q.m.Lock()
 	q.prefetch = p
 	q.m.Unlock()
 	return q
 }
 
+func (q *Query) Prefetch(p float64) imgo.Query {
+	return q.prefetcher(p)
+}
+
+// ReadPreference sets the servers the query reads from to those selected by
+// pref, regardless of the session's read preference or consistency mode.
+// A nil pref makes the query follow the session's consistency mode. See
+// Session.SetReadPreference.
+func (q *Query) readPreference(pref *ReadPreference) *Query {
+	var prefCopy *ReadPreference
+	if pref != nil {
+		prefCopy = new(ReadPreference)
+		*prefCopy = *pref
+	}
+	q.m.Lock()
+	q.op.readPref = prefCopy
+	q.m.Unlock()
+	return q
+}
+
+func (q *Query) ReadPreference(pref *ReadPreference) imgo.Query {
+	return q.readPreference(pref)
+}
+
 // Skip skips over the n initial documents from the query results.  Note that
 // this only makes sense with capped collections where documents are naturally
 // ordered by insertion time, or with sorted results.
@@ -2030,13 +2397,17 @@ func (q *Query) Limit(n int) imgo.Query {
 //
 //     http://www.mongodb.org/display/DOCS/Retrieving+a+Subset+of+Fields
 //
-func (q *Query) Select(selector interface{}) *Query {
+func (q *Query) selector(selector interface{}) *Query {
 	q.m.Lock()
 	q.op.selector = selector
 	q.m.Unlock()
 	return q
 }
 
+func (q *Query) Select(selector interface{}) imgo.Query {
+	return q.selector(selector)
+}
+
 // Sort asks the database to order returned documents according to the
 // provided field names. A field name may be prefixed by - (minus) for
 // it to be sorted in reverse order.
@@ -2101,7 +2472,7 @@ func (q *Query) Sort(fields ...string) imgo.Query {
 //
 func (q *Query) Explain(result interface{}) error {
 	q.m.Lock()
-	clone := &Query{session: q.session, query: q.query}
+	clone := &Query{session: q.session, query: q.query, writeConcern: q.writeConcern}
 	q.m.Unlock()
 	clone.op.options.Explain = true
 	clone.op.hasOptions = true
@@ -2131,7 +2502,7 @@ func (q *Query) Explain(result interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Optimization
 //     http://www.mongodb.org/display/DOCS/Query+Optimizer
 //
-func (q *Query) Hint(indexKey ...string) *Query {
+func (q *Query) hint(indexKey ...string) *Query {
 	q.m.Lock()
 	_, realKey, err := parseIndexKey(indexKey)
 	q.op.options.Hint = realKey
@@ -2143,6 +2514,10 @@ func (q *Query) Hint(indexKey ...string) *Query {
 	return q
 }
 
+func (q *Query) Hint(indexKey ...string) imgo.Query {
+	return q.hint(indexKey...)
+}
+
 // Snapshot will force the performed query to make use of an available
 // index on the _id field to prevent the same document from being returned
 // more than once in a single iteration. This might happen without this
@@ -2166,7 +2541,7 @@ func (q *Query) Hint(indexKey ...string) *Query {
 //
 //     http://www.mongodb.org/display/DOCS/How+to+do+Snapshotted+Queries+in+the+Mongo+Database
 //
-func (q *Query) Snapshot() *Query {
+func (q *Query) snapshot() *Query {
 	q.m.Lock()
 	q.op.options.Snapshot = true
 	q.op.hasOptions = true
@@ -2174,17 +2549,25 @@ func (q *Query) Snapshot() *Query {
 	return q
 }
 
+func (q *Query) Snapshot() imgo.Query {
+	return q.snapshot()
+}
+
 // LogReplay enables an option that optimizes queries that are typically
 // made on the MongoDB oplog for replaying it. This is an internal
 // implementation aspect and most likely uninteresting for other uses.
 // It has seen at least one use case, though, so it's exposed via the API.
-func (q *Query) LogReplay() *Query {
+func (q *Query) logReplay() *Query {
 	q.m.Lock()
 	q.op.flags |= flagLogReplay
 	q.m.Unlock()
 	return q
 }
 
+func (q *Query) LogReplay() imgo.Query {
+	return q.logReplay()
+}
+
 func checkQueryError(fullname string, d []byte) error {
 	l := len(d)
 	if l < 16 {
@@ -2206,6 +2589,11 @@ func checkQueryError(fullname string, d []byte) error {
 Error:
 	result := &queryError{}
 	bson.Unmarshal(d, result)
+	if result.Err == "" && result.Ok == 1 {
+		// Successful command whose result mentions some errmsg, such as
+		// in the writeConcernError of a findAndModify.
+		return nil
+	}
 	Logf("queryError: %#v\n", result)
 	if result.LastError != nil {
 		return result.LastError
@@ -2237,21 +2625,26 @@ Error:
 // desired.
 //
 func (q *Query) One(result interface{}) (err error) {
+	return q.OneContext(context.Background(), result)
+}
+
+// OneContext works like One, but gives up waiting for the result with
+// ctx.Err() once ctx is done, releasing the socket in use.
+func (q *Query) OneContext(ctx context.Context, result interface{}) (err error) {
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
 	q.m.Unlock()
 
-	socket, err := session.acquireSocket(true)
+	socket, err := session.acquireReadSocket(ctx, &op)
 	if err != nil {
 		return err
 	}
 	defer socket.Release()
 
-	op.flags |= session.slaveOkFlag()
 	op.limit = -1
 
-	data, err := socket.SimpleQuery(&op)
+	data, err := socket.SimpleQueryContext(ctx, session.commandMonitor(), &op)
 	if err != nil {
 		return err
 	}
@@ -2261,9 +2654,9 @@ func (q *Query) One(result interface{}) (err error) {
 	if result != nil {
 		err = bson.Unmarshal(data, result)
 		if err == nil {
-			Debugf("Query %p document unmarshaled: %#v", q, result)
+			session.debugf("Query %p document unmarshaled: %#v", q, result)
 		} else {
-			Debugf("Query %p document unmarshaling failed: %#v", q, err)
+			session.debugf("Query %p document unmarshaling failed: %#v", q, err)
 			return err
 		}
 	}
@@ -2282,13 +2675,7 @@ func (q *Query) One(result interface{}) (err error) {
 //
 //     http://www.mongodb.org/display/DOCS/Database+References
 //
-type DBRef struct {
-	Collection string      `bson:"$ref"`
-	Id         interface{} `bson:"$id"`
-	Database   string      `bson:"$db,omitempty"`
-}
-
-// NOTE: Order of fields for DBRef above does matter, per documentation.
+type DBRef = imgo.DBRef
 
 // FindRef returns a query that looks for the document in the provided
 // reference. If the reference includes the DB field, the document will
@@ -2303,9 +2690,9 @@ type DBRef struct {
 func (db *Database) FindRef(ref *DBRef) imgo.Query {
 	var c *Collection
 	if ref.Database == "" {
-		c = db.C(ref.Collection)
+		c = db.c(ref.Collection)
 	} else {
-		c = db.Session.DB(ref.Database).C(ref.Collection)
+		c = db.Session.db(ref.Database).c(ref.Collection)
 	}
 	return c.FindId(ref.Id)
 }
@@ -2324,14 +2711,14 @@ func (s *Session) FindRef(ref *DBRef) imgo.Query {
 	if ref.Database == "" {
 		panic(errors.New(fmt.Sprintf("Can't resolve database for %#v", ref)))
 	}
-	c := s.DB(ref.Database).C(ref.Collection)
+	c := s.db(ref.Database).c(ref.Collection)
 	return c.FindId(ref.Id)
 }
 
 // CollectionNames returns the collection names present in database.
 func (db *Database) CollectionNames() (names []string, err error) {
 	c := len(db.Name) + 1
-	iter := db.C("system.namespaces").Find(nil).Iter()
+	iter := db.c("system.namespaces").Find(nil).Iter()
 	var result *struct{ Name string }
 	for iter.Next(&result) {
 		if strings.Index(result.Name, "$") < 0 || strings.Index(result.Name, ".oplog.$") >= 0 {
@@ -2373,6 +2760,13 @@ func (s *Session) DatabaseNames() (names []string, err error) {
 // size (see the Batch method) and more documents will be requested when a
 // configurable number of documents is iterated over (see the Prefetch method).
 func (q *Query) iter() *Iter {
+	return q.iterContext(context.Background())
+}
+
+// IterContext works like Iter, but the returned iterator stops once ctx is
+// done: Next returns false, Err and Close report ctx.Err(), and the cursor
+// is killed in the server.
+func (q *Query) iterContext(ctx context.Context) *Iter {
 	q.m.Lock()
 	session := q.session
 	op := q.op
@@ -2385,6 +2779,7 @@ func (q *Query) iter() *Iter {
 		prefetch: prefetch,
 		limit:    limit,
 		timeout:  -1,
+		ctx:      ctx,
 	}
 	iter.gotReply.L = &iter.m
 	iter.op.collection = op.collection
@@ -2392,14 +2787,13 @@ func (q *Query) iter() *Iter {
 	iter.op.replyFunc = iter.replyFunc()
 	iter.docsToReceive++
 	op.replyFunc = iter.op.replyFunc
-	op.flags |= session.slaveOkFlag()
 
-	socket, err := session.acquireSocket(true)
+	socket, err := session.acquireReadSocket(ctx, &op)
 	if err != nil {
 		iter.err = err
 	} else {
 		iter.server = socket.Server()
-		err = socket.Query(&op)
+		err = socket.MonitoredQuery(session.commandMonitor(), &op)
 		if err != nil {
 			// Must lock as the query above may call replyFunc.
 			iter.m.Lock()
@@ -2407,6 +2801,7 @@ func (q *Query) iter() *Iter {
 			iter.m.Unlock()
 		}
 		socket.Release()
+		iter.stopCtx = context.AfterFunc(ctx, iter.cancel)
 	}
 	return iter
 }
@@ -2415,6 +2810,10 @@ func (q *Query) Iter() imgo.Iter {
 	return q.iter()
 }
 
+func (q *Query) IterContext(ctx context.Context) imgo.Iter {
+	return q.iterContext(ctx)
+}
+
 // Tail returns a tailable iterator. Unlike a normal iterator, a
 // tailable iterator may wait for new values to be inserted in the
 // collection once the end of the current result set is reached,
@@ -2461,14 +2860,24 @@ func (q *Query) Iter() imgo.Iter {
 //     http://www.mongodb.org/display/DOCS/Capped+Collections
 //     http://www.mongodb.org/display/DOCS/Sorting+and+Natural+Order
 //
-func (q *Query) Tail(timeout time.Duration) *Iter {
+func (q *Query) tail(timeout time.Duration) *Iter {
+	return q.tailContext(context.Background(), timeout)
+}
+
+func (q *Query) Tail(timeout time.Duration) imgo.Iter {
+	return q.tail(timeout)
+}
+
+// tailContext works like tail, but the returned iterator stops once ctx is
+// done, even while Next is blocked waiting for new documents.
+func (q *Query) tailContext(ctx context.Context, timeout time.Duration) *Iter {
 	q.m.Lock()
 	session := q.session
 	op := q.op
 	prefetch := q.prefetch
 	q.m.Unlock()
 
-	iter := &Iter{session: session, prefetch: prefetch}
+	iter := &Iter{session: session, prefetch: prefetch, ctx: ctx}
 	iter.gotReply.L = &iter.m
 	iter.timeout = timeout
 	iter.op.collection = op.collection
@@ -2476,14 +2885,14 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 	iter.op.replyFunc = iter.replyFunc()
 	iter.docsToReceive++
 	op.replyFunc = iter.op.replyFunc
-	op.flags |= flagTailable | flagAwaitData | session.slaveOkFlag()
+	op.flags |= flagTailable | flagAwaitData
 
-	socket, err := session.acquireSocket(true)
+	socket, err := session.acquireReadSocket(ctx, &op)
 	if err != nil {
 		iter.err = err
 	} else {
 		iter.server = socket.Server()
-		err = socket.Query(&op)
+		err = socket.MonitoredQuery(session.commandMonitor(), &op)
 		if err != nil {
 			// Must lock as the query above may call replyFunc.
 			iter.m.Lock()
@@ -2491,6 +2900,7 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 			iter.m.Unlock()
 		}
 		socket.Release()
+		iter.stopCtx = context.AfterFunc(ctx, iter.cancel)
 	}
 	return iter
 }
@@ -2536,6 +2946,9 @@ func (iter *Iter) Err() error {
 // standard ways for MongoDB to report an improper query, the returned value has
 // a *QueryError type.
 func (iter *Iter) Close() error {
+	if iter.stopCtx != nil {
+		iter.stopCtx()
+	}
 	iter.m.Lock()
 	iter.killCursor()
 	err := iter.err
@@ -2548,10 +2961,11 @@ func (iter *Iter) Close() error {
 
 func (iter *Iter) killCursor() error {
 	if iter.op.cursorId != 0 {
-		socket, err := iter.acquireSocket()
+		// Kill the cursor even if the iteration was cancelled.
+		socket, err := iter.acquireSocket(context.Background())
 		if err == nil {
 			// TODO Batch kills.
-			err = socket.Query(&killCursorsOp{[]int64{iter.op.cursorId}})
+			err = socket.MonitoredQuery(iter.session.commandMonitor(), &killCursorsOp{[]int64{iter.op.cursorId}})
 			socket.Release()
 		}
 		if err != nil && (iter.err == nil || iter.err == ErrNotFound) {
@@ -2596,6 +3010,7 @@ func (iter *Iter) Timeout() bool {
 //
 func (iter *Iter) Next(result interface{}) bool {
 	iter.m.Lock()
+	iter.checkContext()
 	iter.timedout = false
 	timeout := time.Time{}
 	for iter.err == nil && iter.docData.Len() == 0 && (iter.docsToReceive > 0 || iter.op.cursorId != 0) {
@@ -2643,7 +3058,7 @@ func (iter *Iter) Next(result interface{}) bool {
 		iter.m.Unlock()
 		err := bson.Unmarshal(docData, result)
 		if err != nil {
-			Debugf("Iter %p document unmarshaling failed: %#v", iter, err)
+			iter.session.debugf("Iter %p document unmarshaling failed: %#v", iter, err)
 			iter.m.Lock()
 			if iter.err == nil {
 				iter.err = err
@@ -2651,7 +3066,7 @@ func (iter *Iter) Next(result interface{}) bool {
 			iter.m.Unlock()
 			return false
 		}
-		Debugf("Iter %p document unmarshaled: %#v", iter, result)
+		iter.session.debugf("Iter %p document unmarshaled: %#v", iter, result)
 		// XXX Only have to check first document for a query error?
 		err = checkQueryError(iter.op.collection, docData)
 		if err != nil {
@@ -2664,12 +3079,12 @@ func (iter *Iter) Next(result interface{}) bool {
 		}
 		return true
 	} else if iter.err != nil {
-		Debugf("Iter %p returning false: %s", iter, iter.err)
+		iter.session.debugf("Iter %p returning false: %s", iter, iter.err)
 		iter.m.Unlock()
 		return false
 	} else if iter.op.cursorId == 0 {
 		iter.err = ErrNotFound
-		Debugf("Iter %p exhausted with cursor=0", iter)
+		iter.session.debugf("Iter %p exhausted with cursor=0", iter)
 		iter.m.Unlock()
 		return false
 	}
@@ -2730,6 +3145,11 @@ func (q *Query) All(result interface{}) error {
 	return q.Iter().All(result)
 }
 
+// AllContext works like All, with cancellation as in IterContext.
+func (q *Query) AllContext(ctx context.Context, result interface{}) error {
+	return q.iterContext(ctx).All(result)
+}
+
 // The For method is obsolete and will be removed in a future release.
 // See Iter as an elegant replacement.
 func (q *Query) For(result interface{}, f func() error) error {
@@ -2765,8 +3185,8 @@ func (iter *Iter) For(result interface{}, f func() error) (err error) {
 	return iter.Err()
 }
 
-func (iter *Iter) acquireSocket() (*mongoSocket, error) {
-	socket, err := iter.session.acquireSocket(true)
+func (iter *Iter) acquireSocket(ctx context.Context) (*mongoSocket, error) {
+	socket, err := iter.session.acquireSocketContext(ctx, true)
 	if err != nil {
 		return nil, err
 	}
@@ -2779,7 +3199,7 @@ func (iter *Iter) acquireSocket() (*mongoSocket, error) {
 		sockTimeout := iter.session.sockTimeout
 		iter.session.m.Unlock()
 		socket.Release()
-		socket, _, err = iter.server.AcquireSocket(0, sockTimeout)
+		socket, _, err = iter.server.AcquireSocket(ctx, 0, sockTimeout)
 		if err != nil {
 			return nil, err
 		}
@@ -2792,22 +3212,65 @@ func (iter *Iter) acquireSocket() (*mongoSocket, error) {
 	return socket, nil
 }
 
+// cancel stops the iteration once its context is done.
+func (iter *Iter) cancel() {
+	iter.m.Lock()
+	iter.checkContext()
+	iter.gotReply.Broadcast()
+	iter.m.Unlock()
+}
+
+// checkContext stops the iteration if its context is done, discarding
+// pending documents and killing the server cursor if it's already known.
+// Must be called with iter.m held.
+func (iter *Iter) checkContext() {
+	if iter.err != nil || iter.ctx == nil || iter.ctx.Err() == nil {
+		return
+	}
+	iter.err = iter.ctx.Err()
+	iter.docData = Queue{}
+	iter.session.m.RLock()
+	closed := iter.session.cluster_ == nil
+	iter.session.m.RUnlock()
+	if !closed {
+		iter.killCursor()
+	}
+}
+
+// killLateCursor kills a cursor whose id arrived after the iteration was
+// cancelled.
+func (iter *Iter) killLateCursor(cursorId int64) {
+	socket, err := iter.acquireSocket(context.Background())
+	if err != nil {
+		iter.session.debugf("Iter %p cannot kill cursor %d: %v", iter, cursorId, err)
+		return
+	}
+	socket.MonitoredQuery(iter.session.commandMonitor(), &killCursorsOp{[]int64{cursorId}})
+	socket.Release()
+}
+
+// cancelled returns whether iteration was stopped by its context.
+// Must be called with iter.m held.
+func (iter *Iter) cancelled() bool {
+	return iter.err != nil && iter.ctx != nil && iter.err == iter.ctx.Err()
+}
+
 func (iter *Iter) getMore() {
-	socket, err := iter.acquireSocket()
+	socket, err := iter.acquireSocket(iter.ctx)
 	if err != nil {
 		iter.err = err
 		return
 	}
 	defer socket.Release()
 
-	Debugf("Iter %p requesting more documents", iter)
+	iter.session.debugf("Iter %p requesting more documents", iter)
 	if iter.limit > 0 {
 		limit := iter.limit - int32(iter.docsToReceive) - int32(iter.docData.Len())
 		if limit < iter.op.limit {
 			iter.op.limit = limit
 		}
 	}
-	if err := socket.Query(&iter.op); err != nil {
+	if err := socket.MonitoredQuery(iter.session.commandMonitor(), &iter.op); err != nil {
 		iter.err = err
 	}
 	iter.docsToReceive++
@@ -2822,6 +3285,12 @@ type countCmd struct {
 
 // Count returns the total number of documents in the result set.
 func (q *Query) Count() (n int, err error) {
+	return q.CountContext(context.Background())
+}
+
+// CountContext works like Count, but gives up waiting for the count with
+// ctx.Err() once ctx is done.
+func (q *Query) CountContext(ctx context.Context) (n int, err error) {
 	q.m.Lock()
 	session := q.session
 	op := q.op
@@ -2837,7 +3306,8 @@ func (q *Query) Count() (n int, err error) {
 	cname := op.collection[c+1:]
 
 	result := struct{ N int }{}
-	err = session.DB(dbname).Run(countCmd{cname, op.query, limit, op.skip}, &result)
+	cmd := session.db(dbname).c("$cmd").find(countCmd{cname, op.query, limit, op.skip})
+	err = cmd.readPreference(op.readPref).OneContext(ctx, &result)
 	return result.N, err
 }
 
@@ -2880,7 +3350,8 @@ func (q *Query) Distinct(key string, result interface{}) error {
 	cname := op.collection[c+1:]
 
 	var doc struct{ Values bson.Raw }
-	err := session.DB(dbname).Run(distinctCmd{cname, key, op.query}, &doc)
+	cmd := session.db(dbname).c("$cmd").find(distinctCmd{cname, key, op.query})
+	err := cmd.readPreference(op.readPref).One(&doc)
 	if err != nil {
 		return err
 	}
@@ -3027,7 +3498,7 @@ func (q *Query) MapReduce(job *MapReduce, result interface{}) (info *MapReduceIn
 	}
 
 	var doc mapReduceResult
-	err = session.DB(dbname).Run(&cmd, &doc)
+	err = session.db(dbname).Run(&cmd, &doc)
 	if err != nil {
 		return nil, err
 	}
@@ -3100,22 +3571,19 @@ func fixMROut(out interface{}) interface{} {
 
 // Change holds fields for running a findAndModify MongoDB command via
 // the Query.Apply method.
-type Change struct {
-	Update    interface{} // The update document
-	Upsert    bool        // Whether to insert in case the document isn't found
-	Remove    bool        // Whether to remove the document found rather than updating
-	ReturnNew bool        // Should the modified document be returned rather than the old one
-}
+type Change = imgo.Change
 
 type findModifyCmd struct {
 	Collection                  string      "findAndModify"
 	Query, Update, Sort, Fields interface{} ",omitempty"
 	Upsert, Remove, New         bool        ",omitempty"
+	WriteConcern                bson.D      "writeConcern,omitempty"
 }
 
 type valueResult struct {
-	Value     bson.Raw
-	LastError LastError "lastErrorObject"
+	Value             bson.Raw
+	LastError         LastError                 "lastErrorObject"
+	WriteConcernError *commandWriteConcernError "writeConcernError"
 }
 
 // Apply runs the findAndModify MongoDB command, which allows updating, upserting
@@ -3149,6 +3617,7 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
+	wc := q.writeConcern
 	q.m.Unlock()
 
 	c := strings.Index(op.collection, ".")
@@ -3170,12 +3639,30 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		Fields:     op.selector,
 	}
 
-	session = session.Clone()
+	session = session.clone()
 	defer session.Close()
 	session.SetMode(Strong, false)
 
+	if wc != nil && !wc.Unacknowledged {
+		if err := validateWriteConcern(wc); err != nil {
+			return nil, err
+		}
+		if wc.WMode != "" {
+			socket, err := session.acquireSocket(false)
+			if err != nil {
+				return nil, err
+			}
+			err = session.cluster().CheckWriteMode(socket, wc.WMode)
+			socket.Release()
+			if err != nil {
+				return nil, err
+			}
+		}
+		cmd.WriteConcern = writeConcernDocument(wc)
+	}
+
 	var doc valueResult
-	err = session.DB(dbname).Run(&cmd, &doc)
+	err = session.db(dbname).Run(&cmd, &doc)
 	if err != nil {
 		if qerr, ok := err.(*QueryError); ok && qerr.Message == "No matching object found" {
 			return nil, ErrNotFound
@@ -3200,6 +3687,9 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 	} else if change.Upsert {
 		info.UpsertedId = lerr.UpsertedId
 	}
+	if doc.WriteConcernError != nil {
+		return info, doc.WriteConcernError.error(lerr)
+	}
 	return info, nil
 }
 
@@ -3241,6 +3731,13 @@ func (s *Session) BuildInfo() (info BuildInfo, err error) {
 // Internal session handling helpers.
 
 func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
+	return s.acquireSocketContext(context.Background(), slaveOk)
+}
+
+func (s *Session) acquireSocketContext(ctx context.Context, slaveOk bool) (*mongoSocket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Read-only lock to check for previously reserved socket.
 	s.m.RLock()
@@ -3273,7 +3770,7 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	}
 
 	// Still not good.  We need a new socket.
-	sock, err := s.cluster().AcquireSocket(slaveOk && s.slaveOk, s.syncTimeout, s.sockTimeout, s.queryConfig.op.serverTags)
+	sock, err := s.cluster().AcquireSocket(ctx, slaveOk && s.slaveOk, s.syncTimeout, s.sockTimeout, s.queryConfig.op.serverTags, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -3301,6 +3798,36 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	return sock, nil
 }
 
+// acquireReadSocket acquires a socket for running the query op, according
+// to its read preference if it has one or to the session's consistency mode
+// otherwise, and sets the slaveOk flag of op accordingly. Sockets acquired
+// for a read preference other than ReadPrimary are never reserved.
+func (s *Session) acquireReadSocket(ctx context.Context, op *queryOp) (*mongoSocket, error) {
+	pref := op.readPref
+	if pref == nil || pref.Mode == ReadPrimary {
+		socket, err := s.acquireSocketContext(ctx, pref == nil)
+		if err == nil && pref == nil {
+			op.flags |= s.slaveOkFlag()
+		}
+		return socket, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	sock, err := s.cluster().AcquireSocket(ctx, true, s.syncTimeout, s.sockTimeout, nil, pref)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.socketLogin(sock); err != nil {
+		sock.Release()
+		return nil, err
+	}
+	op.flags |= flagSlaveOk
+	return sock, nil
+}
+
 // setSocket binds socket to this section.
 func (s *Session) setSocket(socket *mongoSocket) {
 	info := socket.Acquire()
@@ -3333,11 +3860,21 @@ func (iter *Iter) replyFunc() replyFunc {
 	return func(err error, op *replyOp, docNum int, docData []byte) {
 		iter.m.Lock()
 		iter.docsToReceive--
+		if iter.cancelled() {
+			if op != nil && op.cursorId != 0 && op.cursorId != iter.op.cursorId {
+				// The cursor was created after cancellation. Kill it
+				// elsewhere as the socket is busy delivering this reply.
+				go iter.killLateCursor(op.cursorId)
+			}
+			iter.gotReply.Broadcast()
+			iter.m.Unlock()
+			return
+		}
 		if err != nil {
 			iter.err = err
-			Debugf("Iter %p received an error: %s", iter, err.Error())
+			iter.session.debugf("Iter %p received an error: %s", iter, err.Error())
 		} else if docNum == -1 {
-			Debugf("Iter %p received no documents (cursor=%d).", iter, op.cursorId)
+			iter.session.debugf("Iter %p received no documents (cursor=%d).", iter, op.cursorId)
 			if op != nil && op.cursorId != 0 {
 				// It's a tailable cursor.
 				iter.op.cursorId = op.cursorId
@@ -3357,7 +3894,7 @@ func (iter *Iter) replyFunc() replyFunc {
 				iter.op.cursorId = op.cursorId
 			}
 			// XXX Handle errors and flags.
-			Debugf("Iter %p received reply document %d/%d (cursor=%d)", iter, docNum+1, rdocs, op.cursorId)
+			iter.session.debugf("Iter %p received reply document %d/%d (cursor=%d)", iter, docNum+1, rdocs, op.cursorId)
 			iter.docData.Push(docData)
 		}
 		iter.gotReply.Broadcast()
@@ -3369,57 +3906,83 @@ func (iter *Iter) replyFunc() replyFunc {
 // by a getLastError command in case the session is in safe mode.  The
 // LastError result is made available in lerr, and if lerr.Err is set it
 // will also be returned as err.
-func (c *Collection) writeQuery(op interface{}) (lerr *LastError, err error) {
+func (c *Collection) writeQuery(ctx context.Context, op interface{}) (lerr *LastError, err error) {
 	s := c.Database.Session
 	dbname := c.Database.Name
-	socket, err := s.acquireSocket(dbname == "local")
+	socket, err := s.acquireSocketContext(ctx, dbname == "local")
 	if err != nil {
 		return nil, err
 	}
 	defer socket.Release()
 
-	s.m.RLock()
-	safeOp := s.safeOp
-	s.m.RUnlock()
+	safeOp, err := c.safeOp(socket)
+	if err != nil {
+		return nil, err
+	}
+	return c.writeOp(ctx, socket, safeOp, s.commandMonitor(), op)
+}
 
+// writeOp sends op over socket followed by safeOp, and returns the outcome
+// it reports. If safeOp is nil, the outcome isn't waited for.
+func (c *Collection) writeOp(ctx context.Context, socket *mongoSocket, safeOp *queryOp, monitor CommandMonitor, op interface{}) (lerr *LastError, err error) {
 	if safeOp == nil {
-		return nil, socket.Query(op)
-	} else {
-		var mutex sync.Mutex
-		var replyData []byte
-		var replyErr error
-		mutex.Lock()
-		query := *safeOp // Copy the data.
-		query.collection = dbname + ".$cmd"
-		query.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
-			replyData = docData
-			replyErr = err
-			mutex.Unlock()
-		}
-		err = socket.Query(op, &query)
+		return nil, socket.MonitoredQuery(monitor, op)
+	}
+	reply := make(replyChan, 1)
+	query := *safeOp // Copy the data.
+	query.collection = c.Database.Name + ".$cmd"
+	query.replyFunc = func(err error, _ *replyOp, docNum int, docData []byte) {
+		reply.send(docData, err)
+	}
+	err = socket.MonitoredQuery(monitor, op, &query)
+	if err != nil {
+		return nil, err
+	}
+	replyData, err := waitReply(ctx, reply)
+	if err != nil {
+		return nil, err // XXX TESTME
+	}
+	if hasErrMsg(replyData) {
+		// Looks like getLastError itself failed.
+		err = checkQueryError(query.collection, replyData)
 		if err != nil {
 			return nil, err
 		}
-		mutex.Lock() // Wait.
-		if replyErr != nil {
-			return nil, replyErr // XXX TESTME
+	}
+	result := &LastError{}
+	bson.Unmarshal(replyData, &result)
+	c.Database.Session.debugf("Result from writing query: %#v", result)
+	if err := writeConcernError(replyData, result); err != nil {
+		return result, err
+	}
+	if result.Err != "" {
+		return result, result
+	}
+	return result, nil
+}
+
+// safeOp returns the getLastError query that must follow writes made with
+// the collection over socket, or nil if their outcome isn't waited for.
+func (c *Collection) safeOp(socket *mongoSocket) (*queryOp, error) {
+	s := c.Database.Session
+	s.m.RLock()
+	safeOp := s.safeOp
+	s.m.RUnlock()
+
+	if wc := c.writeConcern; wc != nil {
+		if err := validateWriteConcern(wc); err != nil {
+			return nil, err
 		}
-		if hasErrMsg(replyData) {
-			// Looks like getLastError itself failed.
-			err = checkQueryError(query.collection, replyData)
-			if err != nil {
+		safeOp = writeConcernSafeOp(wc)
+	}
+	if safeOp != nil {
+		if mode, ok := safeOp.query.(*getLastError).W.(string); ok {
+			if err := s.cluster().CheckWriteMode(socket, mode); err != nil {
 				return nil, err
 			}
 		}
-		result := &LastError{}
-		bson.Unmarshal(replyData, &result)
-		Debugf("Result from writing query: %#v", result)
-		if result.Err != "" {
-			return result, result
-		}
-		return result, nil
 	}
-	panic("unreachable")
+	return safeOp, nil
 }
 
 func hasErrMsg(d []byte) bool {
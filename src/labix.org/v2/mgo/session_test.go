@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"labix.org/v2/base/bson"
@@ -125,7 +126,7 @@ func (s *S) TestInsertFindOne(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 
 	result := struct{ A, B int }{}
@@ -141,7 +142,7 @@ func (s *S) TestInsertFindOneNil(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Find(nil).One(nil)
 	c.Assert(err, ErrorMatches, "unauthorized.*|not authorized.*")
 }
@@ -151,7 +152,7 @@ func (s *S) TestInsertFindOneMap(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 	result := make(M)
 	err = coll.Find(M{"a": 1}).One(result)
@@ -165,7 +166,7 @@ func (s *S) TestInsertFindAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 	coll.Insert(M{"a": 3, "b": 4})
 
@@ -209,11 +210,11 @@ func (s *S) TestFindRef(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db1 := session.DB("db1")
-	db1col1 := db1.C("col1")
+	db1 := session.db("db1")
+	db1col1 := db1.c("col1")
 
-	db2 := session.DB("db2")
-	db2col1 := db2.C("col1")
+	db2 := session.db("db2")
+	db2col1 := db2.c("col1")
 
 	db1col1.Insert(M{"_id": 1, "n": 1})
 	db1col1.Insert(M{"_id": 2, "n": 2})
@@ -252,12 +253,12 @@ func (s *S) TestDatabaseAndCollectionNames(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db1 := session.DB("db1")
-	db1col1 := db1.C("col1")
-	db1col2 := db1.C("col2")
+	db1 := session.db("db1")
+	db1col1 := db1.c("col1")
+	db1col2 := db1.c("col2")
 
-	db2 := session.DB("db2")
-	db2col1 := db2.C("col3")
+	db2 := session.db("db2")
+	db2col1 := db2.c("col3")
 
 	db1col1.Insert(M{"_id": 1})
 	db1col2.Insert(M{"_id": 1})
@@ -284,12 +285,12 @@ func (s *S) TestSelect(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 
 	result := struct{ A, B int }{}
 
-	err = coll.find(M{"a": 1}).Select(M{"b": 1}).One(&result)
+	err = coll.find(M{"a": 1}).selector(M{"b": 1}).One(&result)
 	c.Assert(err, IsNil)
 	c.Assert(result.A, Equals, 0)
 	c.Assert(result.B, Equals, 2)
@@ -300,7 +301,7 @@ func (s *S) TestInlineMap(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	var v, result1 struct {
 		A int
@@ -314,13 +315,13 @@ func (s *S) TestInlineMap(c *C) {
 
 	noId := M{"_id": 0}
 
-	err = coll.find(nil).Select(noId).One(&result1)
+	err = coll.find(nil).selector(noId).One(&result1)
 	c.Assert(err, IsNil)
 	c.Assert(result1.A, Equals, 1)
 	c.Assert(result1.M, DeepEquals, map[string]int{"b": 2})
 
 	var result2 M
-	err = coll.find(nil).Select(noId).One(&result2)
+	err = coll.find(nil).selector(noId).One(&result2)
 	c.Assert(err, IsNil)
 	c.Assert(result2, DeepEquals, M{"a": 1, "b": 2})
 
@@ -331,7 +332,7 @@ func (s *S) TestUpdate(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -359,7 +360,7 @@ func (s *S) TestUpdateId(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -387,7 +388,7 @@ func (s *S) TestUpdateNil(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"k": 42, "n": 42})
 	c.Assert(err, IsNil)
@@ -418,7 +419,7 @@ func (s *S) TestUpsert(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -471,7 +472,7 @@ func (s *S) TestUpsertId(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -508,7 +509,7 @@ func (s *S) TestUpdateAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -546,7 +547,7 @@ func (s *S) TestRemove(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -575,7 +576,7 @@ func (s *S) TestRemoveId(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"_id": 40}, M{"_id": 41}, M{"_id": 42})
 	c.Assert(err, IsNil)
@@ -593,7 +594,7 @@ func (s *S) TestRemoveAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -619,16 +620,56 @@ func (s *S) TestRemoveAll(c *C) {
 	c.Assert(err, Equals, ErrNotFound)
 }
 
+func (s *S) TestBulk(c *C) {
+	session, err := Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.db("mydb").c("mycoll")
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	bulk := coll.Bulk()
+	bulk.Insert(M{"_id": 2, "n": 2}, M{"_id": 1}, M{"_id": 3, "n": 3})
+	bulk.Upsert(M{"_id": 4}, M{"$set": M{"n": 4}})
+	result, err := bulk.Run()
+	c.Assert(err, FitsTypeOf, &BulkError{})
+	ecases := err.(*BulkError).Cases()
+	c.Assert(ecases, HasLen, 1)
+	c.Assert(ecases[0].Index, Equals, 1)
+	c.Assert(IsDup(ecases[0].Err), Equals, true)
+	c.Assert(result.Inserted, Equals, 1)
+
+	bulk = coll.Bulk()
+	bulk.Unordered()
+	bulk.Insert(M{"_id": 1}, M{"_id": 3, "n": 3})
+	bulk.UpdateAll(M{"n": M{"$lt": 3}}, M{"$inc": M{"n": 10}})
+	bulk.Upsert(M{"_id": 4}, M{"$set": M{"n": 4}})
+	bulk.RemoveAll(M{"n": 3})
+	result, err = bulk.Run()
+	c.Assert(err, FitsTypeOf, &BulkError{})
+	c.Assert(err.(*BulkError).Cases()[0].Index, Equals, 0)
+	c.Assert(result.Inserted, Equals, 1)
+	c.Assert(result.Matched, Equals, 2)
+	c.Assert(result.Upserted, Equals, 1)
+	c.Assert(result.UpsertedIds, DeepEquals, []BulkUpserted{{3, 4}})
+	c.Assert(result.Removed, Equals, 1)
+
+	n, err := coll.Find(M{"n": M{"$gt": 10}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
 func (s *S) TestDropDatabase(c *C) {
 	session, err := Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db1 := session.DB("db1")
-	db1.C("col").Insert(M{"_id": 1})
+	db1 := session.db("db1")
+	db1.c("col").Insert(M{"_id": 1})
 
-	db2 := session.DB("db2")
-	db2.C("col").Insert(M{"_id": 1})
+	db2 := session.db("db2")
+	db2.c("col").Insert(M{"_id": 1})
 
 	err = db1.DropDatabase()
 	c.Assert(err, IsNil)
@@ -656,18 +697,18 @@ func (s *S) TestDropCollection(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	db := session.DB("db1")
-	db.C("col1").Insert(M{"_id": 1})
-	db.C("col2").Insert(M{"_id": 1})
+	db := session.db("db1")
+	db.c("col1").Insert(M{"_id": 1})
+	db.c("col2").Insert(M{"_id": 1})
 
-	err = db.C("col1").DropCollection()
+	err = db.c("col1").DropCollection()
 	c.Assert(err, IsNil)
 
 	names, err := db.CollectionNames()
 	c.Assert(err, IsNil)
 	c.Assert(names, DeepEquals, []string{"col2", "system.indexes"})
 
-	err = db.C("col2").DropCollection()
+	err = db.c("col2").DropCollection()
 	c.Assert(err, IsNil)
 
 	names, err = db.CollectionNames()
@@ -680,7 +721,7 @@ func (s *S) TestCreateCollectionCapped(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	info := &CollectionInfo{
 		Capped:   true,
@@ -706,7 +747,7 @@ func (s *S) TestCreateCollectionNoIndex(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	info := &CollectionInfo{
 		DisableIdIndex: true,
@@ -726,7 +767,7 @@ func (s *S) TestCreateCollectionForceIndex(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	info := &CollectionInfo{
 		ForceIdIndex: true,
@@ -762,7 +803,7 @@ func (s *S) TestIsDupPrimary(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"_id": 1})
 	c.Assert(err, IsNil)
@@ -781,7 +822,7 @@ func (s *S) TestIsDupUnique(c *C) {
 		Unique: true,
 	}
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndex(index)
 	c.Assert(err, IsNil)
@@ -798,7 +839,7 @@ func (s *S) TestIsDupCapped(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	info := &CollectionInfo{
 		ForceIdIndex: true,
@@ -822,7 +863,7 @@ func (s *S) TestIsDupFindAndModify(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndex(Index{Key: []string{"n"}, Unique: true})
 	c.Assert(err, IsNil)
@@ -841,7 +882,7 @@ func (s *S) TestFindAndModify(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"n": 42})
 
@@ -880,7 +921,7 @@ func (s *S) TestFindAndModify(c *C) {
 	c.Assert(info.UpsertedId, IsNil)
 
 	result = M{}
-	info, err = coll.find(M{"n": 52}).Select(M{"o": 1}).Apply(Change{Remove: true}, result)
+	info, err = coll.find(M{"n": 52}).selector(M{"o": 1}).Apply(Change{Remove: true}, result)
 	c.Assert(err, IsNil)
 	c.Assert(result["n"], IsNil)
 	c.Assert(result["o"], Equals, 52)
@@ -900,7 +941,7 @@ func (s *S) TestFindAndModifyBug997828(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"n": "not-a-number"})
 
@@ -928,7 +969,7 @@ func (s *S) TestCountCollection(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42}
 	for _, n := range ns {
@@ -946,7 +987,7 @@ func (s *S) TestCountQuery(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42}
 	for _, n := range ns {
@@ -964,7 +1005,7 @@ func (s *S) TestCountQuerySorted(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42}
 	for _, n := range ns {
@@ -982,7 +1023,7 @@ func (s *S) TestCountSkipLimit(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44}
 	for _, n := range ns {
@@ -1004,7 +1045,7 @@ func (s *S) TestQueryExplain(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42}
 	for _, n := range ns {
@@ -1035,11 +1076,11 @@ func (s *S) TestQueryHint(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.EnsureIndexKey("a")
 
 	m := M{}
-	err = coll.find(nil).Hint("a").Explain(m)
+	err = coll.find(nil).hint("a").Explain(m)
 	c.Assert(err, IsNil)
 	c.Assert(m["indexBounds"], NotNil)
 	c.Assert(m["indexBounds"].(M)["a"], NotNil)
@@ -1050,7 +1091,7 @@ func (s *S) TestFindOneNotFound(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	result := struct{ A, B int }{}
 	err = coll.Find(M{"a": 1}).One(&result)
@@ -1064,7 +1105,7 @@ func (s *S) TestFindNil(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"n": 1})
 	c.Assert(err, IsNil)
 
@@ -1080,7 +1121,7 @@ func (s *S) TestFindId(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"_id": 41, "n": 41})
 	c.Assert(err, IsNil)
 	err = coll.Insert(M{"_id": 42, "n": 42})
@@ -1098,7 +1139,7 @@ func (s *S) TestFindIterAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1109,7 +1150,7 @@ func (s *S) TestFindIterAll(c *C) {
 
 	ResetStats()
 
-	iter := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2).iter()
+	iter := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2).iter()
 	result := struct{ N int }{}
 	for i := 2; i < 7; i++ {
 		ok := iter.Next(&result)
@@ -1139,7 +1180,7 @@ func (s *S) TestFindIterTwiceWithSameQuery(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for i := 40; i != 47; i++ {
 		coll.Insert(M{"n": i})
@@ -1164,7 +1205,7 @@ func (s *S) TestFindIterWithoutResults(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"n": 42})
 
 	iter := coll.Find(M{"n": 0}).Iter()
@@ -1181,7 +1222,7 @@ func (s *S) TestFindIterLimit(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1222,7 +1263,7 @@ func (s *S) TestTooManyItemsLimitBug(c *C) {
 	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
 
 	SetDebug(false)
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	words := strings.Split("foo bar baz", " ")
 	for i := 0; i < 5; i++ {
 		words = append(words, words...)
@@ -1266,7 +1307,7 @@ func (s *S) TestFindIterLimitWithMore(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	// Insane amounts of logging otherwise due to the
 	// amount of data being shuffled.
@@ -1329,7 +1370,7 @@ func (s *S) TestFindIterLimitWithBatch(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1343,7 +1384,7 @@ func (s *S) TestFindIterLimitWithBatch(c *C) {
 
 	ResetStats()
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").limiter(3).Batch(2)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").limiter(3).batch(2)
 	iter := query.Iter()
 	result := struct{ N int }{}
 	for i := 2; i < 5; i++ {
@@ -1374,7 +1415,7 @@ func (s *S) TestFindIterSortWithBatch(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1392,7 +1433,7 @@ func (s *S) TestFindIterSortWithBatch(c *C) {
 
 	ResetStats()
 
-	query := coll.find(M{"n": M{"$lte": 44}}).sort("-n").Batch(2)
+	query := coll.find(M{"n": M{"$lte": 44}}).sort("-n").batch(2)
 	iter := query.Iter()
 	ns = []int{46, 45, 44, 43, 42, 41, 40}
 	result := struct{ N int }{}
@@ -1433,11 +1474,11 @@ func (s *S) TestFindTailTimeoutWithSleep(c *C) {
 
 	cresult := struct{ ErrMsg string }{}
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 	err = db.Run(bson.D{{"create", "mycoll"}, {"capped", true}, {"size", 1024}}, &cresult)
 	c.Assert(err, IsNil)
 	c.Assert(cresult.ErrMsg, Equals, "")
-	coll := db.C("mycoll")
+	coll := db.c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1450,8 +1491,8 @@ func (s *S) TestFindTailTimeoutWithSleep(c *C) {
 
 	timeout := 3 * time.Second
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2)
-	iter := query.Tail(timeout)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2)
+	iter := query.tail(timeout)
 
 	n := len(ns)
 	result := struct{ N int }{}
@@ -1475,9 +1516,9 @@ func (s *S) TestFindTailTimeoutWithSleep(c *C) {
 		// so this should force to sleep at least once by itself to
 		// respect the requested timeout.
 		time.Sleep(timeout + 5e8*time.Nanosecond)
-		session := session.New()
+		session := session.new()
 		defer session.Close()
-		coll := session.DB("mydb").C("mycoll")
+		coll := session.db("mydb").c("mycoll")
 		coll.Insert(M{"n": 47})
 	}()
 
@@ -1527,11 +1568,11 @@ func (s *S) TestFindTailTimeoutNoSleep(c *C) {
 
 	cresult := struct{ ErrMsg string }{}
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 	err = db.Run(bson.D{{"create", "mycoll"}, {"capped", true}, {"size", 1024}}, &cresult)
 	c.Assert(err, IsNil)
 	c.Assert(cresult.ErrMsg, Equals, "")
-	coll := db.C("mycoll")
+	coll := db.c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1544,8 +1585,8 @@ func (s *S) TestFindTailTimeoutNoSleep(c *C) {
 
 	timeout := 1 * time.Second
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2)
-	iter := query.Tail(timeout)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2)
+	iter := query.tail(timeout)
 
 	n := len(ns)
 	result := struct{ N int }{}
@@ -1568,9 +1609,9 @@ func (s *S) TestFindTailTimeoutNoSleep(c *C) {
 		// The internal AwaitData timing of MongoDB is around 2 seconds,
 		// so this item should arrive within the AwaitData threshold.
 		time.Sleep(5e8)
-		session := session.New()
+		session := session.new()
 		defer session.Close()
-		coll := session.DB("mydb").C("mycoll")
+		coll := session.db("mydb").c("mycoll")
 		coll.Insert(M{"n": 47})
 	}()
 
@@ -1624,11 +1665,11 @@ func (s *S) TestFindTailNoTimeout(c *C) {
 
 	cresult := struct{ ErrMsg string }{}
 
-	db := session.DB("mydb")
+	db := session.db("mydb")
 	err = db.Run(bson.D{{"create", "mycoll"}, {"capped", true}, {"size", 1024}}, &cresult)
 	c.Assert(err, IsNil)
 	c.Assert(cresult.ErrMsg, Equals, "")
-	coll := db.C("mycoll")
+	coll := db.c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1639,8 +1680,8 @@ func (s *S) TestFindTailNoTimeout(c *C) {
 
 	ResetStats()
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2)
-	iter := query.Tail(-1)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2)
+	iter := query.tail(-1)
 	c.Assert(err, IsNil)
 
 	n := len(ns)
@@ -1660,9 +1701,9 @@ func (s *S) TestFindTailNoTimeout(c *C) {
 	// The following call to Next will block.
 	go func() {
 		time.Sleep(5e8)
-		session := session.New()
+		session := session.new()
 		defer session.Close()
-		coll := session.DB("mydb").C("mycoll")
+		coll := session.db("mydb").c("mycoll")
 		coll.Insert(M{"n": 47})
 	}()
 
@@ -1717,7 +1758,7 @@ func (s *S) TestIterNextResetsResult(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{1, 2, 3}
 	for _, n := range ns {
@@ -1787,7 +1828,7 @@ func (s *S) TestFindForOnIter(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1798,7 +1839,7 @@ func (s *S) TestFindForOnIter(c *C) {
 
 	ResetStats()
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2)
 	iter := query.iter()
 
 	i := 2
@@ -1829,7 +1870,7 @@ func (s *S) TestFindFor(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1840,7 +1881,7 @@ func (s *S) TestFindFor(c *C) {
 
 	ResetStats()
 
-	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").Prefetch(0).Batch(2)
+	query := coll.find(M{"n": M{"$gte": 42}}).sort("$natural").prefetcher(0).batch(2)
 
 	i := 2
 	var result *struct{ N int }
@@ -1870,7 +1911,7 @@ func (s *S) TestFindForStopOnError(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -1897,7 +1938,7 @@ func (s *S) TestFindForResetsResult(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{1, 2, 3}
 	for _, n := range ns {
@@ -1972,7 +2013,7 @@ func (s *S) TestFindIterSnapshot(c *C) {
 	SetDebug(false)
 	defer SetDebug(true)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	var a [1024000]byte
 
@@ -1981,8 +2022,8 @@ func (s *S) TestFindIterSnapshot(c *C) {
 		c.Assert(err, IsNil)
 	}
 
-	query := coll.find(M{"n": M{"$gt": -1}}).Batch(2).Prefetch(0)
-	query.Snapshot()
+	query := coll.find(M{"n": M{"$gt": -1}}).batch(2).prefetcher(0)
+	query.snapshot()
 	iter := query.Iter()
 
 	seen := map[int]bool{}
@@ -2011,7 +2052,7 @@ func (s *S) TestSort(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	coll.Insert(M{"a": 1, "b": 1})
 	coll.Insert(M{"a": 2, "b": 2})
@@ -2046,7 +2087,7 @@ func (s *S) TestSortWithBadArgs(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	f1 := func() { coll.Find(nil).Sort("") }
 	f2 := func() { coll.Find(nil).Sort("+") }
@@ -2062,7 +2103,7 @@ func (s *S) TestPrefetching(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	SetDebug(false)
 	docs := make([]interface{}, 800)
@@ -2090,15 +2131,15 @@ func (s *S) TestPrefetching(c *C) {
 			beforeMore = 73
 
 		case 1: // Changing via query methods.
-			iter = coll.find(M{}).Prefetch(0.27).Batch(100).iter()
+			iter = coll.find(M{}).prefetcher(0.27).batch(100).iter()
 			beforeMore = 73
 
 		case 3: // With prefetch on first document.
-			iter = coll.find(M{}).Prefetch(1.0).Batch(100).iter()
+			iter = coll.find(M{}).prefetcher(1.0).batch(100).iter()
 			beforeMore = 0
 
 		case 4: // Without prefetch.
-			iter = coll.find(M{}).Prefetch(0).Batch(100).iter()
+			iter = coll.find(M{}).prefetcher(0).batch(100).iter()
 			beforeMore = 100
 		}
 
@@ -2219,7 +2260,7 @@ func (s *S) TestSafeSetting(c *C) {
 	c.Assert(safe.J, Equals, false)
 
 	// Changing the safety of a cloned session doesn't touch the original.
-	clone := session.Clone()
+	clone := session.clone()
 	defer clone.Close()
 	clone.EnsureSafe(&Safe{WMode: "foo"})
 	safe = session.Safe()
@@ -2231,7 +2272,7 @@ func (s *S) TestSafeInsert(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	// Insert an element with a predefined key.
 	err = coll.Insert(M{"_id": 1})
@@ -2265,7 +2306,7 @@ func (s *S) TestSafeParameters(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	// Tweak the safety parameters to something unachievable.
 	session.SetSafe(&Safe{W: 4, WTimeout: 100})
@@ -2282,13 +2323,13 @@ func (s *S) TestQueryErrorOne(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	result := struct {
 		Err string "$err"
 	}{}
 
-	err = coll.find(M{"a": 1}).Select(M{"a": M{"b": 1}}).One(&result)
+	err = coll.find(M{"a": 1}).selector(M{"a": M{"b": 1}}).One(&result)
 	c.Assert(err, ErrorMatches, ".*Unsupported projection option:.*")
 	c.Assert(err.(*QueryError).Message, Matches, ".*Unsupported projection option:.*")
 	if s.versionAtLeast(2, 6) {
@@ -2307,13 +2348,13 @@ func (s *S) TestQueryErrorNext(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	result := struct {
 		Err string "$err"
 	}{}
 
-	iter := coll.find(M{"a": 1}).Select(M{"a": M{"b": 1}}).iter()
+	iter := coll.find(M{"a": 1}).selector(M{"a": M{"b": 1}}).iter()
 
 	ok := iter.Next(&result)
 	c.Assert(ok, Equals, false)
@@ -2364,14 +2405,14 @@ func (s *S) TestEnsureIndex(c *C) {
 		Bits: 32,
 	}
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, index := range []Index{index1, index2, index3, index4} {
 		err = coll.EnsureIndex(index)
 		c.Assert(err, IsNil)
 	}
 
-	sysidx := session.DB("mydb").C("system.indexes")
+	sysidx := session.db("mydb").c("system.indexes")
 
 	result1 := M{}
 	err = sysidx.Find(M{"name": "a_1"}).One(result1)
@@ -2443,7 +2484,7 @@ func (s *S) TestEnsureIndexWithBadInfo(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndex(Index{})
 	c.Assert(err, ErrorMatches, "invalid index key:.*")
@@ -2459,7 +2500,7 @@ func (s *S) TestEnsureIndexWithUnsafeSession(c *C) {
 
 	session.SetSafe(nil)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"a": 1})
 	c.Assert(err, IsNil)
@@ -2482,7 +2523,7 @@ func (s *S) TestEnsureIndexKey(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndexKey("a")
 	c.Assert(err, IsNil)
@@ -2490,7 +2531,7 @@ func (s *S) TestEnsureIndexKey(c *C) {
 	err = coll.EnsureIndexKey("a", "-b")
 	c.Assert(err, IsNil)
 
-	sysidx := session.DB("mydb").C("system.indexes")
+	sysidx := session.db("mydb").c("system.indexes")
 
 	result1 := M{}
 	err = sysidx.Find(M{"name": "a_1"}).One(result1)
@@ -2522,7 +2563,7 @@ func (s *S) TestEnsureIndexDropIndex(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndexKey("a")
 	c.Assert(err, IsNil)
@@ -2533,7 +2574,7 @@ func (s *S) TestEnsureIndexDropIndex(c *C) {
 	err = coll.DropIndex("-b")
 	c.Assert(err, IsNil)
 
-	sysidx := session.DB("mydb").C("system.indexes")
+	sysidx := session.db("mydb").c("system.indexes")
 	dummy := &struct{}{}
 
 	err = sysidx.Find(M{"name": "a_1"}).One(dummy)
@@ -2557,7 +2598,7 @@ func (s *S) TestEnsureIndexCaching(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndexKey("a")
 	c.Assert(err, IsNil)
@@ -2598,7 +2639,7 @@ func (s *S) TestEnsureIndexGetIndexes(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.EnsureIndexKey("-b")
 	c.Assert(err, IsNil)
@@ -2632,7 +2673,7 @@ func (s *S) TestEnsureIndexEvalGetIndexes(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = session.Run(bson.D{{"eval", "db.getSiblingDB('mydb').mycoll.ensureIndex({b: -1})"}}, nil)
 	c.Assert(err, IsNil)
@@ -2666,7 +2707,7 @@ func (s *S) TestEnsureIndexExpireAfter(c *C) {
 
 	session.SetSafe(nil)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	err = coll.Insert(M{"n": 1, "t": time.Now().Add(-120 * time.Second)})
 	c.Assert(err, IsNil)
@@ -2712,7 +2753,7 @@ func (s *S) TestDistinct(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2730,7 +2771,7 @@ func (s *S) TestMapReduce(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2772,7 +2813,7 @@ func (s *S) TestMapReduceFinalize(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2803,7 +2844,7 @@ func (s *S) TestMapReduceToCollection(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2830,7 +2871,7 @@ func (s *S) TestMapReduceToCollection(c *C) {
 		Id    int "_id"
 		Value int
 	}
-	mr := session.DB("mydb").C("mr")
+	mr := session.db("mydb").c("mr")
 	iter := mr.Find(nil).Iter()
 	for iter.Next(&item) {
 		c.Logf("Item: %#v", &item)
@@ -2845,7 +2886,7 @@ func (s *S) TestMapReduceToOtherDb(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2872,7 +2913,7 @@ func (s *S) TestMapReduceToOtherDb(c *C) {
 		Id    int "_id"
 		Value int
 	}
-	mr := session.DB("otherdb").C("mr")
+	mr := session.db("otherdb").c("mr")
 	iter := mr.Find(nil).Iter()
 	for iter.Next(&item) {
 		c.Logf("Item: %#v", &item)
@@ -2887,7 +2928,7 @@ func (s *S) TestMapReduceOutOfOrder(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -2910,7 +2951,7 @@ func (s *S) TestMapReduceScope(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	coll.Insert(M{"n": 1})
 
@@ -2931,7 +2972,7 @@ func (s *S) TestMapReduceVerbose(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for i := 0; i < 100; i++ {
 		err = coll.Insert(M{"n": i})
@@ -2956,7 +2997,7 @@ func (s *S) TestMapReduceLimit(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for _, i := range []int{1, 4, 6, 2, 2, 3, 4} {
 		coll.Insert(M{"n": i})
@@ -3014,7 +3055,7 @@ func (s *S) TestZeroTimeRoundtrip(c *C) {
 	defer session.Close()
 
 	var d struct{ T time.Time }
-	conn := session.DB("mydb").C("mycoll")
+	conn := session.db("mydb").c("mycoll")
 	err = conn.Insert(d)
 	c.Assert(err, IsNil)
 
@@ -3031,7 +3072,7 @@ func (s *S) TestFsyncLock(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	clone := session.Clone()
+	clone := session.clone()
 	defer clone.Close()
 
 	err = session.FsyncLock()
@@ -3046,7 +3087,7 @@ func (s *S) TestFsyncLock(c *C) {
 		done <- now
 	}()
 
-	err = clone.DB("mydb").C("mycoll").Insert(bson.M{"n": 1})
+	err = clone.db("mydb").c("mycoll").Insert(bson.M{"n": 1})
 	unlocked := time.Now()
 	unlocking := <-done
 	c.Assert(err, IsNil)
@@ -3076,7 +3117,7 @@ func (s *S) TestPipeIter(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -3104,7 +3145,7 @@ func (s *S) TestPipeAll(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
@@ -3129,7 +3170,7 @@ func (s *S) TestPipeOne(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	coll.Insert(M{"a": 1, "b": 2})
 
 	result := struct{ A, B int }{}
@@ -3150,7 +3191,7 @@ func (s *S) TestBatch1Bug(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for i := 0; i < 3; i++ {
 		err := coll.Insert(M{"n": i})
@@ -3158,7 +3199,7 @@ func (s *S) TestBatch1Bug(c *C) {
 	}
 
 	var ns []struct{ N int }
-	err = coll.find(nil).Batch(1).All(&ns)
+	err = coll.find(nil).batch(1).All(&ns)
 	c.Assert(err, IsNil)
 	c.Assert(len(ns), Equals, 3)
 
@@ -3173,7 +3214,7 @@ func (s *S) TestInterfaceIterBug(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 
 	for i := 0; i < 3; i++ {
 		err := coll.Insert(M{"n": i})
@@ -3198,32 +3239,83 @@ func (s *S) TestFindIterCloseKillsCursor(c *C) {
 
 	cursors := serverCursorsOpen(session)
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
 		err = coll.Insert(M{"n": n})
 		c.Assert(err, IsNil)
 	}
 
-	iter := coll.find(nil).Batch(2).iter()
+	iter := coll.find(nil).batch(2).iter()
 	c.Assert(iter.Next(bson.M{}), Equals, true)
 
 	c.Assert(iter.Close(), IsNil)
 	c.Assert(serverCursorsOpen(session), Equals, cursors)
 }
 
+func (s *S) TestFindIterContextCancelKillsCursor(c *C) {
+	session, err := Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	cursors := serverCursorsOpen(session)
+
+	coll := session.db("mydb").c("mycoll")
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err = coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := coll.find(nil).batch(2).IterContext(ctx)
+	c.Assert(iter.Next(bson.M{}), Equals, true)
+	cancel()
+	c.Assert(iter.Next(bson.M{}), Equals, false)
+	c.Assert(iter.Err(), Equals, context.Canceled)
+	c.Assert(iter.Close(), Equals, context.Canceled)
+	c.Assert(serverCursorsOpen(session), Equals, cursors)
+}
+
+func (s *S) TestQueryContextDeadline(c *C) {
+	session, err := Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.db("mydb").c("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = coll.find(M{"$where": "sleep(2000) || true"}).OneContext(ctx, nil)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+
+	// The session remains usable.
+	n, err := coll.find(nil).CountContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	err = coll.InsertContext(ctx, M{"n": 2})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	err = session.db("mydb").RunContext(ctx, "ping", nil)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+}
+
 func (s *S) TestLogReplay(c *C) {
 	session, err := Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	for i := 0; i < 5; i++ {
 		err = coll.Insert(M{"ts": time.Now()})
 		c.Assert(err, IsNil)
 	}
 
-	iter := coll.find(nil).LogReplay().iter()
+	iter := coll.find(nil).logReplay().iter()
 	if s.versionAtLeast(2, 6) {
 		// This used to fail in 2.4. Now it's just a smoke test.
 		c.Assert(iter.Err(), IsNil)
@@ -3238,7 +3330,7 @@ func (s *S) TestSetCursorTimeout(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	coll := session.DB("mydb").C("mycoll")
+	coll := session.db("mydb").c("mycoll")
 	err = coll.Insert(M{"n": 42})
 
 	// This is just a smoke test. Won't wait 10 minutes for an actual timeout.
@@ -27,10 +27,12 @@
 package mgo
 
 import (
+	"context"
 	"errors"
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -52,6 +54,8 @@ type mongoSocket struct {
 	gotNonce      sync.Cond
 	dead          error
 	serverInfo    *mongoServerInfo
+	idleSince     time.Time // Guarded by the server lock.
+	handshaken    bool
 }
 
 type queryOpFlags uint32
@@ -77,6 +81,7 @@ type queryOp struct {
 	options    queryWrapper
 	hasOptions bool
 	serverTags []bson.D
+	readPref   *ReadPreference
 }
 
 type queryWrapper struct {
@@ -89,9 +94,14 @@ type queryWrapper struct {
 }
 
 func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
-	if op.flags&flagSlaveOk != 0 && len(op.serverTags) > 0 && socket.ServerInfo().Mongos {
-		op.hasOptions = true
-		op.options.ReadPreference = bson.D{{"mode", "secondaryPreferred"}, {"tags", op.serverTags}}
+	if op.flags&flagSlaveOk != 0 && socket.ServerInfo().Mongos {
+		if op.readPref != nil {
+			op.hasOptions = true
+			op.options.ReadPreference = readPrefDocument(op.readPref)
+		} else if len(op.serverTags) > 0 {
+			op.hasOptions = true
+			op.options.ReadPreference = bson.D{{"mode", "secondaryPreferred"}, {"tags", op.serverTags}}
+		}
 	}
 	if op.hasOptions {
 		if op.query == nil {
@@ -123,6 +133,7 @@ type replyOp struct {
 type insertOp struct {
 	collection string        // "database.collection"
 	documents  []interface{} // One or more documents to insert
+	flags      uint32
 }
 
 type updateOp struct {
@@ -145,6 +156,7 @@ type killCursorsOp struct {
 type requestInfo struct {
 	bufferPos int
 	replyFunc replyFunc
+	monitored *monitoredOp
 }
 
 func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongoSocket {
@@ -165,6 +177,16 @@ func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongo
 	return socket
 }
 
+// handshake returns true the first time it's called for the socket, when
+// the cluster must introduce the client to the server.
+func (socket *mongoSocket) handshake() bool {
+	socket.Lock()
+	first := !socket.handshaken
+	socket.handshaken = true
+	socket.Unlock()
+	return first
+}
+
 // Server returns the server that the socket is associated with.
 // It returns nil while the socket is cached in its respective server.
 func (socket *mongoSocket) Server() *mongoServer {
@@ -297,6 +319,7 @@ func (socket *mongoSocket) kill(err error, abend bool) {
 	socket.dead = err
 	socket.conn.Close()
 	stats.socketsAlive(-1)
+	stats.connClosed(socket.addr, abend)
 	replyFuncs := socket.replyFuncs
 	socket.replyFuncs = make(map[uint32]replyFunc)
 	server := socket.server
@@ -312,27 +335,57 @@ func (socket *mongoSocket) kill(err error, abend bool) {
 }
 
 func (socket *mongoSocket) SimpleQuery(op *queryOp) (data []byte, err error) {
-	var mutex sync.Mutex
-	var replyData []byte
-	var replyErr error
-	mutex.Lock()
-	op.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
-		replyData = docData
-		replyErr = err
-		mutex.Unlock()
-	}
-	err = socket.Query(op)
+	return socket.SimpleQueryContext(context.Background(), nil, op)
+}
+
+// SimpleQueryContext works like SimpleQuery, but stops waiting for the reply
+// and returns ctx.Err() once ctx is done. The reply is discarded when it
+// arrives, so the socket remains usable. The query is reported to monitor
+// if it's not nil.
+func (socket *mongoSocket) SimpleQueryContext(ctx context.Context, monitor CommandMonitor, op *queryOp) (data []byte, err error) {
+	reply := make(replyChan, 1)
+	op.replyFunc = func(err error, _ *replyOp, docNum int, docData []byte) {
+		reply.send(docData, err)
+	}
+	err = socket.MonitoredQuery(monitor, op)
 	if err != nil {
 		return nil, err
 	}
-	mutex.Lock() // Wait.
-	if replyErr != nil {
-		return nil, replyErr
+	return waitReply(ctx, reply)
+}
+
+type simpleReply struct {
+	data []byte
+	err  error
+}
+
+type replyChan chan simpleReply
+
+// send delivers a reply without ever blocking the socket's read loop,
+// since nobody is listening anymore once the waiter gave up.
+func (reply replyChan) send(data []byte, err error) {
+	select {
+	case reply <- simpleReply{data, err}:
+	default:
+	}
+}
+
+func waitReply(ctx context.Context, reply replyChan) ([]byte, error) {
+	select {
+	case r := <-reply:
+		return r.data, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return replyData, nil
 }
 
 func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
+	return socket.MonitoredQuery(nil, ops...)
+}
+
+// MonitoredQuery works like Query, but reports the operations sent to
+// monitor if it's not nil.
+func (socket *mongoSocket) MonitoredQuery(monitor CommandMonitor, ops ...interface{}) (err error) {
 
 	if lops := socket.flushLogout(); len(lops) > 0 {
 		ops = append(lops, ops...)
@@ -346,14 +399,21 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 	// ids at once later with the lock already held.
 	requests := make([]requestInfo, len(ops))
 	requestCount := 0
+	observe := observing()
+	write := ""
+	var monitored []*monitoredOp
 
 	for _, op := range ops {
 		Debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, op)
 		start := len(buf)
 		var replyFunc replyFunc
+		var opName string
+		var collection, cmdName string
 		switch op := op.(type) {
 
 		case *updateOp:
+			write = "update"
+			collection, cmdName = op.collection, "update"
 			buf = addHeader(buf, 2001)
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.collection)
@@ -370,8 +430,10 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			}
 
 		case *insertOp:
+			write = "insert"
+			collection, cmdName = op.collection, "insert"
 			buf = addHeader(buf, 2002)
-			buf = addInt32(buf, 0) // Reserved
+			buf = addInt32(buf, int32(op.flags))
 			buf = addCString(buf, op.collection)
 			for _, doc := range op.documents {
 				Debugf("Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, doc)
@@ -382,15 +444,29 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			}
 
 		case *queryOp:
+			switch {
+			case write != "":
+				// The getLastError following a write.
+				opName = write
+			case strings.HasSuffix(op.collection, ".$cmd"):
+				opName = "command"
+			default:
+				opName = "query"
+			}
 			buf = addHeader(buf, 2004)
 			buf = addInt32(buf, int32(op.flags))
 			buf = addCString(buf, op.collection)
 			buf = addInt32(buf, op.skip)
 			buf = addInt32(buf, op.limit)
+			docStart := len(buf)
 			buf, err = addBSON(buf, op.finalQuery(socket))
 			if err != nil {
 				return err
 			}
+			collection, cmdName = op.collection, "find"
+			if opName != "query" {
+				cmdName = commandName(buf[docStart:])
+			}
 			if op.selector != nil {
 				buf, err = addBSON(buf, op.selector)
 				if err != nil {
@@ -400,6 +476,8 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			replyFunc = op.replyFunc
 
 		case *getMoreOp:
+			opName = "getMore"
+			collection, cmdName = op.collection, "getMore"
 			buf = addHeader(buf, 2005)
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.collection)
@@ -408,6 +486,8 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			replyFunc = op.replyFunc
 
 		case *deleteOp:
+			write = "delete"
+			collection, cmdName = op.collection, "delete"
 			buf = addHeader(buf, 2006)
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.collection)
@@ -419,6 +499,7 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			}
 
 		case *killCursorsOp:
+			cmdName = "killCursors"
 			buf = addHeader(buf, 2007)
 			buf = addInt32(buf, 0) // Reserved
 			buf = addInt32(buf, int32(len(op.cursorIds)))
@@ -432,10 +513,23 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 
 		setInt32(buf, start, int32(len(buf)-start))
 
+		var m *monitoredOp
+		if monitor != nil {
+			m = newMonitoredOp(monitor, socket.addr, collection, cmdName)
+			monitored = append(monitored, m)
+		}
+
 		if replyFunc != nil {
+			if observe {
+				replyFunc = observeReply(socket.addr, opName, collection, replyFunc)
+			}
+			if m != nil {
+				replyFunc = m.wrap(collection, replyFunc)
+			}
 			request := &requests[requestCount]
 			request.replyFunc = replyFunc
 			request.bufferPos = start
+			request.monitored = m
 			requestCount++
 		}
 	}
@@ -447,6 +541,7 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		dead := socket.dead
 		socket.Unlock()
 		Debugf("Socket %p to %s: failing query, already closed: %s", socket, socket.addr, socket.dead.Error())
+		monitorSent(monitored, dead)
 		// XXX This seems necessary in case the session is closed concurrently
 		// with a query being performed, but it's not yet tested:
 		for i := 0; i != requestCount; i++ {
@@ -470,8 +565,15 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		request := &requests[i]
 		setInt32(buf, request.bufferPos+4, int32(requestId))
 		socket.replyFuncs[requestId] = request.replyFunc
+		if request.monitored != nil {
+			request.monitored.event.RequestId = int32(requestId)
+		}
 		requestId++
 	}
+	now := time.Now()
+	for _, m := range monitored {
+		m.start = now
+	}
 
 	Debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
 	stats.sentOps(len(ops))
@@ -482,9 +584,53 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		socket.updateDeadline(readDeadline)
 	}
 	socket.Unlock()
+	monitorSent(monitored, err)
 	return err
 }
 
+// replyQueryFailure is set in the flags of replies to failed queries.
+const replyQueryFailure = 2
+
+// observeReply returns a replyFunc that accounts for the latency of the
+// operation on collection when its reply arrives, and then calls replyFunc.
+func observeReply(server, op, collection string, replyFunc replyFunc) replyFunc {
+	start := time.Now()
+	var once sync.Once
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		once.Do(func() {
+			failed := err != nil || replyFailed(collection, reply, docNum, docData)
+			stats.opDone(server, op, time.Since(start), failed)
+		})
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// replyFailed returns whether the first document replied to an operation on
+// collection reports a failure. Besides failed queries, which are flagged
+// as such, that covers commands replying with ok: 0 and getLastError
+// replying with the error of the write it follows.
+func replyFailed(collection string, reply *replyOp, docNum int, docData []byte) bool {
+	if reply != nil && reply.flags&replyQueryFailure != 0 {
+		return true
+	}
+	if docNum != 0 || !strings.HasSuffix(collection, ".$cmd") {
+		return false
+	}
+	if checkQueryError(collection, docData) != nil {
+		return true
+	}
+	var result struct {
+		Ok                float64
+		Err               string
+		WriteErrors       []bson.Raw "writeErrors"
+		WriteConcernError *bson.Raw  "writeConcernError"
+	}
+	if err := bson.Unmarshal(docData, &result); err != nil {
+		return true
+	}
+	return result.Ok == 0 || result.Err != "" || len(result.WriteErrors) > 0 || result.WriteConcernError != nil
+}
+
 func fill(r net.Conn, b []byte) error {
 	l := len(b)
 	n, err := r.Read(b)
@@ -572,7 +718,7 @@ func (socket *mongoSocket) readLoop() {
 					return
 				}
 
-				if GetDebug() && GetLogger() != nil {
+				if Enabled(DebugLevel) {
 					m := bson.M{}
 					if err := bson.Unmarshal(b, m); err == nil {
 						Debugf("Socket %p to %s: received document: %#v", socket, socket.addr, m)
@@ -0,0 +1,282 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "labix.org/v2/base/log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the DNS records used to find the servers of a cluster
+// named by DialInfo.SRVName. It's satisfied by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// srvPollInterval is how often the SRV records are looked up again by
+// default to notice servers being added to or removed from the cluster.
+const srvPollInterval = 60 * time.Second
+
+// srvLookupTimeout bounds each lookup of the DNS records of a cluster.
+const srvLookupTimeout = 10 * time.Second
+
+// srvSeeds holds what's needed for the cluster to poll the SRV records
+// its seeds came from.
+type srvSeeds struct {
+	name     string
+	resolver Resolver
+	interval time.Duration
+	polled   time.Time
+}
+
+// resolveSRV returns a copy of info with the seed servers found in the
+// SRV records for info.SRVName, and with the options in its TXT record
+// applied where info doesn't define them already, along with what's
+// needed to poll the SRV records later.
+func (info *DialInfo) resolveSRV() (*DialInfo, *srvSeeds, error) {
+	if info.Direct {
+		return nil, nil, errors.New("direct connections can't be used with SRV records")
+	}
+	srv := &srvSeeds{
+		name:     info.SRVName,
+		resolver: info.Resolver,
+		interval: info.SRVPollInterval,
+		polled:   time.Now(),
+	}
+	if srv.resolver == nil {
+		srv.resolver = net.DefaultResolver
+	}
+	if srv.interval <= 0 {
+		srv.interval = srvPollInterval
+	}
+	addrs, err := lookupSRV(srv.resolver, srv.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	records, err := srv.resolver.LookupTXT(ctx, srv.name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, nil, err
+		}
+		records = nil
+	}
+	if len(records) > 1 {
+		return nil, nil, errors.New("found multiple TXT records for " + srv.name)
+	}
+
+	resolved := *info
+	resolved.Addrs = addrs
+	if len(records) == 1 {
+		for _, pair := range strings.FieldsFunc(records[0], isOptSep) {
+			l := strings.SplitN(pair, "=", 2)
+			if len(l) != 2 || l[0] == "" || l[1] == "" {
+				return nil, nil, errors.New("TXT record option must be key=value: " + pair)
+			}
+			value, err := url.PathUnescape(l[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot unescape TXT record option value: %q", pair)
+			}
+			// Only these options may be provided via DNS, and the
+			// ones set explicitly take precedence.
+			switch strings.ToLower(l[0]) {
+			case "authsource":
+				if resolved.Source == "" {
+					resolved.Source = value
+				}
+			case "replicaset":
+				if resolved.ReplicaSetName == "" {
+					resolved.ReplicaSetName = value
+				}
+			default:
+				return nil, nil, errors.New("unsupported TXT record option: " + pair)
+			}
+		}
+	}
+	return &resolved, srv, nil
+}
+
+// lookupSRV returns the addresses of the servers listed in the SRV records
+// for name. The servers must be in the parent domain of name, which must
+// have at least three labels.
+func lookupSRV(resolver Resolver, name string) ([]string, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if len(labels) < 3 {
+		return nil, errors.New("SRV name must have at least three labels: " + name)
+	}
+	domain := "." + strings.ToLower(strings.Join(labels[1:], "."))
+
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	_, records, err := resolver.LookupSRV(ctx, "mongodb", "tcp", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no SRV records found for " + name)
+	}
+	addrs := make([]string, len(records))
+	for i, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if !strings.HasSuffix(strings.ToLower(target), domain) {
+			return nil, fmt.Errorf("SRV record for %s points outside of its domain: %s", name, target)
+		}
+		addrs[i] = net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+	}
+	return addrs, nil
+}
+
+// pollSRV looks up the SRV records of the cluster again once its poll
+// interval has passed, so that servers added to them are synchronized
+// and servers removed from them are dropped. The current seeds are kept
+// if the lookup fails.
+//
+// Only mongos routers are found this way. Replica sets and standalone
+// servers report their own peers, so polling stops as soon as a server
+// other than a mongos is known.
+func (cluster *mongoCluster) pollSRV() {
+	srv := cluster.srv
+	if srv == nil || time.Since(srv.polled) < srv.interval {
+		return
+	}
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	for _, server := range servers {
+		if !server.Info().Mongos {
+			Log("SYNC ", server.Addr, " isn't a mongos; no longer polling SRV records for ", srv.name)
+			cluster.srv = nil
+			return
+		}
+	}
+	srv.polled = time.Now()
+	addrs, err := lookupSRV(srv.resolver, srv.name)
+	if err != nil {
+		Log("SYNC Failed to look up SRV records for ", srv.name, ": ", err.Error())
+		return
+	}
+
+	listed := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		listed[addr] = true
+	}
+	cluster.Lock()
+	dropped := make(map[string]bool)
+	for _, addr := range cluster.userSeeds {
+		if !listed[addr] {
+			dropped[addr] = true
+		}
+	}
+	cluster.userSeeds = addrs
+	dynaSeeds := cluster.dynaSeeds[:0]
+	for _, addr := range cluster.dynaSeeds {
+		if !dropped[addr] {
+			dynaSeeds = append(dynaSeeds, addr)
+		}
+	}
+	cluster.dynaSeeds = dynaSeeds
+	servers = nil
+	for _, server := range cluster.servers.Slice() {
+		if dropped[server.Addr] && server.Info().Mongos {
+			servers = append(servers, server)
+		}
+	}
+	cluster.Unlock()
+
+	if len(dropped) > 0 {
+		Debugf("SYNC SRV records for %s dropped seeds %v", srv.name, dropped)
+	}
+	for _, server := range servers {
+		cluster.removeServer(server)
+	}
+}
+
+// pollSRVTimer returns a channel that fires when the SRV records of the
+// cluster are due to be looked up again, or nil if the cluster seeds
+// didn't come from SRV records.
+func (cluster *mongoCluster) pollSRVTimer() <-chan time.Time {
+	if cluster.srv == nil {
+		return nil
+	}
+	return time.After(time.Until(cluster.srv.polled.Add(cluster.srv.interval)))
+}
+
+// resolveAddr resolves addr into a TCP address, using the resolver of the
+// cluster if one was provided.
+func (cluster *mongoCluster) resolveAddr(addr string) (*net.TCPAddr, error) {
+	if cluster.resolver == nil {
+		return resolveAddr(addr)
+	}
+	tcpaddr, err := lookupAddr(cluster.resolver, addr)
+	if err != nil {
+		Log("SYNC Failed to resolve ", addr, ": ", err.Error())
+		return nil, err
+	}
+	if tcpaddr.String() != addr {
+		Debug("SYNC Address ", addr, " resolved as ", tcpaddr.String())
+	}
+	return tcpaddr, nil
+}
+
+// lookupAddr resolves addr into a TCP address using resolver, preferring
+// IPv4 addresses as net.ResolveTCPAddr does.
+func lookupAddr(resolver Resolver, addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	hosts, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	for _, h := range hosts {
+		if hip := net.ParseIP(h); hip != nil && (ip == nil || ip.To4() == nil && hip.To4() != nil) {
+			ip = hip
+		}
+	}
+	if ip == nil {
+		return nil, errors.New("no addresses found for " + host)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
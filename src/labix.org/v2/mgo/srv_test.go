@@ -0,0 +1,165 @@
+package mgo
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"net"
+	"regexp"
+)
+
+type SRVSuite struct{}
+
+var _ = Suite(SRVSuite{})
+
+// fakeResolver answers lookups from its maps, as if it was DNS.
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	txt   map[string][]string
+	hosts map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := "_" + service + "._" + proto + "." + name
+	if records, ok := r.srv[name]; ok {
+		return cname, records, nil
+	}
+	return "", nil, notFound(cname)
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+func (SRVSuite) TestResolveSRV(c *C) {
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"db.example.com": {
+				{Target: "db1.example.com.", Port: 27017},
+				{Target: "DB2.Example.com", Port: 27018},
+			},
+		},
+		txt: map[string][]string{
+			"db.example.com": {"authSource=other%20db&replicaSet=rs0"},
+		},
+	}
+	info := &DialInfo{SRVName: "db.example.com", Resolver: resolver, Addrs: []string{"ignored"}}
+	resolved, srv, err := info.resolveSRV()
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Addrs, DeepEquals, []string{"db1.example.com:27017", "DB2.Example.com:27018"})
+	c.Assert(resolved.Source, Equals, "other db")
+	c.Assert(resolved.ReplicaSetName, Equals, "rs0")
+	c.Assert(info.Addrs, DeepEquals, []string{"ignored"})
+	c.Assert(srv.name, Equals, "db.example.com")
+	c.Assert(srv.interval, Equals, srvPollInterval)
+
+	// Explicit options take precedence over the TXT record.
+	info = &DialInfo{SRVName: "db.example.com", Resolver: resolver, Source: "admin", ReplicaSetName: "rs1"}
+	resolved, _, err = info.resolveSRV()
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Source, Equals, "admin")
+	c.Assert(resolved.ReplicaSetName, Equals, "rs1")
+
+	// The TXT record is optional.
+	delete(resolver.txt, "db.example.com")
+	info = &DialInfo{SRVName: "db.example.com", Resolver: resolver}
+	resolved, _, err = info.resolveSRV()
+	c.Assert(err, IsNil)
+	c.Assert(resolved.Addrs, HasLen, 2)
+	c.Assert(resolved.Source, Equals, "")
+}
+
+var resolveSRVErrorTests = []struct {
+	name    string
+	direct  bool
+	targets []string
+	txt     []string
+	error   string
+}{{
+	name:  "example.com",
+	error: "SRV name must have at least three labels: example.com",
+}, {
+	name:  "db.example.com",
+	error: "lookup _mongodb._tcp.db.example.com: no such host",
+}, {
+	name:    "db.example.com",
+	targets: []string{},
+	error:   "no SRV records found for db.example.com",
+}, {
+	name:    "db.example.com",
+	targets: []string{"db1.example.com", "db2.notexample.com"},
+	error:   "SRV record for db.example.com points outside of its domain: db2.notexample.com",
+}, {
+	name:    "db.example.com",
+	targets: []string{"example.com"},
+	error:   "SRV record for db.example.com points outside of its domain: example.com",
+}, {
+	name:    "db.example.com",
+	targets: []string{"db1.example.com"},
+	txt:     []string{"replicaSet=rs0", "authSource=admin"},
+	error:   "found multiple TXT records for db.example.com",
+}, {
+	name:    "db.example.com",
+	targets: []string{"db1.example.com"},
+	txt:     []string{"ssl=false"},
+	error:   "unsupported TXT record option: ssl=false",
+}, {
+	name:    "db.example.com",
+	targets: []string{"db1.example.com"},
+	txt:     []string{"replicaSet"},
+	error:   "TXT record option must be key=value: replicaSet",
+}, {
+	name:    "db.example.com",
+	direct:  true,
+	targets: []string{"db1.example.com"},
+	error:   "direct connections can't be used with SRV records",
+}}
+
+func (SRVSuite) TestResolveSRVErrors(c *C) {
+	for _, test := range resolveSRVErrorTests {
+		c.Logf("Test: %#v", test)
+		resolver := &fakeResolver{srv: map[string][]*net.SRV{}, txt: map[string][]string{}}
+		if test.targets != nil {
+			records := []*net.SRV{}
+			for _, target := range test.targets {
+				records = append(records, &net.SRV{Target: target, Port: 27017})
+			}
+			resolver.srv[test.name] = records
+		}
+		if test.txt != nil {
+			resolver.txt[test.name] = test.txt
+		}
+		info := &DialInfo{SRVName: test.name, Direct: test.direct, Resolver: resolver}
+		resolved, _, err := info.resolveSRV()
+		c.Assert(err, ErrorMatches, regexp.QuoteMeta(test.error))
+		c.Assert(resolved, IsNil)
+	}
+}
+
+func (SRVSuite) TestLookupAddr(c *C) {
+	resolver := &fakeResolver{hosts: map[string][]string{
+		"db1.example.com": {"::1", "127.0.0.2", "127.0.0.3"},
+		"db2.example.com": {"::1"},
+	}}
+	addr, err := lookupAddr(resolver, "db1.example.com:27017")
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "127.0.0.2:27017")
+	addr, err = lookupAddr(resolver, "db2.example.com:27018")
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "[::1]:27018")
+	_, err = lookupAddr(resolver, "db3.example.com:27017")
+	c.Assert(err, ErrorMatches, "lookup db3.example.com: no such host")
+}
@@ -27,12 +27,23 @@
 package mgo
 
 import (
+	"expvar"
+	"fmt"
+	"io"
 	. "labix.org/v2/base/log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var stats *Stats
 var statsMutex sync.Mutex
+var statsExporter StatsExporter
+
+// statsObserved is 1 while stats or statsExporter are set, so operations
+// may check it without taking statsMutex. See observing.
+var statsObserved int32
 
 func SetStats(enabled bool) {
 	statsMutex.Lock()
@@ -43,12 +54,28 @@ func SetStats(enabled bool) {
 	} else {
 		stats = nil
 	}
+	updateObserving()
 	statsMutex.Unlock()
 }
 
+// GetStats returns a snapshot of the statistics collected since SetStats
+// enabled them or ResetStats reset them, or zero values if disabled.
 func GetStats() (snapshot Stats) {
 	statsMutex.Lock()
-	snapshot = *stats
+	if stats != nil {
+		snapshot = *stats
+		snapshot.Ops = make(map[string]*OpStats, len(stats.Ops))
+		for name, op := range stats.Ops {
+			opCopy := *op
+			opCopy.Latency.Counts = append([]int(nil), op.Latency.Counts...)
+			snapshot.Ops[name] = &opCopy
+		}
+		snapshot.Servers = make(map[string]*ServerStats, len(stats.Servers))
+		for addr, server := range stats.Servers {
+			serverCopy := *server
+			snapshot.Servers[addr] = &serverCopy
+		}
+	}
 	statsMutex.Unlock()
 	return
 }
@@ -63,6 +90,11 @@ func ResetStats() {
 	stats.SocketsInUse = old.SocketsInUse
 	stats.SocketsAlive = old.SocketsAlive
 	stats.SocketRefs = old.SocketRefs
+	stats.PoolWaiting = old.PoolWaiting
+	for addr, server := range old.Servers {
+		stats.server(addr).Conns = server.Conns
+		stats.server(addr).PingRTT = server.PingRTT
+	}
 	statsMutex.Unlock()
 	return
 }
@@ -77,6 +109,188 @@ type Stats struct {
 	SocketsAlive int
 	SocketsInUse int
 	SocketRefs   int
+	PoolWaiting  int
+	PoolTimeouts int
+	PoolReaped   int
+
+	// Ops holds statistics for each kind of operation: "query", "getMore",
+	// "command", "insert", "update" and "delete". Only operations that get
+	// a reply are accounted for, which excludes writes done without safety
+	// (see SetSafe).
+	Ops map[string]*OpStats
+
+	// Servers holds statistics for each server, by address.
+	Servers map[string]*ServerStats
+}
+
+// OpStats holds statistics for a kind of operation.
+type OpStats struct {
+	Count   int
+	Errors  int // Operations that failed to get a reply or got a query failure.
+	Latency Histogram
+}
+
+// ServerStats holds statistics for a server.
+type ServerStats struct {
+	Conns   int // Connections currently alive.
+	Ops     int
+	Errors  int // Failed operations and connections closed due to errors.
+	PingRTT time.Duration
+}
+
+// LatencyBuckets holds the upper bounds of the buckets of the latency
+// histograms in Stats.
+var LatencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram counts durations by the LatencyBuckets they fall in. Counts[i]
+// holds the durations over the previous bound and up to LatencyBuckets[i],
+// and its last element those over all bounds.
+type Histogram struct {
+	Counts []int
+	Count  int
+	Sum    time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(LatencyBuckets)+1)
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// StatsExporter receives measurements as they're taken, so they can be fed
+// into monitoring systems without polling GetStats. Its methods are called
+// synchronously by the driver and must return quickly.
+type StatsExporter interface {
+	// OpDone reports that an operation of the given kind got a reply from
+	// server after latency, or failed.
+	OpDone(server, op string, latency time.Duration, failed bool)
+
+	// ConnOpened and ConnClosed report connections to server being
+	// established and closed, either explicitly or due to an error.
+	ConnOpened(server string)
+	ConnClosed(server string, failed bool)
+
+	// Pinged reports the round trip time of a ping to server.
+	Pinged(server string, rtt time.Duration)
+}
+
+// SetStatsExporter makes the driver report measurements to exporter, or stop
+// reporting them if exporter is nil. Reporting is independent from the
+// statistics enabled with SetStats.
+func SetStatsExporter(exporter StatsExporter) {
+	statsMutex.Lock()
+	statsExporter = exporter
+	updateObserving()
+	statsMutex.Unlock()
+}
+
+// PublishStats publishes the statistics returned by GetStats as an expvar
+// variable with the given name.
+func PublishStats(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return GetStats() }))
+}
+
+// WriteText writes the statistics in the Prometheus text exposition format,
+// with metric names prefixed by "mgo_".
+func (stats *Stats) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	for _, m := range []struct {
+		name, kind string
+		value      int
+	}{
+		{"clusters", "gauge", stats.Clusters},
+		{"master_conns", "counter", stats.MasterConns},
+		{"slave_conns", "counter", stats.SlaveConns},
+		{"sent_ops", "counter", stats.SentOps},
+		{"received_ops", "counter", stats.ReceivedOps},
+		{"received_docs", "counter", stats.ReceivedDocs},
+		{"sockets_alive", "gauge", stats.SocketsAlive},
+		{"sockets_in_use", "gauge", stats.SocketsInUse},
+		{"socket_refs", "gauge", stats.SocketRefs},
+		{"pool_waiting", "gauge", stats.PoolWaiting},
+		{"pool_timeouts", "counter", stats.PoolTimeouts},
+		{"pool_reaped", "counter", stats.PoolReaped},
+	} {
+		ew.printf("# TYPE mgo_%s %s\nmgo_%s %d\n", m.name, m.kind, m.name, m.value)
+	}
+
+	ops := make([]string, 0, len(stats.Ops))
+	for name := range stats.Ops {
+		ops = append(ops, name)
+	}
+	sort.Strings(ops)
+	ew.printf("# TYPE mgo_ops counter\n")
+	for _, name := range ops {
+		ew.printf("mgo_ops{op=%q} %d\n", name, stats.Ops[name].Count)
+	}
+	ew.printf("# TYPE mgo_op_errors counter\n")
+	for _, name := range ops {
+		ew.printf("mgo_op_errors{op=%q} %d\n", name, stats.Ops[name].Errors)
+	}
+	ew.printf("# TYPE mgo_op_latency_seconds histogram\n")
+	for _, name := range ops {
+		h := &stats.Ops[name].Latency
+		n := 0
+		for i, bound := range LatencyBuckets {
+			if h.Counts != nil {
+				n += h.Counts[i]
+			}
+			ew.printf("mgo_op_latency_seconds_bucket{op=%q,le=\"%g\"} %d\n", name, bound.Seconds(), n)
+		}
+		ew.printf("mgo_op_latency_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", name, h.Count)
+		ew.printf("mgo_op_latency_seconds_sum{op=%q} %g\n", name, h.Sum.Seconds())
+		ew.printf("mgo_op_latency_seconds_count{op=%q} %d\n", name, h.Count)
+	}
+
+	servers := make([]string, 0, len(stats.Servers))
+	for addr := range stats.Servers {
+		servers = append(servers, addr)
+	}
+	sort.Strings(servers)
+	for _, m := range []struct {
+		name, kind string
+		value      func(s *ServerStats) interface{}
+	}{
+		{"server_conns", "gauge", func(s *ServerStats) interface{} { return s.Conns }},
+		{"server_ops", "counter", func(s *ServerStats) interface{} { return s.Ops }},
+		{"server_errors", "counter", func(s *ServerStats) interface{} { return s.Errors }},
+		{"server_ping_seconds", "gauge", func(s *ServerStats) interface{} { return s.PingRTT.Seconds() }},
+	} {
+		ew.printf("# TYPE mgo_%s %s\n", m.name, m.kind)
+		for _, addr := range servers {
+			ew.printf("mgo_%s{server=%q} %v\n", m.name, addr, m.value(stats.Servers[addr]))
+		}
+	}
+	return ew.err
+}
+
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
 }
 
 func (stats *Stats) cluster(delta int) {
@@ -146,3 +360,124 @@ func (stats *Stats) socketRefs(delta int) {
 		statsMutex.Unlock()
 	}
 }
+
+func (stats *Stats) poolWaiting(delta int) {
+	if stats != nil {
+		statsMutex.Lock()
+		stats.PoolWaiting += delta
+		statsMutex.Unlock()
+	}
+}
+
+func (stats *Stats) poolTimeouts(delta int) {
+	if stats != nil {
+		statsMutex.Lock()
+		stats.PoolTimeouts += delta
+		statsMutex.Unlock()
+	}
+}
+
+func (stats *Stats) poolReaped(delta int) {
+	if stats != nil {
+		statsMutex.Lock()
+		stats.PoolReaped += delta
+		statsMutex.Unlock()
+	}
+}
+
+// server returns the statistics for the server at addr, creating them if
+// necessary. Must be called with statsMutex held.
+func (stats *Stats) server(addr string) *ServerStats {
+	server := stats.Servers[addr]
+	if server == nil {
+		if stats.Servers == nil {
+			stats.Servers = make(map[string]*ServerStats)
+		}
+		server = &ServerStats{}
+		stats.Servers[addr] = server
+	}
+	return server
+}
+
+func (stats *Stats) opDone(server, op string, latency time.Duration, failed bool) {
+	statsMutex.Lock()
+	exporter := statsExporter
+	if stats != nil {
+		opStats := stats.Ops[op]
+		if opStats == nil {
+			if stats.Ops == nil {
+				stats.Ops = make(map[string]*OpStats)
+			}
+			opStats = &OpStats{}
+			stats.Ops[op] = opStats
+		}
+		opStats.Count++
+		opStats.Latency.observe(latency)
+		serverStats := stats.server(server)
+		serverStats.Ops++
+		if failed {
+			opStats.Errors++
+			serverStats.Errors++
+		}
+	}
+	statsMutex.Unlock()
+	if exporter != nil {
+		exporter.OpDone(server, op, latency, failed)
+	}
+}
+
+func (stats *Stats) connOpened(server string) {
+	statsMutex.Lock()
+	exporter := statsExporter
+	if stats != nil {
+		stats.server(server).Conns++
+	}
+	statsMutex.Unlock()
+	if exporter != nil {
+		exporter.ConnOpened(server)
+	}
+}
+
+func (stats *Stats) connClosed(server string, failed bool) {
+	statsMutex.Lock()
+	exporter := statsExporter
+	if stats != nil {
+		serverStats := stats.server(server)
+		serverStats.Conns--
+		if failed {
+			serverStats.Errors++
+		}
+	}
+	statsMutex.Unlock()
+	if exporter != nil {
+		exporter.ConnClosed(server, failed)
+	}
+}
+
+func (stats *Stats) pinged(server string, rtt time.Duration) {
+	statsMutex.Lock()
+	exporter := statsExporter
+	if stats != nil {
+		stats.server(server).PingRTT = rtt
+	}
+	statsMutex.Unlock()
+	if exporter != nil {
+		exporter.Pinged(server, rtt)
+	}
+}
+
+// observing returns whether operations must be measured, either for the
+// statistics or for an exporter.
+func observing() bool {
+	return atomic.LoadInt32(&statsObserved) != 0
+}
+
+// updateObserving records whether operations must be measured after stats
+// or statsExporter changed. Must be called with statsMutex held.
+func updateObserving() {
+	var observed int32
+	if stats != nil || statsExporter != nil {
+		observed = 1
+	}
+	atomic.StoreInt32(&statsObserved, observed)
+}
@@ -3,6 +3,7 @@ package txn
 import (
 	"bytes"
 	"fmt"
+	"labix.org/v2/base/log"
 	"labix.org/v2/mgo/bson"
 	"sort"
 	"sync/atomic"
@@ -10,21 +11,47 @@ import (
 
 var (
 	debugEnabled bool
-	logger       log_Logger
+	output       log_Logger
+	logger       log.Logger
 )
 
 type log_Logger interface {
 	Output(calldepth int, s string) error
 }
 
-// Specify the *log.Logger where logged messages should be sent to.
+// Specify the *log.Logger where logged messages should be sent to,
+// unless the runner logging them has a logger set with Runner.SetLogger.
 func SetLogger(l log_Logger) {
-	logger = l
+	output = l
+	adaptLogger()
 }
 
 // SetDebug enables or disables debugging.
 func SetDebug(debug bool) {
 	debugEnabled = debug
+	adaptLogger()
+}
+
+func adaptLogger() {
+	logger = nil
+	if output != nil {
+		logger = log.Adapt(output, debugEnabled)
+	}
+}
+
+// SetLogger sets the logger that receives the messages logged while running
+// transactions with r, instead of the one set with the SetLogger function.
+// Debug messages are sent to it if it has them enabled, regardless of
+// SetDebug.
+func (r *Runner) SetLogger(logger log.Logger) {
+	r.logger = logger
+}
+
+func (r *Runner) log() log.Logger {
+	if r.logger != nil {
+		return r.logger
+	}
+	return logger
 }
 
 var ErrChaos = fmt.Errorf("interrupted by chaos")
@@ -44,15 +71,15 @@ func debugPrefix() string {
 	return string(s)
 }
 
-func logf(format string, args ...interface{}) {
-	if logger != nil {
-		logger.Output(2, fmt.Sprintf(format, argsForLog(args)...))
+func (r *Runner) logf(level log.Level, format string, args ...interface{}) {
+	if l := r.log(); l != nil && l.Enabled(level) {
+		l.Log(level, fmt.Sprintf(format, argsForLog(args)...))
 	}
 }
 
-func debugf(format string, args ...interface{}) {
-	if debugEnabled && logger != nil {
-		logger.Output(2, fmt.Sprintf(format, argsForLog(args)...))
+func (r *Runner) debugf(format string, args ...interface{}) {
+	if l := r.log(); l != nil && l.Enabled(log.DebugLevel) {
+		l.Log(log.DebugLevel, fmt.Sprintf(format, argsForLog(args)...))
 	}
 }
 
@@ -989,8 +989,5 @@ func hasToken(tokens []token, tt token) bool {
 }
 
 func (f *flusher) debugf(format string, args ...interface{}) {
-	if !debugEnabled {
-		return
-	}
-	debugf(f.debugId+format, args...)
+	f.Runner.debugf(f.debugId+format, args...)
 }
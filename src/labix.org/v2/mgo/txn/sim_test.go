@@ -177,11 +177,11 @@ func simulate(c *C, params params) {
 	defer session.Close()
 
 	db := session.DB("test")
-	tc := db.C("tc")
+	tc := db.C("tc").(*mgo.Collection)
 
 	runner := txn.NewRunner(tc)
 
-	tclog := db.C("tc.log")
+	tclog := db.C("tc.log").(*mgo.Collection)
 	if params.changelog {
 		info := mgo.CollectionInfo{
 			Capped: true,
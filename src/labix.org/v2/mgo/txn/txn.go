@@ -9,6 +9,7 @@ package txn
 import (
 	"encoding/binary"
 	"fmt"
+	"labix.org/v2/base/log"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"reflect"
@@ -217,6 +218,8 @@ type Runner struct {
 	tc *mgo.Collection // txns
 	sc *mgo.Collection // stash
 	lc *mgo.Collection // log
+
+	logger log.Logger
 }
 
 // NewRunner returns a new transaction runner that uses tc to hold its
@@ -230,7 +233,7 @@ type Runner struct {
 // will be used for implementing the transactional behavior of insert
 // and remove operations.
 func NewRunner(tc *mgo.Collection) *Runner {
-	return &Runner{tc, tc.Database.C(tc.Name + ".stash"), nil}
+	return &Runner{tc, tc.Database.C(tc.Name + ".stash").(*mgo.Collection), nil, nil}
 }
 
 var ErrAborted = fmt.Errorf("transaction aborted")
@@ -313,14 +316,14 @@ func (r *Runner) Run(ops []Op, id bson.ObjectId, info interface{}) (err error) {
 // ResumeAll resumes all pending transactions. All ErrAborted errors
 // from individual transactions are ignored.
 func (r *Runner) ResumeAll() (err error) {
-	debugf("Resuming all unfinished transactions")
+	r.debugf("Resuming all unfinished transactions")
 	iter := r.tc.Find(bson.D{{"s", bson.D{{"$in", []state{tpreparing, tprepared, tapplying}}}}}).Iter()
 	var t transaction
 	for iter.Next(&t) {
 		if t.State == tapplied || t.State == taborted {
 			continue
 		}
-		debugf("Resuming %s from %q", t.Id, t.State)
+		r.debugf("Resuming %s from %q", t.Id, t.State)
 		if err := flush(r, &t); err != nil {
 			return err
 		}
@@ -340,7 +343,7 @@ func (r *Runner) Resume(id bson.ObjectId) (err error) {
 		return err
 	}
 	if !t.done() {
-		debugf("Resuming %s from %q", t, t.State)
+		r.debugf("Resuming %s from %q", t, t.State)
 		if err := flush(r, t); err != nil {
 			return err
 		}
@@ -397,7 +400,7 @@ func (r *Runner) PurgeMissing(collections ...string) error {
 
 	sort.Strings(collections)
 	for _, collection := range collections {
-		c := r.tc.Database.C(collection)
+		c := r.tc.Database.C(collection).(*mgo.Collection)
 		iter := c.Pipe(pipeline).Iter()
 		var tref TRef
 		for iter.Next(&tref) {
@@ -409,7 +412,7 @@ func (r *Runner) PurgeMissing(collections ...string) error {
 				found[txnId] = true
 				continue
 			}
-			logf("WARNING: purging from document %s/%v the missing transaction id %s", collection, tref.DocId, txnId)
+			r.logf(log.WarnLevel, "WARNING: purging from document %s/%v the missing transaction id %s", collection, tref.DocId, txnId)
 			err := c.UpdateId(tref.DocId, M{"$pull": M{"txn-queue": M{"$regex": "^" + txnId.Hex() + "_*"}}})
 			if err != nil {
 				return fmt.Errorf("error purging missing transaction %s: %v", txnId.Hex(), err)
@@ -434,7 +437,7 @@ func (r *Runner) PurgeMissing(collections ...string) error {
 			found[txnId] = true
 			continue
 		}
-		logf("WARNING: purging from stash document %s/%v the missing transaction id %s", stref.Id.C, stref.Id.Id, txnId)
+		r.logf(log.WarnLevel, "WARNING: purging from stash document %s/%v the missing transaction id %s", stref.Id.C, stref.Id.Id, txnId)
 		err := r.sc.UpdateId(stref.Id, M{"$pull": M{"txn-queue": M{"$regex": "^" + txnId.Hex() + "_*"}}})
 		if err != nil {
 			return fmt.Errorf("error purging missing transaction %s: %v", txnId.Hex(), err)
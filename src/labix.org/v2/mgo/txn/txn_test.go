@@ -31,10 +31,10 @@ func (s *S) SetUpTest(c *C) {
 	txn.SetDebug(true)
 	s.MgoSuite.SetUpTest(c)
 
-	s.db = s.session.DB("test")
-	s.tc = s.db.C("tc")
-	s.sc = s.db.C("tc.stash")
-	s.accounts = s.db.C("accounts")
+	s.db = s.session.DB("test").(*mgo.Database)
+	s.tc = s.db.C("tc").(*mgo.Collection)
+	s.sc = s.db.C("tc.stash").(*mgo.Collection)
+	s.accounts = s.db.C("accounts").(*mgo.Collection)
 	s.runner = txn.NewRunner(s.tc)
 }
 
@@ -368,7 +368,7 @@ func (s *S) TestVerifyFieldOrdering(c *C) {
 }
 
 func (s *S) TestChangeLog(c *C) {
-	chglog := s.db.C("chglog")
+	chglog := s.db.C("chglog").(*mgo.Collection)
 	s.runner.ChangeLog(chglog)
 
 	ops := []txn.Op{{
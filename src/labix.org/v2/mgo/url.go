@@ -0,0 +1,332 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"fmt"
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseURL parses a connection URL in the format accepted by Dial into
+// the DialInfo it describes. Timeout is only set if the URL defines
+// connectTimeoutMS. For mongodb+srv:// URLs, the host is returned as
+// SRVName rather than in Addrs, and TLS is enabled unless the URL says
+// otherwise.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/connection-string/
+//
+func ParseURL(url string) (*DialInfo, error) {
+	uinfo, err := parseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	info := &DialInfo{
+		Addrs:    uinfo.addrs,
+		Database: uinfo.db,
+		Username: uinfo.user,
+		Password: uinfo.pass,
+	}
+	if uinfo.srv {
+		if len(uinfo.addrs) != 1 || strings.Contains(uinfo.addrs[0], ":") {
+			return nil, errors.New("mongodb+srv URL must have a single host name without a port")
+		}
+		info.SRVName, info.Addrs = uinfo.addrs[0], nil
+	}
+
+	var readMode *ReadMode
+	var tagSets []bson.D
+	var maxStaleness, localThreshold time.Duration
+	var wc WriteConcern
+	var hasWC bool
+	tlsOptions := make(map[string]bool)
+	for _, opt := range uinfo.options {
+		k, v := opt.key, opt.value
+		bad := errors.New("bad value for connection URL option: " + k + "=" + v)
+		switch name := strings.ToLower(k); name {
+		case "connect":
+			switch v {
+			case "direct":
+				if uinfo.srv {
+					return nil, errors.New("direct connections can't be used with mongodb+srv URLs")
+				}
+				info.Direct = true
+			case "replicaSet":
+			default:
+				return nil, bad
+			}
+		case "directconnection":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, bad
+			}
+			if b && uinfo.srv {
+				return nil, errors.New("direct connections can't be used with mongodb+srv URLs")
+			}
+			info.Direct = b
+		case "replicaset":
+			info.ReplicaSetName = v
+		case "authsource":
+			info.Source = v
+		case "authmechanism":
+			info.Mechanism = v
+		case "gssapiservicename":
+			info.Service = v
+		case "authmechanismproperties":
+			for _, prop := range strings.Split(v, ",") {
+				pair := strings.SplitN(prop, ":", 2)
+				if len(pair) != 2 || pair[0] != "SERVICE_NAME" {
+					return nil, errors.New("unsupported authentication mechanism property: " + prop)
+				}
+				info.Service = pair[1]
+			}
+		case "maxpoolsize", "minpoolsize", "maxidletimems", "waitqueuetimeoutms",
+			"connecttimeoutms", "sockettimeoutms", "serverselectiontimeoutms",
+			"wtimeoutms", "maxstalenessseconds", "localthresholdms":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 && !(name == "maxstalenessseconds" && n == -1) {
+				return nil, bad
+			}
+			ms := time.Duration(n) * time.Millisecond
+			switch name {
+			case "maxpoolsize":
+				info.MaxPoolSize = n
+			case "minpoolsize":
+				info.MinPoolSize = n
+			case "maxidletimems":
+				info.MaxIdleTime = ms
+			case "waitqueuetimeoutms":
+				info.WaitQueueTimeout = ms
+			case "connecttimeoutms":
+				info.Timeout = ms
+			case "sockettimeoutms":
+				info.SocketTimeout = ms
+			case "serverselectiontimeoutms":
+				info.ServerSelectionTimeout = ms
+			case "wtimeoutms":
+				wc.WTimeout, hasWC = ms, true
+			case "maxstalenessseconds":
+				// -1 explicitly means no maximum.
+				if n > 0 {
+					maxStaleness = time.Duration(n) * time.Second
+				}
+			case "localthresholdms":
+				localThreshold = ms
+			}
+		case "ssl", "tls", "tlsallowinvalidhostnames", "tlsallowinvalidcertificates", "tlsinsecure", "journal":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, bad
+			}
+			switch name {
+			case "ssl", "tls":
+				if set, ok := tlsOptions[name]; ok && set != b {
+					return nil, errors.New("conflicting ssl and tls connection URL options")
+				}
+				tlsOptions["ssl"], tlsOptions["tls"] = b, b
+				info.TLS = b
+			case "tlsallowinvalidhostnames":
+				tlsOptions[name] = b
+				info.TLSAllowInvalidHostnames = b
+			case "tlsallowinvalidcertificates", "tlsinsecure":
+				tlsOptions[name] = b
+				info.TLSInsecure = b
+			case "journal":
+				wc.J, hasWC = b, true
+			}
+		case "tlscafile":
+			info.TLSCAFile = v
+		case "tlscertificatekeyfile":
+			info.TLSCertificateKeyFile = v
+		case "readpreference":
+			mode, err := ParseReadMode(v)
+			if err != nil {
+				return nil, err
+			}
+			readMode = &mode
+		case "readpreferencetags":
+			tags := bson.D{}
+			if v != "" {
+				for _, tag := range strings.Split(v, ",") {
+					pair := strings.SplitN(tag, ":", 2)
+					if len(pair) != 2 || pair[0] == "" {
+						return nil, bad
+					}
+					tags = append(tags, bson.DocElem{pair[0], pair[1]})
+				}
+			}
+			tagSets = append(tagSets, tags)
+		case "w":
+			n, err := strconv.Atoi(v)
+			switch {
+			case err != nil:
+				wc.WMode = v
+			case n < 0:
+				return nil, bad
+			default:
+				wc.W = n
+				wc.Unacknowledged = n == 0
+			}
+			hasWC = true
+		case "appname":
+			if len(v) > maxAppNameSize {
+				return nil, fmt.Errorf("application name must not exceed %d bytes", maxAppNameSize)
+			}
+			info.AppName = v
+		case "retrywrites", "retryreads", "heartbeatfrequencyms", "serverselectiontryonce",
+			"compressors", "zlibcompressionlevel", "readconcernlevel", "uuidrepresentation",
+			"waitqueuemultiple", "tlsdisableocspendpointcheck", "tlsdisablecertificaterevocationcheck":
+			// Standard options with no equivalent here.
+			Logf("Ignoring connection URL option: %s=%s", k, v)
+		default:
+			return nil, errors.New("unsupported connection URL option: " + k + "=" + v)
+		}
+	}
+
+	if _, ok := tlsOptions["tls"]; uinfo.srv && !ok {
+		info.TLS = true
+	}
+	if _, ok := tlsOptions["tlsinsecure"]; ok {
+		for _, other := range []string{"tlsAllowInvalidHostnames", "tlsAllowInvalidCertificates"} {
+			if _, ok := tlsOptions[strings.ToLower(other)]; ok {
+				return nil, errors.New("tlsInsecure and " + other + " can't be used together")
+			}
+		}
+	}
+	if readMode != nil || tagSets != nil || maxStaleness != 0 || localThreshold != 0 {
+		pref := &ReadPreference{TagSets: tagSets, MaxStaleness: maxStaleness, LocalThreshold: localThreshold}
+		if readMode != nil {
+			pref.Mode = *readMode
+		}
+		if pref.Mode == ReadPrimary && (tagSets != nil || maxStaleness != 0) {
+			return nil, errors.New("read preference tags and maxStalenessSeconds can't be used with the primary mode")
+		}
+		if maxStaleness != 0 && maxStaleness < minMaxStaleness {
+			return nil, errMaxStaleness
+		}
+		info.ReadPreference = pref
+	}
+	if hasWC {
+		if wc.Unacknowledged && wc.J {
+			return nil, errors.New("unacknowledged writes can't wait for the journal")
+		}
+		if !wc.Unacknowledged {
+			if err := validateWriteConcern(&wc); err != nil {
+				return nil, err
+			}
+		}
+		info.WriteConcern = &wc
+	}
+	return info, nil
+}
+
+func isOptSep(c rune) bool {
+	return c == ';' || c == '&'
+}
+
+type urlInfo struct {
+	addrs   []string
+	user    string
+	pass    string
+	db      string
+	options []urlOption
+	srv     bool
+}
+
+// urlOption holds a connection URL option, as some may be repeated.
+type urlOption struct {
+	key, value string
+}
+
+func parseURL(s string) (*urlInfo, error) {
+	info := &urlInfo{}
+	if strings.HasPrefix(s, "mongodb://") {
+		s = s[10:]
+	} else if strings.HasPrefix(s, "mongodb+srv://") {
+		s = s[14:]
+		info.srv = true
+	} else if c := strings.Index(s, "://"); c != -1 {
+		return nil, errors.New("unsupported connection URL scheme: " + s[:c])
+	}
+	if c := strings.Index(s, "?"); c != -1 {
+		for _, pair := range strings.FieldsFunc(s[c+1:], isOptSep) {
+			l := strings.SplitN(pair, "=", 2)
+			if len(l) != 2 || l[0] == "" || l[1] == "" && !strings.EqualFold(l[0], "readPreferenceTags") {
+				return nil, errors.New("connection option must be key=value: " + pair)
+			}
+			value, err := url.PathUnescape(l[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot unescape connection option value: %q", pair)
+			}
+			info.options = append(info.options, urlOption{l[0], value})
+		}
+		s = s[:c]
+	}
+	if c := strings.Index(s, "@"); c != -1 {
+		pair := strings.SplitN(s[:c], ":", 2)
+		if pair[0] == "" {
+			return nil, errors.New("credentials must be provided as user:pass@host")
+		}
+		if strings.ContainsAny(s[:c], "/?#[]") || strings.Contains(s[c+1:], "@") || len(pair) > 1 && strings.Contains(pair[1], ":") {
+			return nil, errors.New("credentials in URL must be percent-encoded")
+		}
+		var err error
+		info.user, err = url.PathUnescape(pair[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot unescape username in URL: %q", pair[0])
+		}
+		if len(pair) > 1 {
+			info.pass, err = url.PathUnescape(pair[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot unescape password in URL")
+			}
+		}
+		s = s[c+1:]
+	}
+	if c := strings.Index(s, "/"); c != -1 {
+		db, err := url.PathUnescape(s[c+1:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot unescape database name in URL: %q", s[c+1:])
+		}
+		info.db = db
+		s = s[:c]
+	}
+	info.addrs = strings.Split(s, ",")
+	for _, addr := range info.addrs {
+		if addr == "" {
+			return nil, errors.New("missing host in connection URL")
+		}
+	}
+	return info, nil
+}
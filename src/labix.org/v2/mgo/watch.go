@@ -0,0 +1,391 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"context"
+	"errors"
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrResumeTokenNotFound is returned when the oplog entry a change stream
+// should resume after is no longer in the oplog, either because the oplog
+// rolled over or because the entry was rolled back during a failover.
+var ErrResumeTokenNotFound = errors.New("resume token not found in the oplog")
+
+// ResumeToken identifies an entry in the oplog. It may be stored, as is or
+// marshalled as BSON, and later provided in WatchOptions to resume watching
+// right after that entry, from this or any other session.
+type ResumeToken struct {
+	Timestamp bson.MongoTimestamp "ts"
+	Hash      int64               "h"
+}
+
+// ChangeEvent describes a change applied to a document, as read from the
+// oplog by a ChangeStream.
+type ChangeEvent struct {
+	// Op is "insert", "update" or "delete".
+	Op string
+
+	Database   string
+	Collection string
+
+	// Id is the _id of the changed document.
+	Id interface{}
+
+	// Doc holds the inserted document, or the replacement document of
+	// an update that replaced the whole document.
+	Doc bson.Raw
+
+	// Update holds the modifiers applied by an update, such as $set and
+	// $unset, when it didn't replace the whole document.
+	Update bson.Raw
+
+	// ResumeToken identifies the event in the oplog.
+	ResumeToken ResumeToken
+}
+
+// WatchOptions holds the options for Session.Watch.
+type WatchOptions struct {
+	// Database limits the change stream to changes in a database.
+	Database string
+
+	// Collections limits the change stream to changes in the given
+	// collections of Database.
+	Collections []string
+
+	// Ops limits the change stream to the given operations, out of
+	// "insert", "update" and "delete". All of them are watched if empty.
+	Ops []string
+
+	// ResumeAfter, if set, makes the change stream start right after the
+	// given oplog entry. Otherwise it starts with the next change made.
+	ResumeAfter *ResumeToken
+
+	// Timeout is how long Next waits for a change before returning false
+	// with Timeout reporting true. Next waits forever if zero.
+	Timeout time.Duration
+}
+
+// watchRetryDelay is how long a change stream waits before querying the
+// oplog again once its cursor is dropped by the server.
+var watchRetryDelay = 100 * time.Millisecond
+
+var watchOps = map[string]string{"insert": "i", "update": "u", "delete": "d"}
+
+// ChangeStream delivers the changes made to a replica set, in the order they
+// were applied, by tailing its oplog. See Session.Watch.
+type ChangeStream struct {
+	m       sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	session *Session
+	opts    WatchOptions
+	filter  bson.D
+	iter    *Iter
+	token   ResumeToken
+	resumed bool
+	timeout bool
+	err     error
+}
+
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp "ts"
+	Hash      int64               "h"
+	Op        string              "op"
+	Namespace string              "ns"
+	Object    bson.Raw            "o"
+	Object2   bson.Raw            "o2"
+}
+
+// Watch returns a change stream that follows the inserts, updates and
+// deletes applied to the replica set the session is connected to, by tailing
+// its local.oplog.rs collection. The stream uses its own copy of the session
+// and must be closed when no longer needed.
+//
+// If the connection is lost, for example because the primary stepped down,
+// the stream refreshes its session and resumes after the last event
+// delivered, as long as that event is still in the oplog of the server it
+// reconnects to. The ResumeToken method returns that resume point, which may
+// be persisted to resume from it in a later stream:
+//
+//     stream, err := session.Watch(mgo.WatchOptions{Database: "mydb", ResumeAfter: token})
+//     if err != nil {
+//         return err
+//     }
+//     var event mgo.ChangeEvent
+//     for stream.Next(&event) {
+//         handle(&event)
+//         saveToken(event.ResumeToken)
+//     }
+//     if err := stream.Close(); err != nil {
+//         return err
+//     }
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/core/replica-set-oplog/
+//
+func (s *Session) Watch(opts WatchOptions) (*ChangeStream, error) {
+	filter := bson.D{}
+	if len(opts.Collections) > 0 {
+		if opts.Database == "" {
+			return nil, errors.New("watching collections requires a database")
+		}
+		ns := make([]string, len(opts.Collections))
+		for i, name := range opts.Collections {
+			ns[i] = opts.Database + "." + name
+		}
+		filter = append(filter, bson.DocElem{"ns", bson.M{"$in": ns}})
+	} else if opts.Database != "" {
+		pattern := "^" + regexp.QuoteMeta(opts.Database) + `\.`
+		filter = append(filter, bson.DocElem{"ns", bson.RegEx{pattern, ""}})
+	}
+	ops := []string{"i", "u", "d"}
+	if len(opts.Ops) > 0 {
+		ops = ops[:0]
+		for _, op := range opts.Ops {
+			code, ok := watchOps[op]
+			if !ok {
+				return nil, errors.New("unknown change stream operation: " + op)
+			}
+			ops = append(ops, code)
+		}
+	}
+	filter = append(filter, bson.DocElem{"op", bson.M{"$in": ops}})
+
+	stream := &ChangeStream{session: s.copy(), opts: opts, filter: filter}
+	if opts.ResumeAfter != nil {
+		stream.token = *opts.ResumeAfter
+		stream.resumed = true
+	} else {
+		var last oplogEntry
+		err := stream.oplog().find(nil).sort("-$natural").One(&last)
+		if err != nil && err != ErrNotFound {
+			stream.session.Close()
+			return nil, err
+		}
+		stream.token = ResumeToken{last.Timestamp, last.Hash}
+	}
+	stream.ctx, stream.cancel = context.WithCancel(context.Background())
+	return stream, nil
+}
+
+func (stream *ChangeStream) oplog() *Collection {
+	return stream.session.db("local").c("oplog.rs")
+}
+
+// tail starts tailing the oplog right after the current resume token,
+// verifying first that the token is still in the oplog if the stream was
+// resumed from it.
+func (stream *ChangeStream) tail() (*Iter, error) {
+	oplog := stream.oplog()
+	if stream.resumed && stream.token.Timestamp != 0 {
+		var entry oplogEntry
+		err := oplog.find(bson.M{"ts": stream.token.Timestamp}).One(&entry)
+		if err == ErrNotFound || err == nil && stream.token.Hash != 0 && entry.Hash != stream.token.Hash {
+			return nil, ErrResumeTokenNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := append(bson.D{{"ts", bson.M{"$gt": stream.token.Timestamp}}}, stream.filter...)
+	timeout := stream.opts.Timeout
+	if timeout == 0 {
+		timeout = -1
+	}
+	return oplog.find(query).logReplay().tailContext(stream.ctx, timeout), nil
+}
+
+// Next retrieves the next change into event, blocking until one is
+// available. It returns false when the stream timed out waiting, as reported
+// by Timeout, in which case Next may be called again, or when it failed, as
+// reported by Err, or was closed.
+func (stream *ChangeStream) Next(event *ChangeEvent) bool {
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	if stream.err != nil || stream.ctx.Err() != nil {
+		return false
+	}
+	stream.timeout = false
+	retried := false
+	var deadline time.Time
+	if stream.opts.Timeout > 0 {
+		deadline = time.Now().Add(stream.opts.Timeout)
+	}
+	for {
+		if stream.iter == nil {
+			iter, err := stream.tail()
+			if err != nil {
+				stream.err = err
+				return false
+			}
+			stream.iter = iter
+			stream.resumed = true
+		}
+
+		// Wait without holding the lock so that Close may interrupt.
+		iter := stream.iter
+		var entry oplogEntry
+		stream.m.Unlock()
+		ok := iter.Next(&entry)
+		stream.m.Lock()
+		if stream.ctx.Err() != nil {
+			return false
+		}
+
+		if ok {
+			stream.token = ResumeToken{entry.Timestamp, entry.Hash}
+			if entry.decode(event) {
+				return true
+			}
+			continue
+		}
+		if iter.Timeout() {
+			stream.timeout = true
+			return false
+		}
+		err := iter.Close()
+		stream.iter = nil
+		if err != nil {
+			if retried {
+				stream.err = err
+				return false
+			}
+			stream.session.logf(WarnLevel, "Change stream interrupted, resuming after %d: %v", stream.token.Timestamp, err)
+			retried = true
+			stream.session.Refresh()
+			continue
+		}
+		// The server drops tailable cursors that find nothing to
+		// return, so wait a moment before trying again.
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			stream.timeout = true
+			return false
+		}
+		stream.m.Unlock()
+		select {
+		case <-stream.ctx.Done():
+		case <-time.After(watchRetryDelay):
+		}
+		stream.m.Lock()
+		if stream.ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+// decode fills event with the change described by the oplog entry,
+// reporting whether the entry describes a change to a user collection.
+func (entry *oplogEntry) decode(event *ChangeEvent) bool {
+	dot := strings.Index(entry.Namespace, ".")
+	if dot < 0 || strings.HasPrefix(entry.Namespace[dot+1:], "system.") {
+		return false
+	}
+	*event = ChangeEvent{
+		Database:    entry.Namespace[:dot],
+		Collection:  entry.Namespace[dot+1:],
+		ResumeToken: ResumeToken{entry.Timestamp, entry.Hash},
+	}
+	var key struct {
+		Id interface{} "_id"
+	}
+	switch entry.Op {
+	case "i":
+		event.Op = "insert"
+		event.Doc = entry.Object
+		entry.Object.Unmarshal(&key)
+	case "u":
+		event.Op = "update"
+		var fields bson.RawD
+		entry.Object.Unmarshal(&fields)
+		if len(fields) > 0 && strings.HasPrefix(fields[0].Name, "$") {
+			event.Update = entry.Object
+		} else {
+			event.Doc = entry.Object
+		}
+		entry.Object2.Unmarshal(&key)
+	case "d":
+		event.Op = "delete"
+		entry.Object.Unmarshal(&key)
+	default:
+		return false
+	}
+	event.Id = key.Id
+	return true
+}
+
+// ResumeToken returns the token of the last event delivered by Next, or of
+// the point the stream started from if no events were delivered yet.
+func (stream *ChangeStream) ResumeToken() ResumeToken {
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	return stream.token
+}
+
+// Timeout returns true if Next returned false due to a timeout waiting for
+// changes.
+func (stream *ChangeStream) Timeout() bool {
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	return stream.timeout
+}
+
+// Err returns the error that stopped the stream, if any.
+func (stream *ChangeStream) Err() error {
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	return stream.err
+}
+
+// Close stops the stream, releasing its session, and returns the error that
+// stopped it, if any. It may be called while another goroutine is blocked in
+// Next, which then returns false.
+func (stream *ChangeStream) Close() error {
+	// Cancel before locking to interrupt a Next blocked on the oplog.
+	stream.cancel()
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	if stream.iter != nil {
+		err := stream.iter.Close()
+		if err != nil && err != stream.ctx.Err() && stream.err == nil {
+			stream.err = err
+		}
+		stream.iter = nil
+	}
+	if stream.session != nil {
+		stream.session.Close()
+		stream.session = nil
+	}
+	return stream.err
+}
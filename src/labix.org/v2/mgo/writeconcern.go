@@ -0,0 +1,294 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"fmt"
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/log"
+	"labix.org/v2/imgo"
+	"strings"
+	"time"
+)
+
+// WriteConcern defines the acknowledgement requested from the servers for
+// a write. See Collection.WithWriteConcern.
+type WriteConcern = imgo.WriteConcern
+
+func validateWriteConcern(wc *WriteConcern) error {
+	switch {
+	case wc.Unacknowledged:
+		return nil
+	case wc.W < 0:
+		return errors.New("write concern W must not be negative")
+	case wc.WTimeout < 0:
+		return errors.New("write concern WTimeout must not be negative")
+	case wc.J && wc.FSync:
+		return errors.New("write concern can't have both J and FSync set")
+	}
+	return nil
+}
+
+func writeConcernW(wc *WriteConcern) interface{} {
+	if wc.WMode != "" {
+		return wc.WMode
+	}
+	if wc.W > 0 {
+		return wc.W
+	}
+	return nil
+}
+
+func writeConcernWTimeout(wc *WriteConcern) int {
+	ms := int(wc.WTimeout / time.Millisecond)
+	if ms == 0 && wc.WTimeout > 0 {
+		ms = 1
+	}
+	return ms
+}
+
+// writeConcernSafeOp returns the getLastError query that follows the writes
+// made with the write concern, or nil if they are unacknowledged.
+func writeConcernSafeOp(wc *WriteConcern) *queryOp {
+	if wc.Unacknowledged {
+		return nil
+	}
+	return &queryOp{
+		query:      &getLastError{1, writeConcernW(wc), writeConcernWTimeout(wc), wc.FSync, wc.J},
+		collection: "admin.$cmd",
+		limit:      -1,
+	}
+}
+
+// writeConcernSafe returns the safety mode equivalent to the write concern,
+// as taken by Session.SetSafe.
+func writeConcernSafe(wc *WriteConcern) *Safe {
+	if wc.Unacknowledged {
+		return nil
+	}
+	return &Safe{
+		W:        wc.W,
+		WMode:    wc.WMode,
+		WTimeout: writeConcernWTimeout(wc),
+		FSync:    wc.FSync,
+		J:        wc.J,
+	}
+}
+
+// writeConcernDocument returns the write concern as provided to commands
+// that write.
+func writeConcernDocument(wc *WriteConcern) bson.D {
+	var doc bson.D
+	if w := writeConcernW(wc); w != nil {
+		doc = append(doc, bson.DocElem{"w", w})
+	}
+	if wc.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{"wtimeout", writeConcernWTimeout(wc)})
+	}
+	if wc.J {
+		doc = append(doc, bson.DocElem{"j", true})
+	}
+	if wc.FSync {
+		doc = append(doc, bson.DocElem{"fsync", true})
+	}
+	return doc
+}
+
+// WithWriteConcern returns a copy of the collection value which makes its
+// writes, including the ones made by Query.Apply on its queries, with the
+// given write concern rather than with the safety mode of the session.
+// Apply always waits for its outcome, even if wc is Unacknowledged.
+func (c *Collection) withWriteConcern(wc *WriteConcern) *Collection {
+	wcCopy := *wc
+	cCopy := *c
+	cCopy.writeConcern = &wcCopy
+	return &cCopy
+}
+
+func (c *Collection) WithWriteConcern(wc *WriteConcern) imgo.Collection {
+	return c.withWriteConcern(wc)
+}
+
+// WriteConcernError is returned when a write was applied but the
+// acknowledgement requested by its write concern could not be obtained,
+// for example because not enough servers replicated it before WTimeout.
+// Other write failures are reported as a *LastError.
+type WriteConcernError struct {
+	Code    int
+	Message string
+
+	// WTimeout reports whether WTimeout elapsed before the write
+	// concern was satisfied.
+	WTimeout bool
+
+	// Waited is how long the server waited for the write concern to be
+	// satisfied, and WrittenTo lists the servers known to have applied
+	// the write, when reported by the server.
+	Waited    time.Duration
+	WrittenTo []string
+
+	// LastError holds the outcome of the write itself.
+	LastError *LastError
+}
+
+func (err *WriteConcernError) Error() string {
+	return err.Message
+}
+
+// Codes of errors reported by servers for unsatisfied write concerns.
+const (
+	codeWriteConcernFailed        = 64
+	codeUnknownReplWriteConcern   = 79
+	codeUnsatisfiableWriteConcern = 100
+)
+
+// replicationResult holds the replication details of a getLastError result.
+type replicationResult struct {
+	Err       string
+	Code      int
+	WTimeout  bool
+	WNote     string   "wnote"
+	Waited    int      "waited"
+	WrittenTo []string "writtenTo"
+}
+
+// writeConcernError returns the *WriteConcernError described by the result
+// of getLastError in data, or nil if the write concern was satisfied.
+func writeConcernError(data []byte, lerr *LastError) error {
+	var result replicationResult
+	bson.Unmarshal(data, &result)
+	switch {
+	case result.WTimeout:
+	case result.Code == codeWriteConcernFailed || result.Code == codeUnknownReplWriteConcern || result.Code == codeUnsatisfiableWriteConcern:
+	case result.WNote != "" && result.Code == 0:
+	default:
+		return nil
+	}
+	msg := result.Err
+	if result.WNote != "" {
+		msg = result.WNote
+	}
+	return &WriteConcernError{
+		Code:      result.Code,
+		Message:   msg,
+		WTimeout:  result.WTimeout,
+		Waited:    time.Duration(result.Waited) * time.Millisecond,
+		WrittenTo: result.WrittenTo,
+		LastError: lerr,
+	}
+}
+
+// commandWriteConcernError holds the writeConcernError reported by
+// commands such as findAndModify.
+type commandWriteConcernError struct {
+	Code    int
+	ErrMsg  string
+	ErrInfo struct {
+		WTimeout bool
+	} "errInfo"
+}
+
+func (doc *commandWriteConcernError) error(lerr *LastError) *WriteConcernError {
+	return &WriteConcernError{
+		Code:      doc.Code,
+		Message:   doc.ErrMsg,
+		WTimeout:  doc.ErrInfo.WTimeout,
+		LastError: lerr,
+	}
+}
+
+// writeModesExpiry is how long the write concern modes read from a server,
+// or the failure to read them, are relied upon before reading them again
+// when a mode isn't found.
+const writeModesExpiry = syncServersDelay
+
+// serverWriteModes holds the write concern modes read from a server.
+type serverWriteModes struct {
+	modes map[string]bool // Nil if they couldn't be read.
+	read  time.Time
+}
+
+// CheckWriteMode returns an error if mode isn't "majority" nor one of the
+// getLastErrorModes defined in the replica set configuration, as read from
+// the server at the other end of socket. Modes can't be checked, and so are
+// left for the server to validate, if the configuration can't be read, as
+// with mongos, standalone servers, or users not allowed to read it.
+func (cluster *mongoCluster) CheckWriteMode(socket *mongoSocket, mode string) error {
+	if mode == "majority" {
+		return nil
+	}
+	addr := socket.Server().ResolvedAddr
+	cluster.RLock()
+	cached, ok := cluster.writeModes[addr]
+	cluster.RUnlock()
+	if !ok || !cached.modes[mode] && time.Since(cached.read) >= writeModesExpiry {
+		// Not seen yet, or the configuration may have changed.
+		modes, err := cluster.readWriteModes(socket)
+		if err != nil {
+			Debugf("Cannot read write concern modes: %v", err)
+		}
+		cached = serverWriteModes{modes, time.Now()}
+		cluster.Lock()
+		if cluster.writeModes == nil {
+			cluster.writeModes = make(map[string]serverWriteModes)
+		}
+		cluster.writeModes[addr] = cached
+		cluster.Unlock()
+	}
+	if cached.modes != nil && !cached.modes[mode] {
+		return fmt.Errorf("unknown write concern mode %q", mode)
+	}
+	return nil
+}
+
+type replSetConfig struct {
+	Settings struct {
+		GetLastErrorModes bson.M "getLastErrorModes"
+	}
+}
+
+func (cluster *mongoCluster) readWriteModes(socket *mongoSocket) (map[string]bool, error) {
+	// Monotonic let's it talk to the socket's server and hold the socket.
+	session := newSession(Monotonic, cluster, 10*time.Second)
+	session.setSocket(socket)
+	defer session.Close()
+	var result struct{ Config replSetConfig }
+	err := session.Run("replSetGetConfig", &result)
+	if err != nil && strings.Contains(err.Error(), "no such") {
+		// Servers older than 3.0 keep it only in local.system.replset.
+		err = session.db("local").c("system.replset").find(nil).One(&result.Config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	modes := make(map[string]bool)
+	for name := range result.Config.Settings.GetLastErrorModes {
+		modes[name] = true
+	}
+	return modes, nil
+}
@@ -1,37 +1,122 @@
 package mockmgo
 
 import (
-	"reflect"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
-	//"time"
-	//"math"
+	"time"
 )
 
 import (
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
-	. "labix.org/v2/base/queue"
 	. "labix.org/v2/error"
 	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/modify"
+	"labix.org/v2/mockmgo/multisort"
 	"labix.org/v2/mockmgo/parse"
 )
 
-type Data map[string]interface{} // _id: json string
+// Data holds documents keyed by the JSON encoding of their _id, or its hex
+// representation for ObjectIds.
+type Data map[string]interface{}
+
+var _ imgo.Collection = (*Collection)(nil)
 
 type Collection struct {
-	name string
-	data Data
+	name     string
+	data     map[string]bson.D // documents as stored by the server, _id first
+	order    []string          // keys of data in natural order
+	info     *imgo.CollectionInfo
+	indexes  []*index   // secondary indexes, the one on _id is implicit
+	inserted *sync.Cond // broadcast on inserts, for tailable iterators
 	sync.RWMutex
 }
 
+// NewCollection returns a collection holding the documents in data, which
+// may be nil. Documents are converted to their stored form, so changing
+// them afterwards has no effect on the collection.
 func NewCollection(name string, data Data) (c *Collection) {
-	c = &Collection{name: name, data: data}
-	if data == nil {
-		c.data = make(Data, 0)
+	c = &Collection{name: name, data: make(map[string]bson.D, len(data))}
+	for key, doc := range data {
+		d, err := storedDoc(doc, nil)
+		if err != nil {
+			panic("mockmgo: cannot store document " + key + ": " + err.Error())
+		}
+		c.data[key] = d
+		c.order = append(c.order, key)
 	}
+	// ObjectId keys sort by creation time.
+	sort.Strings(c.order)
+	c.inserted = sync.NewCond(c.RLocker())
 	return
 }
 
+// checkIndexes returns the error reported by the server when storing data
+// under key would violate an index.
+func (c *Collection) checkIndexes(key string, data bson.D) error {
+	for _, ix := range c.indexes {
+		if err := ix.check(c.name, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add stores a new document under key. It must have been checked against
+// the indexes first.
+func (c *Collection) add(key string, data bson.D) {
+	c.data[key] = data
+	c.order = append(c.order, key)
+	for _, ix := range c.indexes {
+		ix.add(key, data)
+	}
+	if c.info != nil && c.info.Capped && c.info.MaxDocs > 0 && len(c.order) > c.info.MaxDocs {
+		c.remove(c.order[0])
+	}
+	c.inserted.Broadcast()
+}
+
+// set replaces the document stored under key. It must have been checked
+// against the indexes first.
+func (c *Collection) set(key string, data bson.D) {
+	c.data[key] = data
+	for _, ix := range c.indexes {
+		ix.remove(key)
+		ix.add(key, data)
+	}
+}
+
+func (c *Collection) remove(key string) {
+	delete(c.data, key)
+	for _, ix := range c.indexes {
+		ix.remove(key)
+	}
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// waitInsert blocks until a document is inserted or the deadline is
+// reached. It must be called with the read lock held.
+func (c *Collection) waitInsert(deadline time.Time) {
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(deadline.Sub(time.Now()), func() {
+			c.Lock()
+			c.inserted.Broadcast()
+			c.Unlock()
+		})
+		defer timer.Stop()
+	}
+	c.inserted.Wait()
+}
+
 func (c *Collection) Find(query interface{}) imgo.Query {
 	q := &Query{coll: c}
 	q.op.query = query
@@ -42,226 +127,642 @@ func (c *Collection) FindId(id interface{}) (q imgo.Query) {
 	return c.Find(bson.D{{"_id", id}})
 }
 
-func (c *Collection) findOne(query interface{}) (result interface{}, err error) {
-	Debugf("query:%#v", query)
-	queryM, ok := query.(bson.M)
-	if !ok {
-		return nil, UnknownQuery
+// lookup returns the keys of the documents matching query. At most limit
+// keys are returned, unless limit is zero.
+func (c *Collection) lookup(query interface{}, limit int) (keys []string, err error) {
+	keys, _, err = c.lookupHint(query, nil, limit)
+	return keys, err
+}
+
+// queryStats holds the details reported by Query.Explain.
+type queryStats struct {
+	cursor          string
+	nscanned        int
+	nscannedObjects int
+}
+
+// lookupHint is like lookup, but uses the index with the hint key if
+// provided. Otherwise an index is picked by plan.
+func (c *Collection) lookupHint(query interface{}, hint []string, limit int) (keys []string, stats queryStats, err error) {
+	queryM, err := parse.QueryM(query)
+	if err != nil {
+		return nil, stats, err
+	}
+	if err = parse.Check(queryM); err != nil {
+		return nil, stats, queryError(err)
+	}
+	if queryM == nil {
+		queryM = bson.M{}
 	}
 
-	Debugf("query:%#v", queryM)
-	if objId, ok := queryM["_id"]; ok {
-		Debug("good")
-		id, ok := objId.(bson.ObjectId)
-		if !ok {
-			return nil, ErrNotFound
-		}
-		Debug("11111")
-		result, ok := c.data[id.Hex()]
-		if !ok {
-			return nil, ErrNotFound
+	candidates, stats, err := c.plan(queryM, hint)
+	if err != nil {
+		return nil, stats, err
+	}
+	for _, key := range candidates {
+		stats.nscannedObjects++
+		if ok, _ := parse.Match(c.data[key], queryM); ok {
+			keys = append(keys, key)
+			if len(keys) == limit {
+				break
+			}
 		}
-		Debug("22222")
-		return result, nil
 	}
+	return keys, stats, nil
+}
 
-	// no index, iter all data
-	for _, data := range c.data {
-		if ok, _ := parse.Match(data, query); ok {
-			return data, nil
+// plan returns the keys of the documents which may match queryM, in the
+// order they should be considered. Equality lookups on _id use the
+// collection data directly. Otherwise the index with the hint key is used,
+// or the first non-sparse index whose leading field is compared by
+// queryM, preferring equality and unique indexes. Without a suitable
+// index all documents are scanned.
+func (c *Collection) plan(queryM bson.M, hint []string) (candidates []string, stats queryStats, err error) {
+	if hint != nil {
+		name, err := indexName(hint)
+		if err != nil {
+			return nil, stats, err
+		}
+		stats.cursor = "BtreeCursor " + name
+		if name == "_id_" {
+			candidates = append(candidates, c.order...)
+			sort.Sort(keysById{candidates, c.data})
+			stats.nscanned = len(candidates)
+			return candidates, stats, nil
 		}
+		for _, ix := range c.indexes {
+			if ix.info.Name == name {
+				ivs, _ := intervals(queryM, ix.fields[0])
+				candidates, stats.nscanned = ix.scan(ivs)
+				return candidates, stats, nil
+			}
+		}
+		return nil, stats, &mgo.QueryError{Code: 17007, Message: "Unable to execute query: error processing query: planner returned error: bad hint"}
 	}
-	return nil, ErrNotFound
-}
 
-func (c *Collection) count(query interface{}) (n int, err error) {
-	queryM, ok := query.(bson.M)
-	if !ok {
-		return 0, UnknownQuery
+	if id, ok := queryM["_id"]; ok && plannable(id) {
+		if _, isOp := id.(bson.M); !isOp {
+			stats.cursor = "BtreeCursor _id_"
+			key := idKey(id)
+			if _, ok := c.data[key]; ok {
+				candidates = []string{key}
+				stats.nscanned = 1
+			}
+			return candidates, stats, nil
+		}
 	}
 
-	if objId, ok := queryM["_id"]; ok {
-		id, ok := objId.(bson.ObjectId)
+	var best *index
+	var bestIvs []interval
+	bestScore := 0
+	for _, ix := range c.indexes {
+		if ix.info.Sparse {
+			continue
+		}
+		ivs, ok := intervals(queryM, ix.fields[0])
 		if !ok {
-			return
+			continue
 		}
-		if _, ok := c.data[id.Hex()]; !ok {
-			return
+		score := 1
+		if !ivs[0].loUnbound && !ivs[0].hiUnbound {
+			score += 2
 		}
-		n = 1
-		return
-	}
-
-	n = 0
-	for _, data := range c.data {
-		if ok, _ := parse.Match(data, query); ok {
-			n++
+		if ix.info.Unique {
+			score++
+		}
+		if score > bestScore {
+			best, bestIvs, bestScore = ix, ivs, score
 		}
 	}
-	return
+	if best != nil {
+		stats.cursor = "BtreeCursor " + best.info.Name
+		candidates, stats.nscanned = best.scan(bestIvs)
+		return candidates, stats, nil
+	}
+
+	stats.cursor = "BasicCursor"
+	stats.nscanned = len(c.order)
+	return c.order, stats, nil
 }
 
-type Query struct {
-	coll *Collection
-	op   QueryOp
+// keysById sorts the keys of documents by their _id.
+type keysById struct {
+	keys []string
+	data map[string]bson.D
 }
 
-type QueryOp struct {
-	query   interface{}
-	OrderBy bson.D
-	skip    int32
-	limit   int32
+func (p keysById) Len() int { return len(p.keys) }
+func (p keysById) Less(i, j int) bool {
+	return parse.Compare(p.data[p.keys[i]][0].Value, p.data[p.keys[j]][0].Value) < 0
 }
+func (p keysById) Swap(i, j int) { p.keys[i], p.keys[j] = p.keys[j], p.keys[i] }
 
-func (q *Query) One(result interface{}) (err error) {
-	q.coll.RLock()
-	defer q.coll.RUnlock()
+// find returns the keys of the documents selected by op, in the order
+// defined by its sort, skip and limit settings.
+func (c *Collection) find(op QueryOp) (keys []string, err error) {
+	keys, _, err = c.explain(op)
+	return keys, err
+}
 
-	resultv := reflect.ValueOf(result)
-	if resultv.Kind() != reflect.Ptr {
-		return ErrType
+// explain is like find, also returning the details of how the documents
+// were looked up.
+func (c *Collection) explain(op QueryOp) (keys []string, stats queryStats, err error) {
+	keys, stats, err = c.lookupHint(op.query, op.hint, 0)
+	if err == nil && len(op.OrderBy) > 0 {
+		keys, err = c.sort(keys, op.OrderBy)
+	}
+	if err != nil {
+		return nil, stats, err
 	}
 
-	data, err := q.coll.findOne(q.op.query)
+	if op.skip > 0 {
+		if int(op.skip) >= len(keys) {
+			return nil, stats, nil
+		}
+		keys = keys[op.skip:]
+	}
+	limit := int(op.limit)
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys, stats, nil
+}
+
+// sort orders the documents stored under keys as defined by orderBy.
+func (c *Collection) sort(keys []string, orderBy bson.D) ([]string, error) {
+	var err error
+	docs := make([]interface{}, len(keys))
+	byDoc := make(map[string]string, len(keys))
+	for i, key := range keys {
+		docs[i] = c.data[key]
+		id, _ := docId(docs[i])
+		byDoc[idKey(id)] = key
+	}
+	if docs, err = multisort.MultiSort(docs, orderBy); err != nil {
+		return nil, err
+	}
+	for i, doc := range docs {
+		id, _ := docId(doc)
+		keys[i] = byDoc[idKey(id)]
+	}
+	return keys, nil
+}
+
+func (c *Collection) findOne(query interface{}) (result bson.D, err error) {
+	Debugf("query:%#v", query)
+	keys, err := c.lookup(query, 1)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound
 	}
+	return c.data[keys[0]], nil
+}
 
-	resultv.Elem().Set(reflect.ValueOf(data))
+func (c *Collection) count(query interface{}) (n int, err error) {
+	keys, err := c.lookup(query, 0)
+	return len(keys), err
+}
 
-	return
+// exists reports whether the collection holds any document, index or
+// settings, in which case the server would list it.
+func (c *Collection) exists() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.data) > 0 || len(c.indexes) > 0 || c.info != nil
 }
 
-func (q *Query) All(result interface{}) (err error) {
-	return q.Iter().All(result)
+// Count returns the total number of documents in the collection.
+func (c *Collection) Count() (n int, err error) {
+	return c.Find(nil).Count()
 }
 
-func (q *Query) Iter() imgo.Iter {
-	iter := &Iter{
-		coll: q.coll,
-		op:   q.op,
+// Insert inserts one or more documents in the collection. Documents without
+// an _id field are assigned a new bson.ObjectId, as the server would do.
+// Documents are inserted in order, and inserting stops at the first failure.
+func (c *Collection) Insert(docs ...interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, doc := range docs {
+		if _, err := c.insert(doc); err != nil {
+			return err
+		}
 	}
-	return iter
+	return nil
 }
 
-func (q *Query) Count() (n int, err error) {
-	q.coll.RLock()
-	defer q.coll.RUnlock()
+// InsertContext works like Insert, but fails with ctx.Err() without
+// inserting anything if ctx is done.
+func (c *Collection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Insert(docs...)
+}
 
-	return q.coll.count(q.op.query)
+func (c *Collection) insert(doc interface{}) (id interface{}, err error) {
+	data, err := storedDoc(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	id = data[0].Value
+	key := idKey(id)
+	if _, ok := c.data[key]; ok {
+		return nil, dupKeyError(c.name, "_id_", id)
+	}
+	if err = c.checkIndexes(key, data); err != nil {
+		return nil, err
+	}
+	c.add(key, data)
+	return id, nil
 }
 
-func (q *Query) Skip(n int) imgo.Query {
-	q.op.skip = int32(n)
-	return q
+// Update finds a single document matching the provided selector document
+// and modifies it according to the update document, which may either hold
+// modifiers such as $set and $inc, or be a replacement for the document.
+// ErrNotFound is returned if no document matches the selector.
+func (c *Collection) Update(selector interface{}, update interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	keys, err := c.lookup(selector, 1)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+	return c.update(keys[0], update)
 }
 
-func (q *Query) Limit(n int) imgo.Query {
-	q.op.limit = int32(n)
-	return q
+// UpdateContext works like Update, with cancellation as in InsertContext.
+func (c *Collection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Update(selector, update)
 }
 
-func (q *Query) Sort(fields ...string) imgo.Query {
-	var order bson.D
-	for _, field := range fields {
-		n := 1
-		if field != "" {
-			switch field[0] {
-			case '+':
-				field = field[1:]
-			case '-':
-				n = -1
-				field = field[1:]
-			}
+// UpdateId is a convenience helper equivalent to:
+//
+//     err := collection.Update(bson.M{"_id": id}, update)
+//
+func (c *Collection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.M{"_id": id}, update)
+}
+
+// UpdateAll finds all documents matching the provided selector document
+// and modifies them according to the update document. It is not an error
+// for the update to not be applied on any documents.
+func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *imgo.ChangeInfo, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	keys, err := c.lookup(selector, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err = c.update(key, update); err != nil {
+			return nil, err
 		}
-		if field == "" {
-			panic("Sort: empty field name")
+	}
+	return &imgo.ChangeInfo{Updated: len(keys)}, nil
+}
+
+// UpdateAllContext works like UpdateAll, with cancellation as in
+// InsertContext.
+func (c *Collection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (info *imgo.ChangeInfo, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.UpdateAll(selector, update)
+}
+
+// Upsert finds a single document matching the provided selector document
+// and modifies it according to the update document. If no document matching
+// the selector is found, the update document is applied to the selector
+// document and the result is inserted in the collection.
+func (c *Collection) Upsert(selector interface{}, update interface{}) (info *imgo.ChangeInfo, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	keys, err := c.lookup(selector, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		if err = c.update(keys[0], update); err != nil {
+			return nil, err
 		}
-		order = append(order, bson.DocElem{field, n})
+		return &imgo.ChangeInfo{Updated: 1}, nil
 	}
-	q.op.OrderBy = order
-	return q
+	id, err := c.upsert(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	return &imgo.ChangeInfo{UpsertedId: id}, nil
 }
 
-type Iter struct {
-	coll    *Collection
-	err     error
-	op      QueryOp
-	docData Queue
-	got     bool
+// UpsertContext works like Upsert, with cancellation as in InsertContext.
+func (c *Collection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (info *imgo.ChangeInfo, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Upsert(selector, update)
 }
 
-func (iter *Iter) Err() error {
-	return iter.err
+// UpsertId is a convenience helper equivalent to:
+//
+//     info, err := collection.Upsert(bson.M{"_id": id}, update)
+//
+func (c *Collection) UpsertId(id interface{}, update interface{}) (info *imgo.ChangeInfo, err error) {
+	return c.Upsert(bson.M{"_id": id}, update)
 }
 
-func (iter *Iter) Close() error {
-	return iter.err
+func (c *Collection) upsert(selector interface{}, update interface{}) (id interface{}, err error) {
+	doc, err := modify.Upsert(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	return c.insert(doc)
 }
 
-func (iter *Iter) Timeout() bool {
-	return true
+func (c *Collection) update(key string, update interface{}) error {
+	hasModifiers, err := modify.HasModifiers(update)
+	if err != nil {
+		return err
+	}
+	if !hasModifiers {
+		return c.replace(key, update)
+	}
+	data, err := modify.Apply(c.data[key], update, false)
+	if err != nil {
+		return err
+	}
+	if err = c.checkIndexes(key, data); err != nil {
+		return err
+	}
+	c.set(key, data)
+	return nil
 }
 
-func (iter *Iter) getAll() {
-	iter.coll.RLock()
-	defer iter.coll.RUnlock()
+func (c *Collection) replace(key string, update interface{}) error {
+	oldId, _ := docId(c.data[key])
+	if newId, ok := docId(update); ok && !isMissingId(newId) && idKey(newId) != key {
+		return modify.IdChangedError(oldId, newId)
+	}
+	data, err := storedDoc(update, oldId)
+	if err != nil {
+		return err
+	}
+	if err = c.checkIndexes(key, data); err != nil {
+		return err
+	}
+	c.set(key, data)
+	return nil
+}
 
-	for _, data := range iter.coll.data {
-		if ok, _ := parse.Match(data, iter.op.query); !ok {
-			continue
-		}
-		iter.docData.Push(data)
+// Remove finds a single document matching the provided selector document
+// and removes it from the collection. ErrNotFound is returned if no
+// document matches the selector.
+func (c *Collection) Remove(selector interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	keys, err := c.lookup(selector, 1)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
 	}
+	c.remove(keys[0])
+	return nil
+}
 
-	if len(iter.op.OrderBy) > 0 {
-		_ = iter.docData.Sort(iter.op.OrderBy)
+// RemoveContext works like Remove, with cancellation as in InsertContext.
+func (c *Collection) RemoveContext(ctx context.Context, selector interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return c.Remove(selector)
+}
 
-	iter.docData.Skip(int(iter.op.skip))
-	iter.docData.Limit(int(iter.op.limit))
+// RemoveId is a convenience helper equivalent to:
+//
+//     err := collection.Remove(bson.M{"_id": id})
+//
+func (c *Collection) RemoveId(id interface{}) error {
+	return c.Remove(bson.M{"_id": id})
+}
 
-	iter.got = true
-	return
+// RemoveAll finds all documents matching the provided selector document
+// and removes them from the collection.
+func (c *Collection) RemoveAll(selector interface{}) (info *imgo.ChangeInfo, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	keys, err := c.lookup(selector, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		c.remove(key)
+	}
+	return &imgo.ChangeInfo{Removed: len(keys)}, nil
+}
+
+// RemoveAllContext works like RemoveAll, with cancellation as in
+// InsertContext.
+func (c *Collection) RemoveAllContext(ctx context.Context, selector interface{}) (info *imgo.ChangeInfo, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.RemoveAll(selector)
+}
+
+// WithWriteConcern is accepted for compatibility with mgo. Writes are
+// applied in memory before returning, so it has no effect.
+func (c *Collection) WithWriteConcern(wc *imgo.WriteConcern) imgo.Collection {
+	return c
 }
 
-func (iter *Iter) Next(result interface{}) bool {
-	if iter.err == nil && !iter.got {
-		iter.getAll()
+// DropCollection removes all documents, indexes and settings of the
+// collection.
+func (c *Collection) DropCollection() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.data = make(map[string]bson.D)
+	c.order = nil
+	c.info = nil
+	c.indexes = nil
+	return nil
+}
+
+// Create records the details of info for the collection. Capped
+// collections are supported by enforcing info.MaxDocs; MaxBytes is
+// only validated.
+func (c *Collection) Create(info *imgo.CollectionInfo) error {
+	if info.Capped && info.MaxBytes < 1 {
+		return fmt.Errorf("Collection.Create: with Capped, MaxBytes must also be set")
 	}
 
-	resultv := reflect.ValueOf(result)
-	if docData := iter.docData.Pop(); docData != nil {
-		resultv.Elem().Set(reflect.ValueOf(docData))
-		return true
+	c.Lock()
+	defer c.Unlock()
+
+	if c.info != nil || len(c.data) > 0 {
+		return &mgo.QueryError{Code: 48, Message: "collection already exists"}
 	}
-	return false
+	infoCopy := *info
+	c.info = &infoCopy
+	return nil
 }
 
-func (iter *Iter) All(result interface{}) error {
-	resultv := reflect.ValueOf(result)
-	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
-		return ErrTypeAll
+// EnsureIndexKey ensures an index with the given key exists, creating it
+// if necessary.
+func (c *Collection) EnsureIndexKey(key ...string) error {
+	return c.EnsureIndex(imgo.Index{Key: key})
+}
+
+// EnsureIndex ensures an index with the given details exists, creating it
+// if necessary. Creating a unique index fails if documents in the
+// collection have the same key, unless index.DropDups is set, in which
+// case all but the first of them are removed.
+func (c *Collection) EnsureIndex(index imgo.Index) error {
+	ix, err := newIndex(index)
+	if err != nil {
+		return err
 	}
-	slicev := resultv.Elem()
-	slicev = slicev.Slice(0, slicev.Cap())
-	elemt := slicev.Type().Elem()
-	i := 0
-	for {
-		if slicev.Len() == i {
-			elemp := reflect.New(elemt)
-			if !iter.Next(elemp.Interface()) {
-				break
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, existing := range c.indexes {
+		if existing.info.Name != ix.info.Name {
+			continue
+		}
+		if existing.info.Unique != index.Unique || existing.info.Sparse != index.Sparse {
+			return &mgo.LastError{Code: 85, Err: "Index with name: " + ix.info.Name + " already exists with different options"}
+		}
+		return nil
+	}
+
+	var dups []string
+	for _, key := range c.order {
+		doc := c.data[key]
+		if err := ix.check(c.name, key, doc); err != nil {
+			if index.DropDups && mgo.IsDup(err) {
+				dups = append(dups, key)
+				continue
 			}
-			slicev = reflect.Append(slicev, elemp.Elem())
-			slicev = slicev.Slice(0, slicev.Cap())
-		} else {
-			if !iter.Next(slicev.Index(i).Addr().Interface()) {
-				break
+			return err
+		}
+		ix.add(key, doc)
+	}
+	for _, key := range dups {
+		c.remove(key)
+	}
+	c.indexes = append(c.indexes, ix)
+	return nil
+}
+
+// DropIndex removes the index with the given key.
+func (c *Collection) DropIndex(key ...string) error {
+	name, err := indexName(key)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if name == "_id_" {
+		return &mgo.QueryError{Message: "may not delete _id index"}
+	}
+	for i, ix := range c.indexes {
+		if ix.info.Name == name {
+			c.indexes = append(c.indexes[:i], c.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return &mgo.QueryError{Code: 27, Message: "index not found with name [" + name + "]"}
+}
+
+// Indexes returns the indexes of the collection, including the one on _id,
+// sorted by name.
+func (c *Collection) Indexes() (indexes []imgo.Index, err error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	indexes = append(indexes, imgo.Index{Key: []string{"_id"}, Name: "_id_"})
+	for _, ix := range c.indexes {
+		indexes = append(indexes, ix.info)
+	}
+	sort.Sort(indexesByName(indexes))
+	return indexes, nil
+}
+
+type indexesByName []imgo.Index
+
+func (p indexesByName) Len() int           { return len(p) }
+func (p indexesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p indexesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// indexName returns the name the server assigns to an index with the given
+// key, such as "a_1_b_-1" for []string{"a", "-b"}.
+func indexName(key []string) (string, error) {
+	var parts []string
+	for _, field := range key {
+		order := "1"
+		if field != "" {
+			switch field[0] {
+			case '+':
+				field = field[1:]
+			case '-':
+				order = "-1"
+				field = field[1:]
+			case '@':
+				order = "2d"
+				field = field[1:]
 			}
 		}
-		i++
+		if field == "" {
+			return "", fmt.Errorf("Invalid index key: empty field name")
+		}
+		parts = append(parts, field, order)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("Invalid index key: no fields provided")
+	}
+	return strings.Join(parts, "_"), nil
+}
+
+// queryError converts the errors reported by the parse package into the
+// ones mgo returns for queries rejected by the server.
+func queryError(err error) error {
+	if qerr, ok := err.(*parse.QueryError); ok {
+		return &mgo.QueryError{Code: qerr.Code, Message: qerr.Message}
+	}
+	return err
+}
+
+// dupKeyError returns the error reported by the server when storing
+// a document would violate the unique index named index, with the given
+// key values.
+func dupKeyError(coll, index string, values ...interface{}) error {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf(": %#v", value)
+	}
+	return &mgo.LastError{
+		Code: 11000,
+		Err:  fmt.Sprintf("E11000 duplicate key error index: %s.$%s  dup key: { %s }", coll, index, strings.Join(parts, ", ")),
 	}
-	resultv.Elem().Set(slicev.Slice(0, i))
-	return iter.Close()
 }
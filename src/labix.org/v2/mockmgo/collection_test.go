@@ -10,6 +10,8 @@ import (
 
 	"labix.org/v2/base/bson"
 	. "labix.org/v2/base/log"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
 )
 
 type cLogger struct{}
@@ -276,6 +278,784 @@ func testFindAll(t *testing.T) {
 	}
 }
 
+func TestWrite(t *testing.T) {
+	type Test struct {
+		Id bson.ObjectId `bson:"_id,omitempty"`
+		A  int           `bson:"a"`
+	}
+
+	c := NewCollection("test3", nil)
+
+	// insert
+	data := Test{A: 10}
+	err := c.Insert(&data, bson.M{"a": 20})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	if data.Id != "" {
+		t.Fatal("insert modified the provided document:", data)
+	}
+
+	var result Test
+	err = c.Find(bson.M{"a": 10}).One(&result)
+	if err != nil {
+		t.Fatal("find failed:", err)
+	}
+	if !result.Id.Valid() || result.A != 10 {
+		t.Fatal("bad document inserted:", result)
+	}
+
+	var resultM bson.M
+	err = c.Find(bson.M{"a": 20}).One(&resultM)
+	if err != nil {
+		t.Fatal("find failed:", err)
+	}
+	if _, ok := resultM["_id"].(bson.ObjectId); !ok {
+		t.Fatal("_id not assigned:", resultM)
+	}
+
+	err = c.Insert(result)
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+
+	// update
+	err = c.Update(bson.M{"a": 10}, Test{A: 11})
+	if err != nil {
+		t.Fatal("update failed:", err)
+	}
+
+	err = c.Find(bson.M{"_id": result.Id}).One(&result)
+	if err != nil || result.A != 11 {
+		t.Fatal("update not applied:", result, err)
+	}
+
+	err = c.UpdateId(result.Id, Test{A: 12})
+	if err != nil {
+		t.Fatal("update failed:", err)
+	}
+
+	n, err := c.Find(bson.M{"a": 12}).Count()
+	if err != nil || n != 1 {
+		t.Fatal("update not applied:", n, err)
+	}
+
+	err = c.UpdateId(result.Id, bson.M{"$inc": bson.M{"a": 2}, "$set": bson.M{"b.c": 1}})
+	if err != nil {
+		t.Fatal("update failed:", err)
+	}
+
+	resultM = nil
+	err = c.Find(bson.M{"_id": result.Id}).One(&resultM)
+	if err != nil || resultM["a"] != 14 || resultM["b"].(bson.M)["c"] != 1 {
+		t.Fatal("update not applied:", resultM, err)
+	}
+
+	err = c.UpdateId(result.Id, bson.M{"$inc": bson.M{"a": "x"}})
+	if err == nil {
+		t.Fatal("$inc with a string should fail")
+	}
+
+	err = c.UpdateId(result.Id, Test{A: 12})
+	if err != nil {
+		t.Fatal("update failed:", err)
+	}
+
+	newId := bson.NewObjectId()
+	err = c.Update(bson.M{"a": 12}, Test{Id: newId, A: 13})
+	expected := "The _id field cannot be changed from {_id: ObjectId('" + result.Id.Hex() + "')} to {_id: ObjectId('" + newId.Hex() + "')}."
+	if lerr, ok := err.(*mgo.LastError); !ok || lerr.Code != 16837 || lerr.Err != expected {
+		t.Fatal("expected _id change error, got:", err)
+	}
+
+	err = c.Update(bson.M{"a": 10}, Test{A: 11})
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	// remove
+	err = c.RemoveId(result.Id)
+	if err != nil {
+		t.Fatal("remove failed:", err)
+	}
+
+	err = c.RemoveId(result.Id)
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	err = c.Remove(bson.M{"a": 20})
+	if err != nil {
+		t.Fatal("remove failed:", err)
+	}
+
+	n, err = c.Find(nil).Count()
+	if err != nil || n != 0 {
+		t.Fatal("remove not applied:", n, err)
+	}
+
+	// write concerns don't change the outcome of writes
+	err = c.WithWriteConcern(&mgo.WriteConcern{WMode: "majority"}).Insert(bson.M{"_id": 1})
+	if err != nil {
+		t.Fatal("insert with a write concern failed:", err)
+	}
+	err = c.WithWriteConcern(&mgo.WriteConcern{Unacknowledged: true}).Insert(bson.M{"_id": 1})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+}
+
+func TestWriteZeroIds(t *testing.T) {
+	c := NewCollection("test3z", nil)
+
+	// Zero values other than the empty ObjectId are valid ids.
+	for _, id := range []interface{}{0, ""} {
+		err := c.Insert(bson.M{"_id": id, "a": 1})
+		if err != nil {
+			t.Fatalf("insert of _id %#v failed: %v", id, err)
+		}
+		var result bson.M
+		err = c.Find(bson.M{"_id": id}).One(&result)
+		if err != nil || result["_id"] != id || result["a"] != 1 {
+			t.Fatalf("_id %#v not stored as is: %v %v", id, result, err)
+		}
+		n, err := c.FindId(id).Count()
+		if err != nil || n != 1 {
+			t.Fatalf("count of _id %#v: %d %v", id, n, err)
+		}
+		err = c.Insert(bson.D{{"_id", id}, {"a", 2}})
+		if !mgo.IsDup(err) {
+			t.Fatalf("expected duplicate key error for _id %#v, got: %v", id, err)
+		}
+		err = c.UpdateId(id, bson.M{"_id": id, "a": 3})
+		if err != nil {
+			t.Fatalf("update of _id %#v failed: %v", id, err)
+		}
+	}
+
+	// Missing ids are assigned: nil, the empty ObjectId, and empty ids
+	// tagged omitempty.
+	type Test struct {
+		Id int `bson:"_id,omitempty"`
+		A  int `bson:"a"`
+	}
+	docs := []interface{}{bson.M{"_id": nil, "a": 4}, bson.M{"_id": bson.ObjectId(""), "a": 4}, Test{A: 4}}
+	for _, doc := range docs {
+		if err := c.Insert(doc); err != nil {
+			t.Fatalf("insert of %#v failed: %v", doc, err)
+		}
+	}
+	var results []bson.M
+	err := c.Find(bson.M{"a": 4}).All(&results)
+	if err != nil || len(results) != 3 {
+		t.Fatal("unexpected documents:", results, err)
+	}
+	for _, result := range results {
+		if id, ok := result["_id"].(bson.ObjectId); !ok || !id.Valid() {
+			t.Fatal("_id not assigned:", result)
+		}
+	}
+	n, err := c.Find(nil).Count()
+	if err != nil || n != 5 {
+		t.Fatal("unexpected count:", n, err)
+	}
+}
+
+func TestWriteMany(t *testing.T) {
+	c := NewCollection("test4", nil)
+
+	err := c.Insert(bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 1}, bson.M{"_id": 3, "a": 2})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	info, err := c.UpdateAll(bson.M{"a": 1}, bson.M{"$set": bson.M{"b": true}})
+	if err != nil || info.Updated != 2 {
+		t.Fatal("update all failed:", info, err)
+	}
+
+	n, err := c.Find(bson.M{"b": true}).Count()
+	if err != nil || n != 2 {
+		t.Fatal("update all not applied:", n, err)
+	}
+
+	info, err = c.Upsert(bson.M{"a": 2}, bson.M{"$inc": bson.M{"n": 1}})
+	if err != nil || info.Updated != 1 || info.UpsertedId != nil {
+		t.Fatal("upsert on existing document failed:", info, err)
+	}
+
+	info, err = c.Upsert(bson.M{"a": 3}, bson.M{"$inc": bson.M{"n": 1}})
+	if err != nil || info.UpsertedId == nil {
+		t.Fatal("upsert failed:", info, err)
+	}
+
+	var result bson.M
+	err = c.Find(bson.M{"_id": info.UpsertedId}).One(&result)
+	if err != nil || result["a"] != 3 || result["n"] != 1 {
+		t.Fatal("upsert not applied:", result, err)
+	}
+
+	info, err = c.UpsertId(5, bson.M{"a": 5})
+	if err != nil || info.UpsertedId != 5 {
+		t.Fatal("upsert by id failed:", info, err)
+	}
+
+	n, err = c.Count()
+	if err != nil || n != 5 {
+		t.Fatal("count failed:", n, err)
+	}
+
+	info, err = c.RemoveAll(bson.M{"a": bson.M{"$gte": 2}})
+	if err != nil || info.Removed != 3 {
+		t.Fatal("remove all failed:", info, err)
+	}
+
+	err = c.DropCollection()
+	if err != nil {
+		t.Fatal("drop failed:", err)
+	}
+
+	n, err = c.Count()
+	if err != nil || n != 0 {
+		t.Fatal("drop not applied:", n, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	type Test struct {
+		Id int   `bson:"_id"`
+		A  int   `bson:"a"`
+		B  []int `bson:"b"`
+	}
+
+	c := NewCollection("test5", nil)
+	err := c.Insert(Test{1, 10, []int{1, 2}}, Test{2, 20, []int{2, 3}}, Test{3, 30, nil})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// query types
+	var result Test
+	err = c.FindId(2).One(&result)
+	if err != nil || result.A != 20 {
+		t.Fatal("find by id failed:", result, err)
+	}
+
+	n, err := c.Find(bson.D{{"a", bson.D{{"$gte", 20}}}}).Count()
+	if err != nil || n != 2 {
+		t.Fatal("find with bson.D failed:", n, err)
+	}
+
+	err = c.Find(struct {
+		A int `bson:"a"`
+	}{30}).One(&result)
+	if err != nil || result.Id != 3 {
+		t.Fatal("find with struct failed:", result, err)
+	}
+
+	n, err = c.Find(bson.M{"b": bson.M{"$size": 2}, "a": bson.M{"$not": bson.M{"$gt": 15}}}).Count()
+	if err != nil || n != 1 {
+		t.Fatal("find with $size and $not failed:", n, err)
+	}
+
+	err = c.Find(bson.M{"a": bson.M{"$foo": 1}}).One(&result)
+	if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 17287 {
+		t.Fatal("expected bad value error, got:", err)
+	}
+
+	err = c.UpdateId(3, bson.M{"$set": bson.M{"a": 30}})
+	if err != nil {
+		t.Fatal("update by id failed:", err)
+	}
+
+	// select
+	var resultM bson.M
+	err = c.Find(bson.M{"_id": 2}).Select(bson.M{"a": 1}).One(&resultM)
+	if err != nil || !reflect.DeepEqual(resultM, bson.M{"_id": 2, "a": 20}) {
+		t.Fatal("select failed:", resultM, err)
+	}
+
+	resultM = nil
+	err = c.Find(bson.M{"_id": 2}).Select(bson.M{"_id": 0, "b": 0}).One(&resultM)
+	if err != nil || !reflect.DeepEqual(resultM, bson.M{"a": 20}) {
+		t.Fatal("select failed:", resultM, err)
+	}
+
+	// distinct
+	var values []int
+	err = c.Find(nil).Distinct("b", &values)
+	if err != nil || !reflect.DeepEqual(values, []int{1, 2, 3}) {
+		t.Fatal("distinct failed:", values, err)
+	}
+
+	// for
+	var sum int
+	var elem *Test
+	err = c.Find(nil).Sort("-a").Limit(2).For(&elem, func() error {
+		sum += elem.A
+		return nil
+	})
+	if err != nil || sum != 50 {
+		t.Fatal("for failed:", sum, err)
+	}
+
+	// count honors skip and limit
+	n, err = c.Find(nil).Skip(1).Limit(1).Count()
+	if err != nil || n != 1 {
+		t.Fatal("count failed:", n, err)
+	}
+
+	// read preferences don't change the results
+	n, err = c.Find(nil).ReadPreference(&mgo.ReadPreference{Mode: mgo.ReadSecondary}).Count()
+	if err != nil || n != 3 {
+		t.Fatal("count with a read preference failed:", n, err)
+	}
+
+	// apply
+	info, err := c.Find(bson.M{"a": bson.M{"$gte": 20}}).Sort("-a").Apply(imgo.Change{
+		Update:    bson.M{"$inc": bson.M{"a": 1}},
+		ReturnNew: true,
+	}, &result)
+	if err != nil || info.Updated != 1 || result.Id != 3 || result.A != 31 {
+		t.Fatal("apply failed:", info, result, err)
+	}
+
+	info, err = c.Find(bson.M{"_id": 1}).Apply(imgo.Change{Remove: true}, &result)
+	if err != nil || info.Removed != 1 || result.Id != 1 {
+		t.Fatal("apply remove failed:", info, result, err)
+	}
+
+	_, err = c.Find(bson.M{"_id": 1}).Apply(imgo.Change{Update: bson.M{"a": 1}}, &result)
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	info, err = c.Find(bson.M{"_id": 1}).Apply(imgo.Change{Update: bson.M{"$set": bson.M{"a": 1}}, Upsert: true}, nil)
+	if err != nil || info.UpsertedId != 1 {
+		t.Fatal("apply upsert failed:", info, err)
+	}
+}
+
+func TestTail(t *testing.T) {
+	c := NewCollection("test6", nil)
+	err := c.Insert(bson.M{"_id": 1})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	iter := c.Find(nil).Tail(100 * time.Millisecond)
+	var result bson.M
+	if !iter.Next(&result) || result["_id"] != 1 {
+		t.Fatal("tail failed:", result, iter.Err())
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Insert(bson.M{"_id": 2})
+	}()
+	if !iter.Next(&result) || result["_id"] != 2 {
+		t.Fatal("tail failed:", result, iter.Err())
+	}
+
+	if iter.Next(&result) || !iter.Timeout() {
+		t.Fatal("tail should time out:", result, iter.Err())
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	c := NewCollection("test7", nil)
+
+	err := c.EnsureIndexKey("a", "-b")
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	err = c.EnsureIndex(imgo.Index{Key: []string{"c"}, Unique: true})
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+
+	indexes, err := c.Indexes()
+	if err != nil {
+		t.Fatal("indexes failed:", err)
+	}
+	var names []string
+	for _, index := range indexes {
+		names = append(names, index.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"_id_", "a_1_b_-1", "c_1"}) {
+		t.Fatal("bad indexes:", names)
+	}
+
+	err = c.DropIndex("a", "-b")
+	if err != nil {
+		t.Fatal("drop index failed:", err)
+	}
+	err = c.DropIndex("a", "-b")
+	if err == nil {
+		t.Fatal("dropping a missing index should fail")
+	}
+}
+
+func TestUniqueIndexes(t *testing.T) {
+	c := NewCollection("test9", nil)
+	err := c.Insert(bson.M{"_id": 1, "a": 1, "b": 1}, bson.M{"_id": 2, "a": 1, "b": 2}, bson.M{"_id": 3, "a": 2.0, "b": 1})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// compound unique index
+	err = c.EnsureIndex(imgo.Index{Key: []string{"a"}, Unique: true})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	err = c.EnsureIndex(imgo.Index{Key: []string{"a", "b"}, Unique: true})
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 4, "a": int64(2), "b": 1.0})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	err = c.Update(bson.M{"_id": 2}, bson.M{"$set": bson.M{"b": 1}})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	err = c.Update(bson.M{"_id": 2}, bson.M{"a": 1, "b": 3})
+	if err != nil {
+		t.Fatal("update failed:", err)
+	}
+	_, err = c.Upsert(bson.M{"_id": 5}, bson.M{"$set": bson.M{"a": 1, "b": 3}})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	if n, _ := c.Count(); n != 3 {
+		t.Fatal("failed writes changed the collection:", n)
+	}
+	err = c.EnsureIndex(imgo.Index{Key: []string{"a", "b"}, Sparse: true})
+	if err == nil {
+		t.Fatal("ensuring an index with different options should fail")
+	}
+
+	// missing fields are indexed as null, unless the index is sparse
+	err = c.EnsureIndex(imgo.Index{Key: []string{"c"}, Unique: true})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	err = c.EnsureIndex(imgo.Index{Key: []string{"c"}, Unique: true, Sparse: true})
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 6, "a": 3, "c": "x"}, bson.M{"_id": 7, "a": 4})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 8, "a": 5, "c": "x"})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+
+	// array elements are indexed individually
+	err = c.EnsureIndex(imgo.Index{Key: []string{"tags"}, Unique: true, Sparse: true})
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 9, "a": 9, "tags": []string{"x", "y"}})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 10, "a": 10, "tags": []string{"z", "y"}})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	err = c.Insert(bson.M{"_id": 11, "a": 11, "tags": []string{"z", "z"}})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	err = c.Insert(bson.M{"_id": 12, "a": []int{1}, "b": []int{1}})
+	if lerr, ok := err.(*mgo.LastError); !ok || lerr.Code != 10088 {
+		t.Fatal("expected parallel arrays error, got:", err)
+	}
+
+	// dropDups keeps the first document with each key
+	d := NewCollection("test10", nil)
+	err = d.Insert(bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 1}, bson.M{"_id": 3, "a": 2})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	err = d.EnsureIndex(imgo.Index{Key: []string{"a"}, Unique: true, DropDups: true})
+	if err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	var ids []struct {
+		Id int `bson:"_id"`
+	}
+	err = d.Find(nil).All(&ids)
+	if err != nil || len(ids) != 2 || ids[0].Id != 1 || ids[1].Id != 3 {
+		t.Fatal("duplicates not dropped:", ids, err)
+	}
+}
+
+func TestQueryPlanner(t *testing.T) {
+	c := NewCollection("test11", nil)
+	for i := 0; i < 10; i++ {
+		err := c.Insert(bson.M{"_id": i, "a": i % 5, "b": []int{i, i + 10}, "c": 10 - i})
+		if err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+	err := c.Insert(bson.M{"_id": 10, "a": "3"})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	for _, key := range [][]string{{"a"}, {"b"}, {"-c"}} {
+		if err = c.EnsureIndexKey(key...); err != nil {
+			t.Fatal("ensure index failed:", err)
+		}
+	}
+
+	type explain struct {
+		Cursor          string
+		N               int
+		NScanned        int `bson:"nscanned"`
+		NScannedObjects int `bson:"nscannedObjects"`
+	}
+	tests := []struct {
+		query   bson.M
+		hint    []string
+		ids     []int
+		explain explain
+	}{
+		{bson.M{"a": 3}, nil, []int{3, 8}, explain{"BtreeCursor a_1", 2, 2, 2}},
+		{bson.M{"a": 3.0, "c": bson.M{"$lt": 5}}, nil, []int{8}, explain{"BtreeCursor a_1", 1, 2, 2}},
+		{bson.M{"a": bson.M{"$in": []int{4, 1}}}, nil, []int{1, 6, 4, 9}, explain{"BtreeCursor a_1", 4, 4, 4}},
+		{bson.M{"a": bson.M{"$gte": 3}}, nil, []int{3, 8, 4, 9}, explain{"BtreeCursor a_1", 4, 4, 4}},
+		{bson.M{"a": bson.M{"$lt": "4"}}, nil, []int{10}, explain{"BtreeCursor a_1", 1, 1, 1}},
+		{bson.M{"b": bson.M{"$gt": 5, "$lt": 12}}, nil, []int{6, 7, 8, 9, 0, 1, 2, 3, 4, 5}, explain{"BtreeCursor b_1", 10, 14, 10}},
+		{bson.M{"b": bson.M{"$elemMatch": bson.M{"$gt": 5, "$lt": 12}}}, nil, []int{0, 1, 6, 7, 8, 9}, explain{"BasicCursor", 6, 11, 11}},
+		{bson.M{"c": bson.M{"$lte": 2}}, nil, []int{8, 9}, explain{"BtreeCursor c_-1", 2, 2, 2}},
+		{bson.M{"_id": 7}, nil, []int{7}, explain{"BtreeCursor _id_", 1, 1, 1}},
+		{bson.M{"c": bson.M{"$exists": false}}, nil, []int{10}, explain{"BasicCursor", 1, 11, 11}},
+		{bson.M{"c": bson.M{"$gt": 7}}, []string{"a"}, []int{0, 1, 2}, explain{"BtreeCursor a_1", 3, 11, 11}},
+		{nil, []string{"-c"}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, explain{"BtreeCursor c_-1", 11, 11, 11}},
+	}
+	for _, test := range tests {
+		var docs []struct {
+			Id int `bson:"_id"`
+		}
+		err := c.Find(test.query).Hint(test.hint...).All(&docs)
+		if err != nil {
+			t.Fatalf("query %#v failed: %v", test.query, err)
+		}
+		var ids []int
+		for _, doc := range docs {
+			ids = append(ids, doc.Id)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("query %#v returned %v, expected %v", test.query, ids, test.ids)
+		}
+
+		var result explain
+		err = c.Find(test.query).Hint(test.hint...).Explain(&result)
+		if err != nil || result != test.explain {
+			t.Errorf("query %#v explained as %+v, expected %+v (%v)", test.query, result, test.explain, err)
+		}
+	}
+
+	err = c.Find(nil).Hint("d").One(&bson.M{})
+	if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 17007 {
+		t.Fatal("expected bad hint error, got:", err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	type Item struct {
+		N int    `bson:"n"`
+		S string `bson:"s"`
+	}
+	type Doc struct {
+		Id    int    `bson:"_id"`
+		A     int    `bson:"a"`
+		B     Item   `bson:"b"`
+		Items []Item `bson:"items"`
+		L     []int  `bson:"l"`
+	}
+
+	doc := Doc{1, 10, Item{1, "x"}, []Item{{1, "x"}, {2, "y"}, {3, "y"}}, []int{1, 2, 3, 4, 5}}
+	c := NewCollection("test8", nil)
+	if err := c.Insert(&doc); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// documents decode into any compatible type, and don't share memory
+	// with the stored ones
+	var other struct {
+		A int64   `bson:"a"`
+		L []int32 `bson:"l"`
+	}
+	err := c.FindId(1).One(&other)
+	if err != nil || other.A != 10 || len(other.L) != 5 {
+		t.Fatal("find into a different type failed:", other, err)
+	}
+	other.L[0] = 100
+	doc.L[1] = 100
+	var result Doc
+	err = c.FindId(1).One(&result)
+	if err != nil || !reflect.DeepEqual(result, Doc{1, 10, Item{1, "x"}, []Item{{1, "x"}, {2, "y"}, {3, "y"}}, []int{1, 2, 3, 4, 5}}) {
+		t.Fatal("stored document was modified:", result, err)
+	}
+
+	tests := []struct {
+		selector interface{}
+		expected bson.M
+	}{
+		{bson.M{"a": 1}, bson.M{"_id": 1, "a": 10}},
+		{bson.D{{"a", 1}, {"_id", 0}}, bson.M{"a": 10}},
+		{bson.M{"_id": 1}, bson.M{"_id": 1}},
+		{bson.M{"b.s": 1}, bson.M{"_id": 1, "b": bson.M{"s": "x"}}},
+		{bson.M{"items.n": 1}, bson.M{"_id": 1, "items": []interface{}{bson.M{"n": 1}, bson.M{"n": 2}, bson.M{"n": 3}}}},
+		{bson.M{"items": 0, "l": 0, "b.n": 0}, bson.M{"_id": 1, "a": 10, "b": bson.M{"s": "x"}}},
+		{bson.M{"_id": 0, "items": 0, "b": 0}, bson.M{"a": 10, "l": []interface{}{1, 2, 3, 4, 5}}},
+		{bson.M{"l": bson.M{"$slice": 2}, "a": 1}, bson.M{"_id": 1, "a": 10, "l": []interface{}{1, 2}}},
+		{bson.M{"l": bson.M{"$slice": -2}, "a": 1}, bson.M{"_id": 1, "a": 10, "l": []interface{}{4, 5}}},
+		{bson.M{"l": bson.M{"$slice": []int{1, 2}}, "a": 1}, bson.M{"_id": 1, "a": 10, "l": []interface{}{2, 3}}},
+		{bson.M{"l": bson.M{"$slice": []int{-2, 5}}, "a": 1}, bson.M{"_id": 1, "a": 10, "l": []interface{}{4, 5}}},
+		{bson.M{"items": bson.M{"$elemMatch": bson.M{"s": "y"}}}, bson.M{"_id": 1, "items": []interface{}{bson.M{"n": 2, "s": "y"}}}},
+		{bson.M{"items": bson.M{"$elemMatch": bson.M{"s": "z"}}}, bson.M{"_id": 1}},
+	}
+	for _, test := range tests {
+		var result bson.M
+		err := c.FindId(1).Select(test.selector).One(&result)
+		if err != nil || !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("select %#v: expected %#v, got %#v, %v", test.selector, test.expected, result, err)
+		}
+	}
+
+	// $slice alone doesn't restrict the other fields
+	var sliced Doc
+	err = c.Find(nil).Select(bson.M{"items": bson.M{"$slice": 1}}).One(&sliced)
+	if err != nil || sliced.A != 10 || len(sliced.Items) != 1 || len(sliced.L) != 5 {
+		t.Fatal("select with $slice failed:", sliced, err)
+	}
+
+	var all []bson.M
+	err = c.Find(nil).Select(bson.M{"a": 1}).All(&all)
+	if err != nil || !reflect.DeepEqual(all, []bson.M{{"_id": 1, "a": 10}}) {
+		t.Fatal("select with All failed:", all, err)
+	}
+
+	for _, selector := range []bson.M{
+		{"a": 1, "b": 0},
+		{"l": bson.M{"$slice": []int{1, 0}}},
+		{"l": bson.M{"$slice": "x"}},
+		{"items": bson.M{"$elemMatch": 1}},
+		{"a": bson.M{"$foo": 1}},
+	} {
+		err = c.Find(nil).Select(selector).One(&result)
+		if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 17287 {
+			t.Fatalf("select %#v: expected bad value error, got %v", selector, err)
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	c := NewCollection("test9", nil)
+	err := c.Insert(
+		bson.M{"_id": 1, "item": "a", "price": 10, "qty": 2, "tags": []string{"x", "y"}},
+		bson.M{"_id": 2, "item": "b", "price": 20, "qty": 1, "tags": []string{"y"}},
+		bson.M{"_id": 3, "item": "a", "price": 5.5, "qty": 10},
+		bson.M{"_id": 4, "item": "c", "price": 8, "qty": 5, "tags": []string{}},
+	)
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	tests := []struct {
+		pipeline interface{}
+		expected []bson.M
+	}{
+		{[]bson.M{{"$match": bson.M{"qty": bson.M{"$gt": 2}}}, {"$project": bson.M{"item": 1}}},
+			[]bson.M{{"_id": 3, "item": "a"}, {"_id": 4, "item": "c"}}},
+		{[]bson.M{{"$project": bson.M{"_id": 0, "name": "$item", "total": bson.M{"$multiply": []interface{}{"$price", "$qty"}}}}, {"$limit": 2}},
+			[]bson.M{{"name": "a", "total": 20}, {"name": "b", "total": 20}}},
+		{[]bson.M{{"$project": bson.M{"cheap": bson.M{"$cond": []interface{}{bson.M{"$lt": []interface{}{"$price", 10}}, true, false}}}}, {"$skip": 2}},
+			[]bson.M{{"_id": 3, "cheap": true}, {"_id": 4, "cheap": true}}},
+		{[]bson.M{{"$project": bson.M{"item": 1, "x.upper": bson.M{"$toUpper": "$item"}}}, {"$match": bson.M{"_id": 2}}},
+			[]bson.M{{"_id": 2, "item": "b", "x": bson.M{"upper": "B"}}}},
+		{[]bson.M{{"$sort": bson.D{{"item", -1}, {"qty", 1}}}, {"$project": bson.M{"_id": 1}}},
+			[]bson.M{{"_id": 4}, {"_id": 2}, {"_id": 1}, {"_id": 3}}},
+		{[]bson.M{{"$unwind": "$tags"}, {"$project": bson.M{"tags": 1}}},
+			[]bson.M{{"_id": 1, "tags": "x"}, {"_id": 1, "tags": "y"}, {"_id": 2, "tags": "y"}}},
+		{[]bson.M{{"$unwind": "$tags"}, {"$group": bson.M{"_id": "$tags", "n": bson.M{"$sum": 1}}}, {"$sort": bson.M{"_id": 1}}},
+			[]bson.M{{"_id": "x", "n": 1}, {"_id": "y", "n": 2}}},
+		{[]bson.M{{"$group": bson.D{
+			{"_id", "$item"},
+			{"qty", bson.M{"$sum": "$qty"}},
+			{"price", bson.M{"$sum": "$price"}},
+			{"avg", bson.M{"$avg": "$qty"}},
+			{"min", bson.M{"$min": "$price"}},
+			{"max", bson.M{"$max": "$price"}},
+			{"ids", bson.M{"$push": "$_id"}},
+			{"tags", bson.M{"$addToSet": "$tags"}},
+			{"first", bson.M{"$first": "$qty"}},
+			{"last", bson.M{"$last": "$qty"}},
+		}}, {"$match": bson.M{"_id": "a"}}},
+			[]bson.M{{"_id": "a", "qty": 12, "price": 15.5, "avg": 6.0, "min": 5.5, "max": 10, "ids": []interface{}{1, 3},
+				"tags": []interface{}{[]interface{}{"x", "y"}}, "first": 2, "last": 10}}},
+		{[]bson.M{{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": 1}, "items": bson.M{"$addToSet": "$item"}}}},
+			[]bson.M{{"_id": nil, "n": 4, "items": []interface{}{"a", "b", "c"}}}},
+		{[]bson.M{{"$group": bson.M{"_id": bson.M{"cheap": bson.M{"$lt": []interface{}{"$price", 10}}}, "n": bson.M{"$sum": 1}}}},
+			[]bson.M{{"_id": bson.M{"cheap": false}, "n": 2}, {"_id": bson.M{"cheap": true}, "n": 2}}},
+	}
+	for _, test := range tests {
+		var result []bson.M
+		err := c.Pipe(test.pipeline).All(&result)
+		if err != nil || !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("pipeline %#v: expected %#v, got %#v, %v", test.pipeline, test.expected, result, err)
+		}
+	}
+
+	var doc struct{ A, B int }
+	err = c.Pipe([]bson.M{{"$match": bson.M{"_id": 2}}, {"$project": bson.M{"a": "$qty", "b": bson.M{"$add": []interface{}{"$qty", 1}}}}}).One(&doc)
+	if err != nil || doc.A != 1 || doc.B != 2 {
+		t.Fatal("pipe one failed:", doc, err)
+	}
+	err = c.Pipe([]bson.M{{"$match": bson.M{"item": "z"}}}).One(&doc)
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	iter := c.Pipe([]bson.M{{"$match": bson.M{"qty": bson.M{"$gte": 5}}}}).Iter()
+	var n int
+	for iter.Next(&doc) {
+		n++
+	}
+	if err := iter.Close(); err != nil || n != 2 {
+		t.Fatal("pipe iter failed:", n, err)
+	}
+
+	errors := []struct {
+		pipeline interface{}
+		code     int
+	}{
+		{[]bson.M{{"$foo": 1}}, 16436},
+		{[]bson.D{{{"$match", bson.M{}}, {"$limit", 1}}}, 16435},
+		{[]bson.M{{"$group": bson.M{"n": bson.M{"$sum": 1}}}}, 15955},
+		{[]bson.M{{"$group": bson.M{"_id": nil, "n": bson.M{"$foo": 1}}}}, 15952},
+		{[]bson.M{{"$project": bson.M{"a": bson.M{"$foo": 1}}}}, 15999},
+		{[]bson.M{{"$project": bson.M{"item": 0}}}, 16406},
+		{[]bson.M{{"$match": bson.M{"a": bson.M{"$foo": 1}}}}, 16810},
+		{[]bson.M{{"$limit": 0}}, 15958},
+		{[]bson.M{{"$unwind": "$item"}}, 15978},
+		{[]bson.M{{"$project": bson.M{"a": bson.M{"$add": []interface{}{"$item", 1}}}}}, 16554},
+	}
+	for _, test := range errors {
+		err := c.Pipe(test.pipeline).All(&[]bson.M{})
+		if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != test.code {
+			t.Fatalf("pipeline %#v: expected error %d, got %v", test.pipeline, test.code, err)
+		}
+	}
+}
+
 func TestFind(t *testing.T) {
 	SetDebug(true)
 	SetLogger(new(cLogger))
@@ -0,0 +1,198 @@
+package mockmgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/error"
+	"labix.org/v2/mockmgo/modify"
+	"labix.org/v2/mockmgo/parse"
+)
+
+// idKey returns the key under which a document with the given _id is
+// stored in the collection data.
+func idKey(id interface{}) string {
+	if objId, ok := id.(bson.ObjectId); ok {
+		return objId.Hex()
+	}
+	data, err := json.Marshal(id)
+	if err != nil {
+		return fmt.Sprintf("%#v", id)
+	}
+	return string(data)
+}
+
+// docValue dereferences doc until a non-pointer value is found.
+func docValue(doc interface{}) reflect.Value {
+	v := reflect.ValueOf(doc)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// docId returns the _id field of doc, if it has one.
+func docId(doc interface{}) (id interface{}, ok bool) {
+	v := docValue(doc)
+	if d, isD := v.Interface().(bson.D); isD {
+		for _, elem := range d {
+			if elem.Name == "_id" {
+				return elem.Value, true
+			}
+		}
+		return nil, false
+	}
+	idv, ok := parse.GetStructValueByFlag("_id", v)
+	if !ok || !idv.IsValid() {
+		return nil, false
+	}
+	if v.Kind() == reflect.Struct {
+		// As when marshalling, an empty _id tagged omitempty is left out.
+		if i, omitEmpty := structIdField(v.Type()); i != -1 && omitEmpty && idv.IsZero() {
+			return nil, false
+		}
+	}
+	return idv.Interface(), true
+}
+
+// structIdField returns the index of the field holding _id in the struct
+// type t, or -1 if there's no such field, and whether the field is tagged
+// omitempty.
+func structIdField(t reflect.Type) (index int, omitEmpty bool) {
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("bson")
+		if tag == "" {
+			tag = t.Field(i).Tag.Get("json")
+		}
+		name := tag
+		if index := strings.Index(tag, ","); index != -1 {
+			name = tag[:index]
+		}
+		if name == "_id" {
+			return i, strings.Contains(tag[len(name):], ",omitempty")
+		}
+	}
+	return -1, false
+}
+
+// withId returns a copy of doc which is suitable to be stored in the
+// collection, with its _id field set to id. If id is nil, the _id already
+// present in doc is kept, and a new ObjectId is assigned when doc has none.
+// Pointers are dereferenced, so the stored document doesn't share memory
+// with the value provided by the caller.
+func withId(doc interface{}, id interface{}) (result interface{}, resultId interface{}, err error) {
+	v := docValue(doc)
+	if !v.IsValid() {
+		return nil, nil, fmt.Errorf("cannot store a nil document")
+	}
+
+	if id == nil {
+		if current, ok := docId(doc); ok && !isMissingId(current) {
+			id = current
+		} else {
+			id = bson.NewObjectId()
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			m.SetMapIndex(key, v.MapIndex(key))
+		}
+		idv := reflect.ValueOf(id)
+		if !idv.Type().AssignableTo(v.Type().Elem()) {
+			break
+		}
+		m.SetMapIndex(reflect.ValueOf("_id").Convert(v.Type().Key()), idv)
+		return m.Interface(), id, nil
+	case reflect.Slice:
+		d, ok := v.Interface().(bson.D)
+		if !ok {
+			break
+		}
+		result := bson.D{{"_id", id}}
+		for _, elem := range d {
+			if elem.Name != "_id" {
+				result = append(result, elem)
+			}
+		}
+		return result, id, nil
+	case reflect.Struct:
+		i, _ := structIdField(v.Type())
+		if i == -1 {
+			break
+		}
+		idv := reflect.ValueOf(id)
+		field := v.Type().Field(i)
+		if !idv.Type().AssignableTo(field.Type) {
+			break
+		}
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		s.Field(i).Set(idv)
+		return s.Interface(), id, nil
+	}
+
+	// The document can't hold the _id value natively, so turn it into
+	// a generic document instead.
+	var m bson.M
+	data, err := bson.Marshal(v.Interface())
+	if err == nil {
+		err = bson.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	m["_id"] = id
+	return m, id, nil
+}
+
+// storedDoc returns doc in the form the collection stores it: a bson.D
+// with _id first, holding nested documents as bson.D and arrays as
+// []interface{}, as they would be read back from the server. The _id is
+// set as done by withId.
+func storedDoc(doc interface{}, id interface{}) (bson.D, error) {
+	data, _, err := withId(doc, id)
+	if err != nil {
+		return nil, err
+	}
+	return modify.Normalize(data)
+}
+
+// isMissingId returns whether id stands for a document without an _id,
+// which is assigned a new ObjectId when stored. That's the case of nil and
+// of the empty ObjectId, but not of other zero values such as 0 or "",
+// which are valid ids.
+func isMissingId(id interface{}) bool {
+	if id == nil {
+		return true
+	}
+	objId, ok := id.(bson.ObjectId)
+	return ok && objId == ""
+}
+
+// setResult unmarshals data into the value pointed to by resultv, as mgo
+// does with the documents received from the server. The result never
+// shares memory with data.
+func setResult(resultv reflect.Value, data interface{}) error {
+	if resultv.Kind() != reflect.Ptr {
+		return ErrType
+	}
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, resultv.Interface())
+}
@@ -0,0 +1,347 @@
+package mockmgo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/parse"
+)
+
+// index is an in-memory secondary index. Its entries are kept sorted by
+// key, following the server ordering of BSON values and the direction of
+// each key field.
+type index struct {
+	info    imgo.Index
+	fields  []string
+	dirs    []int
+	entries []indexEntry
+}
+
+// indexEntry records that the document stored under docKey holds values
+// for the fields of the index. Documents holding arrays have an entry per
+// element.
+type indexEntry struct {
+	values []interface{}
+	docKey string
+}
+
+func newIndex(info imgo.Index) (*index, error) {
+	name, err := indexName(info.Key)
+	if err != nil {
+		return nil, err
+	}
+	info.Name = name
+	ix := &index{info: info}
+	for _, field := range info.Key {
+		dir := 1
+		switch field[0] {
+		case '+', '@':
+			field = field[1:]
+		case '-':
+			dir = -1
+			field = field[1:]
+		}
+		ix.fields = append(ix.fields, field)
+		ix.dirs = append(ix.dirs, dir)
+	}
+	return ix, nil
+}
+
+// compare orders index keys as stored in the entries.
+func (ix *index) compare(a, b []interface{}) int {
+	for i, dir := range ix.dirs {
+		if c := parse.Compare(a[i], b[i]) * dir; c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// keys returns the index keys for doc. Array values produce a key per
+// element, and at most one of the fields may hold an array. Missing fields
+// are indexed as null, unless the index is sparse and all of them are
+// missing, in which case doc isn't indexed at all.
+func (ix *index) keys(doc bson.D) (keys [][]interface{}, err error) {
+	keys = [][]interface{}{make([]interface{}, len(ix.fields))}
+	arrayField := ""
+	found := false
+	for i, field := range ix.fields {
+		v, ok := parse.GetStructValueByFlag(field, reflect.ValueOf(doc))
+		if !ok || !v.IsValid() {
+			continue
+		}
+		found = true
+		value := v.Interface()
+		array, isArray := value.([]interface{})
+		if !isArray || len(array) == 0 {
+			for _, key := range keys {
+				key[i] = value
+			}
+			continue
+		}
+		if arrayField != "" {
+			return nil, &mgo.LastError{Code: 10088, Err: fmt.Sprintf("cannot index parallel arrays [%s] [%s]", field, arrayField)}
+		}
+		arrayField = field
+		expanded := make([][]interface{}, 0, len(array))
+		for _, elem := range array {
+			key := append([]interface{}(nil), keys[0]...)
+			key[i] = elem
+			expanded = append(expanded, key)
+		}
+		keys = expanded
+	}
+	if !found && ix.info.Sparse {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// search returns the position of the first entry not sorting before key.
+func (ix *index) search(key []interface{}) int {
+	return sort.Search(len(ix.entries), func(i int) bool {
+		return ix.compare(ix.entries[i].values, key) >= 0
+	})
+}
+
+// check returns the error the server reports when storing doc under docKey
+// would violate the index.
+func (ix *index) check(coll, docKey string, doc bson.D) error {
+	keys, err := ix.keys(doc)
+	if err != nil || !ix.info.Unique {
+		return err
+	}
+	for _, key := range keys {
+		for i := ix.search(key); i < len(ix.entries) && ix.compare(ix.entries[i].values, key) == 0; i++ {
+			if ix.entries[i].docKey != docKey {
+				return dupKeyError(coll, ix.info.Name, key...)
+			}
+		}
+	}
+	return nil
+}
+
+// add indexes doc under docKey. It must have been checked first.
+func (ix *index) add(docKey string, doc bson.D) {
+	keys, _ := ix.keys(doc)
+	seen := make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		dup := false
+		for _, other := range seen {
+			if ix.compare(key, other) == 0 {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		seen = append(seen, key)
+		i := ix.search(key)
+		for i < len(ix.entries) && ix.compare(ix.entries[i].values, key) == 0 {
+			i++
+		}
+		ix.entries = append(ix.entries, indexEntry{})
+		copy(ix.entries[i+1:], ix.entries[i:])
+		ix.entries[i] = indexEntry{key, docKey}
+	}
+}
+
+// remove drops the entries for the document stored under docKey.
+func (ix *index) remove(docKey string) {
+	entries := ix.entries[:0]
+	for _, entry := range ix.entries {
+		if entry.docKey != docKey {
+			entries = append(entries, entry)
+		}
+	}
+	for i := len(entries); i < len(ix.entries); i++ {
+		ix.entries[i] = indexEntry{}
+	}
+	ix.entries = entries
+}
+
+// interval holds the values of the first index field a query may match.
+// An unbounded end stops at the last value of the same BSON type as the
+// other end, as values of other types never match comparison operators.
+type interval struct {
+	lo, hi               interface{}
+	loInc, hiInc         bool
+	loUnbound, hiUnbound bool
+	typ                  int
+}
+
+func pointInterval(v interface{}) interval {
+	return interval{lo: v, hi: v, loInc: true, hiInc: true}
+}
+
+// cmpLo returns whether v sorts before (-1) or within (+1) the lower
+// bound of iv.
+func (iv *interval) cmpLo(v interface{}) int {
+	if iv.loUnbound {
+		if parse.CanonicalType(v) < iv.typ {
+			return -1
+		}
+		return 1
+	}
+	c := parse.Compare(v, iv.lo)
+	if c == 0 && !iv.loInc {
+		return -1
+	}
+	return c
+}
+
+// cmpHi returns whether v sorts within (-1) or after (+1) the upper
+// bound of iv.
+func (iv *interval) cmpHi(v interface{}) int {
+	if iv.hiUnbound {
+		if parse.CanonicalType(v) > iv.typ {
+			return 1
+		}
+		return -1
+	}
+	c := parse.Compare(v, iv.hi)
+	if c == 0 && !iv.hiInc {
+		return 1
+	}
+	return c
+}
+
+// scan returns the keys of the documents with entries in the intervals,
+// in index order, and the number of entries visited. All entries are
+// visited when there are no intervals.
+func (ix *index) scan(intervals []interval) (docKeys []string, nscanned int) {
+	seen := make(map[string]bool)
+	visit := func(entry indexEntry) {
+		nscanned++
+		if !seen[entry.docKey] {
+			seen[entry.docKey] = true
+			docKeys = append(docKeys, entry.docKey)
+		}
+	}
+	if intervals == nil {
+		for _, entry := range ix.entries {
+			visit(entry)
+		}
+		return
+	}
+
+	dir := ix.dirs[0]
+	before := func(iv *interval, v interface{}) bool {
+		if dir > 0 {
+			return iv.cmpLo(v) < 0
+		}
+		return iv.cmpHi(v) > 0
+	}
+	after := func(iv *interval, v interface{}) bool {
+		if dir > 0 {
+			return iv.cmpHi(v) > 0
+		}
+		return iv.cmpLo(v) < 0
+	}
+	sort.Sort(intervalsByOrder{intervals, dir})
+	for i := range intervals {
+		iv := &intervals[i]
+		start := sort.Search(len(ix.entries), func(j int) bool {
+			return !before(iv, ix.entries[j].values[0])
+		})
+		for j := start; j < len(ix.entries) && !after(iv, ix.entries[j].values[0]); j++ {
+			visit(ix.entries[j])
+		}
+	}
+	return
+}
+
+type intervalsByOrder struct {
+	intervals []interval
+	dir       int
+}
+
+func (p intervalsByOrder) Len() int { return len(p.intervals) }
+func (p intervalsByOrder) Less(i, j int) bool {
+	return parse.Compare(p.intervals[i].lo, p.intervals[j].lo)*p.dir < 0
+}
+func (p intervalsByOrder) Swap(i, j int) {
+	p.intervals[i], p.intervals[j] = p.intervals[j], p.intervals[i]
+}
+
+// intervals returns the intervals of values for field which may match
+// queryM, or false if they can't be worked out from the query. Only
+// equality, $in and comparison operators are considered, and documents
+// matching other conditions are filtered afterwards.
+func intervals(queryM bson.M, field string) ([]interval, bool) {
+	value, ok := queryM[field]
+	if !ok || !plannable(value) {
+		return nil, false
+	}
+	ops, ok := value.(bson.M)
+	if !ok {
+		return []interval{pointInterval(value)}, true
+	}
+
+	if in, ok := ops["$in"]; ok {
+		values := reflect.ValueOf(in)
+		if values.Kind() != reflect.Slice {
+			return nil, false
+		}
+		var result []interval
+		for i := 0; i < values.Len(); i++ {
+			v := values.Index(i).Interface()
+			if !plannable(v) {
+				return nil, false
+			}
+			result = append(result, pointInterval(v))
+		}
+		return result, true
+	}
+
+	// Multikey documents may satisfy each bound with a different
+	// element, so only one of them is used.
+	for _, op := range []string{"$gt", "$gte", "$lt", "$lte"} {
+		v, ok := ops[op]
+		if !ok {
+			continue
+		}
+		if !plannable(v) {
+			return nil, false
+		}
+		iv := interval{typ: parse.CanonicalType(v)}
+		switch op {
+		case "$gt", "$gte":
+			iv.lo, iv.loInc, iv.hiUnbound = v, op == "$gte", true
+		default:
+			iv.hi, iv.hiInc, iv.loUnbound = v, op == "$lte", true
+		}
+		return []interval{iv}, true
+	}
+	return nil, false
+}
+
+// plannable reports whether index bounds can be computed for v, which is
+// either a value or a document of operators.
+func plannable(v interface{}) bool {
+	switch v := v.(type) {
+	case bson.M:
+		for k := range v {
+			if !strings.HasPrefix(k, "$") {
+				return false
+			}
+		}
+		return true
+	case bson.RegEx, []interface{}, bson.D:
+		return false
+	}
+	switch parse.CanonicalType(v) {
+	case parse.CanonicalType(bson.MinKey), parse.CanonicalType(bson.MaxKey),
+		parse.CanonicalType([]interface{}{}), parse.CanonicalType(bson.M{}):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,913 @@
+package mockserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/log"
+	. "labix.org/v2/error"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo"
+	"labix.org/v2/mockmgo/modify"
+)
+
+// defaultBatch is the number of documents returned in the first batch of
+// a query when the client doesn't say.
+const defaultBatch = 101
+
+// client holds the state of a connection.
+type client struct {
+	server    *Server
+	conn      net.Conn
+	session   imgo.Session
+	lastError lastError
+
+	// user is the subject of the client certificate once authenticated
+	// with MONGODB-X509.
+	user string
+}
+
+// lastError holds the outcome of the last write made through a connection,
+// as reported by the getLastError command.
+type lastError struct {
+	err             error
+	n               int
+	update          bool
+	updatedExisting bool
+	upserted        interface{}
+}
+
+func (e *lastError) doc() bson.D {
+	var d bson.D
+	if e.err != nil {
+		msg, code := errorInfo(e.err)
+		d = append(d, bson.DocElem{"err", msg}, bson.DocElem{"code", code})
+	} else {
+		d = append(d, bson.DocElem{"err", nil})
+	}
+	d = append(d, bson.DocElem{"n", e.n})
+	if e.update {
+		d = append(d, bson.DocElem{"updatedExisting", e.updatedExisting})
+	}
+	if e.upserted != nil {
+		d = append(d, bson.DocElem{"upserted", e.upserted})
+	}
+	return append(d, bson.DocElem{"ok", 1.0})
+}
+
+// errorInfo returns the message and code the server reports for err.
+func errorInfo(err error) (string, int) {
+	switch err := err.(type) {
+	case *mgo.LastError:
+		return err.Err, err.Code
+	case *mgo.QueryError:
+		return err.Message, err.Code
+	}
+	return err.Error(), 0
+}
+
+func (c *client) run(msg *message) error {
+	switch msg.opCode {
+	case opQuery:
+		return c.query(msg)
+	case opGetMore:
+		return c.getMore(msg)
+	case opInsert:
+		return c.insert(msg)
+	case opUpdate:
+		return c.update(msg)
+	case opDelete:
+		return c.remove(msg)
+	case opKillCursors:
+		return c.killCursors(msg)
+	}
+	return fmt.Errorf("unsupported opcode %d", msg.opCode)
+}
+
+// reply sends r to the client in response to msg, along with docs.
+func (c *client) reply(msg *message, r *reply, docs ...bson.D) error {
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		r.docs = append(r.docs, data)
+	}
+	return writeReply(c.conn, msg.requestId, r)
+}
+
+func splitNamespace(ns string) (dbname, cname string, err error) {
+	i := strings.Index(ns, ".")
+	if i <= 0 || i == len(ns)-1 {
+		return "", "", &mgo.QueryError{Code: 16256, Message: fmt.Sprintf("Invalid ns [%s]", ns)}
+	}
+	return ns[:i], ns[i+1:], nil
+}
+
+// ---------------------------------------------------------------------------
+// Queries and cursors.
+
+// cursor holds the documents of a query not yet returned to the client.
+type cursor struct {
+	docs [][]byte
+	pos  int
+}
+
+func (s *Server) newCursor(docs [][]byte, pos int) int64 {
+	s.Lock()
+	defer s.Unlock()
+	s.cursorId++
+	s.cursors[s.cursorId] = &cursor{docs, pos}
+	return s.cursorId
+}
+
+func (c *client) query(msg *message) error {
+	if _, err := msg.int32(); err != nil { // flags
+		return err
+	}
+	ns, err := msg.cstring()
+	if err != nil {
+		return err
+	}
+	skip, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	limit, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	query, err := msg.doc()
+	if err != nil {
+		return err
+	}
+	var selector bson.D
+	if msg.more() {
+		if selector, err = msg.doc(); err != nil {
+			return err
+		}
+	}
+	Debugf("mockserver: query on %s: %#v", ns, query)
+
+	dbname, cname, err := splitNamespace(ns)
+	if err == nil && cname == "$cmd" {
+		return c.reply(msg, &reply{}, c.command(dbname, query))
+	}
+	var docs [][]byte
+	if err == nil {
+		docs, err = c.find(dbname, cname, query, selector, int(skip), int(limit))
+	}
+	if err != nil {
+		errmsg, code := errorInfo(err)
+		return c.reply(msg, &reply{flags: replyQueryFailure}, bson.D{{"$err", errmsg}, {"code", code}})
+	}
+
+	// A negative limit, or a limit of one, asks for a single batch.
+	batch, single := int(limit), false
+	switch {
+	case batch < 0:
+		batch, single = -batch, true
+	case batch == 1:
+		single = true
+	case batch == 0:
+		batch = defaultBatch
+	}
+	r := &reply{docs: docs}
+	if len(docs) > batch {
+		r.docs = docs[:batch]
+		if !single {
+			r.cursorId = c.server.newCursor(docs, batch)
+		}
+	}
+	return c.reply(msg, r)
+}
+
+// find returns the documents selected by query, which may hold query
+// modifiers such as $orderby, as marshalled by the server.
+func (c *client) find(dbname, cname string, query, selector bson.D, skip, limit int) ([][]byte, error) {
+	var coll imgo.Collection
+	switch cname {
+	case "system.indexes":
+		coll = c.systemIndexes(dbname)
+	case "system.namespaces":
+		coll = c.systemNamespaces(dbname)
+	default:
+		coll = c.session.DB(dbname).C(cname)
+	}
+
+	var filter interface{} = query
+	var options bson.M
+	for _, elem := range query {
+		if elem.Name == "$query" {
+			options = query.Map()
+			filter = options["$query"]
+			break
+		}
+	}
+	q := coll.Find(filter).Skip(skip)
+	if limit < 0 || limit == 1 {
+		q.Limit(-limit)
+	}
+	if selector != nil {
+		q.Select(selector)
+	}
+	if orderBy, ok := options["$orderby"].(bson.D); ok {
+		q.Sort(sortFields(orderBy)...)
+	}
+	if hint, ok := options["$hint"]; ok {
+		key, err := indexKey(coll, hint)
+		if err != nil {
+			return nil, err
+		}
+		q.Hint(key...)
+	}
+	if snapshot, _ := options["$snapshot"].(bool); snapshot {
+		q.Snapshot()
+	}
+	if explain, _ := options["$explain"].(bool); explain {
+		var result bson.D
+		if err := q.Explain(&result); err != nil {
+			return nil, err
+		}
+		data, err := bson.Marshal(result)
+		return [][]byte{data}, err
+	}
+
+	var docs [][]byte
+	var doc bson.Raw
+	iter := q.Iter()
+	for iter.Next(&doc) {
+		docs = append(docs, doc.Data)
+	}
+	return docs, iter.Close()
+}
+
+// sortFields converts a sort document into the field names taken by
+// Query.Sort.
+func sortFields(orderBy bson.D) []string {
+	fields := make([]string, len(orderBy))
+	for i, elem := range orderBy {
+		fields[i] = elem.Name
+		if f, _ := modify.ToFloat(elem.Value); f < 0 {
+			fields[i] = "-" + elem.Name
+		}
+	}
+	return fields
+}
+
+// indexKey returns the key of the index of coll described by hint, which
+// is either an index name or a key document.
+func indexKey(coll imgo.Collection, hint interface{}) ([]string, error) {
+	switch hint := hint.(type) {
+	case bson.D:
+		return keyFields(hint), nil
+	case string:
+		indexes, err := coll.Indexes()
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indexes {
+			if index.Name == hint {
+				return index.Key, nil
+			}
+		}
+	}
+	return nil, &mgo.QueryError{Code: 17007, Message: "Unable to execute query: error processing query: planner returned error: bad hint"}
+}
+
+// keyFields converts an index key document into the field names taken by
+// Collection.EnsureIndex.
+func keyFields(key bson.D) []string {
+	fields := make([]string, len(key))
+	for i, elem := range key {
+		fields[i] = elem.Name
+		switch v := elem.Value.(type) {
+		case string:
+			if v == "2d" {
+				fields[i] = "@" + elem.Name
+			}
+		default:
+			if f, _ := modify.ToFloat(v); f < 0 {
+				fields[i] = "-" + elem.Name
+			}
+		}
+	}
+	return fields
+}
+
+// keyDoc converts the field names of an index key into a key document.
+func keyDoc(fields []string) bson.D {
+	key := make(bson.D, len(fields))
+	for i, field := range fields {
+		switch field[0] {
+		case '-':
+			key[i] = bson.DocElem{field[1:], -1}
+		case '@':
+			key[i] = bson.DocElem{field[1:], "2d"}
+		case '+':
+			key[i] = bson.DocElem{field[1:], 1}
+		default:
+			key[i] = bson.DocElem{field, 1}
+		}
+	}
+	return key
+}
+
+// systemIndexes returns a collection holding a document describing each
+// index of the collections in dbname, as done by the system.indexes
+// collection of the server.
+func (c *client) systemIndexes(dbname string) imgo.Collection {
+	data := make(mockmgo.Data)
+	db := c.session.DB(dbname)
+	names, _ := db.CollectionNames()
+	for _, name := range names {
+		indexes, _ := db.C(name).Indexes()
+		for _, index := range indexes {
+			spec := bson.D{{"v", 1}, {"key", keyDoc(index.Key)}, {"name", index.Name}, {"ns", dbname + "." + name}}
+			if index.Unique {
+				spec = append(spec, bson.DocElem{"unique", true})
+			}
+			if index.DropDups {
+				spec = append(spec, bson.DocElem{"dropDups", true})
+			}
+			if index.Sparse {
+				spec = append(spec, bson.DocElem{"sparse", true})
+			}
+			if index.ExpireAfter > 0 {
+				spec = append(spec, bson.DocElem{"expireAfterSeconds", int(index.ExpireAfter / time.Second)})
+			}
+			data[fmt.Sprintf("%08d", len(data))] = spec
+		}
+	}
+	return mockmgo.NewCollection(dbname+".system.indexes", data)
+}
+
+// systemNamespaces returns a collection holding the names of the
+// collections in dbname, as done by the system.namespaces collection of the
+// server.
+func (c *client) systemNamespaces(dbname string) imgo.Collection {
+	data := make(mockmgo.Data)
+	names, _ := c.session.DB(dbname).CollectionNames()
+	for _, name := range names {
+		data[fmt.Sprintf("%08d", len(data))] = bson.D{{"name", dbname + "." + name}}
+	}
+	return mockmgo.NewCollection(dbname+".system.namespaces", data)
+}
+
+func (c *client) getMore(msg *message) error {
+	if _, err := msg.int32(); err != nil { // reserved
+		return err
+	}
+	if _, err := msg.cstring(); err != nil {
+		return err
+	}
+	n, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	id, err := msg.int64()
+	if err != nil {
+		return err
+	}
+
+	s := c.server
+	s.Lock()
+	cur := s.cursors[id]
+	if cur == nil {
+		s.Unlock()
+		return c.reply(msg, &reply{flags: replyCursorNotFound})
+	}
+	r := &reply{cursorId: id, from: int32(cur.pos)}
+	end := len(cur.docs)
+	if n > 0 && cur.pos+int(n) < end {
+		end = cur.pos + int(n)
+	}
+	r.docs = cur.docs[cur.pos:end]
+	cur.pos = end
+	if cur.pos == len(cur.docs) {
+		delete(s.cursors, id)
+		r.cursorId = 0
+	}
+	s.Unlock()
+	return c.reply(msg, r)
+}
+
+func (c *client) killCursors(msg *message) error {
+	if _, err := msg.int32(); err != nil { // reserved
+		return err
+	}
+	n, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	s := c.server
+	s.Lock()
+	defer s.Unlock()
+	for i := 0; i < int(n); i++ {
+		id, err := msg.int64()
+		if err != nil {
+			return err
+		}
+		delete(s.cursors, id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Writes. Their outcome is only reported through getLastError.
+
+const (
+	insertContinueOnError = 1 << 0
+	updateUpsert          = 1 << 0
+	updateMulti           = 1 << 1
+	deleteSingle          = 1 << 0
+)
+
+func (c *client) insert(msg *message) error {
+	flags, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	ns, err := msg.cstring()
+	if err != nil {
+		return err
+	}
+	var docs []bson.D
+	for msg.more() {
+		doc, err := msg.doc()
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+	Debugf("mockserver: insert on %s: %#v", ns, docs)
+
+	c.lastError = lastError{}
+	dbname, cname, err := splitNamespace(ns)
+	if err != nil {
+		c.lastError.err = err
+		return nil
+	}
+	for _, doc := range docs {
+		if cname == "system.indexes" {
+			err = c.ensureIndex(dbname, doc)
+		} else {
+			err = c.session.DB(dbname).C(cname).Insert(doc)
+		}
+		if err != nil {
+			c.lastError.err = err
+			if flags&insertContinueOnError == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ensureIndex creates the index described by spec, as inserted into the
+// system.indexes collection.
+func (c *client) ensureIndex(dbname string, spec bson.D) error {
+	m := spec.Map()
+	ns, _ := m["ns"].(string)
+	key, _ := m["key"].(bson.D)
+	specdb, cname, err := splitNamespace(ns)
+	if err != nil {
+		return err
+	}
+	if specdb != dbname || len(key) == 0 {
+		return &mgo.LastError{Code: 10096, Err: "invalid ns to index"}
+	}
+	index := imgo.Index{Key: keyFields(key)}
+	index.Unique, _ = m["unique"].(bool)
+	index.DropDups, _ = m["dropDups"].(bool)
+	index.Background, _ = m["background"].(bool)
+	index.Sparse, _ = m["sparse"].(bool)
+	if seconds, ok := modify.ToFloat(m["expireAfterSeconds"]); ok {
+		index.ExpireAfter = time.Duration(seconds) * time.Second
+	}
+	return c.session.DB(dbname).C(cname).EnsureIndex(index)
+}
+
+func (c *client) update(msg *message) error {
+	if _, err := msg.int32(); err != nil { // reserved
+		return err
+	}
+	ns, err := msg.cstring()
+	if err != nil {
+		return err
+	}
+	flags, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	selector, err := msg.doc()
+	if err != nil {
+		return err
+	}
+	update, err := msg.doc()
+	if err != nil {
+		return err
+	}
+	Debugf("mockserver: update on %s: %#v, %#v", ns, selector, update)
+
+	c.lastError = lastError{update: true}
+	dbname, cname, err := splitNamespace(ns)
+	if err != nil {
+		c.lastError.err = err
+		return nil
+	}
+	coll := c.session.DB(dbname).C(cname)
+	updateDocs(coll, selector, update, flags&updateMulti != 0, flags&updateUpsert != 0, &c.lastError)
+	return nil
+}
+
+// updateDocs applies update to the documents in coll matching selector,
+// recording the outcome in e.
+func updateDocs(coll imgo.Collection, selector, update interface{}, multi, upsert bool, e *lastError) {
+	var info *imgo.ChangeInfo
+	var err error
+	switch {
+	case multi:
+		info, err = coll.UpdateAll(selector, update)
+		if err == nil && info.Updated == 0 && upsert {
+			info, err = coll.Upsert(selector, update)
+		}
+	case upsert:
+		info, err = coll.Upsert(selector, update)
+	default:
+		err = coll.Update(selector, update)
+		if err == nil {
+			info = &imgo.ChangeInfo{Updated: 1}
+		} else if err == ErrNotFound {
+			info, err = &imgo.ChangeInfo{}, nil
+		}
+	}
+	if err != nil {
+		e.err = err
+		return
+	}
+	if info.UpsertedId != nil {
+		e.n, e.upserted = 1, info.UpsertedId
+	} else {
+		e.n, e.updatedExisting = info.Updated, info.Updated > 0
+	}
+}
+
+func (c *client) remove(msg *message) error {
+	if _, err := msg.int32(); err != nil { // reserved
+		return err
+	}
+	ns, err := msg.cstring()
+	if err != nil {
+		return err
+	}
+	flags, err := msg.int32()
+	if err != nil {
+		return err
+	}
+	selector, err := msg.doc()
+	if err != nil {
+		return err
+	}
+	Debugf("mockserver: delete on %s: %#v", ns, selector)
+
+	c.lastError = lastError{}
+	dbname, cname, err := splitNamespace(ns)
+	if err != nil {
+		c.lastError.err = err
+		return nil
+	}
+	coll := c.session.DB(dbname).C(cname)
+	removeDocs(coll, selector, flags&deleteSingle != 0, &c.lastError)
+	return nil
+}
+
+// removeDocs removes the documents in coll matching selector, or just the
+// first one if single is true, recording the outcome in e.
+func removeDocs(coll imgo.Collection, selector interface{}, single bool, e *lastError) {
+	if single {
+		switch err := coll.Remove(selector); err {
+		case nil:
+			e.n = 1
+		case ErrNotFound:
+		default:
+			e.err = err
+		}
+		return
+	}
+	info, err := coll.RemoveAll(selector)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.n = info.Removed
+}
+
+// ---------------------------------------------------------------------------
+// Commands.
+
+// command runs cmd against the database dbname, returning the document
+// to be sent back to the client.
+func (c *client) command(dbname string, cmd bson.D) bson.D {
+	for _, elem := range cmd {
+		if elem.Name == "$query" {
+			cmd, _ = elem.Value.(bson.D)
+			break
+		}
+	}
+	if len(cmd) == 0 {
+		return commandError(&mgo.QueryError{Code: 59, Message: "no such cmd: "})
+	}
+
+	var result bson.D
+	var err error
+	switch strings.ToLower(cmd[0].Name) {
+	case "ismaster":
+		c.server.Lock()
+		result = bson.D{
+			{"ismaster", c.server.setName == "" || c.server.primary},
+			{"maxBsonObjectSize", 16 * 1024 * 1024},
+			{"maxMessageSizeBytes", maxMessageSize},
+			{"maxWriteBatchSize", 1000},
+			{"localTime", time.Now()},
+			{"maxWireVersion", c.server.maxWireVersion},
+			{"minWireVersion", 0},
+		}
+		if c.server.mongos {
+			result = append(result, bson.DocElem{"msg", "isdbgrid"})
+		}
+		if c.server.setName != "" {
+			result = append(result,
+				bson.DocElem{"secondary", !c.server.primary},
+				bson.DocElem{"setName", c.server.setName},
+				bson.DocElem{"hosts", c.server.setHosts})
+		}
+		c.server.Unlock()
+	case "buildinfo":
+		result = bson.D{
+			{"version", "2.6.0"},
+			{"gitVersion", "mockmgo"},
+			{"versionArray", []int{2, 6, 0, 0}},
+			{"bits", 64},
+			{"debug", false},
+			{"maxBsonObjectSize", 16 * 1024 * 1024},
+		}
+	case "authenticate":
+		result, err = c.authenticate(dbname, cmd)
+	case "connectionstatus":
+		users := []interface{}{}
+		if c.user != "" {
+			users = append(users, bson.D{{"user", c.user}, {"db", "$external"}})
+		}
+		result = bson.D{{"authInfo", bson.D{{"authenticatedUsers", users}}}}
+	case "getnonce":
+		result = bson.D{{"nonce", fmt.Sprintf("%016x", rand.Int63())}}
+	case "getlasterror":
+		doc := c.lastError.doc()
+		if c.lastError.err == nil {
+			doc = append(writeConcernProblem(cmd.Map()["w"], true), doc[1:]...)
+		}
+		return doc
+	case "findandmodify":
+		result, err = c.findAndModify(dbname, cmd)
+	case "insert", "update", "delete":
+		result = c.writeCommand(dbname, cmd)
+	case "dropindexes", "deleteindexes":
+		result, err = c.dropIndexes(dbname, cmd)
+	default:
+		err = c.session.DB(dbname).Run(cmd, &result)
+		if err == nil {
+			return result
+		}
+	}
+	if err != nil {
+		return commandError(err)
+	}
+	return append(result, bson.DocElem{"ok", 1.0})
+}
+
+func commandError(err error) bson.D {
+	errmsg, code := errorInfo(err)
+	return bson.D{{"errmsg", errmsg}, {"code", code}, {"ok", 0.0}}
+}
+
+func (c *client) findAndModify(dbname string, cmd bson.D) (bson.D, error) {
+	m := cmd.Map()
+	cname, _ := m[cmd[0].Name].(string)
+	q := c.session.DB(dbname).C(cname).Find(m["query"])
+	if orderBy, ok := m["sort"].(bson.D); ok {
+		q.Sort(sortFields(orderBy)...)
+	}
+	if fields, ok := m["fields"].(bson.D); ok {
+		q.Select(fields)
+	}
+	var change imgo.Change
+	change.Update = m["update"]
+	change.Upsert, _ = m["upsert"].(bool)
+	change.Remove, _ = m["remove"].(bool)
+	change.ReturnNew, _ = m["new"].(bool)
+	if change.Remove == (change.Update != nil) {
+		return nil, &mgo.QueryError{Message: "need remove or update"}
+	}
+
+	var wcerr bson.D
+	if wc, ok := m["writeConcern"].(bson.D); ok {
+		wcerr = writeConcernProblem(wc.Map()["w"], false)
+	}
+
+	var value bson.D
+	info, err := q.Apply(change, &value)
+	if err == ErrNotFound {
+		return bson.D{{"lastErrorObject", bson.D{{"updatedExisting", false}, {"n", 0}}}, {"value", nil}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lerr := bson.D{{"updatedExisting", info.Updated > 0}, {"n", 1}}
+	if info.UpsertedId != nil {
+		lerr = append(lerr, bson.DocElem{"upserted", info.UpsertedId})
+	}
+	var v interface{}
+	if value != nil {
+		v = value
+	}
+	result := bson.D{{"lastErrorObject", lerr}, {"value", v}}
+	if wcerr != nil {
+		result = append(result, bson.DocElem{"writeConcernError", wcerr})
+	}
+	return result, nil
+}
+
+// writeConcernProblem returns what a standalone server reports when asked
+// for the write concern w, which it can only satisfy if it's at most 1 or
+// "majority". The problem is described as in the result of getLastError
+// if gle is true, or as in the writeConcernError of commands otherwise.
+// If there's no problem, the result of getLastError holds just a null err.
+func writeConcernProblem(w interface{}, gle bool) bson.D {
+	var msg string
+	var code int
+	switch w := w.(type) {
+	case int:
+		if w > 1 {
+			msg = fmt.Sprintf("no replication has been enabled, so w=%d won't work", w)
+			code = 100
+		}
+	case string:
+		if w != "majority" {
+			msg = "unrecognized getLastError mode: " + w
+			code = 79
+		}
+	}
+	switch {
+	case !gle && msg == "":
+		return nil
+	case !gle:
+		return bson.D{{"code", code}, {"errmsg", msg}}
+	case code == 100:
+		return bson.D{{"err", "norepl"}, {"wnote", msg}}
+	case code != 0:
+		return bson.D{{"err", msg}, {"code", code}}
+	}
+	return bson.D{{"err", nil}}
+}
+
+// codeAuthenticationFailed is the error code of failed logins.
+const codeAuthenticationFailed = 18
+
+// authenticate emulates the MONGODB-X509 mechanism, which authenticates
+// TLS clients presenting a certificate as the subject set with
+// Server.SetX509Subject.
+func (c *client) authenticate(dbname string, cmd bson.D) (bson.D, error) {
+	m := cmd.Map()
+	if mechanism, _ := m["mechanism"].(string); mechanism != "MONGODB-X509" {
+		return nil, &mgo.QueryError{Code: codeAuthenticationFailed, Message: "unsupported mechanism: " + mechanism}
+	}
+	if dbname != "$external" {
+		return nil, &mgo.QueryError{Code: codeAuthenticationFailed, Message: "X.509 authentication must always use the $external database."}
+	}
+	var subject string
+	if conn, ok := c.conn.(*tls.Conn); ok && len(conn.ConnectionState().PeerCertificates) > 0 {
+		c.server.Lock()
+		subject = c.server.x509Subject
+		c.server.Unlock()
+	}
+	if subject == "" {
+		return nil, &mgo.QueryError{Code: codeAuthenticationFailed, Message: "No verified subject name available from client"}
+	}
+	if user, _ := m["user"].(string); user != "" && user != subject {
+		msg := fmt.Sprintf("There is no x.509 client certificate matching the user: %s", user)
+		return nil, &mgo.QueryError{Code: codeAuthenticationFailed, Message: msg}
+	}
+	c.user = subject
+	return bson.D{{"dbname", dbname}, {"user", subject}}, nil
+}
+
+// writeCommand runs the insert, update or delete command cmd, which holds
+// a batch of writes, as sent by mgo.Bulk.
+func (c *client) writeCommand(dbname string, cmd bson.D) bson.D {
+	m := cmd.Map()
+	kind := strings.ToLower(cmd[0].Name)
+	cname, _ := m[cmd[0].Name].(string)
+	coll := c.session.DB(dbname).C(cname)
+	ordered := true
+	if o, ok := m["ordered"].(bool); ok {
+		ordered = o
+	}
+	var entries []interface{}
+	switch kind {
+	case "insert":
+		entries, _ = m["documents"].([]interface{})
+	case "update":
+		entries, _ = m["updates"].([]interface{})
+	case "delete":
+		entries, _ = m["deletes"].([]interface{})
+	}
+	Debugf("mockserver: %s command on %s.%s: %#v", kind, dbname, cname, entries)
+
+	var n, modified int
+	var upserted, writeErrors []interface{}
+	for i, entry := range entries {
+		doc, _ := entry.(bson.D)
+		op := doc.Map()
+		var e lastError
+		switch kind {
+		case "insert":
+			if e.err = coll.Insert(doc); e.err == nil {
+				e.n = 1
+			}
+		case "update":
+			multi, _ := op["multi"].(bool)
+			upsert, _ := op["upsert"].(bool)
+			updateDocs(coll, op["q"], op["u"], multi, upsert, &e)
+		case "delete":
+			limit, _ := modify.ToFloat(op["limit"])
+			removeDocs(coll, op["q"], limit == 1, &e)
+		}
+		if e.err != nil {
+			msg, code := errorInfo(e.err)
+			writeErrors = append(writeErrors, bson.D{{"index", i}, {"code", code}, {"errmsg", msg}})
+			if ordered {
+				break
+			}
+			continue
+		}
+		n += e.n
+		if e.upserted != nil {
+			upserted = append(upserted, bson.D{{"index", i}, {"_id", e.upserted}})
+		} else {
+			modified += e.n
+		}
+	}
+
+	result := bson.D{{"n", n}}
+	if kind == "update" {
+		result = append(result, bson.DocElem{"nModified", modified})
+		if len(upserted) > 0 {
+			result = append(result, bson.DocElem{"upserted", upserted})
+		}
+	}
+	if len(writeErrors) > 0 {
+		result = append(result, bson.DocElem{"writeErrors", writeErrors})
+	}
+	if wc, ok := m["writeConcern"].(bson.D); ok {
+		if wcerr := writeConcernProblem(wc.Map()["w"], false); wcerr != nil {
+			result = append(result, bson.DocElem{"writeConcernError", wcerr})
+		}
+	}
+	return result
+}
+
+func (c *client) dropIndexes(dbname string, cmd bson.D) (bson.D, error) {
+	m := cmd.Map()
+	cname, _ := m[cmd[0].Name].(string)
+	coll := c.session.DB(dbname).C(cname)
+	indexes, err := coll.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	result := bson.D{{"nIndexesWas", len(indexes)}}
+	if m["index"] == "*" {
+		for _, index := range indexes {
+			if index.Name == "_id_" {
+				continue
+			}
+			if err := coll.DropIndex(index.Key...); err != nil {
+				return nil, err
+			}
+		}
+		return append(result, bson.DocElem{"msg", "non-_id indexes dropped for collection"}), nil
+	}
+	key, err := indexKey(coll, m["index"])
+	if err != nil {
+		return nil, &mgo.QueryError{Code: 27, Message: "index not found"}
+	}
+	return result, coll.DropIndex(key...)
+}
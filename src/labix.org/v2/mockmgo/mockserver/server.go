@@ -0,0 +1,345 @@
+// Package mockserver serves the databases of an imgo.Session, usually an
+// in-memory mockmgo session, over the MongoDB wire protocol. It allows code
+// using *mgo.Session directly to be tested without a real server:
+//
+//     srv, err := mockserver.Start(mockmgo.NewSession(""))
+//     if err != nil {
+//         return err
+//     }
+//     defer srv.Close()
+//     session, err := mgo.Dial(srv.Addr())
+//
+// The legacy opcodes used by mgo are understood: OP_QUERY, OP_GET_MORE,
+// OP_INSERT, OP_UPDATE, OP_DELETE and OP_KILL_CURSORS.
+package mockserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/log"
+	"labix.org/v2/imgo"
+)
+
+const (
+	opReply       = 1
+	opUpdate      = 2001
+	opInsert      = 2002
+	opQuery       = 2004
+	opGetMore     = 2005
+	opDelete      = 2006
+	opKillCursors = 2007
+)
+
+// Flags set in OP_REPLY messages.
+const (
+	replyCursorNotFound = 1 << iota
+	replyQueryFailure
+)
+
+// maxMessageSize is the largest message accepted from clients, as
+// advertised by isMaster.
+const maxMessageSize = 48000000
+
+// Server accepts connections from MongoDB clients and runs their operations
+// against the databases of a session.
+type Server struct {
+	session  imgo.Session
+	listener net.Listener
+	conns    map[net.Conn]bool
+	cursors  map[int64]*cursor
+	cursorId int64
+	closed   bool
+
+	maxWireVersion int
+	mongos         bool
+	setName        string
+	setHosts       []string
+	primary        bool
+	x509Subject    string
+	done           sync.WaitGroup
+	sync.Mutex
+}
+
+// Start returns a server listening on a random local TCP port, serving the
+// databases of session.
+func Start(session imgo.Session) (*Server, error) {
+	return Listen("127.0.0.1:0", session)
+}
+
+// Listen returns a server listening on the TCP address addr, serving the
+// databases of session.
+func Listen(addr string, session imgo.Session) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return Serve(l, session), nil
+}
+
+// Serve returns a server accepting connections from l, serving the
+// databases of session. It allows serving over TLS with a listener made
+// by crypto/tls. The listener is closed with the server.
+func Serve(l net.Listener, session imgo.Session) *Server {
+	s := &Server{
+		session:  session,
+		listener: l,
+		conns:    make(map[net.Conn]bool),
+		cursors:  make(map[int64]*cursor),
+
+		maxWireVersion: 2,
+	}
+	s.done.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the address the server is listening on, suitable for
+// mgo.Dial.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// SetMaxWireVersion sets the maxWireVersion reported to clients connecting
+// from then on, which is 2 by default as with MongoDB 2.6. Reporting 0 makes
+// clients use the legacy write operations instead of write commands.
+func (s *Server) SetMaxWireVersion(v int) {
+	s.Lock()
+	s.maxWireVersion = v
+	s.Unlock()
+}
+
+// SetMongos sets whether the server reports itself as a mongos router to
+// clients connecting from then on.
+func (s *Server) SetMongos(mongos bool) {
+	s.Lock()
+	s.mongos = mongos
+	s.Unlock()
+}
+
+// SetReplicaSet makes the server report itself as a member of the replica
+// set name, which holds hosts, to clients connecting from then on. The
+// server is the primary if primary is true, and a secondary otherwise.
+func (s *Server) SetReplicaSet(name string, hosts []string, primary bool) {
+	s.Lock()
+	s.setName = name
+	s.setHosts = hosts
+	s.primary = primary
+	s.Unlock()
+}
+
+// SetX509Subject sets the subject clients presenting a certificate are
+// authenticated as with MONGODB-X509. A real server reads it from the
+// certificate; the mock takes it as given, so tests state the subject
+// they expect the client to derive.
+func (s *Server) SetX509Subject(subject string) {
+	s.Lock()
+	s.x509Subject = subject
+	s.Unlock()
+}
+
+// Close stops listening, closes all client connections and waits for their
+// operations to finish.
+func (s *Server) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+	s.done.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.done.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.done.Add(1)
+		s.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle reads and runs the operations sent through conn until it's closed.
+func (s *Server) handle(conn net.Conn) {
+	defer s.done.Done()
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	c := &client{server: s, conn: conn, session: s.session.Copy()}
+	defer c.session.Close()
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				Debugf("mockserver: connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := c.run(msg); err != nil {
+			Debugf("mockserver: connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// message holds a request read from a client, past its header.
+type message struct {
+	requestId int32
+	opCode    int32
+	body      []byte
+	pos       int
+}
+
+var errCorrupted = errors.New("corrupted message")
+
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := getInt32(header, 0)
+	if length < 16 || length > maxMessageSize {
+		return nil, errCorrupted
+	}
+	msg := &message{
+		requestId: getInt32(header, 4),
+		opCode:    getInt32(header, 12),
+		body:      make([]byte, length-16),
+	}
+	if _, err := io.ReadFull(r, msg.body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (msg *message) more() bool {
+	return msg.pos < len(msg.body)
+}
+
+func (msg *message) int32() (int32, error) {
+	if msg.pos+4 > len(msg.body) {
+		return 0, errCorrupted
+	}
+	i := getInt32(msg.body, msg.pos)
+	msg.pos += 4
+	return i, nil
+}
+
+func (msg *message) int64() (int64, error) {
+	if msg.pos+8 > len(msg.body) {
+		return 0, errCorrupted
+	}
+	i := getInt64(msg.body, msg.pos)
+	msg.pos += 8
+	return i, nil
+}
+
+func (msg *message) cstring() (string, error) {
+	for i := msg.pos; i < len(msg.body); i++ {
+		if msg.body[i] == 0 {
+			s := string(msg.body[msg.pos:i])
+			msg.pos = i + 1
+			return s, nil
+		}
+	}
+	return "", errCorrupted
+}
+
+// doc returns the next document of the message, decoded as a bson.D.
+func (msg *message) doc() (bson.D, error) {
+	data, err := msg.rawDoc()
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (msg *message) rawDoc() ([]byte, error) {
+	if msg.pos+4 > len(msg.body) {
+		return nil, errCorrupted
+	}
+	n := int(getInt32(msg.body, msg.pos))
+	if n < 5 || msg.pos+n > len(msg.body) {
+		return nil, errCorrupted
+	}
+	data := msg.body[msg.pos : msg.pos+n]
+	msg.pos += n
+	return data, nil
+}
+
+// reply holds the fields of an OP_REPLY message.
+type reply struct {
+	flags    int32
+	cursorId int64
+	from     int32
+	docs     [][]byte
+}
+
+func writeReply(w io.Writer, responseTo int32, r *reply) error {
+	b := make([]byte, 36, 256)
+	setInt32(b, 8, responseTo)
+	setInt32(b, 12, opReply)
+	setInt32(b, 16, r.flags)
+	setInt64(b, 20, r.cursorId)
+	setInt32(b, 28, r.from)
+	setInt32(b, 32, int32(len(r.docs)))
+	for _, doc := range r.docs {
+		b = append(b, doc...)
+	}
+	setInt32(b, 0, int32(len(b)))
+	_, err := w.Write(b)
+	return err
+}
+
+func setInt32(b []byte, pos int, i int32) {
+	b[pos] = byte(i)
+	b[pos+1] = byte(i >> 8)
+	b[pos+2] = byte(i >> 16)
+	b[pos+3] = byte(i >> 24)
+}
+
+func setInt64(b []byte, pos int, i int64) {
+	setInt32(b, pos, int32(i))
+	setInt32(b, pos+4, int32(i>>32))
+}
+
+func getInt32(b []byte, pos int) int32 {
+	return (int32(b[pos+0])) |
+		(int32(b[pos+1]) << 8) |
+		(int32(b[pos+2]) << 16) |
+		(int32(b[pos+3]) << 24)
+}
+
+func getInt64(b []byte, pos int) int64 {
+	return int64(uint32(getInt32(b, pos))) | int64(getInt32(b, pos+4))<<32
+}
@@ -0,0 +1,1500 @@
+package mockserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"labix.org/v2/base/bson"
+	"labix.org/v2/base/log"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo"
+)
+
+func dial(t *testing.T) (*Server, *mockmgo.Session, *mgo.Session) {
+	mock := mockmgo.NewSession("")
+	srv, err := Start(mock)
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	session, err := mgo.DialWithTimeout(srv.Addr(), 5*time.Second)
+	if err != nil {
+		srv.Close()
+		t.Fatal("dial failed:", err)
+	}
+	return srv, mock, session
+}
+
+func TestWrites(t *testing.T) {
+	srv, mock, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	if err := session.Ping(); err != nil {
+		t.Fatal("ping failed:", err)
+	}
+
+	c := session.DB("mydb").C("mycoll")
+	err := c.Insert(bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2}, bson.M{"_id": 3, "a": 3})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	if n, err := mock.DB("mydb").C("mycoll").Count(); err != nil || n != 3 {
+		t.Fatal("documents weren't stored in the mock session:", n, err)
+	}
+
+	err = c.Insert(bson.M{"_id": 1})
+	if lerr, ok := err.(*mgo.LastError); !ok || lerr.Code != 11000 {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+
+	if err = c.Update(bson.M{"_id": 1}, bson.M{"$inc": bson.M{"a": 10}}); err != nil {
+		t.Fatal("update failed:", err)
+	}
+	if err = c.Update(bson.M{"_id": 10}, bson.M{"$inc": bson.M{"a": 10}}); err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+	info, err := c.UpdateAll(bson.M{"a": bson.M{"$lt": 5}}, bson.M{"$set": bson.M{"b": true}})
+	if err != nil || info.Updated != 2 {
+		t.Fatal("update all failed:", info, err)
+	}
+	info, err = c.Upsert(bson.M{"_id": 4}, bson.M{"a": 4})
+	if err != nil || info.Updated != 0 || info.UpsertedId != 4 {
+		t.Fatal("upsert failed:", info, err)
+	}
+	info, err = c.Upsert(bson.M{"_id": 4}, bson.M{"a": 40})
+	if err != nil || info.Updated != 1 || info.UpsertedId != nil {
+		t.Fatal("upsert of an existing document failed:", info, err)
+	}
+
+	var result []bson.M
+	err = c.Find(nil).Sort("-a").Select(bson.M{"_id": 0, "a": 1}).All(&result)
+	expected := []bson.M{{"a": 40}, {"a": 11}, {"a": 3}, {"a": 2}}
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Fatal("find failed:", result, err)
+	}
+
+	if err = c.Remove(bson.M{"a": 40}); err != nil {
+		t.Fatal("remove failed:", err)
+	}
+	if err = c.Remove(bson.M{"a": 40}); err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+	info, err = c.RemoveAll(bson.M{"b": true})
+	if err != nil || info.Removed != 2 {
+		t.Fatal("remove all failed:", info, err)
+	}
+	if n, err := c.Count(); err != nil || n != 1 {
+		t.Fatal("count failed:", n, err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	c := session.DB("mydb").C("mycoll")
+	for i := 0; i < 250; i++ {
+		if err := c.Insert(bson.M{"_id": i, "n": i % 10}); err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+
+	// Results are returned in batches, fetched with OP_GET_MORE.
+	var doc struct {
+		Id int "_id"
+	}
+	iter := c.Find(nil).Batch(20).Iter()
+	i := 0
+	for iter.Next(&doc) {
+		if doc.Id != i {
+			t.Fatal("unexpected document:", doc, i)
+		}
+		i++
+	}
+	if err := iter.Close(); err != nil || i != 250 {
+		t.Fatal("iteration failed:", i, err)
+	}
+
+	// Closing an unfinished iterator kills its cursor.
+	iter = c.Find(nil).Batch(10).Iter()
+	iter.Next(&doc)
+	if err := iter.Close(); err != nil {
+		t.Fatal("close failed:", err)
+	}
+
+	n, err := c.Find(bson.M{"n": 3}).Count()
+	if err != nil || n != 25 {
+		t.Fatal("count failed:", n, err)
+	}
+	var ids []struct {
+		Id int "_id"
+	}
+	err = c.Find(bson.M{"n": 3}).Sort("-_id").Skip(2).Limit(3).All(&ids)
+	if err != nil || len(ids) != 3 || ids[0].Id != 223 || ids[2].Id != 203 {
+		t.Fatal("find with sort, skip and limit failed:", ids, err)
+	}
+
+	if err := c.Find(bson.M{"_id": -1}).One(&doc); err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	err = c.Find(bson.M{"n": bson.M{"$foo": 1}}).One(&doc)
+	if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 17287 {
+		t.Fatal("expected bad value error, got:", err)
+	}
+
+	var result bson.M
+	change := imgo.Change{Update: bson.M{"$set": bson.M{"n": 100}}, ReturnNew: true}
+	info, err := c.Find(bson.M{"_id": 5}).Apply(change, &result)
+	if err != nil || info.Updated != 1 || result["n"] != 100 {
+		t.Fatal("find and modify failed:", info, result, err)
+	}
+	change = imgo.Change{Update: bson.M{"n": 1}, Upsert: true}
+	info, err = c.Find(bson.M{"_id": 1000}).Apply(change, &result)
+	if err != nil || info.UpsertedId != 1000 {
+		t.Fatal("find and modify with upsert failed:", info, err)
+	}
+	_, err = c.Find(bson.M{"_id": 2000}).Apply(imgo.Change{Remove: true}, &result)
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+
+	var sum struct{ Total int }
+	err = c.Pipe([]bson.M{{"$match": bson.M{"n": 2}}, {"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$_id"}}}}).One(&sum)
+	if err != nil || sum.Total != 3050 {
+		t.Fatal("aggregate failed:", sum, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	srv, mock, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	db := session.DB("mydb")
+	c := db.C("mycoll")
+	for i := 0; i < 50; i++ {
+		if err := c.Insert(bson.M{"_id": i}); err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+
+	// Iteration stops once the context is cancelled, and the cursor is
+	// killed in the server.
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := c.Find(nil).Batch(10).IterContext(ctx)
+	var doc bson.M
+	if !iter.Next(&doc) {
+		t.Fatal("next failed:", iter.Err())
+	}
+	srv.Lock()
+	cursors := len(srv.cursors)
+	srv.Unlock()
+	if cursors != 1 {
+		t.Fatal("expected an open cursor, got:", cursors)
+	}
+	cancel()
+	if iter.Next(&doc) {
+		t.Fatal("next succeeded after cancellation")
+	}
+	if err := iter.Close(); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got:", err)
+	}
+	// The cursor is killed through the same connection, so it's gone
+	// once a later command is answered.
+	if err := session.Ping(); err != nil {
+		t.Fatal("ping failed:", err)
+	}
+	srv.Lock()
+	cursors = len(srv.cursors)
+	srv.Unlock()
+	if cursors != 0 {
+		t.Fatal("cursor wasn't killed:", cursors)
+	}
+
+	// Operations don't start with a done context.
+	q := c.Find(bson.M{"_id": 1})
+	if err := q.OneContext(ctx, &doc); err != context.Canceled {
+		t.Fatal("expected context.Canceled from OneContext, got:", err)
+	}
+	var docs []bson.M
+	if err := q.AllContext(ctx, &docs); err != context.Canceled {
+		t.Fatal("expected context.Canceled from AllContext, got:", err)
+	}
+	if _, err := q.CountContext(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled from CountContext, got:", err)
+	}
+	if err := db.RunContext(ctx, "ping", nil); err != context.Canceled {
+		t.Fatal("expected context.Canceled from RunContext, got:", err)
+	}
+	pipe := c.Pipe([]bson.M{{"$match": bson.M{}}})
+	if err := pipe.AllContext(ctx, &docs); err != context.Canceled {
+		t.Fatal("expected context.Canceled from Pipe.AllContext, got:", err)
+	}
+	if err := c.InsertContext(ctx, bson.M{"_id": 100}); err != context.Canceled {
+		t.Fatal("expected context.Canceled from InsertContext, got:", err)
+	}
+	if err := c.RemoveContext(ctx, bson.M{"_id": 1}); err != context.Canceled {
+		t.Fatal("expected context.Canceled from RemoveContext, got:", err)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").Count(); n != 50 {
+		t.Fatal("writes were applied with a done context:", n)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := q.OneContext(expired, &doc); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got:", err)
+	}
+
+	// The session remains usable.
+	live, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.OneContext(live, &doc); err != nil || doc["_id"] != 1 {
+		t.Fatal("find with a live context failed:", doc, err)
+	}
+	if err := c.UpdateContext(live, bson.M{"_id": 1}, bson.M{"$set": bson.M{"a": 1}}); err != nil {
+		t.Fatal("update with a live context failed:", err)
+	}
+	if err := pipe.AllContext(live, &docs); err != nil || len(docs) != 50 {
+		t.Fatal("aggregate with a live context failed:", len(docs), err)
+	}
+}
+
+func conns(srv *Server) int {
+	srv.Lock()
+	defer srv.Unlock()
+	return len(srv.conns)
+}
+
+func TestPool(t *testing.T) {
+	srv, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv.Close()
+	mgo.SetStats(true)
+	defer mgo.SetStats(false)
+
+	info := &mgo.DialInfo{
+		Addrs:            []string{srv.Addr()},
+		Direct:           true,
+		Timeout:          5 * time.Second,
+		MaxPoolSize:      2,
+		MinPoolSize:      1,
+		MaxIdleTime:      100 * time.Millisecond,
+		WaitQueueTimeout: 200 * time.Millisecond,
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+
+	// Reserve all sockets the pool allows.
+	var held []*mgo.Session
+	for i := 0; i < 2; i++ {
+		s := session.Copy().(*mgo.Session)
+		defer s.Close()
+		if err := s.Ping(); err != nil {
+			t.Fatal("ping failed:", err)
+		}
+		held = append(held, s)
+	}
+
+	// Further operations wait in line, and time out.
+	s := session.Copy().(*mgo.Session)
+	defer s.Close()
+	started := time.Now()
+	if err := s.Ping(); err != mgo.ErrPoolTimeout {
+		t.Fatal("expected ErrPoolTimeout, got:", err)
+	}
+	if d := time.Since(started); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatal("unexpected wait for a socket:", d)
+	}
+	if stats := mgo.GetStats(); stats.PoolTimeouts != 1 || stats.PoolWaiting != 0 {
+		t.Fatal("unexpected pool stats:", stats)
+	}
+
+	// A released socket is handed over to the waiting operation.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held[0].Refresh()
+	}()
+	if err := s.Ping(); err != nil {
+		t.Fatal("ping failed after a socket was released:", err)
+	}
+	if n := conns(srv); n != 2 {
+		t.Fatal("expected 2 connections, got:", n)
+	}
+
+	// Idle sockets are reaped down to MinPoolSize.
+	s.Refresh()
+	held[1].Refresh()
+	for i := 0; conns(srv) != 1; i++ {
+		if i == 50 {
+			t.Fatal("idle sockets weren't closed:", conns(srv))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if stats := mgo.GetStats(); stats.PoolReaped != 1 {
+		t.Fatal("unexpected pool stats:", stats)
+	}
+}
+
+func TestPoolPrewarm(t *testing.T) {
+	srv, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv.Close()
+
+	session, err := mgo.Dial(srv.Addr() + "?connect=direct&minPoolSize=5")
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	for i := 0; conns(srv) != 5; i++ {
+		if i == 50 {
+			t.Fatal("pool wasn't pre-warmed:", conns(srv))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := mgo.Dial(srv.Addr() + "?maxPoolSize=x"); err == nil {
+		t.Fatal("bad maxPoolSize should fail")
+	}
+}
+
+type exporter struct {
+	sync.Mutex
+	ops    map[string]int
+	failed int
+	opened int
+	pings  int
+}
+
+func (e *exporter) OpDone(server, op string, latency time.Duration, failed bool) {
+	e.Lock()
+	e.ops[op]++
+	if failed {
+		e.failed++
+	}
+	e.Unlock()
+}
+
+func (e *exporter) ConnOpened(server string) {
+	e.Lock()
+	e.opened++
+	e.Unlock()
+}
+
+func (e *exporter) ConnClosed(server string, failed bool) {}
+
+func (e *exporter) Pinged(server string, rtt time.Duration) {
+	e.Lock()
+	e.pings++
+	e.Unlock()
+}
+
+func TestStats(t *testing.T) {
+	mgo.SetStats(true)
+	defer mgo.SetStats(false)
+	e := &exporter{ops: make(map[string]int)}
+	mgo.SetStatsExporter(e)
+	defer mgo.SetStatsExporter(nil)
+
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	c := session.DB("mydb").C("mycoll")
+	for i := 0; i < 5; i++ {
+		if err := c.Insert(bson.M{"_id": i}); err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+	var docs []bson.M
+	if err := c.Find(nil).Batch(2).All(&docs); err != nil || len(docs) != 5 {
+		t.Fatal("find failed:", docs, err)
+	}
+	if err := c.Find(bson.M{"n": bson.M{"$foo": 1}}).One(nil); err == nil {
+		t.Fatal("bad query should fail")
+	}
+	// Neither write errors nor failed commands are flagged as query failures.
+	if err := c.Insert(bson.M{"_id": 1}); !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+	if err := session.DB("mydb").Run(bson.D{{"dropIndexes", "mycoll"}, {"index", "missing"}}, nil); err == nil {
+		t.Fatal("dropping a missing index should fail")
+	}
+
+	stats := mgo.GetStats()
+	if op := stats.Ops["insert"]; op == nil || op.Count != 6 || op.Errors != 1 || op.Latency.Count != 6 {
+		t.Fatal("unexpected insert stats:", op)
+	}
+	if op := stats.Ops["query"]; op == nil || op.Count != 2 || op.Errors != 1 {
+		t.Fatal("unexpected query stats:", op)
+	}
+	if op := stats.Ops["getMore"]; op == nil || op.Count != 2 {
+		t.Fatal("unexpected getMore stats:", op)
+	}
+	if op := stats.Ops["command"]; op == nil || op.Count == 0 || op.Errors != 1 {
+		t.Fatal("unexpected command stats:", op)
+	}
+	server := stats.Servers[srv.Addr()]
+	if server == nil || server.Conns == 0 || server.Errors != 3 || server.PingRTT == 0 {
+		t.Fatal("unexpected server stats:", server)
+	}
+
+	e.Lock()
+	if e.ops["insert"] != 6 || e.ops["getMore"] != 2 || e.failed != 3 || e.opened == 0 || e.pings == 0 {
+		t.Fatal("unexpected exported measurements:", e.ops, e.failed, e.opened, e.pings)
+	}
+	e.Unlock()
+
+	var text strings.Builder
+	if err := stats.WriteText(&text); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	for _, line := range []string{
+		`mgo_ops{op="insert"} 6`,
+		`mgo_op_latency_seconds_count{op="getMore"} 2`,
+		`mgo_op_latency_seconds_bucket{op="insert",le="+Inf"} 6`,
+		`mgo_server_errors{server="` + srv.Addr() + `"} 3`,
+	} {
+		if !strings.Contains(text.String(), line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, text.String())
+		}
+	}
+}
+
+type monitor struct {
+	sync.Mutex
+	started   map[int32]*mgo.CommandEvent
+	succeeded []*mgo.CommandEvent
+	failed    []*mgo.CommandEvent
+}
+
+func (m *monitor) Started(event *mgo.CommandEvent) {
+	m.Lock()
+	if event.RequestId != 0 {
+		m.started[event.RequestId] = event
+	}
+	m.Unlock()
+}
+
+func (m *monitor) Succeeded(event *mgo.CommandEvent) {
+	m.Lock()
+	m.succeeded = append(m.succeeded, event)
+	m.Unlock()
+}
+
+func (m *monitor) Failed(event *mgo.CommandEvent) {
+	m.Lock()
+	m.failed = append(m.failed, event)
+	m.Unlock()
+}
+
+func (m *monitor) names() []string {
+	m.Lock()
+	defer m.Unlock()
+	var names []string
+	for _, event := range m.succeeded {
+		names = append(names, event.CommandName)
+	}
+	return names
+}
+
+func TestCommandMonitor(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	m := &monitor{started: make(map[int32]*mgo.CommandEvent)}
+	session.SetCommandMonitor(m)
+	c := session.DB("mydb").C("mycoll")
+	for i := 0; i < 3; i++ {
+		if err := c.Insert(bson.M{"_id": i}); err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+	var docs []bson.M
+	if err := c.Find(nil).Batch(2).All(&docs); err != nil || len(docs) != 3 {
+		t.Fatal("find failed:", docs, err)
+	}
+	if n, err := c.Count(); err != nil || n != 3 {
+		t.Fatal("count failed:", n, err)
+	}
+	if err := c.Find(bson.M{"n": bson.M{"$foo": 1}}).One(nil); err == nil {
+		t.Fatal("bad query should fail")
+	}
+	want := []string{
+		"insert", "getLastError", "insert", "getLastError", "insert", "getLastError",
+		"find", "getMore", "count",
+	}
+	if names := m.names(); !reflect.DeepEqual(names, want) {
+		t.Fatal("unexpected succeeded operations:", names)
+	}
+
+	m.Lock()
+	for _, event := range m.succeeded {
+		if event.Database != "mydb" || event.Server != srv.Addr() || event.Duration <= 0 || event.Err != nil {
+			t.Fatal("unexpected event:", event)
+		}
+		if event.RequestId != 0 && m.started[event.RequestId] == nil {
+			t.Fatal("operation done but not started:", event)
+		}
+	}
+	if len(m.failed) != 1 || m.failed[0].CommandName != "find" || m.failed[0].Err == nil || m.started[m.failed[0].RequestId] == nil {
+		t.Fatal("unexpected failed operations:", m.failed)
+	}
+	m.Unlock()
+
+	// Copies inherit the monitor, which may be unset.
+	copy := session.Copy().(*mgo.Session)
+	defer copy.Close()
+	copy.SetSafe(nil)
+	if err := copy.DB("mydb").C("mycoll").Insert(bson.M{"_id": 10}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	m.Lock()
+	last := m.succeeded[len(m.succeeded)-1]
+	m.Unlock()
+	if last.CommandName != "insert" || last.RequestId != 0 {
+		t.Fatal("unexpected unacknowledged insert event:", last)
+	}
+	copy.SetCommandMonitor(nil)
+	if _, err := copy.DB("mydb").C("mycoll").Count(); err != nil {
+		t.Fatal("count failed:", err)
+	}
+	if names := m.names(); len(names) != len(want)+1 {
+		t.Fatal("unmonitored session reported operations:", names)
+	}
+}
+
+type recorder struct {
+	sync.Mutex
+	msgs   []string
+	fields []interface{}
+}
+
+func (r *recorder) Enabled(level log.Level) bool {
+	return true
+}
+
+func (r *recorder) Log(level log.Level, msg string, fields ...interface{}) {
+	r.Lock()
+	r.msgs = append(r.msgs, msg)
+	r.fields = fields
+	r.Unlock()
+}
+
+func TestSessionLogger(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	r := &recorder{}
+	session.SetLogger(log.With(r, "tenant", "acme"))
+	copy := session.Copy()
+	defer copy.Close()
+	c := copy.DB("mydb").C("mycoll")
+	if err := c.Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	var doc bson.M
+	if err := c.Find(nil).One(&doc); err != nil {
+		t.Fatal("find failed:", err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	var copied, queried bool
+	for _, msg := range r.msgs {
+		copied = copied || strings.HasPrefix(msg, "New session")
+		queried = queried || strings.HasPrefix(msg, "Query")
+	}
+	if !copied || !queried {
+		t.Fatal("missing session messages:", r.msgs)
+	}
+	if !reflect.DeepEqual(r.fields, []interface{}{"tenant", "acme"}) {
+		t.Fatal("unexpected fields:", r.fields)
+	}
+}
+
+func TestReadPreference(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	c := session.DB("mydb").C("mycoll")
+	if err := c.Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// The mock server is a primary, which is used when preferred.
+	session.SetReadPreference(&mgo.ReadPreference{Mode: mgo.ReadSecondaryPreferred})
+	if session.Mode() != mgo.Eventual || session.ReadPreference().Mode != mgo.ReadSecondaryPreferred {
+		t.Fatal("unexpected session settings:", session.Mode(), session.ReadPreference())
+	}
+	var doc bson.M
+	if err := c.Find(nil).One(&doc); err != nil || doc["_id"] != 1 {
+		t.Fatal("find failed:", doc, err)
+	}
+	query := c.Find(nil).ReadPreference(&mgo.ReadPreference{Mode: mgo.ReadNearest})
+	if n, err := query.Count(); err != nil || n != 1 {
+		t.Fatal("count failed:", n, err)
+	}
+
+	// There are no secondaries.
+	session.SetSyncTimeout(300 * time.Millisecond)
+	session.SetReadPreference(&mgo.ReadPreference{Mode: mgo.ReadSecondary})
+	if err := c.Find(nil).One(&doc); err == nil || !strings.Contains(err.Error(), "read preference") {
+		t.Fatal("find from a secondary should fail:", err)
+	}
+	query = c.Find(nil).ReadPreference(&mgo.ReadPreference{Mode: mgo.ReadPrimary})
+	if err := query.One(&doc); err != nil {
+		t.Fatal("find from the primary failed:", err)
+	}
+
+	session.SetReadPreference(&mgo.ReadPreference{Mode: mgo.ReadNearest, MaxStaleness: time.Second})
+	if err := c.Find(nil).One(&doc); err == nil || !strings.Contains(err.Error(), "maxStaleness") {
+		t.Fatal("small maxStaleness should fail:", err)
+	}
+
+	mode, err := mgo.ParseReadMode("primaryPreferred")
+	if err != nil || mode != mgo.ReadPrimaryPreferred || mode.String() != "primaryPreferred" {
+		t.Fatal("unexpected mode:", mode, err)
+	}
+}
+
+func TestWriteConcern(t *testing.T) {
+	srv, mock, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	c := session.DB("mydb").C("mycoll")
+
+	// The mock server is a standalone, so the write succeeds but
+	// isn't replicated.
+	err := c.WithWriteConcern(&mgo.WriteConcern{W: 2, WTimeout: time.Second}).Insert(bson.M{"_id": 1})
+	wcerr, ok := err.(*mgo.WriteConcernError)
+	if !ok || !strings.Contains(wcerr.Message, "w=2") || wcerr.LastError == nil {
+		t.Fatalf("expected write concern error, got %#v", err)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").Count(); n != 1 {
+		t.Fatal("document not inserted")
+	}
+	if err := c.WithWriteConcern(&mgo.WriteConcern{WMode: "majority", J: true}).Insert(bson.M{"_id": 2}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// Write failures are still reported as such.
+	err = c.WithWriteConcern(&mgo.WriteConcern{W: 2}).Insert(bson.M{"_id": 1})
+	if _, ok := err.(*mgo.LastError); !ok || !mgo.IsDup(err) {
+		t.Fatalf("expected duplicate key error, got %#v", err)
+	}
+
+	for _, wc := range []mgo.WriteConcern{{W: -1}, {J: true, FSync: true}, {WTimeout: -time.Second}} {
+		if err := c.WithWriteConcern(&wc).Insert(bson.M{"_id": 3}); err == nil {
+			t.Fatalf("write concern %#v should be rejected", wc)
+		}
+	}
+
+	// Unknown modes are left to the server until the replica set
+	// configuration is known, and failures to read it are remembered.
+	mgo.SetStats(true)
+	defer mgo.SetStats(false)
+	lookups := func() int {
+		stats := mgo.GetStats()
+		n := 0
+		for _, op := range []string{"command", "query"} {
+			if stats.Ops[op] != nil {
+				n += stats.Ops[op].Count
+			}
+		}
+		return n
+	}
+	for i := 0; i < 2; i++ {
+		before := lookups()
+		err = c.WithWriteConcern(&mgo.WriteConcern{WMode: "dc"}).Insert(bson.M{"_id": 10 + i})
+		if wcerr, ok := err.(*mgo.WriteConcernError); !ok || wcerr.Code != 79 {
+			t.Fatalf("expected unknown mode error, got %#v", err)
+		}
+		if n := lookups() - before; i == 0 && n == 0 || i == 1 && n != 0 {
+			t.Fatalf("write %d made %d lookups of the configuration", i, n)
+		}
+	}
+	config := bson.M{"_id": "rs", "settings": bson.M{"getLastErrorModes": bson.M{"dc": bson.M{"dc": 2}}}}
+	if err := mock.DB("local").C("system.replset").Insert(config); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	other, err := mgo.DialWithTimeout(srv.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer other.Close()
+	oc := other.DB("mydb").C("mycoll")
+	err = oc.WithWriteConcern(&mgo.WriteConcern{WMode: "rack"}).Insert(bson.M{"_id": 4})
+	if err == nil || err.Error() != `unknown write concern mode "rack"` {
+		t.Fatal("unknown mode should be rejected:", err)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").FindId(4).Count(); n != 0 {
+		t.Fatal("write with unknown mode was sent")
+	}
+
+	// Unacknowledged writes report nothing.
+	unsafe := c.WithWriteConcern(&mgo.WriteConcern{Unacknowledged: true})
+	if err := unsafe.Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("unacknowledged insert failed:", err)
+	}
+
+	var doc bson.M
+	change := imgo.Change{Update: bson.M{"$set": bson.M{"a": 1}}}
+	info, err := c.WithWriteConcern(&mgo.WriteConcern{W: 3}).Find(bson.M{"_id": 2}).Apply(change, &doc)
+	if wcerr, ok := err.(*mgo.WriteConcernError); !ok || wcerr.Code != 100 || info == nil || info.Updated != 1 {
+		t.Fatalf("expected write concern error, got %#v %#v", info, err)
+	}
+	if _, err := c.Find(bson.M{"_id": 2}).Apply(change, &doc); err != nil {
+		t.Fatal("apply failed:", err)
+	}
+	if err := c.Remove(bson.M{"_id": 2}); err != nil {
+		t.Fatal("remove failed:", err)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	srv, mock, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	c := session.DB("mydb").C("mycoll").(*mgo.Collection)
+	if err := c.Insert(bson.M{"_id": 1, "n": 1}, bson.M{"_id": 2, "n": 2}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	bulk := c.Bulk()
+	bulk.Insert(bson.M{"_id": 3, "n": 3}, bson.M{"_id": 4, "n": 4})
+	bulk.Update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"n": 10}})
+	bulk.UpdateAll(bson.M{"n": bson.M{"$lt": 4}}, bson.M{"$inc": bson.M{"n": 1}})
+	bulk.Upsert(bson.M{"_id": 5}, bson.M{"$set": bson.M{"n": 5}})
+	bulk.Remove(bson.M{"_id": 4})
+	bulk.RemoveAll(bson.M{"n": bson.M{"$gt": 100}})
+	result, err := bulk.Run()
+	if err != nil {
+		t.Fatal("bulk failed:", err)
+	}
+	want := &mgo.BulkResult{
+		Inserted:    2,
+		Matched:     3,
+		Modified:    3,
+		Upserted:    1,
+		Removed:     1,
+		UpsertedIds: []mgo.BulkUpserted{{4, 5}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	var docs []bson.M
+	if err := mock.DB("mydb").C("mycoll").Find(nil).Sort("_id").All(&docs); err != nil {
+		t.Fatal("find failed:", err)
+	}
+	if len(docs) != 4 || docs[0]["n"] != 10 || docs[1]["n"] != 3 || docs[2]["n"] != 4 || docs[3]["n"] != 5 {
+		t.Fatal("unexpected documents:", docs)
+	}
+
+	// Ordered bulks stop at the first failure.
+	bulk = c.Bulk()
+	bulk.Insert(bson.M{"_id": 6}, bson.M{"_id": 1}, bson.M{"_id": 7})
+	bulk.Remove(bson.M{"_id": 6})
+	result, err = bulk.Run()
+	berr, ok := err.(*mgo.BulkError)
+	if !ok || len(berr.Cases()) != 1 || berr.Cases()[0].Index != 1 || !mgo.IsDup(berr.Cases()[0].Err) {
+		t.Fatalf("expected duplicate key error, got %#v", err)
+	}
+	if result.Inserted != 1 || result.Removed != 0 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+
+	// Unordered ones keep going.
+	bulk = c.Bulk()
+	bulk.Unordered()
+	bulk.Insert(bson.M{"_id": 1}, bson.M{"_id": 7}, bson.M{"_id": 2})
+	bulk.Remove(bson.M{"_id": 6})
+	bulk.Insert(bson.M{"_id": 8})
+	result, err = bulk.Run()
+	berr, ok = err.(*mgo.BulkError)
+	if !ok || len(berr.Cases()) != 2 || berr.Cases()[0].Index != 0 || berr.Cases()[1].Index != 2 {
+		t.Fatalf("expected two duplicate key errors, got %#v", err)
+	}
+	if result.Inserted != 2 || result.Removed != 1 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+
+	// Large bulks are split in batches within the server limits.
+	m := &monitor{started: make(map[int32]*mgo.CommandEvent)}
+	session.SetCommandMonitor(m)
+	bulk = c.Bulk()
+	for i := 0; i < 2500; i++ {
+		bulk.Insert(bson.M{"_id": 100 + i})
+	}
+	result, err = bulk.Run()
+	if err != nil || result.Inserted != 2500 {
+		t.Fatal("large bulk failed:", result, err)
+	}
+	if names := m.names(); !reflect.DeepEqual(names, []string{"insert", "insert", "insert"}) {
+		t.Fatal("unexpected commands:", names)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").Count(); n != 2506 {
+		t.Fatal("unexpected count:", n)
+	}
+
+	// Write concern problems are reported after the writes are done.
+	bulk = c.WithWriteConcern(&mgo.WriteConcern{W: 2}).(*mgo.Collection).Bulk()
+	bulk.Remove(bson.M{"_id": 100})
+	result, err = bulk.Run()
+	if wcerr, ok := err.(*mgo.WriteConcernError); !ok || wcerr.Code != 100 || result.Removed != 1 {
+		t.Fatalf("expected write concern error, got %#v", err)
+	}
+}
+
+func TestBulkLegacy(t *testing.T) {
+	mock := mockmgo.NewSession("")
+	srv, err := Start(mock)
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv.Close()
+	srv.SetMaxWireVersion(0)
+
+	// The whole bulk runs over a single socket.
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:            []string{srv.Addr()},
+		Timeout:          5 * time.Second,
+		MaxPoolSize:      1,
+		WaitQueueTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Eventual, true)
+	m := &monitor{started: make(map[int32]*mgo.CommandEvent)}
+	session.SetCommandMonitor(m)
+
+	c := session.DB("mydb").C("mycoll").(*mgo.Collection)
+	bulk := c.Bulk()
+	bulk.Insert(bson.M{"_id": 1, "n": 1}, bson.M{"_id": 2, "n": 2}, bson.M{"_id": 3, "n": 3})
+	bulk.UpdateAll(bson.M{"n": bson.M{"$lt": 3}}, bson.M{"$inc": bson.M{"n": 1}})
+	bulk.Upsert(bson.M{"_id": 4}, bson.M{"$set": bson.M{"n": 4}})
+	bulk.Remove(bson.M{"_id": 3})
+	result, err := bulk.Run()
+	if err != nil {
+		t.Fatal("bulk failed:", err)
+	}
+	want := &mgo.BulkResult{
+		Inserted:    3,
+		Matched:     2,
+		Modified:    2,
+		Upserted:    1,
+		Removed:     1,
+		UpsertedIds: []mgo.BulkUpserted{{4, 4}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	want2 := []string{"insert", "getLastError", "update", "getLastError", "update", "getLastError", "delete", "getLastError"}
+	if names := m.names(); !reflect.DeepEqual(names, want2) {
+		t.Fatal("unexpected commands:", names)
+	}
+
+	// A failed batch of inserts is reported at its first document.
+	bulk = c.Bulk()
+	bulk.Remove(bson.M{"_id": 4})
+	bulk.Insert(bson.M{"_id": 5}, bson.M{"_id": 1}, bson.M{"_id": 6})
+	bulk.Remove(bson.M{"_id": 5})
+	result, err = bulk.Run()
+	berr, ok := err.(*mgo.BulkError)
+	if !ok || len(berr.Cases()) != 1 || berr.Cases()[0].Index != 1 || !mgo.IsDup(berr.Cases()[0].Err) {
+		t.Fatalf("expected duplicate key error, got %#v", err)
+	}
+	if result.Inserted != 0 || result.Removed != 1 {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").FindId(6).Count(); n != 0 {
+		t.Fatal("ordered insert went on after a failure")
+	}
+
+	// Unordered ones keep going.
+	bulk = c.Bulk()
+	bulk.Unordered()
+	bulk.Insert(bson.M{"_id": 1}, bson.M{"_id": 7})
+	result, err = bulk.Run()
+	if _, ok := err.(*mgo.BulkError); !ok || result.Inserted != 0 {
+		t.Fatalf("expected duplicate key error, got %#v", err)
+	}
+	if n, _ := mock.DB("mydb").C("mycoll").FindId(7).Count(); n != 1 {
+		t.Fatal("unordered insert stopped at a failure")
+	}
+}
+
+func TestIndexesAndNames(t *testing.T) {
+	srv, mock, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	db := session.DB("mydb")
+	c := db.C("mycoll")
+	if err := c.EnsureIndex(imgo.Index{Key: []string{"a", "-b"}, Unique: true}); err != nil {
+		t.Fatal("ensure index failed:", err)
+	}
+	indexes, err := mock.DB("mydb").C("mycoll").Indexes()
+	if err != nil || len(indexes) != 2 || indexes[1].Name != "a_1_b_-1" || !indexes[1].Unique {
+		t.Fatal("index wasn't created in the mock session:", indexes, err)
+	}
+	indexes, err = c.Indexes()
+	if err != nil || len(indexes) != 2 || !reflect.DeepEqual(indexes[1].Key, []string{"a", "-b"}) {
+		t.Fatal("indexes failed:", indexes, err)
+	}
+
+	if err := c.Insert(bson.M{"a": 1, "b": 1}, bson.M{"a": 1, "b": 1}); err == nil {
+		t.Fatal("unique index wasn't enforced")
+	}
+	var explain bson.M
+	if err := c.Find(bson.M{"a": 1}).Explain(&explain); err != nil || explain["cursor"] != "BtreeCursor a_1_b_-1" {
+		t.Fatal("explain failed:", explain, err)
+	}
+
+	if err := c.DropIndex("a", "-b"); err != nil {
+		t.Fatal("drop index failed:", err)
+	}
+	if err := c.DropIndex("a", "-b"); err == nil {
+		t.Fatal("dropping a missing index should fail")
+	}
+
+	db.C("other").Insert(bson.M{"a": 1})
+	names, err := db.CollectionNames()
+	if err != nil || !reflect.DeepEqual(names, []string{"mycoll", "other"}) {
+		t.Fatal("collection names failed:", names, err)
+	}
+	dbs, err := session.DatabaseNames()
+	if err != nil || !reflect.DeepEqual(dbs, []string{"mydb"}) {
+		t.Fatal("database names failed:", dbs, err)
+	}
+
+	if err := db.C("other").DropCollection(); err != nil {
+		t.Fatal("drop collection failed:", err)
+	}
+	if err := db.Run("nosuchcmd", nil); err == nil {
+		t.Fatal("unknown command should fail")
+	}
+}
+
+func TestGridFS(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	defer session.Close()
+
+	gfs := session.DB("mydb").(*mgo.Database).GridFS("fs")
+	file, err := gfs.Create("hello.txt")
+	if err != nil {
+		t.Fatal("create failed:", err)
+	}
+	file.SetChunkSize(4)
+	if _, err := file.Write([]byte("hello, world")); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal("close failed:", err)
+	}
+
+	file, err = gfs.Open("hello.txt")
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || string(data) != "hello, world" {
+		t.Fatal("read failed:", string(data), err)
+	}
+}
+
+// testCerts holds a certificate authority along with server and client
+// certificates signed by it, and the PEM files holding them.
+type testCerts struct {
+	pool       *x509.CertPool
+	server     tls.Certificate
+	caFile     string
+	clientFile string
+}
+
+func newTestCerts(t *testing.T, client pkix.Name) *testCerts {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	certs := &testCerts{pool: x509.NewCertPool()}
+	certs.pool.AddCert(ca)
+	certs.caFile = dir + "/ca.pem"
+	if err := ioutil.WriteFile(certs.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, subject pkix.Name, usage x509.ExtKeyUsage, dnsNames []string) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     dnsNames,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+
+	// The server certificate isn't valid for the address it listens on.
+	certPEM, keyPEM := issue(2, pkix.Name{CommonName: "localhost"}, x509.ExtKeyUsageServerAuth, []string{"localhost"})
+	if certs.server, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM = issue(3, client, x509.ExtKeyUsageClientAuth, nil)
+	certs.clientFile = dir + "/client.pem"
+	if err := ioutil.WriteFile(certs.clientFile, append(certPEM, keyPEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+// startTLS returns a server accepting TLS connections with the server
+// certificate in certs, which asks clients for their certificates.
+func startTLS(t *testing.T, certs *testCerts, mock *mockmgo.Session) *Server {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientCAs:    certs.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	return Serve(l, mock)
+}
+
+func TestTLS(t *testing.T) {
+	certs := newTestCerts(t, pkix.Name{CommonName: "client"})
+	mock := mockmgo.NewSession("")
+	srv := startTLS(t, certs, mock)
+	defer srv.Close()
+	if err := mock.DB("mydb").C("mycoll").Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	good := []*mgo.DialInfo{{
+		TLSConfig: &tls.Config{RootCAs: certs.pool, ServerName: "localhost"},
+	}, {
+		TLSCAFile:                certs.caFile,
+		TLSCertificateKeyFile:    certs.clientFile,
+		TLSAllowInvalidHostnames: true,
+	}, {
+		TLS:         true,
+		TLSInsecure: true,
+	}}
+	for _, info := range good {
+		info.Addrs = []string{srv.Addr()}
+		info.Timeout = 5 * time.Second
+		session, err := mgo.DialWithInfo(info)
+		if err != nil {
+			t.Fatalf("dial with %#v failed: %v", info, err)
+		}
+		if n, err := session.DB("mydb").C("mycoll").Count(); err != nil || n != 1 {
+			t.Fatal("count failed:", n, err)
+		}
+		session.Close()
+	}
+
+	bad := []struct {
+		info  *mgo.DialInfo
+		error string
+	}{
+		{&mgo.DialInfo{TLSCAFile: certs.caFile}, "no reachable servers"},
+		{&mgo.DialInfo{TLS: true}, "no reachable servers"},
+		{&mgo.DialInfo{TLSCAFile: certs.clientFile + ".missing"}, "open .*: no such file or directory"},
+		{&mgo.DialInfo{TLSCertificateKeyFile: certs.caFile}, "tls: .*"},
+	}
+	for _, b := range bad {
+		b.info.Addrs = []string{srv.Addr()}
+		b.info.Timeout = 500 * time.Millisecond
+		b.info.FailFast = true
+		session, err := mgo.DialWithInfo(b.info)
+		if err == nil {
+			session.Close()
+			t.Fatalf("dial with %#v should fail", b.info)
+		}
+		if ok, _ := regexp.MatchString("^"+b.error+"$", err.Error()); !ok {
+			t.Fatalf("dial with %#v failed with %q, want %q", b.info, err, b.error)
+		}
+	}
+
+	url := srv.Addr() + "?ssl=true&tlsCAFile=" + certs.caFile + "&tlsAllowInvalidHostnames=true"
+	session, err := mgo.DialWithTimeout(url, 5*time.Second)
+	if err != nil {
+		t.Fatal("dial with URL failed:", err)
+	}
+	session.Close()
+	if _, err := mgo.DialWithTimeout(srv.Addr()+"?ssl=maybe", time.Second); err == nil || err.Error() != "bad value for connection URL option: ssl=maybe" {
+		t.Fatal("bad ssl option should be rejected:", err)
+	}
+}
+
+// authenticatedUsers returns the users authenticated with the socket
+// reserved by session.
+func authenticatedUsers(t *testing.T, session *mgo.Session) []string {
+	var status struct {
+		AuthInfo struct {
+			AuthenticatedUsers []struct{ User, Db string } "authenticatedUsers"
+		} "authInfo"
+	}
+	if err := session.Run("connectionStatus", &status); err != nil {
+		t.Fatal("connectionStatus failed:", err)
+	}
+	var users []string
+	for _, user := range status.AuthInfo.AuthenticatedUsers {
+		users = append(users, user.Db+"/"+user.User)
+	}
+	return users
+}
+
+func TestX509(t *testing.T) {
+	// The subject holds attributes pkix.Name doesn't know about, in the
+	// order of the certificate, and a value that must be escaped.
+	certs := newTestCerts(t, pkix.Name{
+		CommonName:         "client",
+		OrganizationalUnit: []string{"Services"},
+		Organization:       []string{"Acme, Inc."},
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, Value: "client@example.com"},
+			{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "com"},
+			{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "example"},
+		},
+	})
+	const subject = `DC=example,DC=com,emailAddress=client@example.com,CN=client,OU=Services,O=Acme\, Inc.`
+	srv := startTLS(t, certs, mockmgo.NewSession(""))
+	defer srv.Close()
+	srv.SetX509Subject(subject)
+
+	info := &mgo.DialInfo{
+		Addrs:                    []string{srv.Addr()},
+		Timeout:                  5 * time.Second,
+		Mechanism:                "MONGODB-X509",
+		TLSCAFile:                certs.caFile,
+		TLSCertificateKeyFile:    certs.clientFile,
+		TLSAllowInvalidHostnames: true,
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	if users := authenticatedUsers(t, session); !reflect.DeepEqual(users, []string{"$external/" + subject}) {
+		t.Fatal("unexpected users:", users)
+	}
+
+	// New sockets log in too.
+	session.Refresh()
+	copy := session.Copy().(*mgo.Session)
+	defer copy.Close()
+	if users := authenticatedUsers(t, copy); !reflect.DeepEqual(users, []string{"$external/" + subject}) {
+		t.Fatal("unexpected users after refresh:", users)
+	}
+
+	info.Username = "CN=other"
+	info.FailFast = true
+	if _, err := mgo.DialWithInfo(info); err == nil || !strings.Contains(err.Error(), "no x.509 client certificate matching the user: CN=other") {
+		t.Fatal("login as another user should fail:", err)
+	}
+
+	url := srv.Addr() + "?authMechanism=MONGODB-X509&tlsCAFile=" + certs.caFile +
+		"&tlsCertificateKeyFile=" + certs.clientFile + "&tlsAllowInvalidHostnames=true"
+	session, err = mgo.DialWithTimeout(url, 5*time.Second)
+	if err != nil {
+		t.Fatal("dial with URL failed:", err)
+	}
+	defer session.Close()
+	if users := authenticatedUsers(t, session); len(users) != 1 {
+		t.Fatal("unexpected users:", users)
+	}
+
+	// Without a client certificate, the user name must be provided and
+	// the server rejects it.
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{Addrs: []string{srv.Addr()}, Timeout: 5 * time.Second, TLS: true, TLSInsecure: true})
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	err = session.Login(&mgo.Credential{Mechanism: "MONGODB-X509"})
+	if err == nil || err.Error() != "MONGODB-X509 authentication requires a TLS client certificate" {
+		t.Fatal("login without certificate should fail:", err)
+	}
+	err = session.Login(&mgo.Credential{Username: subject, Mechanism: "MONGODB-X509"})
+	if err == nil || err.Error() != "No verified subject name available from client" {
+		t.Fatal("login without certificate should fail:", err)
+	}
+}
+
+func TestDialURLOptions(t *testing.T) {
+	srv, _, session := dial(t)
+	defer srv.Close()
+	session.Close()
+
+	url := "mongodb://" + srv.Addr() + "/mydb?readPreference=secondaryPreferred&readPreferenceTags=dc:ny" +
+		"&w=majority&wtimeoutMS=100&journal=true&socketTimeoutMS=2000&appName=tests"
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	pref := session.ReadPreference()
+	if pref == nil || pref.Mode != mgo.ReadSecondaryPreferred || len(pref.TagSets) != 1 {
+		t.Fatalf("unexpected read preference: %#v", pref)
+	}
+	if safe := session.Safe(); safe == nil || safe.WMode != "majority" || safe.WTimeout != 100 || !safe.J {
+		t.Fatalf("unexpected safety mode: %#v", safe)
+	}
+	if err := session.DB("").C("mycoll").Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	session, err = mgo.Dial(srv.Addr() + "?w=0")
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	if safe := session.Safe(); safe != nil {
+		t.Fatalf("unexpected safety mode: %#v", safe)
+	}
+
+	// The mock server isn't a replica set member.
+	_, err = mgo.Dial(srv.Addr() + "?replicaSet=rs0&connectTimeoutMS=500")
+	if err == nil || err.Error() != "no reachable servers" {
+		t.Fatal("dial to another replica set should fail:", err)
+	}
+}
+
+// fakeResolver serves the SRV records for cluster.example.com, pointing
+// to the mock servers it knows about.
+type fakeResolver struct {
+	m       sync.Mutex
+	servers map[string]*Server
+}
+
+func (r *fakeResolver) set(servers map[string]*Server) {
+	r.m.Lock()
+	r.servers = servers
+	r.m.Unlock()
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "mongodb" || proto != "tcp" || name != "cluster.example.com" {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	var records []*net.SRV
+	for host, srv := range r.servers {
+		_, port, _ := net.SplitHostPort(srv.Addr())
+		p, _ := strconv.Atoi(port)
+		records = append(records, &net.SRV{Target: host + ".", Port: uint16(p)})
+	}
+	return "_mongodb._tcp." + name, records, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return []string{"authSource=admin"}, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if strings.HasSuffix(host, ".example.com") {
+		return []string{"127.0.0.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// waitLiveServers waits for the live servers of session to be addrs.
+func waitLiveServers(t *testing.T, session *mgo.Session, addrs ...string) {
+	sort.Strings(addrs)
+	var live []string
+	for i := 0; i < 100; i++ {
+		live = session.LiveServers()
+		sort.Strings(live)
+		if reflect.DeepEqual(live, addrs) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("live servers are %v, want %v", live, addrs)
+}
+
+// srvAddr returns the address of srv as listed in the SRV records of
+// fakeResolver under host.
+func srvAddr(host string, srv *Server) string {
+	_, port, _ := net.SplitHostPort(srv.Addr())
+	return host + ":" + port
+}
+
+func TestSRV(t *testing.T) {
+	srv1, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv1.Close()
+	srv2, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv2.Close()
+	srv1.SetMongos(true)
+	srv2.SetMongos(true)
+
+	resolver := &fakeResolver{}
+	resolver.set(map[string]*Server{"db1.example.com": srv1})
+	info, err := mgo.ParseURL("mongodb+srv://cluster.example.com/mydb?tls=false")
+	if err != nil {
+		t.Fatal("parse failed:", err)
+	}
+	info.Resolver = resolver
+	info.SRVPollInterval = 50 * time.Millisecond
+	info.Timeout = 5 * time.Second
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	waitLiveServers(t, session, srvAddr("db1.example.com", srv1))
+
+	// Servers added to and removed from the records are noticed.
+	resolver.set(map[string]*Server{"db1.example.com": srv1, "db2.example.com": srv2})
+	waitLiveServers(t, session, srvAddr("db1.example.com", srv1), srvAddr("db2.example.com", srv2))
+	resolver.set(map[string]*Server{"db2.example.com": srv2})
+	waitLiveServers(t, session, srvAddr("db2.example.com", srv2))
+	if err := session.DB("").C("mycoll").Insert(bson.M{"_id": 1}); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	// The seeds are kept while the records can't be found.
+	resolver.set(nil)
+	time.Sleep(200 * time.Millisecond)
+	waitLiveServers(t, session, srvAddr("db2.example.com", srv2))
+
+	info.SRVName = "other.example.com"
+	_, err = mgo.DialWithInfo(info)
+	if err == nil || err.Error() != "lookup other.example.com: no such host" {
+		t.Fatal("dial with missing SRV records should fail:", err)
+	}
+}
+
+func TestSRVReplicaSet(t *testing.T) {
+	srv1, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv1.Close()
+	srv2, err := Start(mockmgo.NewSession(""))
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	defer srv2.Close()
+	hosts := []string{srvAddr("db1.example.com", srv1), srvAddr("db2.example.com", srv2)}
+	srv1.SetReplicaSet("rs0", hosts, true)
+	srv2.SetReplicaSet("rs0", hosts, false)
+
+	resolver := &fakeResolver{}
+	resolver.set(map[string]*Server{"db1.example.com": srv1, "db2.example.com": srv2})
+	info, err := mgo.ParseURL("mongodb+srv://cluster.example.com/mydb?tls=false")
+	if err != nil {
+		t.Fatal("parse failed:", err)
+	}
+	info.Resolver = resolver
+	info.SRVPollInterval = 50 * time.Millisecond
+	info.Timeout = 5 * time.Second
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer session.Close()
+	waitLiveServers(t, session, hosts...)
+	conns := func() map[net.Conn]bool {
+		srv2.Lock()
+		defer srv2.Unlock()
+		conns := make(map[net.Conn]bool)
+		for conn := range srv2.conns {
+			conns[conn] = true
+		}
+		return conns
+	}
+	before := conns()
+
+	// The replica set reports its own members, so a target removed from
+	// the SRV records but still listed in hosts is kept, along with the
+	// connections to it.
+	resolver.set(map[string]*Server{"db1.example.com": srv1})
+	time.Sleep(1500 * time.Millisecond)
+	waitLiveServers(t, session, hosts...)
+	after := conns()
+	for conn := range before {
+		if !after[conn] {
+			t.Fatal("connection to server removed from the SRV records was closed")
+		}
+	}
+}
@@ -0,0 +1,913 @@
+// Package modify applies MongoDB update documents, such as
+//
+//     bson.M{"$set": bson.M{"a.b": 1}, "$inc": bson.M{"n": 1}}
+//
+// to in-memory documents, reporting the same errors a server would.
+package modify
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/parse"
+)
+
+const (
+	codeFailedToParse   = 9
+	codeTypeMismatch    = 14
+	codeConflict        = 16836
+	codeInvalidDocument = 16837
+	codeNoPositional    = 16650
+)
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &mgo.LastError{Code: code, Err: fmt.Sprintf(format, args...)}
+}
+
+// Normalize converts doc, which may be a bson.D, a bson.M, a map or a
+// tagged struct, into a bson.D holding nested documents as bson.D and
+// arrays as []interface{}. The _id field is moved first, as the server
+// stores it.
+func Normalize(doc interface{}) (result bson.D, err error) {
+	data, err := bson.Marshal(doc)
+	if err == nil {
+		err = bson.Unmarshal(data, &result)
+	}
+	for i := 1; i < len(result); i++ {
+		if result[i].Name == "_id" {
+			id := result[i]
+			copy(result[1:i+1], result[:i])
+			result[0] = id
+			break
+		}
+	}
+	return result, err
+}
+
+// normalizeValue converts v as Normalize does for documents.
+func normalizeValue(v interface{}) (interface{}, error) {
+	d, err := Normalize(bson.D{{"v", v}})
+	if err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+// HasModifiers reports whether change is an update document made of
+// modifiers, rather than a replacement document.
+func HasModifiers(change interface{}) (bool, error) {
+	d, err := Normalize(change)
+	if err != nil {
+		return false, err
+	}
+	if len(d) == 0 || !strings.HasPrefix(d[0].Name, "$") {
+		for _, elem := range d {
+			if strings.HasPrefix(elem.Name, "$") {
+				return false, errorf(codeInvalidDocument, "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", elem.Name, elem.Name)
+			}
+		}
+		return false, nil
+	}
+	for _, elem := range d {
+		if !strings.HasPrefix(elem.Name, "$") {
+			return false, errorf(codeFailedToParse, "Unknown modifier: %s", elem.Name)
+		}
+	}
+	return true, nil
+}
+
+// modifier holds a single field modification, such as the {"a": 1}
+// in {"$inc": {"a": 1, "b": 2}}.
+type modifier struct {
+	name string
+	path string
+	arg  interface{}
+}
+
+type modifierFunc func(m *modifier, doc bson.D, insert bool) (bson.D, error)
+
+var modifiers map[string]modifierFunc
+
+func init() {
+	modifiers = map[string]modifierFunc{
+		"$set":         applySet,
+		"$setOnInsert": applySetOnInsert,
+		"$unset":       applyUnset,
+		"$inc":         applyInc,
+		"$mul":         applyMul,
+		"$push":        applyPush,
+		"$pushAll":     applyPushAll,
+		"$addToSet":    applyAddToSet,
+		"$pull":        applyPull,
+		"$pullAll":     applyPullAll,
+		"$pop":         applyPop,
+		"$rename":      applyRename,
+	}
+}
+
+// Apply applies the modifiers in the update document change to doc, and
+// returns the resulting document. If insert is true the document is being
+// created by an upsert, and $setOnInsert modifiers take effect.
+func Apply(doc interface{}, change interface{}, insert bool) (result bson.D, err error) {
+	if result, err = Normalize(doc); err != nil {
+		return nil, err
+	}
+	mods, err := parseChange(change)
+	if err != nil {
+		return nil, err
+	}
+
+	oldId, hasId := Lookup(result, "_id")
+	for _, m := range mods {
+		if result, err = modifiers[m.name](m, result, insert); err != nil {
+			return nil, err
+		}
+	}
+	newId, stillHasId := Lookup(result, "_id")
+	if hasId && (!stillHasId || !Equal(oldId, newId)) {
+		return nil, errorf(codeInvalidDocument, "After applying the update to the document {_id: %s , ...}, the (immutable) field '_id' was found to have been altered to _id: %s", format(oldId), format(newId))
+	}
+	return result, nil
+}
+
+// IdChangedError returns the error the server reports when a replacement
+// document changes the _id of the document it replaces.
+func IdChangedError(oldId, newId interface{}) error {
+	return errorf(codeInvalidDocument, "The _id field cannot be changed from {_id: %s} to {_id: %s}.", format(oldId), format(newId))
+}
+
+// Upsert returns the document inserted by an upsert when no document
+// matches selector. Equality conditions in selector are copied into the
+// new document before change is applied with $setOnInsert enabled. If
+// change is a replacement document, only the _id in selector is kept.
+func Upsert(selector interface{}, change interface{}) (result bson.D, err error) {
+	hasModifiers, err := HasModifiers(change)
+	if err != nil {
+		return nil, err
+	}
+	var sel bson.D
+	if selector != nil {
+		if sel, err = Normalize(selector); err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasModifiers {
+		if result, err = Normalize(change); err != nil {
+			return nil, err
+		}
+		if _, ok := Lookup(result, "_id"); ok {
+			return result, nil
+		}
+		if id, ok := Lookup(sel, "_id"); ok && !isOperator(id) {
+			result = append(bson.D{{"_id", id}}, result...)
+		}
+		return result, nil
+	}
+
+	seed := bson.D{}
+	if id, ok := Lookup(sel, "_id"); ok && !isOperator(id) {
+		seed = append(seed, bson.DocElem{"_id", id})
+	}
+	for _, elem := range sel {
+		if elem.Name == "_id" || strings.HasPrefix(elem.Name, "$") || isOperator(elem.Value) {
+			continue
+		}
+		value := elem.Value
+		seed, err = update(seed, elem.Name, func(interface{}, bool) (interface{}, action, error) {
+			return value, store, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Apply(seed, change, true)
+}
+
+// isOperator reports whether v is a query operator document, such as
+// {"$gt": 1}.
+func isOperator(v interface{}) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Name, "$")
+}
+
+// parseChange breaks the update document change into modifiers sorted by
+// path, which is the order in which the server applies them.
+func parseChange(change interface{}) (mods []*modifier, err error) {
+	d, err := Normalize(change)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) == 0 {
+		return nil, errorf(codeFailedToParse, "Update document is empty")
+	}
+
+	for _, elem := range d {
+		if _, ok := modifiers[elem.Name]; !ok {
+			return nil, errorf(codeFailedToParse, "Unknown modifier: %s", elem.Name)
+		}
+		fields, ok := elem.Value.(bson.D)
+		if !ok {
+			return nil, errorf(codeFailedToParse, "Modifiers operate on fields but we found a %s instead. For example: {$mod: {<field>: ...}} not {%s: %s}", TypeName(elem.Value), elem.Name, format(elem.Value))
+		}
+		if len(fields) == 0 {
+			return nil, errorf(codeFailedToParse, "'%s' is empty. You must specify a field like so: {%s: {<field>: ...}}", elem.Name, elem.Name)
+		}
+		for _, field := range fields {
+			if err := checkPath(field.Name); err != nil {
+				return nil, err
+			}
+			mods = append(mods, &modifier{elem.Name, field.Name, field.Value})
+		}
+	}
+
+	// Check that no two modifiers touch the same part of the document.
+	var paths []string
+	for _, m := range mods {
+		paths = append(paths, m.path)
+		if m.name == "$rename" {
+			to, ok := m.arg.(string)
+			if !ok {
+				return nil, errorf(codeTypeMismatch, "The 'to' field for $rename must be a string: %s: %s", m.path, format(m.arg))
+			}
+			if to == m.path {
+				return nil, errorf(codeFailedToParse, "The source and target field for $rename must differ: %s: %s", m.path, format(m.arg))
+			}
+			if err := checkPath(to); err != nil {
+				return nil, err
+			}
+			paths = append(paths, to)
+		}
+	}
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] || strings.HasPrefix(sorted[i], sorted[i-1]+".") {
+			return nil, errorf(codeConflict, "Cannot update '%s' and '%s' at the same time", sorted[i-1], sorted[i])
+		}
+	}
+
+	sort.Stable(modifiersByPath(mods))
+	return mods, nil
+}
+
+func checkPath(path string) error {
+	if path == "" {
+		return errorf(codeFailedToParse, "An empty update path is not valid.")
+	}
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			return errorf(codeFailedToParse, "The update path '%s' contains an empty field name, which is not allowed.", path)
+		}
+		if part == "$" {
+			return errorf(codeNoPositional, "The positional operator did not find the match needed from the query. Unexpanded update: %s", path)
+		}
+	}
+	return nil
+}
+
+type modifiersByPath []*modifier
+
+func (p modifiersByPath) Len() int           { return len(p) }
+func (p modifiersByPath) Less(i, j int) bool { return p[i].path < p[j].path }
+func (p modifiersByPath) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// ---------------------------------------------------------------------------
+// Path handling.
+
+// Lookup returns the value found at the dotted path in doc.
+func Lookup(doc interface{}, path string) (value interface{}, found bool) {
+	value = doc
+	for _, part := range strings.Split(path, ".") {
+		switch container := value.(type) {
+		case bson.D:
+			found = false
+			for _, elem := range container {
+				if elem.Name == part {
+					value, found = elem.Value, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(container) {
+				return nil, false
+			}
+			value = container[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+type action int
+
+const (
+	keep action = iota
+	store
+	drop
+)
+
+// updateFunc receives the value currently found at a path, and decides
+// what should be done with it.
+type updateFunc func(value interface{}, found bool) (interface{}, action, error)
+
+// update runs f against the value at the dotted path in doc, creating the
+// path as needed when f stores a value.
+func update(doc bson.D, path string, f updateFunc) (bson.D, error) {
+	result, err := updatePath(doc, strings.Split(path, "."), path, f)
+	if err != nil {
+		return nil, err
+	}
+	return result.(bson.D), nil
+}
+
+func updatePath(container interface{}, parts []string, path string, f updateFunc) (interface{}, error) {
+	part := parts[0]
+	switch c := container.(type) {
+	case bson.D:
+		for i := range c {
+			if c[i].Name != part {
+				continue
+			}
+			if len(parts) > 1 {
+				child, err := updateChild(c[i].Value, parts, path, f)
+				if err != nil {
+					return nil, err
+				}
+				c[i].Value = child
+				return c, nil
+			}
+			value, act, err := f(c[i].Value, true)
+			switch {
+			case err != nil:
+				return nil, err
+			case act == store:
+				c[i].Value = value
+			case act == drop:
+				c = append(c[:i], c[i+1:]...)
+			}
+			return c, nil
+		}
+		value, act, err := f(nil, false)
+		if err != nil || act != store {
+			return c, err
+		}
+		return append(c, bson.DocElem{part, build(parts[1:], value)}), nil
+
+	case []interface{}:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			_, act, err := f(nil, false)
+			if err != nil || act != store {
+				return c, err
+			}
+			return nil, errorf(codeInvalidDocument, "cannot use the part (%s of %s) to traverse the element (%s)", part, path, format(c))
+		}
+		if i < len(c) {
+			if len(parts) > 1 {
+				child, err := updateChild(c[i], parts, path, f)
+				if err != nil {
+					return nil, err
+				}
+				c[i] = child
+				return c, nil
+			}
+			value, act, err := f(c[i], true)
+			switch {
+			case err != nil:
+				return nil, err
+			case act == store:
+				c[i] = value
+			case act == drop:
+				// The server keeps array positions stable.
+				c[i] = nil
+			}
+			return c, nil
+		}
+		value, act, err := f(nil, false)
+		if err != nil || act != store {
+			return c, err
+		}
+		for len(c) < i {
+			c = append(c, nil)
+		}
+		return append(c, build(parts[1:], value)), nil
+	}
+	panic("unreachable")
+}
+
+// updateChild continues the traversal of parts into child.
+func updateChild(child interface{}, parts []string, path string, f updateFunc) (interface{}, error) {
+	switch child.(type) {
+	case bson.D, []interface{}:
+		return updatePath(child, parts[1:], path, f)
+	}
+	_, act, err := f(nil, false)
+	if err != nil || act != store {
+		return child, err
+	}
+	return nil, errorf(codeInvalidDocument, "cannot use the part (%s of %s) to traverse the element ({%s: %s})", parts[1], path, parts[0], format(child))
+}
+
+// build returns value nested under the documents named by parts.
+func build(parts []string, value interface{}) interface{} {
+	for i := len(parts) - 1; i >= 0; i-- {
+		value = bson.D{{parts[i], value}}
+	}
+	return value
+}
+
+// ---------------------------------------------------------------------------
+// Modifiers.
+
+func applySet(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	arg, err := normalizeValue(m.arg)
+	if err != nil {
+		return nil, err
+	}
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		return arg, store, nil
+	})
+}
+
+func applySetOnInsert(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	if !insert {
+		return doc, nil
+	}
+	return applySet(m, doc, insert)
+}
+
+func applyUnset(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		return nil, drop, nil
+	})
+}
+
+func applyInc(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	return applyArith(m, doc, "$inc", "increment", add)
+}
+
+func applyMul(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	return applyArith(m, doc, "$mul", "multiply", mul)
+}
+
+func applyArith(m *modifier, doc bson.D, name, verb string, op func(a, b interface{}) interface{}) (bson.D, error) {
+	if !IsNumber(m.arg) {
+		return nil, errorf(codeTypeMismatch, "Cannot %s with non-numeric argument: {%s: %s}", verb, m.path, format(m.arg))
+	}
+	arg, _ := normalizeValue(m.arg)
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		if !found {
+			if name == "$mul" {
+				return op(arg, 0), store, nil
+			}
+			return arg, store, nil
+		}
+		if !IsNumber(value) {
+			return nil, keep, errorf(codeInvalidDocument, "Cannot apply %s to a value of non-numeric type. {_id: %s} has the field '%s' of non-numeric type %s", name, format(docIdOf(doc)), lastPart(m.path), TypeName(value))
+		}
+		return op(value, arg), store, nil
+	})
+}
+
+func applyPush(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	arg, err := normalizeValue(m.arg)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []interface{}{arg}
+	position, slice, hasSlice := -1, 0, false
+	if d, ok := arg.(bson.D); ok && len(d) > 0 && d[0].Name == "$each" {
+		for _, elem := range d {
+			switch elem.Name {
+			case "$each":
+				each, ok := elem.Value.([]interface{})
+				if !ok {
+					return nil, errorf(codeTypeMismatch, "The argument to $each in $push must be an array but it was of type: %s", TypeName(elem.Value))
+				}
+				items = each
+			case "$slice":
+				n, ok := toInt(elem.Value)
+				if !ok {
+					return nil, errorf(codeTypeMismatch, "The value for $slice must be a numeric value not a %s", TypeName(elem.Value))
+				}
+				slice, hasSlice = n, true
+			case "$position":
+				n, ok := toInt(elem.Value)
+				if !ok || n < 0 {
+					return nil, errorf(codeTypeMismatch, "The value for $position must be a positive numeric value not a %s", TypeName(elem.Value))
+				}
+				position = n
+			default:
+				return nil, errorf(codeFailedToParse, "Unrecognized clause in $push: %s", elem.Name)
+			}
+		}
+	}
+
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		var array []interface{}
+		if found {
+			var ok bool
+			if array, ok = value.([]interface{}); !ok {
+				return nil, keep, errorf(codeInvalidDocument, "The field '%s' must be an array but is of type %s in document {_id: %s}", m.path, TypeName(value), format(docIdOf(doc)))
+			}
+		}
+		if position < 0 || position > len(array) {
+			position = len(array)
+		}
+		result := make([]interface{}, 0, len(array)+len(items))
+		result = append(result, array[:position]...)
+		result = append(result, items...)
+		result = append(result, array[position:]...)
+		if hasSlice {
+			switch {
+			case slice >= 0 && slice < len(result):
+				result = result[:slice]
+			case slice < 0 && -slice < len(result):
+				result = result[len(result)+slice:]
+			}
+		}
+		return result, store, nil
+	})
+}
+
+func applyPushAll(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	return applyPush(&modifier{m.name, m.path, bson.D{{"$each", m.arg}}}, doc, insert)
+}
+
+func applyAddToSet(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	arg, err := normalizeValue(m.arg)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []interface{}{arg}
+	if d, ok := arg.(bson.D); ok && len(d) > 0 && d[0].Name == "$each" {
+		each, ok := d[0].Value.([]interface{})
+		if !ok {
+			return nil, errorf(codeTypeMismatch, "The argument to $each in $addToSet must be an array but it was of type %s", TypeName(d[0].Value))
+		}
+		items = each
+	}
+
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		var array []interface{}
+		if found {
+			var ok bool
+			if array, ok = value.([]interface{}); !ok {
+				return nil, keep, errorf(codeInvalidDocument, "Cannot apply $addToSet to a non-array field. Field named '%s' has a non-array type %s in the document _id: %s", lastPart(m.path), TypeName(value), format(docIdOf(doc)))
+			}
+		}
+		result := append([]interface{}(nil), array...)
+	next:
+		for _, item := range items {
+			for _, elem := range result {
+				if Equal(elem, item) {
+					continue next
+				}
+			}
+			result = append(result, item)
+		}
+		return result, store, nil
+	})
+}
+
+func applyPull(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	arg, err := normalizeValue(m.arg)
+	if err != nil {
+		return nil, err
+	}
+	return applyPullIf(m, doc, "$pull", func(elem interface{}) bool {
+		return pullMatch(elem, arg)
+	})
+}
+
+func applyPullAll(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	arg, err := normalizeValue(m.arg)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := arg.([]interface{})
+	if !ok {
+		return nil, errorf(codeFailedToParse, "$pullAll requires an array argument but was given a %s", TypeName(arg))
+	}
+	return applyPullIf(m, doc, "$pullAll", func(elem interface{}) bool {
+		for _, item := range items {
+			if Equal(elem, item) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func applyPullIf(m *modifier, doc bson.D, name string, match func(elem interface{}) bool) (bson.D, error) {
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		if !found {
+			return nil, keep, nil
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil, keep, errorf(codeInvalidDocument, "Cannot apply %s to a non-array value", name)
+		}
+		result := make([]interface{}, 0, len(array))
+		for _, elem := range array {
+			if !match(elem) {
+				result = append(result, elem)
+			}
+		}
+		return result, store, nil
+	})
+}
+
+// pullMatch reports whether elem is matched by the $pull condition cond.
+// A document condition is taken as a query on the array elements.
+func pullMatch(elem, cond interface{}) bool {
+	d, ok := cond.(bson.D)
+	if !ok {
+		return Equal(elem, cond)
+	}
+	query, _ := toM(d).(bson.M)
+	if len(d) > 0 && strings.HasPrefix(d[0].Name, "$") {
+		match, _ := parse.Match(bson.M{"v": elem}, bson.M{"v": query})
+		return match
+	}
+	if _, ok := elem.(bson.D); !ok {
+		return false
+	}
+	match, _ := parse.Match(elem, query)
+	return match
+}
+
+// toM converts nested bson.D values into bson.M, as expected by parse.Match.
+func toM(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := make(bson.M, len(v))
+		for _, elem := range v {
+			m[elem.Name] = toM(elem.Value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			s[i] = toM(elem)
+		}
+		return s
+	}
+	return v
+}
+
+func applyPop(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	n, ok := toInt(m.arg)
+	if !ok {
+		return nil, errorf(codeFailedToParse, "$pop expects a number, found: %s", format(m.arg))
+	}
+	return update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		if !found {
+			return nil, keep, nil
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil, keep, errorf(codeInvalidDocument, "Path '%s' contains an element of non-array type '%s'", m.path, TypeName(value))
+		}
+		if len(array) == 0 {
+			return array, store, nil
+		}
+		if n < 0 {
+			return array[1:], store, nil
+		}
+		return array[:len(array)-1], store, nil
+	})
+}
+
+func applyRename(m *modifier, doc bson.D, insert bool) (bson.D, error) {
+	value, found := Lookup(doc, m.path)
+	if !found {
+		return doc, nil
+	}
+	doc, err := update(doc, m.path, func(value interface{}, found bool) (interface{}, action, error) {
+		return nil, drop, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update(doc, m.arg.(string), func(interface{}, bool) (interface{}, action, error) {
+		return value, store, nil
+	})
+}
+
+// ---------------------------------------------------------------------------
+// Values.
+
+// IsNumber reports whether v holds one of the numeric BSON types.
+func IsNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, float32, float64:
+		return true
+	}
+	return false
+}
+
+func toInt(v interface{}) (int, bool) {
+	if !IsNumber(v) {
+		return 0, false
+	}
+	f, _ := ToFloat(v)
+	return int(f), true
+}
+
+// ToFloat returns the value of the number v as a float64, reporting
+// whether v was a number.
+func ToFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	}
+	f, _ := ToFloat(v)
+	return int64(f)
+}
+
+// Arith computes the result of an arithmetic operation the way the server
+// does: doubles win over longs, and longs win over ints. Ints that overflow
+// are promoted to longs.
+func Arith(a, b interface{}, fop func(a, b float64) float64, iop func(a, b int64) int64) interface{} {
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		af, _ := ToFloat(a)
+		bf, _ := ToFloat(b)
+		return fop(af, bf)
+	}
+	r := iop(toInt64(a), toInt64(b))
+	_, aLong := a.(int64)
+	_, bLong := b.(int64)
+	if aLong || bLong || r != int64(int32(r)) {
+		return r
+	}
+	return int(r)
+}
+
+func add(a, b interface{}) interface{} {
+	return Arith(a, b, func(a, b float64) float64 { return a + b }, func(a, b int64) int64 { return a + b })
+}
+
+func mul(a, b interface{}) interface{} {
+	return Arith(a, b, func(a, b float64) float64 { return a * b }, func(a, b int64) int64 { return a * b })
+}
+
+// Equal reports whether the normalized values a and b are equal for the
+// server. Numbers of different types are equal when their values are.
+func Equal(a, b interface{}) bool {
+	if IsNumber(a) && IsNumber(b) {
+		af, _ := ToFloat(a)
+		bf, _ := ToFloat(b)
+		return af == bf && toInt64(a) == toInt64(b)
+	}
+	switch a := a.(type) {
+	case bson.D:
+		b, ok := b.(bson.D)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i].Name != b[i].Name || !Equal(a[i].Value, b[i].Value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case []byte:
+		b, ok := b.([]byte)
+		return ok && string(a) == string(b)
+	}
+	return a == b
+}
+
+// TypeName returns the name the server uses for the BSON type of v.
+func TypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "NULL"
+	case float32, float64:
+		return "Double"
+	case string:
+		return "String"
+	case bson.D, bson.M:
+		return "Object"
+	case []interface{}:
+		return "Array"
+	case []byte, bson.Binary:
+		return "BinData"
+	case bson.ObjectId:
+		return "OID"
+	case bool:
+		return "Boolean"
+	case bson.RegEx:
+		return "RegEx"
+	case bson.MongoTimestamp:
+		return "Timestamp"
+	case int64:
+		return "NumberLong"
+	case int, int8, int16, int32, uint8, uint16, uint32:
+		return "NumberInt"
+	case bson.Symbol:
+		return "Symbol"
+	case bson.JavaScript:
+		return "CodeWScope"
+	case time.Time:
+		return "Date"
+	}
+	switch v {
+	case bson.MinKey:
+		return "MinKey"
+	case bson.MaxKey:
+		return "MaxKey"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// format renders v in the shell-like notation used in server messages.
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId('%s')", v.Hex())
+	case bson.D:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = elem.Name + ": " + format(elem.Value)
+		}
+		return "{ " + strings.Join(parts, ", ") + " }"
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = format(elem)
+		}
+		return "[ " + strings.Join(parts, ", ") + " ]"
+	}
+	return fmt.Sprint(v)
+}
+
+func docIdOf(doc bson.D) interface{} {
+	id, _ := Lookup(doc, "_id")
+	return id
+}
+
+func lastPart(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
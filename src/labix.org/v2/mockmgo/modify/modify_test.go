@@ -0,0 +1,161 @@
+package modify
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	"labix.org/v2/mgo"
+)
+
+type Inner struct {
+	F int `bson:"f"`
+}
+
+type Outer struct {
+	Id int     `bson:"_id"`
+	A  int     `bson:"a"`
+	B  Inner   `bson:"b"`
+	C  []int   `bson:"c"`
+	E  []Inner `bson:"e"`
+}
+
+var applyTests = []struct {
+	doc, change interface{}
+	expected    bson.D
+}{
+	// $set and $unset
+	{bson.M{"_id": 1}, bson.M{"$set": bson.M{"a": 2}}, bson.D{{"_id", 1}, {"a", 2}}},
+	{bson.D{{"_id", 1}, {"a", 1}}, bson.M{"$set": bson.M{"a": "x"}}, bson.D{{"_id", 1}, {"a", "x"}}},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"a.b.c": 1}}, bson.D{{"_id", 1}, {"a", bson.D{{"b", bson.D{{"c", 1}}}}}}},
+	{bson.M{"_id": 1, "a": bson.M{"b": 1}}, bson.M{"$set": bson.M{"a.c": 2}}, bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}, {"c", 2}}}}},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"b": 1, "a": 2}}, bson.D{{"_id", 1}, {"a", 2}, {"b", 1}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$set": bson.M{"a.1": 3}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 3}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1}}}, bson.M{"$set": bson.M{"a.2": 3}}, bson.D{{"_id", 1}, {"a", []interface{}{1, nil, 3}}}},
+	{bson.D{{"_id", 1}, {"a", 1}, {"b", 2}}, bson.M{"$unset": bson.M{"a": 1}}, bson.D{{"_id", 1}, {"b", 2}}},
+	{bson.D{{"_id", 1}}, bson.M{"$unset": bson.M{"a.b": 1}}, bson.D{{"_id", 1}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$unset": bson.M{"a.0": 1}}, bson.D{{"_id", 1}, {"a", []interface{}{nil, 2}}}},
+	{bson.D{{"_id", 1}}, bson.M{"$setOnInsert": bson.M{"a": 1}}, bson.D{{"_id", 1}}},
+
+	// Structs
+	{Outer{Id: 1, A: 1, B: Inner{2}}, bson.M{"$set": bson.M{"b.f": 3}}, bson.D{{"_id", 1}, {"a", 1}, {"b", bson.D{{"f", 3}}}, {"c", []interface{}{}}, {"e", []interface{}{}}}},
+	{Outer{Id: 1, E: []Inner{{1}, {2}}}, bson.M{"$inc": bson.M{"e.1.f": 5}}, bson.D{{"_id", 1}, {"a", 0}, {"b", bson.D{{"f", 0}}}, {"c", []interface{}{}}, {"e", []interface{}{bson.D{{"f", 1}}, bson.D{{"f", 7}}}}}},
+
+	// $inc and $mul
+	{bson.D{{"_id", 1}, {"n", 1}}, bson.M{"$inc": bson.M{"n": 2}}, bson.D{{"_id", 1}, {"n", 3}}},
+	{bson.D{{"_id", 1}, {"n", 1}}, bson.M{"$inc": bson.M{"n": 0.5}}, bson.D{{"_id", 1}, {"n", 1.5}}},
+	{bson.D{{"_id", 1}, {"n", int64(1)}}, bson.M{"$inc": bson.M{"n": 1}}, bson.D{{"_id", 1}, {"n", int64(2)}}},
+	{bson.D{{"_id", 1}, {"n", 2147483647}}, bson.M{"$inc": bson.M{"n": 1}}, bson.D{{"_id", 1}, {"n", int64(2147483648)}}},
+	{bson.D{{"_id", 1}}, bson.M{"$inc": bson.M{"n": -1}}, bson.D{{"_id", 1}, {"n", -1}}},
+	{bson.D{{"_id", 1}, {"n", 3}}, bson.M{"$mul": bson.M{"n": 2}}, bson.D{{"_id", 1}, {"n", 6}}},
+	{bson.D{{"_id", 1}}, bson.M{"$mul": bson.M{"n": 2.0}}, bson.D{{"_id", 1}, {"n", 0.0}}},
+
+	// $push, $pushAll, $addToSet
+	{bson.D{{"_id", 1}}, bson.M{"$push": bson.M{"a": 1}}, bson.D{{"_id", 1}, {"a", []interface{}{1}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1}}}, bson.M{"$push": bson.M{"a": bson.M{"b": 1}}}, bson.D{{"_id", 1}, {"a", []interface{}{1, bson.D{{"b", 1}}}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1}}}, bson.M{"$push": bson.M{"a": bson.M{"$each": []int{2, 3}}}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 3}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$push": bson.M{"a": bson.D{{"$each", []int{3, 4}}, {"$slice", -3}}}}, bson.D{{"_id", 1}, {"a", []interface{}{2, 3, 4}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$push": bson.M{"a": bson.D{{"$each", []int{3}}, {"$position", 0}}}}, bson.D{{"_id", 1}, {"a", []interface{}{3, 1, 2}}}},
+	{bson.D{{"_id", 1}}, bson.M{"$pushAll": bson.M{"a": []int{1, 2}}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$addToSet": bson.M{"a": 2.0}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}, bson.M{"$addToSet": bson.M{"a": bson.M{"$each": []int{2, 3, 3}}}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 3}}}},
+
+	// $pull, $pullAll, $pop
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 1}}}, bson.M{"$pull": bson.M{"a": 1}}, bson.D{{"_id", 1}, {"a", []interface{}{2}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 5, 6}}}, bson.M{"$pull": bson.M{"a": bson.M{"$gte": 5}}}, bson.D{{"_id", 1}, {"a", []interface{}{1}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{bson.D{{"b", 1}, {"c", 1}}, bson.D{{"b", 2}}}}}, bson.M{"$pull": bson.M{"a": bson.M{"b": 1}}}, bson.D{{"_id", 1}, {"a", []interface{}{bson.D{{"b", 2}}}}}},
+	{bson.D{{"_id", 1}}, bson.M{"$pull": bson.M{"a": 1}}, bson.D{{"_id", 1}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 3}}}, bson.M{"$pullAll": bson.M{"a": []int{1, 3}}}, bson.D{{"_id", 1}, {"a", []interface{}{2}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 3}}}, bson.M{"$pop": bson.M{"a": 1}}, bson.D{{"_id", 1}, {"a", []interface{}{1, 2}}}},
+	{bson.D{{"_id", 1}, {"a", []interface{}{1, 2, 3}}}, bson.M{"$pop": bson.M{"a": -1}}, bson.D{{"_id", 1}, {"a", []interface{}{2, 3}}}},
+
+	// $rename
+	{bson.D{{"_id", 1}, {"a", 1}, {"b", 2}}, bson.M{"$rename": bson.M{"a": "c.d"}}, bson.D{{"_id", 1}, {"b", 2}, {"c", bson.D{{"d", 1}}}}},
+	{bson.D{{"_id", 1}, {"b", 2}}, bson.M{"$rename": bson.M{"a": "c"}}, bson.D{{"_id", 1}, {"b", 2}}},
+
+	// _id may be set to its current value.
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"_id": 1.0}}, bson.D{{"_id", 1.0}}},
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range applyTests {
+		result, err := Apply(test.doc, test.change, false)
+		if err != nil {
+			t.Fatalf("apply %#v to %#v failed: %v", test.change, test.doc, err)
+		}
+		if !reflect.DeepEqual(test.expected, result) {
+			t.Fatalf("apply %#v to %#v, expected:%#v, actual:%#v", test.change, test.doc, test.expected, result)
+		}
+	}
+}
+
+func TestApplyOnInsert(t *testing.T) {
+	result, err := Apply(bson.D{{"_id", 1}}, bson.M{"$setOnInsert": bson.M{"a": 1}}, true)
+	if err != nil {
+		t.Fatal("apply failed:", err)
+	}
+	expected := bson.D{{"_id", 1}, {"a", 1}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("expected:%#v, actual:%#v", expected, result)
+	}
+}
+
+var applyErrorTests = []struct {
+	doc, change interface{}
+	code        int
+	message     string
+}{
+	{bson.D{{"_id", 1}}, bson.M{"$foo": bson.M{"a": 1}}, 9, "Unknown modifier: $foo"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{}}, 9, "'$set' is empty. You must specify a field like so: {$set: {<field>: ...}}"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": 1}, 9, "Modifiers operate on fields but we found a NumberInt instead. For example: {$mod: {<field>: ...}} not {$set: 1}"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"a": 1}, "$inc": bson.M{"a": 1}}, 16836, "Cannot update 'a' and 'a' at the same time"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"a": 1}, "$unset": bson.M{"a.b": 1}}, 16836, "Cannot update 'a' and 'a.b' at the same time"},
+	{bson.D{{"_id", 1}, {"a", 1}}, bson.M{"$set": bson.M{"a.b": 1}}, 16837, "cannot use the part (b of a.b) to traverse the element ({a: 1})"},
+	{bson.D{{"_id", 1}}, bson.M{"$inc": bson.M{"a": "x"}}, 14, `Cannot increment with non-numeric argument: {a: "x"}`},
+	{bson.D{{"_id", 1}, {"a", "x"}}, bson.M{"$inc": bson.M{"a": 1}}, 16837, "Cannot apply $inc to a value of non-numeric type. {_id: 1} has the field 'a' of non-numeric type String"},
+	{bson.D{{"_id", 1}}, bson.M{"$mul": bson.M{"a": "x"}}, 14, `Cannot multiply with non-numeric argument: {a: "x"}`},
+	{bson.D{{"_id", 1}, {"a", 1}}, bson.M{"$push": bson.M{"a": 1}}, 16837, "The field 'a' must be an array but is of type NumberInt in document {_id: 1}"},
+	{bson.D{{"_id", 1}}, bson.M{"$push": bson.M{"a": bson.M{"$each": 1}}}, 14, "The argument to $each in $push must be an array but it was of type: NumberInt"},
+	{bson.D{{"_id", 1}, {"a", 1}}, bson.M{"$addToSet": bson.M{"a": 1}}, 16837, "Cannot apply $addToSet to a non-array field. Field named 'a' has a non-array type NumberInt in the document _id: 1"},
+	{bson.D{{"_id", 1}, {"a", 1}}, bson.M{"$pull": bson.M{"a": 1}}, 16837, "Cannot apply $pull to a non-array value"},
+	{bson.D{{"_id", 1}}, bson.M{"$pullAll": bson.M{"a": 1}}, 9, "$pullAll requires an array argument but was given a NumberInt"},
+	{bson.D{{"_id", 1}, {"a", "x"}}, bson.M{"$pop": bson.M{"a": 1}}, 16837, "Path 'a' contains an element of non-array type 'String'"},
+	{bson.D{{"_id", 1}}, bson.M{"$rename": bson.M{"a": "a"}}, 9, `The source and target field for $rename must differ: a: "a"`},
+	{bson.D{{"_id", 1}}, bson.M{"$rename": bson.M{"a": 1}}, 14, "The 'to' field for $rename must be a string: a: 1"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"a.$.b": 1}}, 16650, "The positional operator did not find the match needed from the query. Unexpanded update: a.$.b"},
+	{bson.D{{"_id", 1}}, bson.M{"$set": bson.M{"_id": 2}}, 16837, "After applying the update to the document {_id: 1 , ...}, the (immutable) field '_id' was found to have been altered to _id: 2"},
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, test := range applyErrorTests {
+		_, err := Apply(test.doc, test.change, false)
+		lerr, ok := err.(*mgo.LastError)
+		if !ok {
+			t.Fatalf("apply %#v to %#v: expected *mgo.LastError, got: %#v", test.change, test.doc, err)
+		}
+		if lerr.Code != test.code || lerr.Err != test.message {
+			t.Fatalf("apply %#v to %#v: expected error %d %q, got %d %q", test.change, test.doc, test.code, test.message, lerr.Code, lerr.Err)
+		}
+	}
+}
+
+func TestHasModifiers(t *testing.T) {
+	ok, err := HasModifiers(bson.M{"$set": bson.M{"a": 1}})
+	if !ok || err != nil {
+		t.Fatal("expected modifiers:", ok, err)
+	}
+	ok, err = HasModifiers(bson.M{"a": 1})
+	if ok || err != nil {
+		t.Fatal("expected replacement:", ok, err)
+	}
+	_, err = HasModifiers(bson.D{{"$set", bson.M{"a": 1}}, {"b", 1}})
+	if err == nil || err.Error() != "Unknown modifier: b" {
+		t.Fatal("expected unknown modifier error, got:", err)
+	}
+	_, err = HasModifiers(bson.D{{"b", 1}, {"$set", bson.M{"a": 1}}})
+	if err == nil {
+		t.Fatal("expected error on mixed document")
+	}
+}
@@ -1,8 +1,6 @@
 package multisort
 
 import (
-	"errors"
-	"fmt"
 	"reflect"
 	"sort"
 )
@@ -28,7 +26,6 @@ func MultiSort(dataArray []interface{}, sortBy bson.D) (result []interface{}, er
 
 	for _, sortByElem := range sortBy {
 		dataArray2D, err = Sort(dataArray2D, sortByElem)
-		fmt.Printf("data:%#v\n", dataArray2D)
 		if err != nil {
 			return
 		}
@@ -90,101 +87,42 @@ func (p *ElementSlice) Less(i, j int) bool {
 }
 
 func (p *ElementSlice) compare(i, j int) (op OP, err error) {
-	elementI := reflect.ValueOf(p.elements[i])
-	elementJ := reflect.ValueOf(p.elements[j])
-	dataI, ok1 := parse.GetStructValueByFlag(p.key, elementI)
-	dataJ, ok2 := parse.GetStructValueByFlag(p.key, elementJ)
-	if !ok1 || !ok2 {
-		return LT, nil // 默认升序排列
-	}
-
-	return compare(dataI, dataJ)
+	dataI, _ := parse.GetStructValueByFlag(p.key, reflect.ValueOf(p.elements[i]))
+	dataJ, _ := parse.GetStructValueByFlag(p.key, reflect.ValueOf(p.elements[j]))
+	return compare(p.sortKey(dataI), p.sortKey(dataJ))
 }
 
-func compare(dataI, dataJ reflect.Value) (op OP, err error) {
-	if dataI.Kind() != dataJ.Kind() {
-		err = errors.New("data kind different:" + dataI.Kind().String() + "," + dataJ.Kind().String())
-		return
+// sortKey returns the value data is sorted by. As done by the server, an
+// array sorts by its smallest element in ascending order and by its largest
+// one in descending order. Missing values sort along with null.
+func (p *ElementSlice) sortKey(data reflect.Value) reflect.Value {
+	for data.Kind() == reflect.Interface && !data.IsNil() {
+		data = data.Elem()
 	}
-	if dataI.Type() != dataJ.Type() {
-		err = errors.New("data type different:" + dataI.Type().String() + "," + dataJ.Type().String())
-		return
+	if !data.IsValid() || parse.TypeCode(data.Interface()) != parse.TypeArray || data.Len() == 0 {
+		return data
 	}
 
-	switch dataI.Kind() {
-	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
-		if dataI.Int() < dataJ.Int() {
-			return LT, nil
-		} else if dataI.Int() == dataJ.Int() {
-			return EQ, nil
-		}
-		return GT, nil
-	case reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uintptr, reflect.Uint16, reflect.Uint8:
-		if dataI.Uint() < dataJ.Uint() {
-			return LT, nil
-		} else if dataI.Uint() == dataJ.Uint() {
-			return EQ, nil
-		}
-		return GT, nil
-	case reflect.Float64, reflect.Float32:
-		if dataI.Float() < dataJ.Float() {
-			return LT, nil
-		} else if dataI.Float() == dataJ.Float() {
-			return EQ, nil
+	key := data.Index(0)
+	for i := 1; i < data.Len(); i++ {
+		result := parse.CompareValues(data.Index(i), key)
+		if (p.increment && result < 0) || (!p.increment && result > 0) {
+			key = data.Index(i)
 		}
-		return GT, nil
-	case reflect.String:
-		if dataI.String() < dataJ.String() {
-			return LT, nil
-		} else if dataI.String() == dataJ.String() {
-			return EQ, nil
-		}
-		return GT, nil
-	case reflect.Ptr, reflect.Interface:
-		return compare(dataI.Elem(), dataJ.Elem())
-	case reflect.Struct:
-		if dataI.NumField() != dataJ.NumField() { // should never happend
-			err = fmt.Errorf("data number field different, %d:%d", dataI.NumField(), dataJ.NumField())
-			return
-		}
-		for i := 0; i < dataI.NumField(); i++ {
-			result, err := compare(dataI.Field(i), dataJ.Field(i))
-			if result != EQ || err != nil {
-				return result, err
-			}
-		}
-		return EQ, nil
-	case reflect.Map:
-		keys := dataI.MapKeys()
-		for _, key := range keys {
-			result, err := compare(dataI.MapIndex(key), dataJ.MapIndex(key))
-			if result != EQ || err != nil {
-				return result, err
-			}
-		}
-		return GT, nil
-	case reflect.Array, reflect.Slice:
-		for i := 0; i < dataI.Len() || i < dataJ.Len(); i++ {
-			if i == dataI.Len() || i == dataJ.Len() {
-				if dataI.Len() < dataJ.Len() {
-					return LT, nil
-				} else if dataI.Len() > dataJ.Len() {
-					return GT, nil
-				}
-			}
-			result, err := compare(dataI.Index(i), dataJ.Index(i))
-			if result != EQ || err != nil {
-				return result, err
-			}
-
-		}
-		return EQ, nil
-	default:
-		err = errors.New("not support kind:" + dataI.Kind().String())
-		return
 	}
+	return key
+}
 
-	return // nerver here
+// compare orders dataI and dataJ following the server ordering of BSON
+// values, so values of different types never fail to compare.
+func compare(dataI, dataJ reflect.Value) (op OP, err error) {
+	switch parse.CompareValues(dataI, dataJ) {
+	case -1:
+		return LT, nil
+	case 1:
+		return GT, nil
+	}
+	return EQ, nil
 }
 
 func (p *ElementSlice) Swap(i, j int) {
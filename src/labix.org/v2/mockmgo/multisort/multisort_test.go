@@ -3,6 +3,7 @@ package multisort
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 import (
@@ -108,11 +109,70 @@ func TestMultiSort(t *testing.T) {
 		t.Fatalf("expected:%#v, actual:%#v", expected, result)
 	}
 
-	// negative test
-	datadiff := []interface{}{Test{1, 10.0, "c"}, Test2{"haha", 1, 2}}
-	_, err = MultiSort(datadiff, bson.D{bson.DocElem{"a", 1}})
-	if err == nil {
-		t.Fatal("should got err")
+	// values of different types sort by their BSON type
+	datadiff := []interface{}{Test2{"haha", 1, 2}, Test{1, 10.0, "c"}}
+	result, err = MultiSort(datadiff, bson.D{bson.DocElem{"a", 1}})
+	if err != nil {
+		t.Fatal("got err", err)
+	}
+	expected = []interface{}{Test{1, 10.0, "c"}, Test2{"haha", 1, 2}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("expected:%#v, actual:%#v", expected, result)
 	}
+}
 
+func TestMultiSortTypes(t *testing.T) {
+	now := time.Now()
+	data := []interface{}{
+		bson.M{"_id": 1, "a": bson.MaxKey},
+		bson.M{"_id": 2, "a": bson.RegEx{"a", ""}},
+		bson.M{"_id": 3, "a": bson.MongoTimestamp(1)},
+		bson.M{"_id": 4, "a": now},
+		bson.M{"_id": 5, "a": true},
+		bson.M{"_id": 6, "a": bson.ObjectId("123456789012")},
+		bson.M{"_id": 7, "a": []byte("x")},
+		bson.M{"_id": 8, "a": bson.M{"b": 1}},
+		bson.M{"_id": 9, "a": "s"},
+		bson.M{"_id": 10, "a": 2.5},
+		bson.M{"_id": 11, "a": int64(2)},
+		bson.M{"_id": 12, "a": nil},
+		bson.M{"_id": 13},
+		bson.M{"_id": 14, "a": bson.MinKey},
+		bson.M{"_id": 15, "a": int32(3)},
+		bson.M{"_id": 16, "a": []interface{}{"t", 1}},
+	}
+	result, err := MultiSort(data, bson.D{bson.DocElem{"a", 1}, bson.DocElem{"_id", 1}})
+	if err != nil {
+		t.Fatal("got err:", err)
+	}
+	var ids []int
+	for _, doc := range result {
+		ids = append(ids, doc.(bson.M)["_id"].(int))
+	}
+	// the array sorts by its smallest element, 1, when ascending
+	expected := []int{14, 12, 13, 16, 11, 10, 15, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected:%v, actual:%v", expected, ids)
+	}
+
+	data = []interface{}{
+		bson.M{"_id": 9, "a": "s"},
+		bson.M{"_id": 10, "a": 2.5},
+		bson.M{"_id": 11, "a": int64(2)},
+		bson.M{"_id": 15, "a": int32(3)},
+		bson.M{"_id": 16, "a": []interface{}{"t", 1}},
+	}
+	result, err = MultiSort(data, bson.D{bson.DocElem{"a", -1}})
+	if err != nil {
+		t.Fatal("got err:", err)
+	}
+	ids = nil
+	for _, doc := range result {
+		ids = append(ids, doc.(bson.M)["_id"].(int))
+	}
+	// and by its largest one, "t", when descending
+	expected = []int{16, 9, 15, 10, 11}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected:%v, actual:%v", expected, ids)
+	}
 }
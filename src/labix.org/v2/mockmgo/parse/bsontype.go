@@ -0,0 +1,124 @@
+package parse
+
+import (
+	"math"
+	"reflect"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+)
+
+// BSON type numbers, as used by the $type query operator.
+const (
+	TypeDouble     = 1
+	TypeString     = 2
+	TypeObject     = 3
+	TypeArray      = 4
+	TypeBinary     = 5
+	TypeUndefined  = 6
+	TypeObjectId   = 7
+	TypeBool       = 8
+	TypeDate       = 9
+	TypeNull       = 10
+	TypeRegEx      = 11
+	TypeDBPointer  = 12
+	TypeJavaScript = 13
+	TypeSymbol     = 14
+	TypeCodeWScope = 15
+	TypeInt32      = 16
+	TypeTimestamp  = 17
+	TypeInt64      = 18
+	TypeMinKey     = -1
+	TypeMaxKey     = 127
+)
+
+var (
+	typeTime      = reflect.TypeOf(time.Time{})
+	typeObjectId  = reflect.TypeOf(bson.ObjectId(""))
+	typeSymbol    = reflect.TypeOf(bson.Symbol(""))
+	typeTimestamp = reflect.TypeOf(bson.MongoTimestamp(0))
+	typeOrderKey  = reflect.TypeOf(bson.MinKey)
+	typeRegEx     = reflect.TypeOf(bson.RegEx{})
+	typeBinary    = reflect.TypeOf(bson.Binary{})
+	typeJS        = reflect.TypeOf(bson.JavaScript{})
+	typeUndefined = reflect.TypeOf(bson.Undefined)
+	typeRaw       = reflect.TypeOf(bson.Raw{})
+	typeBytes     = reflect.TypeOf([]byte(nil))
+)
+
+// TypeCode returns the BSON type number v is marshalled as.
+func TypeCode(v interface{}) int {
+	return typeCode(reflect.ValueOf(v))
+}
+
+func typeCode(v reflect.Value) int {
+	v = elem(v)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return TypeNull
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return TypeNull
+	}
+
+	switch v.Type() {
+	case typeTime:
+		return TypeDate
+	case typeObjectId:
+		return TypeObjectId
+	case typeSymbol:
+		return TypeSymbol
+	case typeTimestamp:
+		return TypeTimestamp
+	case typeRegEx:
+		return TypeRegEx
+	case typeBinary, typeBytes:
+		return TypeBinary
+	case typeUndefined:
+		return TypeUndefined
+	case typeD:
+		return TypeObject
+	case typeRaw:
+		return int(v.Interface().(bson.Raw).Kind)
+	case typeJS:
+		if v.Interface().(bson.JavaScript).Scope != nil {
+			return TypeCodeWScope
+		}
+		return TypeJavaScript
+	case typeOrderKey:
+		if v.Int() == int64(bson.MinKey) {
+			return TypeMinKey
+		}
+		return TypeMaxKey
+	}
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return TypeDouble
+	case reflect.String:
+		return TypeString
+	case reflect.Bool:
+		return TypeBool
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return TypeInt32
+	case reflect.Int, reflect.Int64:
+		if n := v.Int(); n >= math.MinInt32 && n <= math.MaxInt32 && v.Kind() == reflect.Int {
+			return TypeInt32
+		}
+		return TypeInt64
+	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() <= math.MaxInt32 && v.Kind() <= reflect.Uint32 {
+			return TypeInt32
+		}
+		return TypeInt64
+	case reflect.Slice, reflect.Array:
+		return TypeArray
+	case reflect.Map, reflect.Struct:
+		return TypeObject
+	}
+	return TypeNull
+}
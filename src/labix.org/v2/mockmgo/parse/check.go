@@ -0,0 +1,227 @@
+package parse
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+import (
+	"labix.org/v2/base/bson"
+)
+
+// QueryError holds the code and message of the error the server reports
+// for a query it rejects. Callers usually convert it into an
+// mgo.QueryError, which can't be used here as mgo depends on this package.
+type QueryError struct {
+	Code    int
+	Message string
+}
+
+func (err *QueryError) Error() string {
+	return err.Message
+}
+
+// badValue returns the error reported by the server for a query it can't
+// make sense of.
+func badValue(format string, args ...interface{}) error {
+	return &QueryError{Code: 17287, Message: "Can't canonicalize query: BadValue " + fmt.Sprintf(format, args...)}
+}
+
+// Check returns the error the server would report for queryM, such as an
+// unknown operator or an operator applied to a value of the wrong type.
+// Queries failing the check never match any document.
+func Check(queryM bson.M) error {
+	return checkQuery(queryM, true)
+}
+
+func sortedKeys(queryM bson.M) []string {
+	keys := make([]string, 0, len(queryM))
+	for k := range queryM {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkQuery(queryM bson.M, top bool) error {
+	for _, k := range sortedKeys(queryM) {
+		v := queryM[k]
+		if !strings.HasPrefix(k, "$") {
+			if err := checkField(v); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := RelationM[k]; !ok {
+			if top {
+				return badValue("unknown top level operator: %s", k)
+			}
+			return badValue("unknown operator: %s", k)
+		}
+		clauses, ok := v.([]bson.M)
+		if !ok {
+			if isArray(reflect.ValueOf(v)) {
+				return badValue("$or/$and/$nor entries need to be full objects")
+			}
+			return badValue("%s needs an array", k)
+		}
+		if len(clauses) == 0 {
+			return badValue("$and/$or/$nor must be a nonempty array")
+		}
+		for _, clause := range clauses {
+			if err := checkQuery(clause, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isOperatorDoc reports whether v is a document of operators, such as
+// {"$gt": 1}, rather than a document to be compared as a whole. As with
+// MongoDB, that's up to the first field of a bson.D. Maps have no order,
+// so any of their fields counts.
+func isOperatorDoc(v interface{}) bool {
+	switch v := v.(type) {
+	case bson.D:
+		return len(v) > 0 && strings.HasPrefix(v[0].Name, "$")
+	case map[string]interface{}:
+		return isOperatorDoc(bson.M(v))
+	case bson.M:
+		for k := range v {
+			if strings.HasPrefix(k, "$") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkField checks v, the value of a field in a query. Documents other
+// than documents of operators are compared as a whole, so they're left
+// alone.
+func checkField(v interface{}) error {
+	switch v := v.(type) {
+	case bson.RegEx:
+		return checkRegEx(v)
+	case bson.M:
+		if isOperatorDoc(v) {
+			return checkOperators(v)
+		}
+	}
+	return nil
+}
+
+func checkOperators(opsM bson.M) error {
+	for _, k := range sortedKeys(opsM) {
+		v := opsM[k]
+		switch k {
+		case "$not":
+			switch v := v.(type) {
+			case bson.RegEx:
+				if err := checkRegEx(v); err != nil {
+					return err
+				}
+			case bson.M:
+				if len(v) == 0 {
+					return badValue("$not cannot be empty")
+				}
+				if !isOperatorDoc(v) {
+					return badValue("$not needs a regex or a document")
+				}
+				if err := checkOperators(v); err != nil {
+					return err
+				}
+			default:
+				return badValue("$not needs a regex or a document")
+			}
+			continue
+		case "$elemMatch":
+			vM, ok := v.(bson.M)
+			if !ok {
+				return badValue("$elemMatch needs an Object")
+			}
+			if isOperatorDoc(vM) {
+				if err := checkOperators(vM); err != nil {
+					return err
+				}
+			} else if err := checkQuery(vM, false); err != nil {
+				return err
+			}
+			continue
+		case "$options":
+			if _, ok := opsM["$regex"]; !ok {
+				return badValue("$options needs a $regex")
+			}
+			continue
+		}
+
+		op, ok := OperateM[k]
+		if !ok {
+			return badValue("unknown operator: %s", k)
+		}
+		value := elem(reflect.ValueOf(v))
+		switch op {
+		case IN, NIN, ALL:
+			if !isArray(value) {
+				return badValue("%s needs an array", k)
+			}
+			for i := 0; i < value.Len(); i++ {
+				if isOperatorDoc(value.Index(i).Interface()) && op != ALL {
+					return badValue("cannot nest $ under %s", k)
+				}
+				if re, ok := value.Index(i).Interface().(bson.RegEx); ok {
+					if err := checkRegEx(re); err != nil {
+						return err
+					}
+				}
+			}
+		case SIZE:
+			if _, ok := toInt64(value); !ok {
+				return badValue("$size needs a number")
+			}
+		case TYPE:
+			if _, ok := toInt64(value); !ok {
+				return badValue("$type has to be a number")
+			}
+		case MOD:
+			if !isArray(value) {
+				return badValue("malformed mod, needs to be an array")
+			}
+			switch {
+			case value.Len() < 2:
+				return badValue("malformed mod, not enough elements")
+			case value.Len() > 2:
+				return badValue("malformed mod, too many elements")
+			}
+			divisor, ok := toInt64(elem(value.Index(0)))
+			if !ok {
+				return badValue("malformed mod, divisor not a number")
+			}
+			if _, ok := toInt64(elem(value.Index(1))); !ok {
+				return badValue("malformed mod, remainder not a number")
+			}
+			if divisor == 0 {
+				return badValue("divisor cannot be 0")
+			}
+		case REGEX:
+			re, ok := regexValue(v, opsM["$options"]).(bson.RegEx)
+			if !ok {
+				return badValue("$regex has to be a string")
+			}
+			if err := checkRegEx(re); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkRegEx(re bson.RegEx) error {
+	if _, err := compileRegEx(re); err != nil {
+		return badValue("Regular expression is invalid: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package parse
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+)
+
+// canonicalTypes maps BSON type numbers to the rank the server uses when
+// ordering values of different types. Types sharing a rank, such as the
+// numeric ones, are compared by value.
+var canonicalTypes = map[int]int{
+	TypeMinKey:     -1,
+	TypeUndefined:  0,
+	TypeNull:       5,
+	TypeDouble:     10,
+	TypeInt32:      10,
+	TypeInt64:      10,
+	TypeString:     15,
+	TypeSymbol:     15,
+	TypeObject:     20,
+	TypeArray:      25,
+	TypeBinary:     30,
+	TypeObjectId:   35,
+	TypeBool:       40,
+	TypeDate:       45,
+	TypeTimestamp:  47,
+	TypeRegEx:      50,
+	TypeDBPointer:  55,
+	TypeJavaScript: 60,
+	TypeCodeWScope: 65,
+	TypeMaxKey:     127,
+}
+
+// CanonicalType returns the rank of v in the BSON type ordering: MinKey,
+// null, numbers, strings, objects, arrays, binary data, ObjectId, booleans,
+// dates, timestamps, regular expressions and MaxKey.
+func CanonicalType(v interface{}) int {
+	return canonicalType(reflect.ValueOf(v))
+}
+
+func canonicalType(v reflect.Value) int {
+	return canonicalTypes[typeCode(v)]
+}
+
+// Compare returns -1, 0 or +1 depending on whether a sorts before, along
+// with or after b, following the server ordering of BSON values. Missing
+// values, represented by nil, sort along with null.
+func Compare(a, b interface{}) int {
+	return CompareValues(reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+// CompareValues is like Compare, for values obtained through reflection.
+func CompareValues(a, b reflect.Value) int {
+	a, b = derefValue(a), derefValue(b)
+	ta, tb := canonicalType(a), canonicalType(b)
+	if ta != tb {
+		return compareInts(int64(ta), int64(tb))
+	}
+
+	switch ta {
+	case canonicalTypes[TypeMinKey], canonicalTypes[TypeMaxKey],
+		canonicalTypes[TypeUndefined], canonicalTypes[TypeNull]:
+		return 0
+	case canonicalTypes[TypeDouble]:
+		return compareNumbers(a, b)
+	case canonicalTypes[TypeString]:
+		return strings.Compare(a.String(), b.String())
+	case canonicalTypes[TypeObject]:
+		return compareDocs(docElems(a), docElems(b))
+	case canonicalTypes[TypeArray]:
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			if c := CompareValues(a.Index(i), b.Index(i)); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(a.Len()), int64(b.Len()))
+	case canonicalTypes[TypeBinary]:
+		ba, bb := binaryValue(a), binaryValue(b)
+		if c := compareInts(int64(len(ba.Data)), int64(len(bb.Data))); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(ba.Kind), int64(bb.Kind)); c != 0 {
+			return c
+		}
+		return bytes.Compare(ba.Data, bb.Data)
+	case canonicalTypes[TypeObjectId]:
+		return strings.Compare(a.String(), b.String())
+	case canonicalTypes[TypeBool]:
+		return compareInts(boolInt(a.Bool()), boolInt(b.Bool()))
+	case canonicalTypes[TypeDate]:
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	case canonicalTypes[TypeTimestamp]:
+		return compareUints(uint64(a.Int()), uint64(b.Int()))
+	case canonicalTypes[TypeRegEx]:
+		ra, rb := a.Interface().(bson.RegEx), b.Interface().(bson.RegEx)
+		if c := strings.Compare(ra.Pattern, rb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ra.Options, rb.Options)
+	case canonicalTypes[TypeJavaScript], canonicalTypes[TypeCodeWScope]:
+		ja, jb := a.Interface().(bson.JavaScript), b.Interface().(bson.JavaScript)
+		if c := strings.Compare(ja.Code, jb.Code); c != 0 {
+			return c
+		}
+		return CompareValues(reflect.ValueOf(ja.Scope), reflect.ValueOf(jb.Scope))
+	}
+	return 0
+}
+
+// derefValue unwraps interfaces and pointers, and decodes raw values, so
+// that v holds the value the server would compare.
+func derefValue(v reflect.Value) reflect.Value {
+	for {
+		v = elem(v)
+		switch {
+		case v.Kind() == reflect.Ptr && !v.IsNil():
+			v = v.Elem()
+		case v.IsValid() && v.Type() == typeRaw:
+			var value interface{}
+			if err := v.Interface().(bson.Raw).Unmarshal(&value); err != nil {
+				return reflect.Value{}
+			}
+			v = reflect.ValueOf(value)
+		default:
+			return v
+		}
+	}
+}
+
+// compareDocs compares documents element by element, ordering each pair by
+// the canonical type of the values, then by name and finally by value.
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		va, vb := reflect.ValueOf(a[i].Value), reflect.ValueOf(b[i].Value)
+		if c := compareInts(int64(canonicalType(va)), int64(canonicalType(vb))); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := CompareValues(va, vb); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+// docElems returns the elements of the document v in the order they are
+// marshalled. Map keys have no order of their own, so they are sorted.
+func docElems(v reflect.Value) bson.D {
+	switch v.Kind() {
+	case reflect.Slice:
+		return v.Interface().(bson.D)
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		doc := make(bson.D, len(keys))
+		for i, key := range keys {
+			doc[i] = bson.DocElem{key, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).Interface()}
+		}
+		return doc
+	}
+
+	var doc bson.D
+	data, err := bson.Marshal(v.Interface())
+	if err == nil {
+		err = bson.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+func binaryValue(v reflect.Value) bson.Binary {
+	if v.Type() == typeBinary {
+		return v.Interface().(bson.Binary)
+	}
+	return bson.Binary{Data: v.Bytes()}
+}
+
+// compareNumbers compares numbers of any kind by value. NaN sorts before
+// every other number.
+func compareNumbers(a, b reflect.Value) int {
+	ia, aok := intValue(a)
+	ib, bok := intValue(b)
+	if aok && bok {
+		return compareInts(ia, ib)
+	}
+	if a.Kind() == reflect.Uint64 && b.Kind() == reflect.Uint64 {
+		return compareUints(a.Uint(), b.Uint())
+	}
+
+	fa, fb := floatValue(a), floatValue(b)
+	switch {
+	case math.IsNaN(fa) && math.IsNaN(fb):
+		return 0
+	case math.IsNaN(fa), fa < fb:
+		return -1
+	case math.IsNaN(fb), fa > fb:
+		return 1
+	}
+	return 0
+}
+
+// intValue returns the value of v if it holds an integer representable
+// as an int64.
+func intValue(v reflect.Value) (n int64, ok bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() <= math.MaxInt64 {
+			return int64(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+func floatValue(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint())
+	}
+	return float64(v.Int())
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package parse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+import (
+	"labix.org/v2/base/bson"
+)
+
+// conformanceDocs are matched against each query of conformanceTests. They
+// hold the types bson.Unmarshal produces for documents read from the server,
+// along with a bson.D as stored by mockmgo, whose fields keep their order.
+var conformanceDocs = []bson.M{
+	{"_id": 1, "a": 1, "b": "abc", "c": []interface{}{1, 2, 3}, "d": bson.M{"x": 1}, "n": 10},
+	{"_id": 2, "a": 2, "b": "ABD", "c": []interface{}{2, 4}, "d": bson.M{"x": 2}, "n": 15.5},
+	{"_id": 3, "a": []interface{}{1, 5}, "b": "xyz", "c": []interface{}{}, "e": nil, "n": int64(7)},
+	{"_id": 4, "a": "1", "c": []interface{}{[]interface{}{1, 2}, 3}, "f": []interface{}{bson.M{"g": 1, "h": "p"}, bson.M{"g": 2, "h": "q"}}},
+	{"_id": 5, "b": "line1\nline2", "f": []interface{}{bson.M{"g": 3, "h": "p"}}, "g": bson.D{{"b", 1}, {"c", 2}}},
+}
+
+// conformanceTests lists queries along with the _id of the documents
+// MongoDB 2.6 returns for them out of conformanceDocs.
+var conformanceTests = []struct {
+	query bson.M
+	ids   []int
+}{
+	// Comparison, with arrays matching when any element does.
+	{bson.M{"a": 1}, []int{1, 3}},
+	{bson.M{"a": bson.M{"$gt": 1}}, []int{2, 3}},
+	{bson.M{"a": bson.M{"$ne": 1}}, []int{2, 4, 5}},
+	{bson.M{"a": bson.M{"$in": []interface{}{5, "1"}}}, []int{3, 4}},
+	{bson.M{"a": bson.M{"$nin": []interface{}{1, 2}}}, []int{4, 5}},
+	{bson.M{"c": 3}, []int{1, 4}},
+	{bson.M{"c": []interface{}{1, 2}}, []int{4}},
+	{bson.M{"d.x": bson.M{"$in": []interface{}{2, 3}}}, []int{2}},
+	{bson.M{"d": bson.M{"$gt": bson.M{"x": 1}}}, []int{2}},
+
+	// Numbers compare by value whatever their type, and other types never
+	// compare to numbers.
+	{bson.M{"n": 10.0}, []int{1}},
+	{bson.M{"n": bson.M{"$gt": 12.0}}, []int{2}},
+	{bson.M{"n": bson.M{"$lt": int64(8)}}, []int{3}},
+	{bson.M{"n": bson.M{"$gte": 7.0, "$lte": int32(10)}}, []int{1, 3}},
+	{bson.M{"n": bson.M{"$in": []interface{}{int64(10), 7.0}}}, []int{1, 3}},
+	{bson.M{"b": bson.M{"$gt": 1}}, nil},
+	{bson.M{"a": bson.M{"$lt": "2"}}, []int{4}},
+	{bson.M{"a": bson.M{"$gt": bson.MinKey}}, []int{1, 2, 3, 4, 5}},
+	{bson.M{"e": bson.M{"$gte": nil}}, []int{1, 2, 3, 4, 5}},
+
+	// Null and $exists.
+	{bson.M{"e": nil}, []int{1, 2, 3, 4, 5}},
+	{bson.M{"e": bson.M{"$exists": true}}, []int{3}},
+	{bson.M{"e": bson.M{"$exists": false}}, []int{1, 2, 4, 5}},
+
+	// $all and $size.
+	{bson.M{"c": bson.M{"$all": []interface{}{2}}}, []int{1, 2}},
+	{bson.M{"c": bson.M{"$all": []interface{}{1, 3}}}, []int{1}},
+	{bson.M{"c": bson.M{"$all": []interface{}{}}}, nil},
+	{bson.M{"c": bson.M{"$size": 0}}, []int{3}},
+	{bson.M{"c": bson.M{"$size": 2}}, []int{2, 4}},
+	{bson.M{"c": bson.M{"$size": 3}}, []int{1}},
+
+	// $regex, with and without options.
+	{bson.M{"b": bson.M{"$regex": "^a"}}, []int{1}},
+	{bson.M{"b": bson.M{"$regex": "^a", "$options": "i"}}, []int{1, 2}},
+	{bson.M{"b": bson.RegEx{"^A", "i"}}, []int{1, 2}},
+	{bson.M{"b": bson.M{"$regex": bson.RegEx{"^A", ""}, "$options": "i"}}, []int{1, 2}},
+	{bson.M{"b": bson.M{"$regex": "^line2"}}, nil},
+	{bson.M{"b": bson.M{"$regex": "^line2", "$options": "m"}}, []int{5}},
+	{bson.M{"b": bson.M{"$regex": "line1.line2"}}, nil},
+	{bson.M{"b": bson.M{"$regex": "line1.line2", "$options": "s"}}, []int{5}},
+	{bson.M{"b": bson.M{"$regex": "a b c # letters", "$options": "x"}}, []int{1}},
+	{bson.M{"b": bson.M{"$in": []interface{}{bson.RegEx{"^x", ""}, "ABD"}}}, []int{2, 3}},
+
+	// $not.
+	{bson.M{"b": bson.M{"$not": bson.RegEx{"^a", ""}}}, []int{2, 3, 4, 5}},
+	{bson.M{"a": bson.M{"$not": bson.M{"$gt": 1}}}, []int{1, 4, 5}},
+
+	// Logical operators.
+	{bson.M{"$and": []bson.M{{"a": bson.M{"$gte": 1}}, {"a": bson.M{"$lte": 1}}}}, []int{1, 3}},
+	{bson.M{"$or": []bson.M{{"a": 2}, {"b": "xyz"}}}, []int{2, 3}},
+	{bson.M{"$or": []bson.M{{"a": 2}, {"a": 1}}, "b": "abc"}, []int{1}},
+	{bson.M{"$nor": []bson.M{{"a": 1}, {"b": "ABD"}}}, []int{4, 5}},
+
+	// $type.
+	{bson.M{"n": bson.M{"$type": 1}}, []int{2}},
+	{bson.M{"n": bson.M{"$type": 16}}, []int{1}},
+	{bson.M{"n": bson.M{"$type": 18}}, []int{3}},
+	{bson.M{"e": bson.M{"$type": 10}}, []int{3}},
+	{bson.M{"a": bson.M{"$type": 2}}, []int{4}},
+	{bson.M{"d": bson.M{"$type": 3}}, []int{1, 2}},
+
+	// $mod truncates doubles.
+	{bson.M{"n": bson.M{"$mod": []interface{}{5, 0}}}, []int{1, 2}},
+	{bson.M{"n": bson.M{"$mod": []interface{}{5, 2}}}, []int{3}},
+
+	// Arrays of documents.
+	{bson.M{"f": bson.M{"$elemMatch": bson.M{"g": bson.M{"$gte": 2}, "h": "q"}}}, []int{4}},
+	{bson.M{"f": bson.M{"$elemMatch": bson.M{"g": 1, "h": "q"}}}, nil},
+	{bson.M{"f.g": 1, "f.h": "q"}, []int{4}},
+	{bson.M{"f.h": "p"}, []int{4, 5}},
+	{bson.M{"f.0.g": 3}, []int{5}},
+	{bson.M{"c": bson.M{"$elemMatch": bson.M{"$gt": 2, "$lt": 4}}}, []int{1, 4}},
+
+	// Embedded documents without operators are compared as a whole, the
+	// order of their fields included.
+	{bson.M{"g": bson.D{{"b", 1}, {"c", 2}}}, []int{5}},
+	{bson.M{"g": bson.M{"b": 1, "c": 2}}, []int{5}},
+	{bson.M{"g": bson.D{{"c", 2}, {"b", 1}}}, nil},
+	{bson.M{"g": bson.M{"b": 1}}, nil},
+	{bson.M{"g": bson.M{}}, nil},
+	{bson.M{"a": bson.M{}}, nil},
+	{bson.M{"g.b": 1}, []int{5}},
+	{bson.M{"d": bson.M{"x": 1.0}}, []int{1}},
+	{bson.M{"f": bson.D{{"g", 1}, {"h", "p"}}}, []int{4}},
+	{bson.M{"f": bson.M{"g": 1}}, nil},
+}
+
+func TestConformance(t *testing.T) {
+	for _, test := range conformanceTests {
+		var ids []int
+		for _, doc := range conformanceDocs {
+			match, err := Match(doc, test.query)
+			if err != nil {
+				t.Fatalf("query %#v failed: %v", test.query, err)
+			}
+			if match {
+				ids = append(ids, doc["_id"].(int))
+			}
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("query %#v matched %v, expected %v", test.query, ids, test.ids)
+		}
+	}
+}
+
+var conformanceErrors = []struct {
+	query   bson.M
+	message string
+}{
+	{bson.M{"a": bson.M{"$foo": 1}}, "unknown operator: $foo"},
+	{bson.M{"$foo": 1}, "unknown top level operator: $foo"},
+	{bson.M{"a": bson.M{"$in": 1}}, "$in needs an array"},
+	{bson.M{"a": bson.M{"$all": 1}}, "$all needs an array"},
+	{bson.M{"a": bson.M{"$size": "x"}}, "$size needs a number"},
+	{bson.M{"a": bson.M{"$type": "x"}}, "$type has to be a number"},
+	{bson.M{"a": bson.M{"$mod": []interface{}{0, 1}}}, "divisor cannot be 0"},
+	{bson.M{"a": bson.M{"$mod": []interface{}{1}}}, "malformed mod, not enough elements"},
+	{bson.M{"a": bson.M{"$mod": 1}}, "malformed mod, needs to be an array"},
+	{bson.M{"a": bson.M{"$regex": "("}}, "Regular expression is invalid"},
+	{bson.M{"a": bson.M{"$regex": 1}}, "$regex has to be a string"},
+	{bson.M{"a": bson.M{"$options": "i"}}, "$options needs a $regex"},
+	{bson.M{"a": bson.M{"$not": 1}}, "$not needs a regex or a document"},
+	{bson.M{"a": bson.M{"$elemMatch": 1}}, "$elemMatch needs an Object"},
+	{bson.M{"$or": []bson.M{}}, "$and/$or/$nor must be a nonempty array"},
+	{bson.M{"$and": 1}, "$and needs an array"},
+}
+
+func TestConformanceErrors(t *testing.T) {
+	for _, test := range conformanceErrors {
+		_, err := Match(conformanceDocs[0], test.query)
+		qerr, ok := err.(*QueryError)
+		if !ok || qerr.Code != 17287 || !strings.Contains(qerr.Message, test.message) {
+			t.Errorf("query %#v: expected error %q, got %v", test.query, test.message, err)
+		}
+	}
+}
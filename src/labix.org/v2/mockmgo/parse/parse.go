@@ -2,7 +2,10 @@ package parse
 
 import (
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 import (
@@ -25,9 +28,11 @@ func Match(data, query interface{}) (match bool, err error) {
 }
 
 func parseQuery(query interface{}) (queryFields QueryFields, err error) {
-	queryM, ok := query.(bson.M)
-	if !ok {
-		err = UnknownQuery
+	queryM, err := QueryM(query)
+	if err != nil {
+		return
+	}
+	if err = Check(queryM); err != nil {
 		return
 	}
 
@@ -35,60 +40,198 @@ func parseQuery(query interface{}) (queryFields QueryFields, err error) {
 	return
 }
 
+// QueryM converts query into the bson.M form understood by Match. The query
+// may be a bson.M, a bson.D, a map[string]interface{}, or any other map or
+// tagged struct accepted by bson.Marshal. Documents of operators are
+// converted to bson.M as well, and so are the clauses of $and, $or and $nor
+// and the queries of $elemMatch, while other values, including documents
+// to be compared as a whole, are kept as provided. A nil query is returned
+// as nil.
+func QueryM(query interface{}) (queryM bson.M, err error) {
+	switch query := query.(type) {
+	case nil:
+		return nil, nil
+	case bson.M, bson.D, map[string]interface{}:
+		queryM, _ = queryDoc(query)
+		return queryM, nil
+	}
+
+	v := reflect.ValueOf(query)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, UnknownQuery
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct && v.Kind() != reflect.Map {
+		return nil, UnknownQuery
+	}
+
+	// Documents are read back as bson.D, so the order of their fields is
+	// kept for comparisons.
+	var queryD bson.D
+	data, err := bson.Marshal(query)
+	if err == nil {
+		err = bson.Unmarshal(data, &queryD)
+	}
+	if err != nil {
+		return nil, err
+	}
+	queryM, _ = queryDoc(queryD)
+	return queryM, nil
+}
+
+// queryDoc converts doc, a query or a document of operators, into bson.M,
+// converting the value of each of its fields with queryValue. It returns
+// false if doc isn't a bson.M, a bson.D or a map[string]interface{}.
+func queryDoc(doc interface{}) (bson.M, bool) {
+	switch doc := doc.(type) {
+	case bson.M:
+		m := make(bson.M, len(doc))
+		for k, elem := range doc {
+			m[k] = queryValue(k, elem)
+		}
+		return m, true
+	case map[string]interface{}:
+		return queryDoc(bson.M(doc))
+	case bson.D:
+		m := make(bson.M, len(doc))
+		for _, elem := range doc {
+			m[elem.Name] = queryValue(elem.Name, elem.Value)
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// queryValue converts v, the value of the key field in a query, into the
+// form understood by parseBsonM. The clauses of $and, $or and $nor become
+// []bson.M, and documents of operators, the query of $elemMatch and the
+// operators of $not become bson.M. Anything else is an operand or a value
+// to be compared as a whole, and is kept as it is.
+func queryValue(key string, v interface{}) interface{} {
+	if _, ok := RelationM[key]; ok {
+		clauses := reflect.ValueOf(v)
+		if clauses.Kind() != reflect.Slice && clauses.Kind() != reflect.Array {
+			return v
+		}
+		result := make([]bson.M, clauses.Len())
+		for i := range result {
+			clause, ok := queryDoc(clauses.Index(i).Interface())
+			if !ok {
+				return v
+			}
+			result[i] = clause
+		}
+		return result
+	}
+	if key == "$elemMatch" || key == "$not" || !strings.HasPrefix(key, "$") && isOperatorDoc(v) {
+		if m, ok := queryDoc(v); ok {
+			return m
+		}
+	}
+	return v
+}
+
 func parseBsonM(field string, queryM bson.M, elematch bool) (queryFields QueryFields) {
 	queryFields.Relation = AND
 	queryFields.ElemMatch = elematch
 	queryFields.Key = field
 	queryLen := len(queryM)
-	for k, v := range queryM {
-		if k == "$or" {
-			k = ""
-			queryFields.Relation = OR
-		}
 
-		if k == "$elemMatch" {
-			k = ""
-			queryFields.ElemMatch = true
+	// Fields are parsed in a stable order, so results don't depend on
+	// map iteration.
+	for _, k := range sortedKeys(queryM) {
+		v := queryM[k]
+
+		if relation, ok := RelationM[k]; ok {
+			clauses := QueryFields{Relation: relation}
+			vsM, _ := v.([]bson.M)
+			for _, vM := range vsM {
+				clauses.add(parseBsonM("", vM, false))
+			}
+			if queryLen == 1 && queryFields.plain() {
+				queryFields.Relation = relation
+				queryFields.Fields = clauses.Fields
+			} else {
+				queryFields.Fields = append(queryFields.Fields, clauses)
+			}
+			continue
 		}
 
-		op := EQ
-		if op_, ok := OperateM[k]; ok {
-			op = op_
-			k = ""
+		switch k {
+		case "$elemMatch":
+			queryFields_ := QueryFields{Relation: AND}
+			if vM, ok := v.(bson.M); ok {
+				queryFields_ = parseBsonM("", vM, false)
+			}
+			queryFields_.Key = field
+			queryFields_.ElemMatch = true
+			queryFields.Key = ""
+			if queryLen == 1 && !queryFields.ElemMatch {
+				queryFields = queryFields_
+			} else {
+				queryFields.Fields = append(queryFields.Fields, queryFields_)
+			}
+			continue
+		case "$not":
+			queryFields_ := QueryFields{Relation: AND, Fields: []interface{}{QueryField{field, v, REGEX}}}
+			if vM, ok := v.(bson.M); ok {
+				queryFields_ = parseBsonM(field, vM, false)
+			}
+			queryFields_.Not = true
+			queryFields.Key = ""
+			queryFields.Fields = append(queryFields.Fields, queryFields_)
+			continue
+		case "$options":
+			// Handled along with $regex.
+			continue
 		}
 
-		if k == "" {
-			k = field
+		if op, ok := OperateM[k]; ok {
+			if op == REGEX {
+				v = regexValue(v, queryM["$options"])
+			}
 			queryFields.Key = ""
+			queryFields.Fields = append(queryFields.Fields, QueryField{field, v, op})
+			continue
 		}
 
-		if vM, ok := v.(bson.M); ok {
-			queryFields_ := parseBsonM(k, vM, queryFields.ElemMatch)
-			if queryLen == 1 {
+		if vM, ok := v.(bson.M); ok && isOperatorDoc(vM) {
+			queryFields_ := parseBsonM(k, vM, false)
+			if queryLen == 1 && queryFields.plain() {
 				queryFields = queryFields_
 			} else {
-				if len(queryFields_.Fields) == 1 {
-					queryFields.Fields = append(queryFields.Fields, queryFields_.Fields[0])
-				} else {
-					queryFields.Fields = append(queryFields.Fields, queryFields_)
-				}
-			}
-		} else if vsM, ok := v.([]bson.M); ok {
-			for _, vM := range vsM {
-				queryFields_ := parseBsonM(k, vM, queryFields.ElemMatch)
-				if len(queryFields_.Fields) == 1 {
-					queryFields.Fields = append(queryFields.Fields, queryFields_.Fields[0])
-				} else {
-					queryFields.Fields = append(queryFields.Fields, queryFields_)
-				}
+				queryFields.add(queryFields_)
 			}
+		} else if _, ok := v.(bson.RegEx); ok {
+			queryFields.Fields = append(queryFields.Fields, QueryField{k, v, REGEX})
 		} else {
-			queryFields.Fields = append(queryFields.Fields, QueryField{k, v, op})
+			queryFields.Fields = append(queryFields.Fields, QueryField{k, v, EQ})
 		}
 	}
 	return
 }
 
+// regexValue returns the bson.RegEx for a $regex operator with value v and
+// the given $options. Values which are neither strings nor bson.RegEx are
+// returned as they are, and never match.
+func regexValue(v interface{}, options interface{}) interface{} {
+	opts, hasOpts := options.(string)
+	switch v := v.(type) {
+	case string:
+		return bson.RegEx{Pattern: v, Options: opts}
+	case bson.RegEx:
+		if hasOpts {
+			v.Options = opts
+		}
+		return v
+	}
+	return v
+}
+
+var typeD = reflect.TypeOf(bson.D{})
+
 func GetStructValueByFlag(k string, data reflect.Value) (result reflect.Value, ok bool) {
 
 	key, left := k, ""
@@ -98,6 +241,76 @@ func GetStructValueByFlag(k string, data reflect.Value) (result reflect.Value, o
 		left = k[index+1:]
 	}
 
+	for data.Kind() == reflect.Ptr || data.Kind() == reflect.Interface {
+		if data.IsNil() {
+			return reflect.ValueOf(nil), false
+		}
+		data = data.Elem()
+	}
+	if !data.IsValid() {
+		return reflect.ValueOf(nil), false
+	}
+
+	if data.Type() == typeD && data.CanInterface() {
+		for _, elem := range data.Interface().(bson.D) {
+			if elem.Name != key {
+				continue
+			}
+			v := reflect.ValueOf(elem.Value)
+			if left != "" {
+				return GetStructValueByFlag(left, v)
+			}
+			return v, true
+		}
+		return reflect.ValueOf(nil), false
+	}
+
+	switch data.Kind() {
+	case reflect.Map:
+		if data.Type().Key().Kind() != reflect.String {
+			return reflect.ValueOf(nil), false
+		}
+		v := data.MapIndex(reflect.ValueOf(key).Convert(data.Type().Key()))
+		if !v.IsValid() {
+			return reflect.ValueOf(nil), false
+		}
+		if v.Kind() == reflect.Interface {
+			v = v.Elem()
+		}
+		if left != "" {
+			return GetStructValueByFlag(left, v)
+		}
+		return v, true
+	case reflect.Slice, reflect.Array:
+		if !isArray(data) {
+			return reflect.ValueOf(nil), false
+		}
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < 0 || i >= data.Len() {
+				return reflect.ValueOf(nil), false
+			}
+			v := elem(data.Index(i))
+			if left != "" {
+				return GetStructValueByFlag(left, v)
+			}
+			return v, true
+		}
+		// Look the field up in every document of the array.
+		var values []interface{}
+		for i := 0; i < data.Len(); i++ {
+			if v, ok := GetStructValueByFlag(k, data.Index(i)); ok && v.IsValid() && v.CanInterface() {
+				values = append(values, v.Interface())
+			}
+		}
+		if values == nil {
+			return reflect.ValueOf(nil), false
+		}
+		return reflect.ValueOf(values), true
+	case reflect.Struct:
+	default:
+		return reflect.ValueOf(nil), false
+	}
+
 	type_ := data.Type()
 	for i := 0; i < data.NumField(); i++ {
 		field := type_.Field(i)
@@ -105,6 +318,9 @@ func GetStructValueByFlag(k string, data reflect.Value) (result reflect.Value, o
 		if tag == "" {
 			tag = field.Tag.Get("json")
 		}
+		if index := strings.Index(tag, ","); index != -1 {
+			tag = tag[:index]
+		}
 		v := data.Field(i)
 		if key == tag {
 			if left != "" {
@@ -128,6 +344,23 @@ type QueryFields struct {
 	Relation  RELATION
 	ElemMatch bool
 	Key       string
+	Not       bool
+}
+
+// plain reports whether queryFields is a conjunction applied to the
+// document itself, so it may be merged into an enclosing one.
+func (queryFields *QueryFields) plain() bool {
+	return queryFields.Relation == AND && queryFields.Key == "" && !queryFields.ElemMatch && !queryFields.Not
+}
+
+// add appends queryFields_ to the fields of queryFields, unwrapping it
+// when it holds a single plain field.
+func (queryFields *QueryFields) add(queryFields_ QueryFields) {
+	if len(queryFields_.Fields) == 1 && queryFields_.plain() {
+		queryFields.Fields = append(queryFields.Fields, queryFields_.Fields[0])
+	} else {
+		queryFields.Fields = append(queryFields.Fields, queryFields_)
+	}
 }
 
 type RELATION int
@@ -135,18 +368,29 @@ type RELATION int
 const (
 	AND RELATION = 1
 	OR  RELATION = 2
+	NOR RELATION = 3
 )
 
+var RelationM = map[string]RELATION{
+	"$and": AND,
+	"$or":  OR,
+	"$nor": NOR,
+}
+
 var OperateM = map[string]OP{
 	"$ne":     NE,
 	"$gt":     GT,
 	"$gte":    GTE,
 	"$lt":     LT,
 	"$lte":    LTE,
-	"$all":    EQ,
+	"$all":    ALL,
 	"$in":     IN,
 	"$nin":    NIN,
 	"$exists": EXISTS,
+	"$regex":  REGEX,
+	"$size":   SIZE,
+	"$type":   TYPE,
+	"$mod":    MOD,
 }
 
 type OP int
@@ -161,15 +405,21 @@ var (
 	IN     OP = 0x00000040
 	NIN    OP = 0x00000080
 	EXISTS OP = 0x00000100
+	ALL    OP = 0x00000200
+	REGEX  OP = 0x00000400
+	SIZE   OP = 0x00000800
+	TYPE   OP = 0x00001000
+	MOD    OP = 0x00002000
 )
 
 func compareElemMatch(data reflect.Value, queryFields QueryFields) bool {
-	if data.Kind() != reflect.Array && data.Kind() != reflect.Slice {
+	data = elem(data)
+	if !isArray(data) {
 		return false
 	}
 
 	for i := 0; i < data.Len(); i++ {
-		if compareWithQuerys(data.Index(i), queryFields) {
+		if compareWithQuerys(elem(data.Index(i)), queryFields) {
 			return true
 		}
 	}
@@ -178,6 +428,11 @@ func compareElemMatch(data reflect.Value, queryFields QueryFields) bool {
 }
 
 func compareWithQuerys(data reflect.Value, queryFields QueryFields) bool {
+	if queryFields.Not {
+		queryFields.Not = false
+		return !compareWithQuerys(data, queryFields)
+	}
+
 	if queryFields.Key != "" {
 		data, _ = GetStructValueByFlag(queryFields.Key, data)
 		queryFields.Key = ""
@@ -189,191 +444,267 @@ func compareWithQuerys(data reflect.Value, queryFields QueryFields) bool {
 	}
 
 	relation := queryFields.Relation
-	match := true
 
 	for _, field := range queryFields.Fields {
+		match := false
 		if queryField, ok := field.(QueryField); ok {
-			actualData, _ := GetStructValueByFlag(queryField.Field, data)
-			match = compare(actualData, reflect.ValueOf(queryField.Value), queryField.Op)
+			match = compareField(data, queryField)
 		} else if queryFields_, ok := field.(QueryFields); ok {
 			match = compareWithQuerys(data, queryFields_)
-		} else {
-			match = false
 		}
-		if (match && relation == OR) || (!match && relation == AND) {
-			return match
+		switch {
+		case match && relation == OR:
+			return true
+		case match && relation == NOR:
+			return false
+		case !match && relation == AND:
+			return false
 		}
 	}
 
-	return match
+	return relation != OR
 }
 
-func compare(data1, data2 reflect.Value, op OP) bool {
-	switch op {
+// compareField reports whether the value of queryField.Field in data
+// satisfies queryField. An empty field refers to data itself, as done
+// for the elements of an array by $elemMatch.
+func compareField(data reflect.Value, queryField QueryField) bool {
+	actualData, found := elem(data), data.IsValid()
+	if queryField.Field != "" {
+		actualData, found = GetStructValueByFlag(queryField.Field, data)
+		actualData = elem(actualData)
+	}
+	value := reflect.ValueOf(queryField.Value)
+
+	switch queryField.Op {
 	case EXISTS:
-		if data2.Kind() != reflect.Bool {
+		return isTrue(value) == found
+	case NE:
+		return !compareValue(actualData, value, EQ)
+	case NIN:
+		return !compareValue(actualData, value, IN)
+	case TYPE:
+		if !found {
 			return false
 		}
-		return data2.Bool() != (data1 == reflect.ValueOf(nil))
-	case IN:
-		if data2.Kind() != reflect.Array && data2.Kind() != reflect.Slice {
+	case SIZE:
+		n, ok := toInt64(elem(value))
+		return ok && isArray(actualData) && int64(actualData.Len()) == n
+	case ALL:
+		value = elem(value)
+		if !isArray(value) || value.Len() == 0 {
 			return false
 		}
-		for i := 0; i < data2.Len(); i++ {
-			if compare(data1, data2.Index(i), EQ) {
-				return true
+		for i := 0; i < value.Len(); i++ {
+			op := EQ
+			if typeCode(value.Index(i)) == TypeRegEx {
+				op = REGEX
 			}
-		}
-		return false
-	case NIN:
-		if data2.Kind() != reflect.Array && data2.Kind() != reflect.Slice {
-			return false
-		}
-		if data1 == reflect.ValueOf(nil) {
-			return true
-		}
-		for i := 0; i < data2.Len(); i++ {
-			if compare(data1, data2.Index(i), EQ) {
+			if !compareValue(actualData, value.Index(i), op) {
 				return false
 			}
 		}
 		return true
-	default:
+	}
+	return compareValue(actualData, value, queryField.Op)
+}
 
-		if data1.Kind() != data2.Kind() {
-			return op == NE
+// compareValue applies op to data and, if data is an array, to each of its
+// elements, reporting whether any of them matches.
+func compareValue(data, value reflect.Value, op OP) bool {
+	if compareOne(data, value, op) {
+		return true
+	}
+	if isArray(data) {
+		for i := 0; i < data.Len(); i++ {
+			if compareOne(elem(data.Index(i)), value, op) {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		switch data1.Kind() {
-		case reflect.Ptr, reflect.Interface:
-			return compare(data1.Elem(), data2.Elem(), op)
-		case reflect.Struct:
-			if data1.NumField() != data2.NumField() {
-				return op == NE
-			}
-			result := true
-			for i := 0; i < data1.NumField(); i++ {
-				result = compare(data1.Field(i), data2.Field(i), op)
-				if (result && op == NE) || (!result && op != NE) {
-					return result
-				}
-			}
-			return result
-		case reflect.Map:
-			result := true
-			keys := data1.MapKeys()
-			for _, key := range keys {
-				result = compare(data1.MapIndex(key), data2.MapIndex(key), op)
-				if (result && op == NE) || (!result && op != NE) {
-					return result
-				}
-			}
-			return result
-		case reflect.Array, reflect.Slice:
-			if data1.Len() != data2.Len() {
-				return op == NE
+func compareOne(data, value reflect.Value, op OP) bool {
+	value = elem(value)
+
+	switch op {
+	case IN:
+		if !isArray(value) {
+			return false
+		}
+		for i := 0; i < value.Len(); i++ {
+			op := EQ
+			if typeCode(value.Index(i)) == TypeRegEx {
+				op = REGEX
 			}
-			result := true
-			for i := 0; i < data1.Len(); i++ {
-				result = compare(data1.Index(i), data2.Index(i), op)
-				if (result && op == NE) || (!result && op != NE) {
-					return result
-				}
+			if compareOne(data, value.Index(i), op) {
+				return true
 			}
-			return result
-		case reflect.Invalid:
-			return op == EQ
-		default:
-			return compareSimple(data1, data2, op)
 		}
+		return false
+	case REGEX:
+		re, ok := value.Interface().(bson.RegEx)
+		if !ok {
+			return false
+		}
+		switch data.Kind() {
+		case reflect.String:
+			compiled, err := compileRegEx(re)
+			return err == nil && compiled.MatchString(data.String())
+		case reflect.Struct:
+			return data.Type() == typeRegEx && data.CanInterface() && data.Interface() == re
+		}
+		return false
+	case TYPE:
+		code, ok := toInt64(value)
+		return ok && int64(typeCode(data)) == code
+	case MOD:
+		if !isArray(value) || value.Len() != 2 {
+			return false
+		}
+		divisor, ok1 := toInt64(elem(value.Index(0)))
+		remainder, ok2 := toInt64(elem(value.Index(1)))
+		n, ok3 := toInt64(data)
+		return ok1 && ok2 && ok3 && divisor != 0 && n%divisor == remainder
 	}
+	return compare(data, value, op)
+}
 
+// isArray reports whether v holds a BSON array. Binary data and bson.D
+// documents are not arrays.
+func isArray(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Type() != typeD && v.Type().Elem().Kind() != reflect.Uint8
+	}
 	return false
 }
 
-func compareSimple(data1, data2 reflect.Value, op OP) bool {
-	switch data1.Kind() {
-	case reflect.String:
-		d1 := data1.String()
-		d2 := data2.String()
-
-		switch op {
-		case GT:
-			return d1 > d2
-		case GTE:
-			return d1 >= d2
-		case LT:
-			return d1 < d2
-		case LTE:
-			return d1 <= d2
-		case EQ:
-			return d1 == d2
-		case NE:
-			return d1 != d2
-		}
-	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
-		d1 := data1.Int()
-		d2 := data2.Int()
-
-		switch op {
-		case GT:
-			return d1 > d2
-		case GTE:
-			return d1 >= d2
-		case LT:
-			return d1 < d2
-		case LTE:
-			return d1 <= d2
-		case EQ:
-			return d1 == d2
-		case NE:
-			return d1 != d2
-		}
-	case reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uintptr, reflect.Uint16, reflect.Uint8:
-		d1 := data1.Uint()
-		d2 := data2.Uint()
-		switch op {
-		case GT:
-			return d1 > d2
-		case GTE:
-			return d1 >= d2
-		case LT:
-			return d1 < d2
-		case LTE:
-			return d1 <= d2
-		case EQ:
-			return d1 == d2
-		case NE:
-			return d1 != d2
-		}
-	case reflect.Bool:
-		d1 := data1.Bool()
-		d2 := data2.Bool()
-		switch op {
-		case GT, GTE, LT, LTE:
-			return false
-		case EQ:
-			return d1 == d2
-		case NE:
-			return d1 != d2
-		}
-	case reflect.Float64, reflect.Float32:
-		d1 := data1.Float()
-		d2 := data2.Float()
-		switch op {
-		case GT:
-			return d1 > d2
-		case GTE:
-			return d1 >= d2
-		case LT:
-			return d1 < d2
-		case LTE:
-			return d1 <= d2
-		case EQ:
-			return d1 == d2
-		case NE:
-			return d1 != d2
-		}
+func isTrue(v reflect.Value) bool {
+	v = elem(v)
+	if v.Kind() == reflect.Bool {
+		return v.Bool()
+	}
+	if n, ok := toInt64(v); ok {
+		return n != 0
+	}
+	return v.IsValid()
+}
+
+// toInt64 returns the value of the number held by v, truncating floating
+// point values.
+func toInt64(v reflect.Value) (n int64, ok bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return int64(v.Float()), true
+	}
+	return 0, false
+}
+
+// compare applies op to data1 and data2 as the server does: values of
+// different types only compare against MinKey and MaxKey, so a query
+// such as {"a": {"$gt": 1}} never matches a string.
+func compare(data1, data2 reflect.Value, op OP) bool {
+	data1, data2 = derefValue(data1), derefValue(data2)
+	type1, type2 := canonicalType(data1), canonicalType(data2)
+	if type1 != type2 && type2 != canonicalTypes[TypeMinKey] && type2 != canonicalTypes[TypeMaxKey] {
+		return op == NE
+	}
+
+	result := CompareValues(data1, data2)
+	switch op {
+	case GT:
+		return result > 0
+	case GTE:
+		return result >= 0
+	case LT:
+		return result < 0
+	case LTE:
+		return result <= 0
+	case EQ:
+		return result == 0
+	case NE:
+		return result != 0
 	}
 	return false
 }
+
+// elem returns the value held by the interface v, or v itself if it isn't
+// a non-nil interface.
+func elem(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+var regExCache = struct {
+	m map[bson.RegEx]*regexp.Regexp
+	sync.Mutex
+}{m: make(map[bson.RegEx]*regexp.Regexp)}
+
+// compileRegEx compiles re, honoring the i, m, s and x options supported by
+// the server.
+func compileRegEx(re bson.RegEx) (*regexp.Regexp, error) {
+	regExCache.Lock()
+	defer regExCache.Unlock()
+
+	if compiled, ok := regExCache.m[re]; ok {
+		return compiled, nil
+	}
+
+	pattern, flags := re.Pattern, ""
+	for _, option := range re.Options {
+		switch option {
+		case 'i', 'm', 's':
+			flags += string(option)
+		case 'x':
+			pattern = stripExtended(pattern)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regExCache.m[re] = compiled
+	return compiled, nil
+}
+
+// stripExtended removes the whitespace and comments ignored in patterns
+// using the x option.
+func stripExtended(pattern string) string {
+	var result []byte
+	escaped, class, comment := false, false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case comment:
+			comment = c != '\n'
+			continue
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '[':
+			class = true
+		case c == ']':
+			class = false
+		case class:
+		case c == '#':
+			comment = true
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			continue
+		}
+		result = append(result, c)
+	}
+	return string(result)
+}
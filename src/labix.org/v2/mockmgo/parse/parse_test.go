@@ -1,8 +1,10 @@
 package parse
 
 import (
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 import (
@@ -43,7 +45,7 @@ func TestParseBsonM(t *testing.T) {
 
 	queryM = bson.M{"A": bson.M{"$all": []int64{1, 2, 3}}}
 	result = parseBsonM("", queryM, false)
-	assertQueryFields(t, QueryFields{Relation: AND, Fields: []interface{}{QueryField{"A", []int64{1, 2, 3}, EQ}}}, result)
+	assertQueryFields(t, QueryFields{Relation: AND, Fields: []interface{}{QueryField{"A", []int64{1, 2, 3}, ALL}}}, result)
 
 	queryM = bson.M{"A": bson.M{"$in": []int64{1, 2, 3}}}
 	result = parseBsonM("", queryM, false)
@@ -149,6 +151,9 @@ func TestMatch(t *testing.T) {
 	assertMatch(t, data, queryM)
 
 	queryM = bson.M{"d": bson.M{"$all": []int{1, 2}}}
+	assertMatch(t, data, queryM)
+
+	queryM = bson.M{"d": bson.M{"$all": []int{1, 4}}}
 	assertNotMatch(t, data, queryM)
 
 	queryM = bson.M{"a": bson.M{"$in": []int{9, 10, 11}}}
@@ -173,6 +178,65 @@ func TestMatch(t *testing.T) {
 	assertNotMatch(t, data, queryM)
 }
 
+func TestMatchQueryTypes(t *testing.T) {
+	type Sub struct {
+		X int `bson:"x"`
+		Y int `bson:"y"`
+	}
+	data := struct {
+		A int    `bson:"a"`
+		B string `bson:"b"`
+		D []int  `bson:"d"`
+		E Sub    `bson:"e"`
+	}{10, "good", []int{1, 2, 3}, Sub{1, 2}}
+
+	type Query struct {
+		A int    `bson:"a"`
+		B string `bson:"b,omitempty"`
+	}
+	type SubQuery struct {
+		E Sub `bson:"e"`
+	}
+
+	queries := []interface{}{
+		bson.D{{"a", 10}, {"b", "good"}},
+		bson.D{{"a", bson.D{{"$gt", 9}, {"$lt", 11}}}},
+		bson.D{{"$or", []bson.D{{{"a", 1}}, {{"b", "good"}}}}},
+		map[string]interface{}{"a": 10},
+		map[string]interface{}{"a": map[string]interface{}{"$in": []int{9, 10}}},
+		bson.M{"a": bson.D{{"$gte", 10}}},
+		Query{A: 10},
+		&Query{A: 10, B: "good"},
+		SubQuery{Sub{1, 2}},
+		bson.M{"e": bson.D{{"x", 1}, {"y", 2}}},
+	}
+	for _, query := range queries {
+		if match, err := Match(data, query); err != nil || !match {
+			t.Fatalf("should be match, data:%#v, query:%#v, err:%v", data, query, err)
+		}
+	}
+
+	queries = []interface{}{
+		bson.D{{"a", 10}, {"b", "bad"}},
+		map[string]interface{}{"a": map[string]interface{}{"$lt": 10}},
+		Query{A: 11},
+		SubQuery{Sub{1, 3}},
+		bson.M{"e": bson.D{{"y", 2}, {"x", 1}}},
+		bson.M{"e": bson.M{"x": 1}},
+	}
+	for _, query := range queries {
+		if match, err := Match(data, query); err != nil || match {
+			t.Fatalf("should not match, data:%#v, query:%#v, err:%v", data, query, err)
+		}
+	}
+
+	for _, query := range []interface{}{"a", 1, []int{1}} {
+		if _, err := Match(data, query); err == nil {
+			t.Fatalf("query %#v should be rejected", query)
+		}
+	}
+}
+
 func assertQueryFields(t *testing.T, expected, result QueryFields) {
 	if !reflect.DeepEqual(expected, result) {
 		t.Fatalf("expected:%#v, actual:%#v", expected, result)
@@ -192,3 +256,59 @@ func assertNotMatch(t *testing.T, data interface{}, queryM bson.M) {
 		t.Fatalf("should not match, data:%#v, query:%#v", data, queryM)
 	}
 }
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	ordered := [][]interface{}{
+		{bson.MinKey},
+		{nil, (*int)(nil)},
+		{math.NaN()},
+		{-1.5},
+		{int32(-1), -1.0},
+		{int8(1), uint(1), int64(1), 1.0},
+		{int64(1) << 60},
+		{"", bson.Symbol("")},
+		{"a", bson.Symbol("a")},
+		{"b"},
+		{bson.M{}, bson.D{}},
+		{bson.M{"a": 1}, bson.D{{"a", 1.0}}, struct{ A int }{1}},
+		{bson.M{"b": 1}},
+		{bson.D{{"b", 1}, {"a", 1}}},
+		{bson.M{"a": "x"}},
+		{[]interface{}{}},
+		{[]interface{}{1, 2}, []int{1, 2}},
+		{[]interface{}{1, 2, 3}},
+		{[]interface{}{2}},
+		{[]byte("b"), bson.Binary{0, []byte("b")}},
+		{bson.Binary{1, []byte("a")}},
+		{[]byte("aa")},
+		{bson.ObjectId("000000000001")},
+		{bson.ObjectId("000000000002")},
+		{false},
+		{true},
+		{now},
+		{now.Add(time.Second)},
+		{bson.MongoTimestamp(1)},
+		{bson.MongoTimestamp(2)},
+		{bson.RegEx{"a", ""}},
+		{bson.RegEx{"a", "i"}},
+		{bson.MaxKey},
+	}
+	for i, values := range ordered {
+		for j, others := range ordered {
+			for _, a := range values {
+				for _, b := range others {
+					expected := 0
+					if i < j {
+						expected = -1
+					} else if i > j {
+						expected = 1
+					}
+					if result := Compare(a, b); result != expected {
+						t.Errorf("compare %#v with %#v: expected %d, got %d", a, b, expected, result)
+					}
+				}
+			}
+		}
+	}
+}
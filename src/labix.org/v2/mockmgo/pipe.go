@@ -0,0 +1,1086 @@
+package mockmgo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/error"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/modify"
+	"labix.org/v2/mockmgo/multisort"
+	"labix.org/v2/mockmgo/parse"
+)
+
+var _ imgo.Pipe = (*Pipe)(nil)
+
+// Pipe runs an aggregation pipeline against the documents of a collection.
+// The stages $match, $project, $group, $sort, $skip, $limit and $unwind are
+// supported.
+type Pipe struct {
+	coll     *Collection
+	pipeline interface{}
+}
+
+// Pipe prepares a pipeline to aggregate, as done by mgo. The pipeline is
+// evaluated in memory when iterated over.
+func (c *Collection) Pipe(pipeline interface{}) imgo.Pipe {
+	return &Pipe{coll: c, pipeline: pipeline}
+}
+
+// Iter executes the pipeline and returns an iterator capable of going
+// over all the generated results.
+func (p *Pipe) Iter() imgo.Iter {
+	return p.IterContext(context.Background())
+}
+
+// IterContext works like Iter, but gives up running the pipeline with
+// ctx.Err() once ctx is done.
+func (p *Pipe) IterContext(ctx context.Context) imgo.Iter {
+	iter := &Iter{coll: p.coll, got: true, ctx: ctx}
+	if iter.err = ctx.Err(); iter.err != nil {
+		return iter
+	}
+	docs, err := p.coll.aggregate(p.pipeline)
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	for _, doc := range docs {
+		iter.docData.Push(doc)
+	}
+	return iter
+}
+
+// All works like Iter.All.
+func (p *Pipe) All(result interface{}) error {
+	return p.Iter().All(result)
+}
+
+// AllContext works like All, with cancellation as in IterContext.
+func (p *Pipe) AllContext(ctx context.Context, result interface{}) error {
+	return p.IterContext(ctx).All(result)
+}
+
+// One executes the pipeline and unmarshals the first item from the
+// result set into the result parameter.
+// It returns ErrNotFound if no items are generated by the pipeline.
+func (p *Pipe) One(result interface{}) error {
+	return p.OneContext(context.Background(), result)
+}
+
+// OneContext works like One, with cancellation as in IterContext.
+func (p *Pipe) OneContext(ctx context.Context, result interface{}) error {
+	iter := p.IterContext(ctx)
+	if iter.Next(result) {
+		return nil
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return ErrNotFound
+}
+
+// stage transforms the documents flowing through a pipeline.
+type stage func(docs []bson.D) ([]bson.D, error)
+
+// aggregate returns the documents produced by running pipeline against the
+// documents of the collection, in natural order. The whole pipeline is
+// checked before any stage runs, as done by the server.
+func (c *Collection) aggregate(pipeline interface{}) ([]bson.D, error) {
+	d, err := modify.Normalize(bson.D{{"pipeline", pipeline}})
+	if err != nil {
+		return nil, err
+	}
+	specs, ok := d[0].Value.([]interface{})
+	if !ok {
+		return nil, &mgo.QueryError{Message: "exception: 'pipeline' option must be specified as an array"}
+	}
+	stages := make([]stage, len(specs))
+	for i, spec := range specs {
+		if stages[i], err = parseStage(i, spec); err != nil {
+			return nil, err
+		}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	docs := make([]bson.D, len(c.order))
+	for i, key := range c.order {
+		docs[i] = c.data[key]
+	}
+	for _, stage := range stages {
+		if docs, err = stage(docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// pipelineError returns the error reported by the server for a pipeline it
+// can't run.
+func pipelineError(code int, format string, args ...interface{}) error {
+	return &mgo.QueryError{Code: code, Message: "exception: " + fmt.Sprintf(format, args...)}
+}
+
+func parseStage(i int, spec interface{}) (stage, error) {
+	d, ok := spec.(bson.D)
+	if !ok {
+		return nil, pipelineError(15942, "pipeline element %d is not an object", i)
+	}
+	if len(d) != 1 {
+		return nil, pipelineError(16435, "A pipeline stage specification object must contain exactly one field.")
+	}
+	name, arg := d[0].Name, d[0].Value
+	switch name {
+	case "$match":
+		return matchStage(arg)
+	case "$project":
+		return projectStage(arg)
+	case "$group":
+		return groupStage(arg)
+	case "$sort":
+		return sortStage(arg)
+	case "$skip":
+		return skipStage(arg)
+	case "$limit":
+		return limitStage(arg)
+	case "$unwind":
+		return unwindStage(arg)
+	}
+	return nil, pipelineError(16436, "Unrecognized pipeline stage name: '%s'", name)
+}
+
+// ---------------------------------------------------------------------------
+// Stages.
+
+func matchStage(arg interface{}) (stage, error) {
+	query, ok := arg.(bson.D)
+	if !ok {
+		return nil, pipelineError(15959, "the match filter must be an expression in an object")
+	}
+	return func(docs []bson.D) ([]bson.D, error) {
+		var result []bson.D
+		for _, doc := range docs {
+			match, err := parse.Match(doc, query)
+			if err != nil {
+				if qerr, ok := err.(*parse.QueryError); ok {
+					msg := strings.TrimPrefix(qerr.Message, "Can't canonicalize query: ")
+					return nil, pipelineError(16810, "bad query: %s", msg)
+				}
+				return nil, err
+			}
+			if match {
+				result = append(result, doc)
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+func skipStage(arg interface{}) (stage, error) {
+	n, ok := toInt(arg)
+	if !ok {
+		return nil, pipelineError(15972, "Argument to $skip must be a number not %s", modify.TypeName(arg))
+	}
+	if n < 0 {
+		return nil, pipelineError(15956, "Argument to $skip cannot be negative")
+	}
+	return func(docs []bson.D) ([]bson.D, error) {
+		if n >= len(docs) {
+			return nil, nil
+		}
+		return docs[n:], nil
+	}, nil
+}
+
+func limitStage(arg interface{}) (stage, error) {
+	n, ok := toInt(arg)
+	if !ok {
+		return nil, pipelineError(15957, "the limit must be specified as a number")
+	}
+	if n <= 0 {
+		return nil, pipelineError(15958, "the limit must be positive")
+	}
+	return func(docs []bson.D) ([]bson.D, error) {
+		if n < len(docs) {
+			docs = docs[:n]
+		}
+		return docs, nil
+	}, nil
+}
+
+func sortStage(arg interface{}) (stage, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, pipelineError(15973, "the $sort key specification must be an object")
+	}
+	if len(spec) == 0 {
+		return nil, pipelineError(15976, "$sort stage must have at least one sort key")
+	}
+	orderBy := make(bson.D, len(spec))
+	for i, elem := range spec {
+		dir, ok := toInt(elem.Value)
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, pipelineError(15975, "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		orderBy[i] = bson.DocElem{elem.Name, dir}
+	}
+	return func(docs []bson.D) ([]bson.D, error) {
+		data := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			data[i] = doc
+		}
+		data, err := multisort.MultiSort(data, orderBy)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]bson.D, len(data))
+		for i, doc := range data {
+			result[i] = doc.(bson.D)
+		}
+		return result, nil
+	}, nil
+}
+
+// unwindStage returns a document per element of the array found at the
+// field path, which replaces the array. Documents where the array is
+// missing, null or empty are dropped.
+func unwindStage(arg interface{}) (stage, error) {
+	path, ok := arg.(string)
+	if !ok {
+		return nil, pipelineError(15981, "the $unwind field path must be specified as a string")
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, pipelineError(15982, "$unwind: field path references must be prefixed with a '$' ('%s'", path)
+	}
+	parts := strings.Split(path[1:], ".")
+	return func(docs []bson.D) ([]bson.D, error) {
+		var result []bson.D
+		for _, doc := range docs {
+			value, _ := modify.Lookup(doc, path[1:])
+			if value == nil {
+				continue
+			}
+			array, ok := value.([]interface{})
+			if !ok {
+				return nil, pipelineError(15978, "$unwind:  value at end of field path must be an array")
+			}
+			for _, elem := range array {
+				result = append(result, setPath(doc, parts, elem))
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// setPath returns a copy of doc with the value at the dotted path parts
+// replaced by value.
+func setPath(doc bson.D, parts []string, value interface{}) bson.D {
+	result := make(bson.D, len(doc), len(doc)+1)
+	copy(result, doc)
+	for i := range result {
+		if result[i].Name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			result[i].Value = value
+		} else {
+			sub, _ := result[i].Value.(bson.D)
+			result[i].Value = setPath(sub, parts[1:], value)
+		}
+		return result
+	}
+	if len(parts) > 1 {
+		value = setPath(nil, parts[1:], value)
+	}
+	return append(result, bson.DocElem{parts[0], value})
+}
+
+// projectSpec holds a parsed $project specification, or the part of it
+// applying to a subdocument.
+type projectSpec struct {
+	excludeId bool
+	fields    []*projectSpecField // in specification order
+}
+
+type projectSpecField struct {
+	name    string
+	include bool
+	expr    interface{}  // computed value, when set
+	sub     *projectSpec // specification for a subdocument, when set
+}
+
+func (spec *projectSpec) field(name string) *projectSpecField {
+	for _, f := range spec.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// computed reports whether spec adds fields not found in the input.
+func (spec *projectSpec) computed() bool {
+	for _, f := range spec.fields {
+		if f.expr != nil || f.sub != nil && f.sub.computed() {
+			return true
+		}
+	}
+	return false
+}
+
+func projectStage(arg interface{}) (stage, error) {
+	d, ok := arg.(bson.D)
+	if !ok {
+		return nil, pipelineError(15969, "$project specification must be an object")
+	}
+	spec := &projectSpec{}
+	if err := spec.parse(d, true); err != nil {
+		return nil, err
+	}
+	if len(spec.fields) == 0 {
+		return nil, pipelineError(16403, "$projection requires at least one output field")
+	}
+	return func(docs []bson.D) ([]bson.D, error) {
+		result := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			var err error
+			if result[i], err = spec.apply(doc, doc, true); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+func (spec *projectSpec) parse(d bson.D, top bool) error {
+	for _, elem := range d {
+		if top && elem.Name == "_id" && isFlag(elem.Value) && !isTrue(elem.Value) {
+			spec.excludeId = true
+			continue
+		}
+		parts := strings.SplitN(elem.Name, ".", 2)
+		f := spec.field(parts[0])
+		if f == nil {
+			f = &projectSpecField{name: parts[0]}
+			spec.fields = append(spec.fields, f)
+		}
+		if len(parts) == 2 {
+			if f.sub == nil {
+				f.sub = &projectSpec{}
+			}
+			if err := f.sub.parse(bson.D{{parts[1], elem.Value}}, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch value := elem.Value.(type) {
+		case bool, int, int64, float64:
+			if !isTrue(value) {
+				return pipelineError(16406, "The top-level _id field is the only field currently supported for exclusion")
+			}
+			f.include = true
+		case bson.D:
+			if len(value) > 0 && strings.HasPrefix(value[0].Name, "$") {
+				if err := checkExpr(value); err != nil {
+					return err
+				}
+				f.expr = value
+				continue
+			}
+			if f.sub == nil {
+				f.sub = &projectSpec{}
+			}
+			if err := f.sub.parse(value, false); err != nil {
+				return err
+			}
+		default:
+			if err := checkExpr(value); err != nil {
+				return err
+			}
+			f.expr = value
+		}
+	}
+	return nil
+}
+
+// apply returns the fields of doc included by spec, in the order they are
+// found in doc, followed by the computed ones. Expressions are evaluated
+// against root, the document going through the stage.
+func (spec *projectSpec) apply(root, doc bson.D, top bool) (bson.D, error) {
+	result := bson.D{}
+	for _, elem := range doc {
+		f := spec.field(elem.Name)
+		switch {
+		case f == nil:
+			if top && elem.Name == "_id" && !spec.excludeId {
+				result = append(result, elem)
+			}
+		case f.expr != nil:
+		case f.include:
+			result = append(result, elem)
+		case f.sub != nil:
+			value, ok, err := f.sub.applyValue(root, elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				result = append(result, bson.DocElem{elem.Name, value})
+			}
+		}
+	}
+	for _, f := range spec.fields {
+		switch {
+		case f.expr != nil:
+			value, found, err := eval(root, f.expr)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				result = append(result, bson.DocElem{f.name, value})
+			}
+		case f.sub != nil && f.sub.computed():
+			if _, found := lookupElem(doc, f.name); found {
+				continue
+			}
+			sub, err := f.sub.apply(root, bson.D{}, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, bson.DocElem{f.name, sub})
+		}
+	}
+	if top {
+		for i := 1; i < len(result); i++ {
+			if result[i].Name == "_id" {
+				id := result[i]
+				copy(result[1:i+1], result[:i])
+				result[0] = id
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// applyValue applies spec to the subdocument value, or to the
+// subdocuments of the array value, reporting whether the result should be
+// kept.
+func (spec *projectSpec) applyValue(root bson.D, value interface{}) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case bson.D:
+		d, err := spec.apply(root, value, false)
+		return d, err == nil, err
+	case []interface{}:
+		result := []interface{}{}
+		for _, elem := range value {
+			projected, ok, err := spec.applyValue(root, elem)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				result = append(result, projected)
+			}
+		}
+		return result, true, nil
+	}
+	return nil, false, nil
+}
+
+// isFlag reports whether v is a value including or excluding a field.
+func isFlag(v interface{}) bool {
+	switch v.(type) {
+	case bool, int, int64, float64:
+		return true
+	}
+	return false
+}
+
+func lookupElem(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// groupField holds an accumulator of a $group specification.
+type groupField struct {
+	name string
+	op   string
+	expr interface{}
+}
+
+// group holds the state of the accumulators for the documents sharing an
+// _id value.
+type group struct {
+	id     interface{}
+	values []interface{}
+	counts []int
+}
+
+func groupStage(arg interface{}) (stage, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, pipelineError(15947, "a group's fields must be specified in an object")
+	}
+	var id interface{}
+	var hasId bool
+	var fields []groupField
+	for _, elem := range spec {
+		if elem.Name == "_id" {
+			if err := checkExpr(elem.Value); err != nil {
+				return nil, err
+			}
+			id, hasId = elem.Value, true
+			continue
+		}
+		if strings.Contains(elem.Name, ".") {
+			return nil, pipelineError(16414, "the group aggregate field name '%s' cannot be used because $group's field names cannot contain '.'", elem.Name)
+		}
+		acc, ok := elem.Value.(bson.D)
+		if !ok || len(acc) != 1 {
+			return nil, pipelineError(15951, "the group aggregate field '%s' must be defined as an expression inside an object", elem.Name)
+		}
+		switch acc[0].Name {
+		case "$sum", "$avg", "$min", "$max", "$push", "$addToSet", "$first", "$last":
+		default:
+			return nil, pipelineError(15952, "unknown group operator '%s'", acc[0].Name)
+		}
+		if err := checkExpr(acc[0].Value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, groupField{elem.Name, acc[0].Name, acc[0].Value})
+	}
+	if !hasId {
+		return nil, pipelineError(15955, "a group specification must include an _id")
+	}
+
+	return func(docs []bson.D) ([]bson.D, error) {
+		var groups []*group // in the order they were first seen
+		var byId []*group   // sorted by _id
+		for _, doc := range docs {
+			key, _, err := eval(doc, id)
+			if err != nil {
+				return nil, err
+			}
+			i := sort.Search(len(byId), func(i int) bool {
+				return parse.Compare(byId[i].id, key) >= 0
+			})
+			if i == len(byId) || parse.Compare(byId[i].id, key) != 0 {
+				g := &group{id: key, values: make([]interface{}, len(fields)), counts: make([]int, len(fields))}
+				groups = append(groups, g)
+				byId = append(byId, nil)
+				copy(byId[i+1:], byId[i:])
+				byId[i] = g
+			}
+			g := byId[i]
+			for j, f := range fields {
+				value, found, err := eval(doc, f.expr)
+				if err != nil {
+					return nil, err
+				}
+				g.accumulate(j, f.op, value, found)
+			}
+		}
+
+		result := make([]bson.D, len(groups))
+		for i, g := range groups {
+			doc := bson.D{{"_id", g.id}}
+			for j, f := range fields {
+				doc = append(doc, bson.DocElem{f.name, g.result(j, f.op)})
+			}
+			result[i] = doc
+		}
+		return result, nil
+	}, nil
+}
+
+// accumulate feeds the value of the j-th accumulator for a document into g.
+func (g *group) accumulate(j int, op string, value interface{}, found bool) {
+	n := g.counts[j]
+	g.counts[j]++
+	switch op {
+	case "$sum":
+		if n == 0 {
+			g.values[j] = 0
+		}
+		if modify.IsNumber(value) {
+			g.values[j] = add(g.values[j], value)
+		}
+	case "$avg":
+		if n == 0 {
+			g.values[j] = []float64{0, 0}
+		}
+		if f, ok := modify.ToFloat(value); ok {
+			avg := g.values[j].([]float64)
+			avg[0] += f
+			avg[1]++
+		}
+	case "$min", "$max":
+		if value == nil {
+			return
+		}
+		c := parse.Compare(value, g.values[j])
+		if g.values[j] == nil || op == "$min" && c < 0 || op == "$max" && c > 0 {
+			g.values[j] = value
+		}
+	case "$push", "$addToSet":
+		if n == 0 {
+			g.values[j] = []interface{}{}
+		}
+		if !found {
+			return
+		}
+		values := g.values[j].([]interface{})
+		if op == "$addToSet" {
+			for _, v := range values {
+				if parse.Compare(v, value) == 0 {
+					return
+				}
+			}
+		}
+		g.values[j] = append(values, value)
+	case "$first":
+		if n == 0 {
+			g.values[j] = value
+		}
+	case "$last":
+		g.values[j] = value
+	}
+}
+
+// result returns the value of the j-th accumulator of g.
+func (g *group) result(j int, op string) interface{} {
+	if op == "$avg" {
+		avg := g.values[j].([]float64)
+		if avg[1] == 0 {
+			return 0.0
+		}
+		return avg[0] / avg[1]
+	}
+	return g.values[j]
+}
+
+// ---------------------------------------------------------------------------
+// Expressions.
+
+// exprOp evaluates an expression operator, given the values of its
+// arguments. Operators taking a fixed number of arguments set nargs.
+type exprOp struct {
+	nargs int
+	f     func(args []interface{}) (interface{}, error)
+}
+
+var exprOps map[string]exprOp
+
+func init() {
+	exprOps = map[string]exprOp{
+		"$add":      {-1, opAdd},
+		"$subtract": {2, opSubtract},
+		"$multiply": {-1, opMultiply},
+		"$divide":   {2, opDivide},
+		"$mod":      {2, opMod},
+
+		"$concat":     {-1, opConcat},
+		"$substr":     {3, opSubstr},
+		"$toLower":    {1, opCase(strings.ToLower)},
+		"$toUpper":    {1, opCase(strings.ToUpper)},
+		"$strcasecmp": {2, opStrcasecmp},
+
+		"$cmp": {2, opCmp(func(c int) interface{} { return c })},
+		"$eq":  {2, opCmp(func(c int) interface{} { return c == 0 })},
+		"$ne":  {2, opCmp(func(c int) interface{} { return c != 0 })},
+		"$gt":  {2, opCmp(func(c int) interface{} { return c > 0 })},
+		"$gte": {2, opCmp(func(c int) interface{} { return c >= 0 })},
+		"$lt":  {2, opCmp(func(c int) interface{} { return c < 0 })},
+		"$lte": {2, opCmp(func(c int) interface{} { return c <= 0 })},
+
+		"$and":     {-1, opAnd},
+		"$or":      {-1, opOr},
+		"$not":     {1, func(args []interface{}) (interface{}, error) { return !isTrue(args[0]), nil }},
+		"$cond":    {3, opCond},
+		"$ifNull":  {2, opIfNull},
+		"$size":    {1, opSize},
+		"$literal": {1, func(args []interface{}) (interface{}, error) { return args[0], nil }},
+
+		"$year":        {1, opDate(func(t time.Time) int { return t.Year() })},
+		"$month":       {1, opDate(func(t time.Time) int { return int(t.Month()) })},
+		"$dayOfMonth":  {1, opDate(func(t time.Time) int { return t.Day() })},
+		"$dayOfYear":   {1, opDate(func(t time.Time) int { return t.YearDay() })},
+		"$dayOfWeek":   {1, opDate(func(t time.Time) int { return int(t.Weekday()) + 1 })},
+		"$week":        {1, opDate(func(t time.Time) int { return (t.YearDay() + 6 - int(t.Weekday())) / 7 })},
+		"$hour":        {1, opDate(func(t time.Time) int { return t.Hour() })},
+		"$minute":      {1, opDate(func(t time.Time) int { return t.Minute() })},
+		"$second":      {1, opDate(func(t time.Time) int { return t.Second() })},
+		"$millisecond": {1, opDate(func(t time.Time) int { return t.Nanosecond() / 1e6 })},
+	}
+}
+
+// checkExpr returns the error reported by the server for an expression
+// using unknown operators.
+func checkExpr(expr interface{}) error {
+	switch expr := expr.(type) {
+	case bson.D:
+		if len(expr) > 0 && strings.HasPrefix(expr[0].Name, "$") {
+			if len(expr) > 1 {
+				return pipelineError(15983, "the operator must be the only field in a pipeline object (at '%s'", expr[0].Name)
+			}
+			if _, ok := exprOps[expr[0].Name]; !ok {
+				return pipelineError(15999, "invalid operator '%s'", expr[0].Name)
+			}
+			if expr[0].Name == "$literal" {
+				return nil
+			}
+			return checkExpr(expr[0].Value)
+		}
+		for _, elem := range expr {
+			if err := checkExpr(elem.Value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, elem := range expr {
+			if err := checkExpr(elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eval returns the value of the expression expr for doc, reporting whether
+// it was found. Only references to missing fields aren't found.
+func eval(doc bson.D, expr interface{}) (value interface{}, found bool, err error) {
+	switch expr := expr.(type) {
+	case string:
+		if !strings.HasPrefix(expr, "$") {
+			return expr, true, nil
+		}
+		path := expr[1:]
+		if strings.HasPrefix(path, "$") {
+			parts := strings.SplitN(path[1:], ".", 2)
+			if parts[0] != "ROOT" && parts[0] != "CURRENT" {
+				return nil, false, pipelineError(17276, "Use of undefined variable: %s", parts[0])
+			}
+			if len(parts) == 1 {
+				return doc, true, nil
+			}
+			path = parts[1]
+		}
+		value, found = fieldPath(doc, strings.Split(path, "."))
+		return value, found, nil
+	case bson.D:
+		if len(expr) > 0 && strings.HasPrefix(expr[0].Name, "$") {
+			value, err = evalOp(doc, expr[0].Name, expr[0].Value)
+			return value, err == nil, err
+		}
+		result := bson.D{}
+		for _, elem := range expr {
+			value, found, err := eval(doc, elem.Value)
+			if err != nil {
+				return nil, false, err
+			}
+			if found {
+				result = append(result, bson.DocElem{elem.Name, value})
+			}
+		}
+		return result, true, nil
+	case []interface{}:
+		result := make([]interface{}, len(expr))
+		for i, elem := range expr {
+			if result[i], err = evalValue(doc, elem); err != nil {
+				return nil, false, err
+			}
+		}
+		return result, true, nil
+	}
+	return expr, true, nil
+}
+
+// evalValue is like eval, with missing values evaluating to null.
+func evalValue(doc bson.D, expr interface{}) (interface{}, error) {
+	value, _, err := eval(doc, expr)
+	return value, err
+}
+
+// fieldPath returns the value at the dotted path parts of v. Paths going
+// through arrays return an array with the values found in each element.
+func fieldPath(v interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return v, true
+	}
+	switch v := v.(type) {
+	case bson.D:
+		value, found := lookupElem(v, parts[0])
+		if !found {
+			return nil, false
+		}
+		return fieldPath(value, parts[1:])
+	case []interface{}:
+		result := []interface{}{}
+		for _, elem := range v {
+			switch elem.(type) {
+			case bson.D, []interface{}:
+				if value, found := fieldPath(elem, parts); found {
+					result = append(result, value)
+				}
+			}
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+func evalOp(doc bson.D, name string, arg interface{}) (interface{}, error) {
+	op, ok := exprOps[name]
+	if !ok {
+		return nil, pipelineError(15999, "invalid operator '%s'", name)
+	}
+	if name == "$literal" {
+		return arg, nil
+	}
+	var exprs []interface{}
+	switch arg := arg.(type) {
+	case []interface{}:
+		exprs = arg
+	case bson.D:
+		if name == "$cond" && len(arg) > 0 && !strings.HasPrefix(arg[0].Name, "$") {
+			cond := make(map[string]interface{})
+			for _, elem := range arg {
+				cond[elem.Name] = elem.Value
+			}
+			exprs = []interface{}{cond["if"], cond["then"], cond["else"]}
+			break
+		}
+		exprs = []interface{}{arg}
+	default:
+		exprs = []interface{}{arg}
+	}
+	if op.nargs >= 0 && len(exprs) != op.nargs {
+		return nil, pipelineError(16020, "Expression %s takes exactly %d arguments. %d were passed in.", name[1:], op.nargs, len(exprs))
+	}
+	args := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		var err error
+		if args[i], err = evalValue(doc, expr); err != nil {
+			return nil, err
+		}
+	}
+	return op.f(args)
+}
+
+func add(a, b interface{}) interface{} {
+	return modify.Arith(a, b, func(a, b float64) float64 { return a + b }, func(a, b int64) int64 { return a + b })
+}
+
+func opAdd(args []interface{}) (interface{}, error) {
+	var sum interface{} = 0
+	var date *time.Time
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case nil:
+			return nil, nil
+		case time.Time:
+			if date != nil {
+				return nil, pipelineError(16612, "only one Date allowed in an $add expression")
+			}
+			date = &arg
+		default:
+			if !modify.IsNumber(arg) {
+				return nil, pipelineError(16554, "$add only supports numeric or date types, not %s", modify.TypeName(arg))
+			}
+			sum = add(sum, arg)
+		}
+	}
+	if date != nil {
+		f, _ := modify.ToFloat(sum)
+		return date.Add(time.Duration(f) * time.Millisecond), nil
+	}
+	return sum, nil
+}
+
+func opSubtract(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	ta, aDate := a.(time.Time)
+	tb, bDate := b.(time.Time)
+	switch {
+	case modify.IsNumber(a) && modify.IsNumber(b):
+		return modify.Arith(a, b, func(a, b float64) float64 { return a - b }, func(a, b int64) int64 { return a - b }), nil
+	case aDate && bDate:
+		return int64(ta.Sub(tb) / time.Millisecond), nil
+	case aDate && modify.IsNumber(b):
+		f, _ := modify.ToFloat(b)
+		return ta.Add(-time.Duration(f) * time.Millisecond), nil
+	}
+	return nil, pipelineError(16556, "cant $subtract a%s from a %s", modify.TypeName(b), modify.TypeName(a))
+}
+
+func opMultiply(args []interface{}) (interface{}, error) {
+	var product interface{} = 1
+	for _, arg := range args {
+		if arg == nil {
+			return nil, nil
+		}
+		if !modify.IsNumber(arg) {
+			return nil, pipelineError(16555, "$multiply only supports numeric types, not %s", modify.TypeName(arg))
+		}
+		product = modify.Arith(product, arg, func(a, b float64) float64 { return a * b }, func(a, b int64) int64 { return a * b })
+	}
+	return product, nil
+}
+
+func opDivide(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	fa, aok := modify.ToFloat(a)
+	fb, bok := modify.ToFloat(b)
+	if !aok || !bok {
+		return nil, pipelineError(16609, "$divide only supports numeric types, not %s and %s", modify.TypeName(a), modify.TypeName(b))
+	}
+	if fb == 0 {
+		return nil, pipelineError(16608, "can't $divide by zero")
+	}
+	return fa / fb, nil
+}
+
+func opMod(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	if !modify.IsNumber(a) || !modify.IsNumber(b) {
+		return nil, pipelineError(16611, "$mod only supports numeric types, not %s and %s", modify.TypeName(a), modify.TypeName(b))
+	}
+	if fb, _ := modify.ToFloat(b); fb == 0 {
+		return nil, pipelineError(16610, "can't $mod by 0")
+	}
+	return modify.Arith(a, b, math.Mod, func(a, b int64) int64 { return a % b }), nil
+}
+
+func opConcat(args []interface{}) (interface{}, error) {
+	var s []string
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case nil:
+			return nil, nil
+		case string:
+			s = append(s, arg)
+		default:
+			return nil, pipelineError(16702, "$concat only supports strings, not %s", modify.TypeName(arg))
+		}
+	}
+	return strings.Join(s, ""), nil
+}
+
+// coerceString converts v to a string as done by the string operators.
+func coerceString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05")
+	}
+	return fmt.Sprint(v)
+}
+
+func opSubstr(args []interface{}) (interface{}, error) {
+	s := coerceString(args[0])
+	start, ok1 := toInt(args[1])
+	length, ok2 := toInt(args[2])
+	if !ok1 || !ok2 {
+		return nil, pipelineError(16034, "$substr: starting index and length must be numbers")
+	}
+	if start < 0 || start >= len(s) {
+		return "", nil
+	}
+	if length < 0 || length > len(s)-start {
+		length = len(s) - start
+	}
+	return s[start : start+length], nil
+}
+
+func opCase(f func(string) string) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return f(coerceString(args[0])), nil
+	}
+}
+
+func opStrcasecmp(args []interface{}) (interface{}, error) {
+	a := strings.ToUpper(coerceString(args[0]))
+	b := strings.ToUpper(coerceString(args[1]))
+	return strings.Compare(a, b), nil
+}
+
+func opCmp(f func(c int) interface{}) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return f(parse.Compare(args[0], args[1])), nil
+	}
+}
+
+func opAnd(args []interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if !isTrue(arg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func opOr(args []interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if isTrue(arg) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func opCond(args []interface{}) (interface{}, error) {
+	if isTrue(args[0]) {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+func opIfNull(args []interface{}) (interface{}, error) {
+	if args[0] != nil {
+		return args[0], nil
+	}
+	return args[1], nil
+}
+
+func opSize(args []interface{}) (interface{}, error) {
+	array, ok := args[0].([]interface{})
+	if !ok {
+		return nil, pipelineError(17124, "The argument to $size must be an Array, but was of type: %s", modify.TypeName(args[0]))
+	}
+	return len(array), nil
+}
+
+func opDate(f func(t time.Time) int) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		t, ok := args[0].(time.Time)
+		if !ok {
+			return nil, pipelineError(16006, "can't convert from BSON type %s to Date", modify.TypeName(args[0]))
+		}
+		return f(t.UTC()), nil
+	}
+}
@@ -0,0 +1,300 @@
+package mockmgo
+
+import (
+	"fmt"
+	"strings"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/modify"
+	"labix.org/v2/mockmgo/parse"
+)
+
+// projection holds a parsed Query.Select selector.
+type projection struct {
+	include bool // only the selected fields are returned
+	fields  projectionFields
+}
+
+// projectionFields holds the details for each field of a document, or of
+// the documents in an array, which are selected with a dotted path.
+type projectionFields map[string]*projectionField
+
+type projectionField struct {
+	on        bool
+	slice     []int // skip and limit, for $slice
+	elemMatch interface{}
+	fields    projectionFields
+}
+
+// projectionError returns the error reported by the server for selector
+// it can't make sense of.
+func projectionError(format string, args ...interface{}) error {
+	return &mgo.QueryError{Code: 17287, Message: "Can't canonicalize query: BadValue " + fmt.Sprintf(format, args...)}
+}
+
+// parseProjection parses selector, as provided to Query.Select. A nil
+// projection is returned if selector selects all fields.
+func parseProjection(selector interface{}) (*projection, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	d, err := modify.Normalize(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) == 0 {
+		return nil, nil
+	}
+
+	p := &projection{fields: make(projectionFields)}
+	included, excluded := false, false
+	for _, elem := range d {
+		field := &projectionField{}
+		switch value := elem.Value.(type) {
+		case bson.D:
+			if len(value) != 1 {
+				return nil, projectionError("Unsupported projection option: %s", elem.Name)
+			}
+			switch value[0].Name {
+			case "$slice":
+				if field.slice, err = sliceArgs(value[0].Value); err != nil {
+					return nil, err
+				}
+			case "$elemMatch":
+				query, ok := value[0].Value.(bson.D)
+				if !ok {
+					return nil, projectionError("elemMatch: Invalid argument, object required.")
+				}
+				if strings.Contains(elem.Name, ".") {
+					return nil, projectionError("Cannot use $elemMatch projection on a nested field.")
+				}
+				field.elemMatch = query
+				included = true
+			default:
+				return nil, projectionError("Unsupported projection option: %s: { %s: %v }", elem.Name, value[0].Name, value[0].Value)
+			}
+		default:
+			if strings.HasSuffix(elem.Name, ".$") || strings.Contains(elem.Name, ".$.") {
+				return nil, fmt.Errorf("mockmgo: positional projection of %s is not supported", elem.Name)
+			}
+			field.on = isTrue(value)
+			if elem.Name != "_id" {
+				if field.on {
+					included = true
+				} else {
+					excluded = true
+				}
+			}
+		}
+		p.fields.add(elem.Name, field)
+	}
+	if included && excluded {
+		return nil, projectionError("Projection cannot have a mix of inclusion and exclusion.")
+	}
+	// {"_id": 1} alone selects only the _id field.
+	if id := p.fields["_id"]; !included && !excluded && id != nil && id.on && len(d) == 1 {
+		included = true
+	}
+	p.include = included
+	return p, nil
+}
+
+// add records field under the dotted path.
+func (fields projectionFields) add(path string, field *projectionField) {
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		fields[path] = field
+		return
+	}
+	parent := fields[parts[0]]
+	if parent == nil || parent.fields == nil {
+		parent = &projectionField{fields: make(projectionFields)}
+		fields[parts[0]] = parent
+	}
+	parent.fields.add(parts[1], field)
+}
+
+// sliceArgs returns the skip and limit arguments of a $slice projection,
+// which may be a number of elements or a [skip, limit] array.
+func sliceArgs(v interface{}) ([]int, error) {
+	if n, ok := toInt(v); ok {
+		if n < 0 {
+			return []int{n, -n}, nil
+		}
+		return []int{0, n}, nil
+	}
+	args, ok := v.([]interface{})
+	if !ok || len(args) != 2 {
+		return nil, projectionError("$slice only supports numbers and [skip, limit] arrays")
+	}
+	skip, ok1 := toInt(args[0])
+	limit, ok2 := toInt(args[1])
+	if !ok1 || !ok2 {
+		return nil, projectionError("$slice only supports numbers and [skip, limit] arrays")
+	}
+	if limit <= 0 {
+		return nil, projectionError("$slice limit must be positive")
+	}
+	return []int{skip, limit}, nil
+}
+
+func toInt(v interface{}) (int, bool) {
+	if !modify.IsNumber(v) {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case int:
+		return v, true
+	}
+	return 0, false
+}
+
+// apply returns doc restricted to the fields selected by p. The _id field
+// is returned unless explicitly excluded.
+func (p *projection) apply(doc bson.D) (bson.D, error) {
+	if p == nil {
+		return doc, nil
+	}
+	return p.fields.apply(doc, p.include, true)
+}
+
+func (fields projectionFields) apply(doc bson.D, include, top bool) (result bson.D, err error) {
+	result = bson.D{}
+	for _, elem := range doc {
+		field, ok := fields[elem.Name]
+		if !ok {
+			if !include || (top && elem.Name == "_id") {
+				result = append(result, elem)
+			}
+			continue
+		}
+
+		value := elem.Value
+		switch {
+		case field.fields != nil:
+			value, ok, err = field.fields.applyValue(value, include)
+			if err != nil {
+				return nil, err
+			}
+		case field.slice != nil:
+			value = slice(value, field.slice[0], field.slice[1])
+		case field.elemMatch != nil:
+			value, ok, err = elemMatch(value, field.elemMatch)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			ok = field.on
+		}
+		if ok {
+			result = append(result, bson.DocElem{elem.Name, value})
+		}
+	}
+	return result, nil
+}
+
+// applyValue applies fields to the subdocument value, or to the
+// subdocuments of the array value, reporting whether the result should
+// be kept.
+func (fields projectionFields) applyValue(value interface{}, include bool) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case bson.D:
+		d, err := fields.apply(value, include, false)
+		return d, err == nil, err
+	case []interface{}:
+		result := []interface{}{}
+		for _, elem := range value {
+			switch elem.(type) {
+			case bson.D, []interface{}:
+				projected, _, err := fields.applyValue(elem, include)
+				if err != nil {
+					return nil, false, err
+				}
+				result = append(result, projected)
+			default:
+				if !include {
+					result = append(result, elem)
+				}
+			}
+		}
+		return result, true, nil
+	}
+	return value, !include, nil
+}
+
+// slice returns the elements of the array value selected by skip and
+// limit. A negative skip counts from the end of the array. Values other
+// than arrays are returned unchanged.
+func slice(value interface{}, skip, limit int) interface{} {
+	array, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	if skip < 0 {
+		skip += len(array)
+		if skip < 0 {
+			skip = 0
+		}
+	}
+	if skip > len(array) {
+		skip = len(array)
+	}
+	if limit > len(array)-skip {
+		limit = len(array) - skip
+	}
+	return array[skip : skip+limit]
+}
+
+// elemMatch returns an array holding the first element of the array value
+// matching query, reporting whether there was such an element.
+func elemMatch(value interface{}, query interface{}) (interface{}, bool, error) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	for _, elem := range array {
+		if _, ok := elem.(bson.D); !ok {
+			continue
+		}
+		match, err := parse.Match(elem, query)
+		if err != nil {
+			return nil, false, queryError(err)
+		}
+		if match {
+			return []interface{}{elem}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// project returns doc restricted to the fields selected by selector.
+func project(doc bson.D, selector interface{}) (bson.D, error) {
+	p, err := parseProjection(selector)
+	if err != nil {
+		return nil, err
+	}
+	return p.apply(doc)
+}
+
+func isTrue(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case int32:
+		return v != 0
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return v != nil
+}
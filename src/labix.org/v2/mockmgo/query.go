@@ -0,0 +1,513 @@
+package mockmgo
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/base/queue"
+	. "labix.org/v2/error"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mockmgo/modify"
+)
+
+var (
+	_ imgo.Query = (*Query)(nil)
+	_ imgo.Iter  = (*Iter)(nil)
+)
+
+type Query struct {
+	coll *Collection
+	op   QueryOp
+}
+
+type QueryOp struct {
+	query    interface{}
+	selector interface{}
+	hint     []string
+	OrderBy  bson.D
+	skip     int32
+	limit    int32
+}
+
+func (q *Query) One(result interface{}) (err error) {
+	q.coll.RLock()
+	defer q.coll.RUnlock()
+
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr {
+		return ErrType
+	}
+
+	op := q.op
+	op.limit = 1
+	keys, err := q.coll.find(op)
+	if err != nil {
+		return
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+
+	data, err := project(q.coll.data[keys[0]], q.op.selector)
+	if err != nil {
+		return
+	}
+	return setResult(resultv, data)
+}
+
+// OneContext works like One, but fails with ctx.Err() if ctx is done.
+func (q *Query) OneContext(ctx context.Context, result interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.One(result)
+}
+
+func (q *Query) All(result interface{}) (err error) {
+	return q.Iter().All(result)
+}
+
+// AllContext works like All, with cancellation as in IterContext.
+func (q *Query) AllContext(ctx context.Context, result interface{}) error {
+	return q.IterContext(ctx).All(result)
+}
+
+func (q *Query) For(result interface{}, f func() error) error {
+	return q.Iter().For(result, f)
+}
+
+func (q *Query) Iter() imgo.Iter {
+	return q.IterContext(context.Background())
+}
+
+// IterContext works like Iter, but the returned iterator stops once ctx is
+// done: Next returns false, and Err and Close report ctx.Err().
+func (q *Query) IterContext(ctx context.Context) imgo.Iter {
+	iter := &Iter{
+		coll: q.coll,
+		op:   q.op,
+		ctx:  ctx,
+	}
+	return iter
+}
+
+// Tail returns a tailable iterator. Once the documents matching the query
+// are exhausted, Next blocks until more documents are inserted or the
+// timeout expires. A negative timeout blocks forever.
+func (q *Query) Tail(timeout time.Duration) imgo.Iter {
+	iter := &Iter{
+		coll:    q.coll,
+		op:      q.op,
+		tailing: true,
+		timeout: timeout,
+		seen:    make(map[string]bool),
+	}
+	return iter
+}
+
+func (q *Query) Count() (n int, err error) {
+	q.coll.RLock()
+	defer q.coll.RUnlock()
+
+	keys, err := q.coll.find(QueryOp{query: q.op.query, skip: q.op.skip, limit: q.op.limit})
+	return len(keys), err
+}
+
+// CountContext works like Count, but fails with ctx.Err() if ctx is done.
+func (q *Query) CountContext(ctx context.Context) (n int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return q.Count()
+}
+
+func (q *Query) Skip(n int) imgo.Query {
+	q.op.skip = int32(n)
+	return q
+}
+
+func (q *Query) Limit(n int) imgo.Query {
+	q.op.limit = int32(n)
+	return q
+}
+
+// Batch is accepted for compatibility with mgo. All documents are already
+// in memory, so it has no effect.
+func (q *Query) Batch(n int) imgo.Query {
+	return q
+}
+
+// Prefetch is accepted for compatibility with mgo and has no effect.
+func (q *Query) Prefetch(p float64) imgo.Query {
+	return q
+}
+
+// Snapshot is accepted for compatibility with mgo. Documents are never
+// moved by updates, so iterators never return a document twice anyway.
+func (q *Query) Snapshot() imgo.Query {
+	return q
+}
+
+// LogReplay is accepted for compatibility with mgo and has no effect.
+func (q *Query) LogReplay() imgo.Query {
+	return q
+}
+
+// ReadPreference is accepted for compatibility with mgo. There's a single
+// in-memory server to read from, so it has no effect.
+func (q *Query) ReadPreference(pref *imgo.ReadPreference) imgo.Query {
+	return q
+}
+
+// Select enables selecting which fields should be retrieved for the results
+// found. For example, the following query would only retrieve the name
+// field:
+//
+//     err := collection.Find(nil).Select(bson.M{"name": 1}).One(&result)
+//
+func (q *Query) Select(selector interface{}) imgo.Query {
+	q.op.selector = selector
+	return q
+}
+
+// Hint records the index the query should use. It is reported by Explain.
+func (q *Query) Hint(indexKey ...string) imgo.Query {
+	q.op.hint = indexKey
+	return q
+}
+
+func (q *Query) Sort(fields ...string) imgo.Query {
+	var order bson.D
+	for _, field := range fields {
+		n := 1
+		if field != "" {
+			switch field[0] {
+			case '+':
+				field = field[1:]
+			case '-':
+				n = -1
+				field = field[1:]
+			}
+		}
+		if field == "" {
+			panic("Sort: empty field name")
+		}
+		order = append(order, bson.DocElem{field, n})
+	}
+	q.op.OrderBy = order
+	return q
+}
+
+// Explain returns a number of details about how the query would be
+// executed, in the same shape as the server's explain output.
+func (q *Query) Explain(result interface{}) error {
+	q.coll.RLock()
+	defer q.coll.RUnlock()
+
+	keys, stats, err := q.coll.explain(q.op)
+	if err != nil {
+		return err
+	}
+	explain := bson.M{
+		"cursor":          stats.cursor,
+		"n":               len(keys),
+		"nscanned":        stats.nscanned,
+		"nscannedObjects": stats.nscannedObjects,
+		"scanAndOrder":    len(q.op.OrderBy) > 0,
+		"millis":          0,
+	}
+	return setResult(reflect.ValueOf(result), explain)
+}
+
+// Distinct unmarshals into result the list of distinct values for the given
+// key. Array values are expanded, as done by the server.
+func (q *Query) Distinct(key string, result interface{}) error {
+	q.coll.RLock()
+	defer q.coll.RUnlock()
+
+	keys, err := q.coll.find(QueryOp{query: q.op.query})
+	if err != nil {
+		return err
+	}
+	values := []interface{}{}
+	add := func(value interface{}) {
+		for _, v := range values {
+			if modify.Equal(v, value) {
+				return
+			}
+		}
+		values = append(values, value)
+	}
+	for _, k := range keys {
+		value, ok := modify.Lookup(q.coll.data[k], key)
+		if !ok {
+			continue
+		}
+		if array, ok := value.([]interface{}); ok {
+			for _, elem := range array {
+				add(elem)
+			}
+		} else {
+			add(value)
+		}
+	}
+
+	var doc struct{ Values bson.Raw }
+	data, err := bson.Marshal(bson.M{"values": values})
+	if err != nil {
+		return err
+	}
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return doc.Values.Unmarshal(result)
+}
+
+// Apply runs the findAndModify logic on the first document matched by the
+// query, honoring its sort order, and unmarshals either the old or the new
+// version of the document into result. ErrNotFound is returned if no
+// document matches and change.Upsert is false.
+func (q *Query) Apply(change imgo.Change, result interface{}) (info *imgo.ChangeInfo, err error) {
+	c := q.coll
+	c.Lock()
+	defer c.Unlock()
+
+	op := q.op
+	op.skip, op.limit = 0, 1
+	keys, err := c.find(op)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.D
+	info = &imgo.ChangeInfo{}
+	switch {
+	case len(keys) == 0 && change.Upsert && !change.Remove:
+		id, err := c.upsert(q.op.query, change.Update)
+		if err != nil {
+			return nil, err
+		}
+		if change.ReturnNew {
+			doc = c.data[idKey(id)]
+		}
+		info.UpsertedId = id
+	case len(keys) == 0:
+		return nil, ErrNotFound
+	case change.Remove:
+		doc = c.data[keys[0]]
+		c.remove(keys[0])
+		info.Removed = 1
+	default:
+		doc = c.data[keys[0]]
+		if err = c.update(keys[0], change.Update); err != nil {
+			return nil, err
+		}
+		if change.ReturnNew {
+			doc = c.data[keys[0]]
+		}
+		info.Updated = 1
+	}
+
+	if doc != nil && result != nil {
+		if doc, err = project(doc, q.op.selector); err != nil {
+			return nil, err
+		}
+		if err = setResult(reflect.ValueOf(result), doc); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+type Iter struct {
+	coll    *Collection
+	err     error
+	op      QueryOp
+	docData Queue
+	got     bool
+	ctx     context.Context
+
+	tailing  bool
+	timeout  time.Duration
+	timedout bool
+	seen     map[string]bool
+}
+
+func (iter *Iter) Err() error {
+	return iter.err
+}
+
+func (iter *Iter) Close() error {
+	return iter.err
+}
+
+// Timeout returns true if Next returned false due to a timeout of
+// a tailable cursor.
+func (iter *Iter) Timeout() bool {
+	return iter.timedout
+}
+
+func (iter *Iter) getAll() {
+	iter.coll.RLock()
+	defer iter.coll.RUnlock()
+
+	iter.got = true
+	keys, err := iter.coll.find(iter.op)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.push(keys)
+}
+
+// push queues the documents stored under keys, skipping the ones
+// a tailable iterator already returned.
+func (iter *Iter) push(keys []string) {
+	p, err := parseProjection(iter.op.selector)
+	if err != nil {
+		iter.err = err
+		return
+	}
+	for _, key := range keys {
+		if iter.tailing {
+			if iter.seen[key] {
+				continue
+			}
+			iter.seen[key] = true
+		}
+		data, err := p.apply(iter.coll.data[key])
+		if err != nil {
+			iter.err = err
+			return
+		}
+		iter.docData.Push(data)
+	}
+}
+
+// tail waits for documents matching the query to be inserted, and queues
+// them. It returns false if the timeout expired first.
+func (iter *Iter) tail() bool {
+	iter.coll.RLock()
+	defer iter.coll.RUnlock()
+
+	var deadline time.Time
+	if iter.timeout >= 0 {
+		deadline = time.Now().Add(iter.timeout)
+	}
+	op := iter.op
+	op.skip, op.limit = 0, 0
+	for {
+		keys, err := iter.coll.find(op)
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		iter.push(keys)
+		if iter.docData.Len() > 0 || iter.err != nil {
+			return iter.err == nil
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return false
+		}
+		iter.coll.waitInsert(deadline)
+	}
+}
+
+// checkContext stops the iteration if its context is done, discarding
+// pending documents.
+func (iter *Iter) checkContext() {
+	if iter.err != nil || iter.ctx == nil || iter.ctx.Err() == nil {
+		return
+	}
+	iter.err = iter.ctx.Err()
+	iter.docData = Queue{}
+}
+
+func (iter *Iter) Next(result interface{}) bool {
+	iter.checkContext()
+	if iter.err == nil && !iter.got {
+		iter.getAll()
+	}
+	if iter.err != nil {
+		return false
+	}
+
+	if iter.docData.Len() == 0 && iter.tailing {
+		iter.timedout = false
+		if !iter.tail() {
+			iter.timedout = iter.err == nil
+			return false
+		}
+	}
+
+	resultv := reflect.ValueOf(result)
+	if docData := iter.docData.Pop(); docData != nil {
+		if err := setResult(resultv, docData); err != nil {
+			iter.err = err
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (iter *Iter) All(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return ErrTypeAll
+	}
+	slicev := resultv.Elem()
+	slicev = slicev.Slice(0, slicev.Cap())
+	elemt := slicev.Type().Elem()
+	i := 0
+	for {
+		if slicev.Len() == i {
+			elemp := reflect.New(elemt)
+			if !iter.Next(elemp.Interface()) {
+				break
+			}
+			slicev = reflect.Append(slicev, elemp.Elem())
+			slicev = slicev.Slice(0, slicev.Cap())
+		} else {
+			if !iter.Next(slicev.Index(i).Addr().Interface()) {
+				break
+			}
+		}
+		i++
+	}
+	resultv.Elem().Set(slicev.Slice(0, i))
+	return iter.Close()
+}
+
+// For iterates over the results, unmarshalling each one into result and
+// calling f. Iteration stops at the first error returned by f.
+func (iter *Iter) For(result interface{}, f func() error) (err error) {
+	valid := false
+	v := reflect.ValueOf(result)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+		switch v.Kind() {
+		case reflect.Map, reflect.Ptr, reflect.Interface, reflect.Slice:
+			valid = v.IsNil()
+		}
+	}
+	if !valid {
+		panic("For needs a pointer to nil reference value.  See the documentation.")
+	}
+	zero := reflect.Zero(v.Type())
+	for {
+		v.Set(zero)
+		if !iter.Next(result) {
+			break
+		}
+		err = f()
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
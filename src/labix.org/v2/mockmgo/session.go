@@ -0,0 +1,508 @@
+package mockmgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"labix.org/v2/base/bson"
+	. "labix.org/v2/error"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mockmgo/modify"
+)
+
+var (
+	_ imgo.Session  = (*Session)(nil)
+	_ imgo.Database = (*Database)(nil)
+)
+
+// server holds the databases shared by a session and all of its copies.
+type server struct {
+	dbs map[string]*Database
+	sync.Mutex
+}
+
+// Session is an in-memory replacement for mgo.Session. Sessions obtained
+// from it through New, Copy and Clone share the same databases, as sessions
+// connected to the same server would.
+type Session struct {
+	server    *server
+	defaultdb string
+	settings  settings
+	sync.RWMutex
+}
+
+// settings holds the session parameters copied over by New, Copy and Clone.
+// They are recorded so they can be read back, but have no effect on how
+// documents are stored or retrieved.
+type settings struct {
+	mode          imgo.Mode
+	safe          *imgo.Safe
+	syncTimeout   time.Duration
+	socketTimeout time.Duration
+	cursorTimeout time.Duration
+	batch         int
+	prefetch      float64
+}
+
+// NewSession returns a session to a new, empty server. The defaultdb
+// database is used when DB is called with an empty name. If defaultdb
+// is also empty, "test" is used, as done by mgo.
+func NewSession(defaultdb string) *Session {
+	if defaultdb == "" {
+		defaultdb = "test"
+	}
+	return &Session{
+		server:    &server{dbs: make(map[string]*Database)},
+		defaultdb: defaultdb,
+		settings: settings{
+			mode:          mgo.Strong,
+			safe:          &imgo.Safe{},
+			syncTimeout:   time.Minute,
+			socketTimeout: time.Minute,
+			cursorTimeout: 10 * time.Minute,
+			batch:         100,
+			prefetch:      0.25,
+		},
+	}
+}
+
+// DB returns a value representing the named database, creating it if
+// necessary. If name is empty, the session's default database is used.
+func (s *Session) DB(name string) imgo.Database {
+	return s.db(name)
+}
+
+func (s *Session) db(name string) *Database {
+	if name == "" {
+		name = s.defaultdb
+	}
+
+	s.server.Lock()
+	defer s.server.Unlock()
+
+	db, ok := s.server.dbs[name]
+	if !ok {
+		db = &Database{
+			server: s.server,
+			name:   name,
+			colls:  make(map[string]*Collection),
+			users:  make(map[string]dbUser),
+		}
+		s.server.dbs[name] = db
+	}
+	return db
+}
+
+func (s *Session) copy() *Session {
+	s.RLock()
+	defer s.RUnlock()
+
+	scopy := &Session{
+		server:    s.server,
+		defaultdb: s.defaultdb,
+		settings:  s.settings,
+	}
+	if s.settings.safe != nil {
+		safe := *s.settings.safe
+		scopy.settings.safe = &safe
+	}
+	return scopy
+}
+
+// New creates a new session with the same parameters as the original
+// session, sharing the same databases.
+func (s *Session) New() imgo.Session {
+	return s.copy()
+}
+
+// Copy works just like New.
+func (s *Session) Copy() imgo.Session {
+	return s.copy()
+}
+
+// Clone works just like New.
+func (s *Session) Clone() imgo.Session {
+	return s.copy()
+}
+
+// Close is accepted for compatibility with mgo. There are no resources
+// to be released.
+func (s *Session) Close() {}
+
+// Refresh is accepted for compatibility with mgo and has no effect.
+func (s *Session) Refresh() {}
+
+// LiveServers returns the address of the one server the session
+// pretends to be connected to.
+func (s *Session) LiveServers() (addrs []string) {
+	return []string{"localhost:27017"}
+}
+
+func (s *Session) SetMode(consistency imgo.Mode, refresh bool) {
+	s.Lock()
+	s.settings.mode = consistency
+	s.Unlock()
+}
+
+func (s *Session) Mode() imgo.Mode {
+	s.RLock()
+	defer s.RUnlock()
+	return s.settings.mode
+}
+
+func (s *Session) SetSyncTimeout(d time.Duration) {
+	s.Lock()
+	s.settings.syncTimeout = d
+	s.Unlock()
+}
+
+func (s *Session) SetSocketTimeout(d time.Duration) {
+	s.Lock()
+	s.settings.socketTimeout = d
+	s.Unlock()
+}
+
+func (s *Session) SetCursorTimeout(d time.Duration) {
+	s.Lock()
+	s.settings.cursorTimeout = d
+	s.Unlock()
+}
+
+func (s *Session) SetBatch(n int) {
+	s.Lock()
+	s.settings.batch = n
+	s.Unlock()
+}
+
+func (s *Session) SetPrefetch(p float64) {
+	s.Lock()
+	s.settings.prefetch = p
+	s.Unlock()
+}
+
+// Safe returns the current safety mode for the session.
+func (s *Session) Safe() (safe *imgo.Safe) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.settings.safe != nil {
+		safeCopy := *s.settings.safe
+		safe = &safeCopy
+	}
+	return safe
+}
+
+func (s *Session) SetSafe(safe *imgo.Safe) {
+	s.Lock()
+	defer s.Unlock()
+	s.settings.safe = nil
+	s.ensureSafe(safe)
+}
+
+// EnsureSafe compares the provided safety parameters with the ones
+// currently in use by the session and picks the most conservative
+// choice for each setting, as mgo does.
+func (s *Session) EnsureSafe(safe *imgo.Safe) {
+	s.Lock()
+	defer s.Unlock()
+	s.ensureSafe(safe)
+}
+
+func (s *Session) ensureSafe(safe *imgo.Safe) {
+	if safe == nil {
+		return
+	}
+	if s.settings.safe == nil {
+		safeCopy := *safe
+		s.settings.safe = &safeCopy
+		return
+	}
+
+	cur := *s.settings.safe
+	if safe.WMode != "" {
+		cur.WMode, cur.W = safe.WMode, 0
+	} else if cur.WMode == "" && safe.W > cur.W {
+		cur.W = safe.W
+	}
+	if safe.WTimeout > 0 && (cur.WTimeout == 0 || safe.WTimeout < cur.WTimeout) {
+		cur.WTimeout = safe.WTimeout
+	}
+	if safe.FSync {
+		cur.FSync, cur.J = true, false
+	} else if safe.J && !cur.FSync {
+		cur.J = true
+	}
+	s.settings.safe = &cur
+}
+
+// Run issues the provided command on the admin database.
+func (s *Session) Run(cmd interface{}, result interface{}) error {
+	return s.db("admin").Run(cmd, result)
+}
+
+// Ping always succeeds.
+func (s *Session) Ping() error {
+	return nil
+}
+
+// DatabaseNames returns the names of non-empty databases, sorted.
+func (s *Session) DatabaseNames() (names []string, err error) {
+	s.server.Lock()
+	dbs := make([]*Database, 0, len(s.server.dbs))
+	for _, db := range s.server.dbs {
+		dbs = append(dbs, db)
+	}
+	s.server.Unlock()
+
+	for _, db := range dbs {
+		collNames, err := db.CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		if len(collNames) > 0 {
+			names = append(names, db.name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FindRef returns a query that looks for the document in the provided
+// reference, which must have its Database field set.
+func (s *Session) FindRef(ref *imgo.DBRef) imgo.Query {
+	if ref.Database == "" {
+		panic(errors.New(fmt.Sprintf("Can't resolve database for %#v", ref)))
+	}
+	return s.db(ref.Database).FindRef(ref)
+}
+
+type dbUser struct {
+	password string
+	readOnly bool
+}
+
+// Database is an in-memory replacement for mgo.Database.
+type Database struct {
+	server *server
+	name   string
+	colls  map[string]*Collection
+	users  map[string]dbUser
+	sync.Mutex
+}
+
+// C returns the named collection, creating it if necessary.
+func (db *Database) C(name string) imgo.Collection {
+	return db.c(name)
+}
+
+func (db *Database) c(name string) *Collection {
+	db.Lock()
+	defer db.Unlock()
+
+	c, ok := db.colls[name]
+	if !ok {
+		c = NewCollection(db.name+"."+name, nil)
+		db.colls[name] = c
+	}
+	return c
+}
+
+// Run issues the provided command on the db database and unmarshals its
+// result in the respective argument. Only a small set of commands is
+// supported: ping, isMaster, count, aggregate, create, drop, dropDatabase
+// and listDatabases. Other commands fail as unknown to the server.
+func (db *Database) Run(cmd interface{}, result interface{}) error {
+	return db.RunContext(context.Background(), cmd, result)
+}
+
+// RunContext works like Run, but fails with ctx.Err() without running the
+// command if ctx is done.
+func (db *Database) RunContext(ctx context.Context, cmd interface{}, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var d bson.D
+	if name, ok := cmd.(string); ok {
+		d = bson.D{{name, 1}}
+	} else {
+		var err error
+		if d, err = modify.Normalize(cmd); err != nil {
+			return err
+		}
+	}
+	if len(d) == 0 {
+		return &mgo.QueryError{Code: 59, Message: "no such cmd: "}
+	}
+
+	name, arg := d[0].Name, d[0].Value
+	options := make(bson.M, len(d)-1)
+	for _, elem := range d[1:] {
+		options[elem.Name] = elem.Value
+	}
+
+	var doc bson.M
+	switch strings.ToLower(name) {
+	case "ping":
+		doc = bson.M{}
+	case "ismaster":
+		doc = bson.M{"ismaster": true, "maxBsonObjectSize": 16 * 1024 * 1024}
+	case "count":
+		cname, _ := arg.(string)
+		q := db.c(cname).Find(options["query"])
+		if skip, ok := options["skip"].(int); ok {
+			q.Skip(skip)
+		}
+		if limit, ok := options["limit"].(int); ok {
+			q.Limit(limit)
+		}
+		n, err := q.Count()
+		if err != nil {
+			return err
+		}
+		doc = bson.M{"n": float64(n)}
+	case "aggregate":
+		cname, _ := arg.(string)
+		docs, err := db.c(cname).aggregate(options["pipeline"])
+		if err != nil {
+			return err
+		}
+		doc = bson.M{"result": docs}
+	case "create":
+		cname, _ := arg.(string)
+		info := &imgo.CollectionInfo{}
+		info.Capped, _ = options["capped"].(bool)
+		info.MaxBytes, _ = options["size"].(int)
+		info.MaxDocs, _ = options["max"].(int)
+		if err := db.c(cname).Create(info); err != nil {
+			return err
+		}
+		doc = bson.M{}
+	case "drop":
+		cname, _ := arg.(string)
+		c := db.c(cname)
+		if !c.exists() {
+			return &mgo.QueryError{Message: "ns not found"}
+		}
+		if err := c.DropCollection(); err != nil {
+			return err
+		}
+		doc = bson.M{"ns": db.name + "." + cname}
+	case "dropdatabase":
+		if err := db.DropDatabase(); err != nil {
+			return err
+		}
+		doc = bson.M{"dropped": db.name}
+	case "listdatabases":
+		if db.name != "admin" {
+			return &mgo.QueryError{Code: 13, Message: "listDatabases may only be run against the admin database."}
+		}
+		names, err := (&Session{server: db.server}).DatabaseNames()
+		if err != nil {
+			return err
+		}
+		var dbs []bson.M
+		for _, name := range names {
+			dbs = append(dbs, bson.M{"name": name, "empty": false})
+		}
+		doc = bson.M{"databases": dbs}
+	default:
+		return &mgo.QueryError{Code: 59, Message: "no such cmd: " + name}
+	}
+
+	doc["ok"] = 1.0
+	if result == nil {
+		return nil
+	}
+	return setResult(reflect.ValueOf(result), doc)
+}
+
+// Login authenticates with the credentials of a user added through
+// AddUser. Access control is not enforced afterwards.
+func (db *Database) Login(user, pass string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if u, ok := db.users[user]; !ok || u.password != pass {
+		return &mgo.QueryError{Code: 18, Message: "auth failed"}
+	}
+	return nil
+}
+
+// Logout is accepted for compatibility with mgo and has no effect.
+func (db *Database) Logout() {}
+
+// AddUser creates or updates the authentication credentials of user
+// within the db database.
+func (db *Database) AddUser(user, pass string, readOnly bool) error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.users[user] = dbUser{pass, readOnly}
+	return nil
+}
+
+// RemoveUser removes the authentication credentials of user from
+// the database. ErrNotFound is returned if there is no such user.
+func (db *Database) RemoveUser(user string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.users[user]; !ok {
+		return ErrNotFound
+	}
+	delete(db.users, user)
+	return nil
+}
+
+// DropDatabase removes the entire database including all of its
+// collections and users.
+func (db *Database) DropDatabase() error {
+	db.Lock()
+	colls := make([]*Collection, 0, len(db.colls))
+	for _, c := range db.colls {
+		colls = append(colls, c)
+	}
+	db.users = make(map[string]dbUser)
+	db.Unlock()
+
+	for _, c := range colls {
+		if err := c.DropCollection(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectionNames returns the names of the collections holding any
+// document, index or settings, sorted.
+func (db *Database) CollectionNames() (names []string, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	for name, c := range db.colls {
+		if c.exists() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FindRef returns a query that looks for the document in the provided
+// reference. If the reference includes the Database field, the document
+// will be retrieved from the respective database.
+func (db *Database) FindRef(ref *imgo.DBRef) imgo.Query {
+	c := db.c(ref.Collection)
+	if ref.Database != "" {
+		c = (&Session{server: db.server}).db(ref.Database).c(ref.Collection)
+	}
+	return c.FindId(ref.Id)
+}
@@ -0,0 +1,256 @@
+package mockmgo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"labix.org/v2/base/bson"
+	"labix.org/v2/imgo"
+	"labix.org/v2/mgo"
+)
+
+// countDocs is written against the imgo interfaces only, as services
+// using mockmgo would be.
+func countDocs(session imgo.Session, db, coll string) (int, error) {
+	s := session.Copy()
+	defer s.Close()
+	return s.DB(db).C(coll).Count()
+}
+
+func TestSession(t *testing.T) {
+	session := NewSession("")
+
+	err := session.DB("").C("c1").Insert(bson.M{"_id": 1}, bson.M{"_id": 2})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+	err = session.DB("other").C("c2").Insert(bson.M{"_id": 1})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	n, err := countDocs(session, "test", "c1")
+	if err != nil || n != 2 {
+		t.Fatal("copy doesn't share databases:", n, err)
+	}
+
+	err = session.DB("test").C("c1").Insert(bson.M{"_id": 1})
+	if !mgo.IsDup(err) {
+		t.Fatal("expected duplicate key error, got:", err)
+	}
+
+	// an untouched collection isn't listed
+	session.DB("test").C("empty")
+
+	names, err := session.DB("test").CollectionNames()
+	if err != nil || !reflect.DeepEqual(names, []string{"c1"}) {
+		t.Fatal("bad collection names:", names, err)
+	}
+
+	names, err = session.DatabaseNames()
+	if err != nil || !reflect.DeepEqual(names, []string{"other", "test"}) {
+		t.Fatal("bad database names:", names, err)
+	}
+
+	var result bson.M
+	err = session.FindRef(&imgo.DBRef{Database: "other", Collection: "c2", Id: 1}).One(&result)
+	if err != nil || result["_id"] != 1 {
+		t.Fatal("find ref failed:", result, err)
+	}
+
+	err = session.DB("other").DropDatabase()
+	if err != nil {
+		t.Fatal("drop database failed:", err)
+	}
+	names, err = session.DatabaseNames()
+	if err != nil || !reflect.DeepEqual(names, []string{"test"}) {
+		t.Fatal("bad database names:", names, err)
+	}
+}
+
+func TestSessionSettings(t *testing.T) {
+	session := NewSession("mydb")
+
+	if session.Mode() != mgo.Strong {
+		t.Fatal("bad default mode:", session.Mode())
+	}
+	session.SetMode(mgo.Monotonic, true)
+	if mode := session.Copy().Mode(); mode != mgo.Monotonic {
+		t.Fatal("mode not copied:", mode)
+	}
+
+	session.SetSafe(&imgo.Safe{W: 1, WTimeout: 100})
+	session.EnsureSafe(&imgo.Safe{W: 2, WTimeout: 200, J: true})
+	safe := session.Safe()
+	if !reflect.DeepEqual(safe, &imgo.Safe{W: 2, WTimeout: 100, J: true}) {
+		t.Fatal("bad safety mode:", safe)
+	}
+
+	session.SetSafe(nil)
+	if safe := session.Safe(); safe != nil {
+		t.Fatal("safety mode not unset:", safe)
+	}
+}
+
+func TestRun(t *testing.T) {
+	session := NewSession("")
+	db := session.DB("mydb")
+
+	var result struct {
+		Ok bool
+		N  int
+	}
+	err := session.Run("ping", &result)
+	if err != nil || !result.Ok {
+		t.Fatal("ping failed:", result, err)
+	}
+
+	err = db.Run(bson.D{{"create", "capped"}, {"capped", true}, {"size", 1024}, {"max", 2}}, nil)
+	if err != nil {
+		t.Fatal("create failed:", err)
+	}
+	c := db.C("capped")
+	err = c.Insert(bson.M{"_id": 1, "a": 1}, bson.M{"_id": 2, "a": 2}, bson.M{"_id": 3, "a": 3})
+	if err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	err = db.Run(bson.D{{"count", "capped"}, {"query", bson.M{"a": bson.M{"$gt": 1}}}}, &result)
+	if err != nil || result.N != 2 {
+		t.Fatal("count failed:", result, err)
+	}
+
+	err = db.Run(bson.D{{"count", "capped"}, {"query", bson.M{"_id": 1}}}, &result)
+	if err != nil || result.N != 0 {
+		t.Fatal("capped collection didn't roll over:", result, err)
+	}
+
+	var aggregate struct{ Result []bson.M }
+	err = db.Run(bson.D{{"aggregate", "capped"}, {"pipeline", []bson.M{{"$match": bson.M{"a": 3}}}}}, &aggregate)
+	if err != nil || len(aggregate.Result) != 1 || aggregate.Result[0]["_id"] != 3 {
+		t.Fatal("aggregate failed:", aggregate, err)
+	}
+
+	err = db.Run(bson.D{{"drop", "capped"}}, nil)
+	if err != nil {
+		t.Fatal("drop failed:", err)
+	}
+	err = db.Run(bson.D{{"drop", "capped"}}, nil)
+	if err == nil {
+		t.Fatal("dropping a missing collection should fail")
+	}
+
+	err = db.Run("nosuchcmd", nil)
+	if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 59 {
+		t.Fatal("expected unknown command error, got:", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db := NewSession("").DB("mydb")
+
+	err := db.AddUser("myuser", "mypass", false)
+	if err != nil {
+		t.Fatal("add user failed:", err)
+	}
+	err = db.Login("myuser", "mypass")
+	if err != nil {
+		t.Fatal("login failed:", err)
+	}
+	err = db.Login("myuser", "wrong")
+	if err == nil {
+		t.Fatal("login with a bad password should fail")
+	}
+
+	err = db.RemoveUser("myuser")
+	if err != nil {
+		t.Fatal("remove user failed:", err)
+	}
+	err = db.RemoveUser("myuser")
+	if err != mgo.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got:", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var session imgo.Session = NewSession("")
+	db := session.DB("mydb")
+	c := db.C("mycoll")
+	for i := 0; i < 5; i++ {
+		if err := c.Insert(bson.M{"_id": i}); err != nil {
+			t.Fatal("insert failed:", err)
+		}
+	}
+
+	// Iteration stops once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := c.Find(nil).Sort("_id").IterContext(ctx)
+	var doc bson.M
+	if !iter.Next(&doc) || doc["_id"] != 0 {
+		t.Fatal("next failed:", doc, iter.Err())
+	}
+	cancel()
+	if iter.Next(&doc) {
+		t.Fatal("next succeeded after cancellation")
+	}
+	if err := iter.Close(); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got:", err)
+	}
+
+	// Operations don't start with a done context.
+	q := c.Find(bson.M{"_id": 1})
+	var docs []bson.M
+	if err := q.OneContext(ctx, &doc); err != context.Canceled {
+		t.Fatal("expected context.Canceled from OneContext, got:", err)
+	}
+	if err := q.AllContext(ctx, &docs); err != context.Canceled {
+		t.Fatal("expected context.Canceled from AllContext, got:", err)
+	}
+	if _, err := q.CountContext(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled from CountContext, got:", err)
+	}
+	if err := db.RunContext(ctx, "ping", nil); err != context.Canceled {
+		t.Fatal("expected context.Canceled from RunContext, got:", err)
+	}
+	pipe := c.Pipe([]bson.M{{"$match": bson.M{}}})
+	if err := pipe.OneContext(ctx, &doc); err != context.Canceled {
+		t.Fatal("expected context.Canceled from Pipe.OneContext, got:", err)
+	}
+	if err := c.InsertContext(ctx, bson.M{"_id": 100}); err != context.Canceled {
+		t.Fatal("expected context.Canceled from InsertContext, got:", err)
+	}
+	if err := c.UpdateContext(ctx, bson.M{"_id": 1}, bson.M{"$set": bson.M{"a": 1}}); err != context.Canceled {
+		t.Fatal("expected context.Canceled from UpdateContext, got:", err)
+	}
+	if _, err := c.UpsertContext(ctx, bson.M{"_id": 101}, bson.M{"a": 1}); err != context.Canceled {
+		t.Fatal("expected context.Canceled from UpsertContext, got:", err)
+	}
+	if _, err := c.RemoveAllContext(ctx, nil); err != context.Canceled {
+		t.Fatal("expected context.Canceled from RemoveAllContext, got:", err)
+	}
+	if n, _ := c.Count(); n != 5 {
+		t.Fatal("writes were applied with a done context:", n)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := q.OneContext(expired, &doc); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got:", err)
+	}
+
+	live := context.Background()
+	if err := q.OneContext(live, &doc); err != nil || doc["_id"] != 1 {
+		t.Fatal("find with a live context failed:", doc, err)
+	}
+	if _, err := c.UpdateAllContext(live, nil, bson.M{"$set": bson.M{"a": 1}}); err != nil {
+		t.Fatal("update with a live context failed:", err)
+	}
+	if err := pipe.AllContext(live, &docs); err != nil || len(docs) != 5 || docs[0]["a"] != 1 {
+		t.Fatal("aggregate with a live context failed:", docs, err)
+	}
+	if err := c.RemoveContext(live, bson.M{"_id": 1}); err != nil {
+		t.Fatal("remove with a live context failed:", err)
+	}
+}